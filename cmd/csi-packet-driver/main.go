@@ -22,9 +22,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/packethost/csi-packet/pkg/driver"
+	"github.com/packethost/csi-packet/pkg/executor"
 	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/packethost/csi-packet/pkg/service"
 	"github.com/packethost/csi-packet/pkg/version"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -34,12 +37,26 @@ var (
 	endpoint       string
 	nodeID         string
 	providerConfig string
+	clusterID      string
+	dryRun         bool
+	adoptOptions   driver.AdoptionOptions
+	markAdopted    bool
+	requireFormat  bool
+	hostExec       string
+	hostRoot       string
+	services       string
+	mpathBlacklist string
+	mpathDevices   string
 )
 
 const (
 	apiKeyName     = "PACKET_API_KEY"
 	projectIDName  = "PACKET_PROJECT_ID"
 	facilityIDName = "PACKET_FACILITY_ID"
+	clusterIDName  = "PACKET_CLUSTER_ID"
+	hostExecName   = "PACKET_HOST_EXEC"
+	hostRootName   = "PACKET_HOST_ROOT"
+	servicesName   = "PACKET_SERVICES"
 )
 
 func init() {
@@ -55,9 +72,6 @@ func init() {
 }
 
 func main() {
-	// log our starting point
-	log.WithFields(log.Fields{"version": version.VERSION}).Info("started")
-
 	flag.CommandLine.Parse([]string{})
 
 	cmd := &cobra.Command{
@@ -73,11 +87,55 @@ func main() {
 	// optional flag to override node ID
 	cmd.PersistentFlags().StringVar(&nodeID, "nodeid", "", "node id")
 
-	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
-	cmd.MarkPersistentFlagRequired("endpoint")
+	// the endpoint is required to serve, but not for any of the maintenance subcommands
+	cmd.Flags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
+	cmd.MarkFlagRequired("endpoint")
 
 	cmd.PersistentFlags().StringVar(&providerConfig, "config", "", "path to provider config file")
 
+	// optional flag to set the ID of the cluster, to share a project with other clusters
+	cmd.PersistentFlags().StringVar(&clusterID, "cluster-id", "", "cluster id")
+
+	cmd.Flags().BoolVar(&requireFormat, "require-format-opt-in", false, "format a blank volume only if its StorageClass sets allowFormat")
+
+	// how to run the host tools; the environment can set it for each node, and the flag overrides it
+	cmd.Flags().StringVar(&hostExec, "host-exec", "", fmt.Sprintf("how to run iscsiadm, mkfs and the other host tools, one of %s; defaults to $%s, or %s", strings.Join(executor.Modes, ", "), hostExecName, executor.ModeContainer))
+	cmd.Flags().StringVar(&hostRoot, "host-root", "", fmt.Sprintf("where the root of the host is mounted, for --host-exec=%s; defaults to $%s, or %s", executor.ModeChroot, hostRootName, executor.DefaultHostRoot))
+	cmd.Flags().StringVar(&services, "services", "", fmt.Sprintf("how to reconfigure iscsid and multipathd when the driver changes their configuration, one of %s; defaults to $%s, or %s", strings.Join(service.Backends, ", "), servicesName, service.BackendMultipathd))
+
+	// the node's own stanzas of the multipath configuration, as files, e.g. of a ConfigMap
+	cmd.Flags().StringVar(&mpathBlacklist, "multipath-blacklist", "", "path to a file with the body of the blacklist section of the multipath configuration, the driver's own if not set")
+	cmd.Flags().StringVar(&mpathDevices, "multipath-devices", "", "path to a file with the body of the devices section of the multipath configuration, the driver's own if not set")
+
+	migrateCmd := &cobra.Command{
+		Use:   "migrate-descriptions",
+		Short: "Upgrade the descriptions of the CSI volumes in the project to the current schema, and assign those of no cluster to --cluster-id",
+		Run: func(cmd *cobra.Command, args []string) {
+			migrateDescriptions()
+		},
+	}
+	migrateCmd.Flags().BoolVar(&dryRun, "dry-run", false, "only report the descriptions that would be upgraded")
+	cmd.AddCommand(migrateCmd)
+
+	adoptCmd := &cobra.Command{
+		Use:   "adopt [volume-id...]",
+		Short: "Write PersistentVolumes for volumes that were not created by the driver, so that it can use them",
+		Long: "Inspect the given volumes, or all of the volumes in the project that were not created by the driver, " +
+			"and write a PersistentVolume manifest for each of the ones the driver can use",
+		// stdout is only for the manifests
+		PreRun: func(cmd *cobra.Command, args []string) {
+			log.SetOutput(os.Stderr)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			adoptVolumes(args)
+		},
+	}
+	adoptCmd.Flags().StringVar(&adoptOptions.Name, "name", "", "name of the PersistentVolume, only when adopting a single volume; defaults to the name of the volume")
+	adoptCmd.Flags().StringVar(&adoptOptions.StorageClassName, "storage-class", "", "storageClassName of the PersistentVolumes")
+	adoptCmd.Flags().StringVar(&adoptOptions.FsType, "fs-type", "", "filesystem on the volumes, ext4 if not set")
+	adoptCmd.Flags().BoolVar(&markAdopted, "mark", false, "rewrite the descriptions of the volumes to mark them as managed by the driver")
+	cmd.AddCommand(adoptCmd)
+
 	cmd.ParseFlags(os.Args[1:])
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "%s", err.Error())
@@ -88,6 +146,150 @@ func main() {
 }
 
 func handle() {
+	// log our starting point
+	log.WithFields(log.Fields{"version": version.VERSION}).Info("started")
+
+	config := loadConfig()
+	host, err := loadHost()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid host configuration: %v\n", err)
+		os.Exit(1)
+	}
+	d, err := driver.NewPacketDriver(endpoint, nodeID, config, host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get packet driver: %v\n", err)
+		os.Exit(1)
+	}
+	d.RequireFormatOptIn = requireFormat
+	d.Run()
+}
+
+// loadHost how to run the host tools and manage its daemons, from the flags or else the environment
+func loadHost() (driver.Host, error) {
+	mode := hostExec
+	if mode == "" {
+		mode = os.Getenv(hostExecName)
+	}
+	root := hostRoot
+	if root == "" {
+		root = os.Getenv(hostRootName)
+	}
+	backend := services
+	if backend == "" {
+		backend = os.Getenv(servicesName)
+	}
+	if backend == "" {
+		backend = service.BackendMultipathd
+	}
+	log.WithFields(log.Fields{"mode": mode, "root": root, "services": backend}).Info("host execution")
+	host, err := driver.NewHost(mode, root)
+	if err != nil {
+		return host, err
+	}
+	// systemd is reached with the host's busctl, like the other tools
+	host.Services, err = service.New(backend, host.Exec)
+	if err != nil {
+		return host, err
+	}
+	if host.Multipath.Blacklist, err = readStanza(mpathBlacklist); err != nil {
+		return host, err
+	}
+	host.Multipath.Devices, err = readStanza(mpathDevices)
+	return host, err
+}
+
+// readStanza the body of a section of the multipath configuration in a file, empty if no file is given
+func readStanza(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read multipath stanza: %v", err)
+	}
+	return string(data), nil
+}
+
+func migrateDescriptions() {
+	config := loadConfig()
+	provider, err := packet.NewPacketProvider(config, packet.MetadataDriver{BaseURL: config.MetadataURL})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get packet provider: %v\n", err)
+		os.Exit(1)
+	}
+	migrations, err := packet.MigrateVolumeDescriptions(provider, config.ClusterID, dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to migrate volume descriptions: %v\n", err)
+		os.Exit(1)
+	}
+	failed := false
+	for _, m := range migrations {
+		result := "ok"
+		if m.Err != nil {
+			result = m.Err.Error()
+			failed = true
+		}
+		cluster := "-"
+		if m.Cluster != "" {
+			cluster = "cluster " + m.Cluster
+		}
+		fmt.Printf("%s\t%s\tversion %d -> %d\t%s\t%s\n", m.VolumeID, m.Name, m.FromVersion, m.ToVersion, cluster, result)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func adoptVolumes(volumeIDs []string) {
+	if adoptOptions.Name != "" && len(volumeIDs) != 1 {
+		fmt.Fprintf(os.Stderr, "--name requires exactly one volume ID\n")
+		os.Exit(1)
+	}
+	config := loadConfig()
+	provider, err := packet.NewPacketProvider(config, packet.MetadataDriver{BaseURL: config.MetadataURL})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get packet provider: %v\n", err)
+		os.Exit(1)
+	}
+	plans := packet.NewPlanCache(provider, packet.DefaultPlanCacheTTL)
+	plans.Limits = config.StoragePlanLimits
+	adoptions, err := packet.InspectVolumesForAdoption(provider, plans, provider.FacilityID(), config.ClusterID, volumeIDs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to inspect volumes: %v\n", err)
+		os.Exit(1)
+	}
+
+	// manifests go to stdout, so they can be piped to kubectl, and everything else to stderr
+	failed := false
+	for _, adoption := range adoptions {
+		if !adoption.Adoptable() {
+			fmt.Fprintf(os.Stderr, "%s\t%s\tcannot be adopted: %s\n", adoption.Volume.ID, adoption.Volume.Name, strings.Join(adoption.Problems, "; "))
+			failed = true
+			continue
+		}
+		manifest, err := driver.PersistentVolumeManifest(adoption, adoptOptions)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\t%s\tunable to write manifest: %v\n", adoption.Volume.ID, adoption.Volume.Name, err)
+			failed = true
+			continue
+		}
+		if markAdopted && !adoption.Managed {
+			name := driver.PersistentVolumeName(adoption, adoptOptions)
+			if err := packet.MarkAdopted(provider, adoption.Volume, name, config.ClusterID); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\t%s\tunable to mark as adopted: %v\n", adoption.Volume.ID, adoption.Volume.Name, err)
+				failed = true
+				continue
+			}
+		}
+		fmt.Printf("---\n%s", manifest)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// loadConfig create our config from the config file and environment
+func loadConfig() packet.Config {
 	// create our config, as needed
 	var config, rawConfig packet.Config
 	if providerConfig != "" {
@@ -121,11 +323,16 @@ func handle() {
 		facilityID = rawConfig.FacilityID
 	}
 	config.FacilityID = facilityID
+	config.StoragePlanLimits = rawConfig.StoragePlanLimits
 
-	d, err := driver.NewPacketDriver(endpoint, nodeID, config)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get packet driver: %v\n", err)
-		os.Exit(1)
+	// the flag takes precedence over the env var, which takes precedence over rawConfig
+	if clusterID == "" {
+		clusterID = os.Getenv(clusterIDName)
 	}
-	d.Run()
+	if clusterID == "" {
+		clusterID = rawConfig.ClusterID
+	}
+	config.ClusterID = clusterID
+
+	return config
 }
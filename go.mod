@@ -5,31 +5,22 @@ go 1.12
 //replace github.com/packethost/packet-api-server => /Users/adeitcher/Documents/Development/go/src/github.com/packethost/packet-api-server
 
 require (
-	github.com/container-storage-interface/spec v1.1.0
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
-	github.com/golang/mock v1.1.1
-	github.com/google/uuid v1.1.1
-	github.com/gorilla/mux v1.7.3
-	github.com/kubernetes-csi/csi-test v2.2.0+incompatible
-	github.com/onsi/ginkgo v1.10.1 // indirect
-	github.com/onsi/gomega v1.7.0 // indirect
+	github.com/container-storage-interface/spec v1.5.0
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/mock v1.4.4
+	github.com/golang/protobuf v1.4.3
+	github.com/google/uuid v1.1.2
+	github.com/kubernetes-csi/csi-test/v4 v4.3.0
 	github.com/packethost/packet-api-server v0.0.0-20191210180413-86f9ff63b495
 	github.com/packethost/packngo v0.2.1-0.20191003144416-9f81c97413a3
 	github.com/pkg/errors v0.8.0
 	github.com/sirupsen/logrus v1.0.5
 	github.com/spf13/cobra v0.0.2
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/stretchr/objx v0.2.0 // indirect
-	github.com/stretchr/testify v1.4.0
-	golang.org/x/crypto v0.0.0-20191029031824-8986dd9e96cf // indirect
-	golang.org/x/net v0.0.0-20191028085509-fe3aa8a45271
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e // indirect
-	golang.org/x/sys v0.0.0-20191029155521-f43be2a4598c
-	golang.org/x/text v0.3.2 // indirect
-	golang.org/x/tools v0.0.0-20191030062658-86caa796c7ab // indirect
-	golang.org/x/xerrors v0.0.0-20191011141410-1b5146add898 // indirect
-	google.golang.org/genproto v0.0.0-20180427144745-86e600f69ee4 // indirect
-	google.golang.org/grpc v1.12.0
+	github.com/stretchr/testify v1.5.1
+	golang.org/x/net v0.0.0-20201209123823-ac852fbbde11
+	golang.org/x/sys v0.0.0-20201207223542-d4d67f95c62d
+	google.golang.org/grpc v1.34.0
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
-	gopkg.in/yaml.v2 v2.2.4 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,100 @@
+package blkid
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+)
+
+// the exit codes of blkid, see blkid(8)
+const (
+	// exitNothingFound no signature was found on the device
+	exitNothingFound = 2
+	// exitAmbivalent low-level probing found signatures that contradict each other
+	exitAmbivalent = 8
+)
+
+// ProbeLowLevel look for signatures on a device by running blkid -p, which knows every type that libblkid
+// does, not just the ones Probe does. Signatures that contradict each other are reported as a single one of
+// type ambivalent, since blkid names neither of them.
+func ProbeLowLevel(ctx context.Context, e executor.Executor, device string) ([]Signature, error) {
+	run, err := e.Run(ctx, nil, "blkid", "-p", "-o", "export", device)
+	if err != nil {
+		return nil, err
+	}
+	switch run.ExitCode {
+	case 0:
+		return parseExport(run.Stdout)
+	case exitNothingFound:
+		return nil, nil
+	case exitAmbivalent:
+		return []Signature{{Type: "ambivalent", Usage: UsageOther}}, nil
+	}
+	return nil, &executor.ExitError{Command: "blkid", Args: []string{"-p", "-o", "export", device}, ExitCode: run.ExitCode, Output: strings.TrimSpace(string(run.Output()))}
+}
+
+// parseExport read the signatures from what blkid -o export writes: a filesystem or other superblock as
+// TYPE, USAGE and SBMAGIC_OFFSET, and a partition table as PTTYPE and PTMAGIC_OFFSET
+func parseExport(out []byte) ([]Signature, error) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid blkid output line: %s", line)
+		}
+		values[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var signatures []Signature
+	if typ := values["TYPE"]; typ != "" {
+		offset, err := parseOffset(values["SBMAGIC_OFFSET"])
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, Signature{Type: typ, Usage: parseUsage(values["USAGE"]), Offset: offset})
+	}
+	if typ := values["PTTYPE"]; typ != "" {
+		offset, err := parseOffset(values["PTMAGIC_OFFSET"])
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, Signature{Type: typ, Usage: UsagePartitionTable, Offset: offset})
+	}
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("blkid found something, but reported neither TYPE nor PTTYPE: %s", strings.TrimSpace(string(out)))
+	}
+	return signatures, nil
+}
+
+// parseOffset parse the offset of a magic, which blkid leaves out for some types
+func parseOffset(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid blkid magic offset %s: %v", value, err)
+	}
+	return offset, nil
+}
+
+// parseUsage the Usage for what blkid reports as USAGE, anything it does not know being other
+func parseUsage(value string) Usage {
+	switch Usage(value) {
+	case UsageFilesystem, UsageRAID, UsageCrypto:
+		return Usage(value)
+	}
+	return UsageOther
+}
@@ -0,0 +1,157 @@
+package blkid
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDevice = "/dev/mapper/volume-3ee59355"
+
+// blkidReturns a script of blkid probing the test device
+func blkidReturns(stdout string, exitCode int) *executor.Script {
+	return executor.NewScript(executor.Expect("blkid", "-p", "-o", "export", testDevice).Returns(stdout, exitCode))
+}
+
+func TestProbeLowLevel(t *testing.T) {
+	tests := []struct {
+		description string
+		stdout      string
+		exitCode    int
+		expected    []Signature
+	}{
+		{"blank", "", exitNothingFound, nil},
+		{"ext4", "DEVNAME=" + testDevice + "\nUUID=0c5b4d8e\nVERSION=1.0\nTYPE=ext4\nUSAGE=filesystem\nSBMAGIC=S\\357\nSBMAGIC_OFFSET=1080\n", 0,
+			[]Signature{{"ext4", UsageFilesystem, 1080}}},
+		{"zfs", "DEVNAME=" + testDevice + "\nLABEL=tank\nVERSION=5000\nTYPE=zfs_member\nUSAGE=raid\nSBMAGIC_OFFSET=135168\n", 0,
+			[]Signature{{"zfs_member", UsageRAID, 135168}}},
+		{"bcache", "DEVNAME=" + testDevice + "\nUUID=8a9b\nTYPE=bcache\nUSAGE=other\nSBMAGIC_OFFSET=4120\n", 0,
+			[]Signature{{"bcache", UsageOther, 4120}}},
+		{"f2fs", "DEVNAME=" + testDevice + "\nTYPE=f2fs\nUSAGE=filesystem\nSBMAGIC_OFFSET=1024\n", 0,
+			[]Signature{{"f2fs", UsageFilesystem, 1024}}},
+		{"reiserfs", "DEVNAME=" + testDevice + "\nTYPE=reiserfs\nUSAGE=filesystem\nSBMAGIC_OFFSET=65588\n", 0,
+			[]Signature{{"reiserfs", UsageFilesystem, 65588}}},
+		{"jfs", "DEVNAME=" + testDevice + "\nTYPE=jfs\nUSAGE=filesystem\nSBMAGIC_OFFSET=32768\n", 0,
+			[]Signature{{"jfs", UsageFilesystem, 32768}}},
+		{"squashfs", "DEVNAME=" + testDevice + "\nVERSION=4.0\nTYPE=squashfs\nUSAGE=filesystem\nSBMAGIC_OFFSET=0\n", 0,
+			[]Signature{{"squashfs", UsageFilesystem, 0}}},
+		{"exfat", "DEVNAME=" + testDevice + "\nTYPE=exfat\nUSAGE=filesystem\nSBMAGIC_OFFSET=3\n", 0,
+			[]Signature{{"exfat", UsageFilesystem, 3}}},
+		{"nilfs2", "DEVNAME=" + testDevice + "\nTYPE=nilfs2\nUSAGE=filesystem\nSBMAGIC_OFFSET=1030\n", 0,
+			[]Signature{{"nilfs2", UsageFilesystem, 1030}}},
+		{"drbd without a magic offset", "DEVNAME=" + testDevice + "\nTYPE=drbd\nUSAGE=raid\n", 0,
+			[]Signature{{"drbd", UsageRAID, 0}}},
+		{"vmfs", "DEVNAME=" + testDevice + "\nTYPE=VMFS\nUSAGE=filesystem\nSBMAGIC_OFFSET=1048576\n", 0,
+			[]Signature{{"VMFS", UsageFilesystem, 1048576}}},
+		{"bitlocker", "DEVNAME=" + testDevice + "\nVERSION=2\nTYPE=BitLocker\nUSAGE=crypto\nSBMAGIC_OFFSET=3\n", 0,
+			[]Signature{{"BitLocker", UsageCrypto, 3}}},
+		{"usage that is not known", "DEVNAME=" + testDevice + "\nTYPE=something\nUSAGE=new\n", 0,
+			[]Signature{{"something", UsageOther, 0}}},
+		{"partition table", "DEVNAME=" + testDevice + "\nPTUUID=5d0a\nPTTYPE=dos\nPTMAGIC=U\\252\nPTMAGIC_OFFSET=510\n", 0,
+			[]Signature{{"dos", UsagePartitionTable, 510}}},
+		{"filesystem and partition table", "DEVNAME=" + testDevice + "\nTYPE=vfat\nUSAGE=filesystem\nSBMAGIC_OFFSET=82\nPTTYPE=dos\nPTMAGIC_OFFSET=510\n", 0,
+			[]Signature{{"vfat", UsageFilesystem, 82}, {"dos", UsagePartitionTable, 510}}},
+		{"ambivalent", "", exitAmbivalent, []Signature{{"ambivalent", UsageOther, 0}}},
+	}
+	for _, tt := range tests {
+		script := blkidReturns(tt.stdout, tt.exitCode)
+		signatures, err := ProbeLowLevel(context.Background(), script, testDevice)
+		assert.Nil(t, err, tt.description)
+		assert.Equal(t, tt.expected, signatures, tt.description)
+		assert.Nil(t, script.Done(), tt.description)
+	}
+}
+
+func TestProbeLowLevelErrors(t *testing.T) {
+	// blkid failing is never taken as nothing found
+	_, err := ProbeLowLevel(context.Background(), blkidReturns("", 4), testDevice)
+	assert.Equal(t, 4, executor.ExitCode(err))
+
+	_, err = ProbeLowLevel(context.Background(), blkidReturns("DEVNAME="+testDevice+"\nUUID=8a9b\n", 0), testDevice)
+	assert.NotNil(t, err)
+
+	_, err = ProbeLowLevel(context.Background(), blkidReturns("TYPE=ext4\nSBMAGIC_OFFSET=x\n", 0), testDevice)
+	assert.NotNil(t, err)
+
+	script := executor.NewScript(executor.Expect("blkid", "-p", "-o", "export", testDevice).Fails("signal: killed"))
+	_, err = ProbeLowLevel(context.Background(), script, testDevice)
+	assert.NotNil(t, err)
+}
+
+func TestProbeData(t *testing.T) {
+	const size = 4 << 20
+	tests := []struct {
+		description string
+		writes      map[int][]byte
+		expected    []Signature
+	}{
+		{"zeroes", nil, nil},
+		{"data in the first MiB", map[int][]byte{dataSpan - 1: {1}}, []Signature{{"data", UsageOther, dataSpan - 1}}},
+		{"data in the last MiB", map[int][]byte{size - dataSpan: {1}}, []Signature{{"data", UsageOther, size - dataSpan}}},
+		{"data in between", map[int][]byte{dataSpan: {1}, size - dataSpan - 1: {1}}, nil},
+	}
+	for _, tt := range tests {
+		signatures, err := probeData(&prober{r: image(size, tt.writes), size: size})
+		assert.Nil(t, err, tt.description)
+		assert.Equal(t, tt.expected, signatures, tt.description)
+	}
+
+	// a device smaller than a MiB is checked whole
+	signatures, err := probeData(&prober{r: image(4096, map[int][]byte{4095: {1}}), size: 4096})
+	assert.Nil(t, err)
+	assert.Equal(t, []Signature{{"data", UsageOther, 4095}}, signatures)
+}
+
+func TestProbeDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blkid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeDevice := func(name string, writes map[int][]byte) string {
+		path := filepath.Join(dir, name)
+		buf := make([]byte, 2<<20)
+		for offset, value := range writes {
+			copy(buf[offset:], value)
+		}
+		if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	probe := func(path, stdout string, exitCode int) Result {
+		script := executor.NewScript(executor.Expect("blkid", "-p", "-o", "export", path).Returns(stdout, exitCode))
+		result, err := ProbeDevice(script, path)
+		assert.Nil(t, err, path)
+		assert.Nil(t, script.Done(), path)
+		return result
+	}
+
+	blank := writeDevice("blank", nil)
+	assert.True(t, probe(blank, "", exitNothingFound).Blank())
+
+	// what only blkid knows
+	result := probe(blank, "TYPE=zfs_member\nUSAGE=raid\nSBMAGIC_OFFSET=135168\n", 0)
+	assert.Equal(t, []Signature{{"zfs_member", UsageRAID, 135168}}, result.Signatures)
+	assert.Equal(t, int64(2<<20), result.Size)
+
+	// what both know is only reported once, as blkid does
+	xfs := writeDevice("xfs", map[int][]byte{0: []byte("XFSB")})
+	result = probe(xfs, "TYPE=xfs\nUSAGE=filesystem\nSBMAGIC_OFFSET=0\n", 0)
+	assert.Equal(t, []Signature{{"xfs", UsageFilesystem, 0}}, result.Signatures)
+
+	// what only Probe knows
+	result = probe(xfs, "", exitNothingFound)
+	assert.Equal(t, []Signature{{"xfs", UsageFilesystem, 0}}, result.Signatures)
+
+	// what neither knows
+	unknown := writeDevice("unknown", map[int][]byte{(2 << 20) - 512: []byte("whatever")})
+	result = probe(unknown, "", exitNothingFound)
+	assert.Equal(t, []Signature{{"data", UsageOther, (2 << 20) - 512}}, result.Signatures)
+}
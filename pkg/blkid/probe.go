@@ -0,0 +1,344 @@
+package blkid
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+)
+
+// Usage what a signature says a device is used for, as in the USAGE reported by blkid -p
+type Usage string
+
+const (
+	// UsageFilesystem a filesystem, that can be mounted
+	UsageFilesystem Usage = "filesystem"
+	// UsagePartitionTable a partition table, with the data in the partitions
+	UsagePartitionTable Usage = "partition table"
+	// UsageRAID a member of a RAID array or LVM volume group
+	UsageRAID Usage = "raid"
+	// UsageCrypto an encrypted volume
+	UsageCrypto Usage = "crypto"
+	// UsageOther anything else, such as swap
+	UsageOther Usage = "other"
+)
+
+// Signature something on a device that says what is on it
+type Signature struct {
+	// Type the type of the signature, named as blkid names it, e.g. ext4 or crypto_LUKS
+	Type  string
+	Usage Usage
+	// Offset where the magic of the signature is on the device
+	Offset int64
+}
+
+func (s Signature) String() string {
+	return fmt.Sprintf("%s (%s) at %d", s.Type, s.Usage, s.Offset)
+}
+
+// Result the signatures found on a device
+type Result struct {
+	Signatures []Signature
+	// Size of the device in bytes
+	Size int64
+}
+
+// Blank determine if there are no signatures at all, so the device has nothing on it to lose
+func (r Result) Blank() bool {
+	return len(r.Signatures) == 0
+}
+
+// Filesystem the filesystem on the device, or nil if there is none
+func (r Result) Filesystem() *Signature {
+	for i := range r.Signatures {
+		if r.Signatures[i].Usage == UsageFilesystem {
+			return &r.Signatures[i]
+		}
+	}
+	return nil
+}
+
+func (r Result) String() string {
+	if r.Blank() {
+		return "blank"
+	}
+	s := make([]string, 0, len(r.Signatures))
+	for _, signature := range r.Signatures {
+		s = append(s, signature.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// magic a fixed sequence of bytes at a fixed offset that identifies a signature
+type magic struct {
+	typ    string
+	usage  Usage
+	offset int64
+	value  []byte
+}
+
+// mdMagic the magic of Linux software RAID superblocks, little endian 0xa92b4efc
+var mdMagic = []byte{0xfc, 0x4e, 0x2b, 0xa9}
+
+// magics the signatures found at fixed offsets from the start of a device
+var magics = []magic{
+	{"xfs", UsageFilesystem, 0, []byte("XFSB")},
+	{"btrfs", UsageFilesystem, 0x10040, []byte("_BHRfS_M")},
+	{"ntfs", UsageFilesystem, 3, []byte("NTFS    ")},
+	{"vfat", UsageFilesystem, 0x36, []byte("FAT12   ")},
+	{"vfat", UsageFilesystem, 0x36, []byte("FAT16   ")},
+	{"vfat", UsageFilesystem, 0x52, []byte("FAT32   ")},
+	{"iso9660", UsageFilesystem, 0x8001, []byte("CD001")},
+	{"crypto_LUKS", UsageCrypto, 0, []byte("LUKS\xba\xbe")},
+	// LUKS2 keeps a second copy of its header, which is all that is left if the first is overwritten
+	{"crypto_LUKS", UsageCrypto, 0x4000, []byte("SKUL\xba\xbe")},
+	{"gpt", UsagePartitionTable, 512, []byte("EFI PART")},
+	{"gpt", UsagePartitionTable, 4096, []byte("EFI PART")},
+	// metadata versions 1.1 and 1.2 are near the start; 0.90 and 1.0 are near the end, see probeMDAtEnd
+	{"linux_raid_member", UsageRAID, 0, mdMagic},
+	{"linux_raid_member", UsageRAID, 4096, mdMagic},
+	{"swap", UsageOther, 4096 - 10, []byte("SWAPSPACE2")},
+	{"swap", UsageOther, 4096 - 10, []byte("SWAP-SPACE")},
+}
+
+// ext superblock fields, see linux/fs/ext4/ext4.h
+const (
+	extSuperblockOffset = 1024
+	extMagicOffset      = extSuperblockOffset + 0x38
+	extCompatOffset     = extSuperblockOffset + 0x5c
+	extIncompatOffset   = extSuperblockOffset + 0x60
+
+	extCompatHasJournal = 0x4
+	// the incompatible features that only ext4 has: extents, 64bit, mmp, flex_bg, inline_data and the like
+	extIncompatExt4 = 0x40 | 0x80 | 0x100 | 0x200 | 0x400 | 0x1000 | 0x8000 | 0x10000
+)
+
+// dataSpan how much of the start and of the end of a device is checked for data that no signature accounts for
+const dataSpan = 1 << 20
+
+// ProbeDevice look for signatures on a device, both with blkid -p, which knows every type that libblkid does, and
+// by reading it, opened read-only. If neither finds any, data in the first or last MiB, where metadata usually is,
+// counts as a signature of type data, so that a device that has something unknown on it never looks blank.
+func ProbeDevice(e executor.Executor, path string) (Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+	// the size of a block device is only found by seeking, not by stat
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Result{}, err
+	}
+	result, err := Probe(f, size)
+	if err != nil {
+		return Result{}, err
+	}
+	lowLevel, err := ProbeLowLevel(context.Background(), e, path)
+	if err != nil {
+		return Result{}, err
+	}
+	result.Signatures = merge(lowLevel, result.Signatures)
+	if result.Blank() {
+		data, err := probeData(&prober{r: f, size: size})
+		if err != nil {
+			return Result{}, err
+		}
+		result.Signatures = data
+	}
+	return result, nil
+}
+
+// merge the signatures that blkid found, followed by those of other types that Probe found
+func merge(lowLevel, probed []Signature) []Signature {
+	merged := lowLevel
+	for _, signature := range probed {
+		found := false
+		for _, s := range lowLevel {
+			found = found || s.Type == signature.Type
+		}
+		if !found {
+			merged = append(merged, signature)
+		}
+	}
+	return merged
+}
+
+// Probe look for signatures of filesystems, partition tables, RAID members and encrypted volumes. An error
+// reading is returned, rather than treated as no signature, so that a failing device never looks blank.
+func Probe(r io.ReaderAt, size int64) (Result, error) {
+	p := &prober{r: r, size: size}
+	result := Result{Size: size}
+	for _, m := range magics {
+		found, err := p.matches(m.offset, m.value)
+		if err != nil {
+			return Result{}, err
+		}
+		if found {
+			result.Signatures = append(result.Signatures, Signature{Type: m.typ, Usage: m.usage, Offset: m.offset})
+		}
+	}
+	for _, probe := range []func(*prober) ([]Signature, error){probeExt, probeLVM, probeMDAtEnd, probeDOS} {
+		signatures, err := probe(p)
+		if err != nil {
+			return Result{}, err
+		}
+		// a DOS partition table shares its magic with the boot sectors of FAT and NTFS, and is the
+		// protective MBR of a GPT, so it only counts if nothing else was found
+		if len(signatures) > 0 && signatures[0].Type == "dos" && !result.Blank() {
+			continue
+		}
+		result.Signatures = append(result.Signatures, signatures...)
+	}
+	return result, nil
+}
+
+// prober reads a device for probing, treating anything beyond its end as not matching
+type prober struct {
+	r    io.ReaderAt
+	size int64
+}
+
+// read read length bytes at offset, or nil if they are beyond the end of the device
+func (p *prober) read(offset int64, length int) ([]byte, error) {
+	if offset < 0 || offset+int64(length) > p.size {
+		return nil, nil
+	}
+	buf := make([]byte, length)
+	n, err := p.r.ReadAt(buf, offset)
+	if n == length {
+		return buf, nil
+	}
+	if err == nil || err == io.EOF {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("reading %d bytes at %d: %v", length, offset, err)
+}
+
+func (p *prober) matches(offset int64, value []byte) (bool, error) {
+	buf, err := p.read(offset, len(value))
+	if err != nil || buf == nil {
+		return false, err
+	}
+	return bytes.Equal(buf, value), nil
+}
+
+// probeData find the first byte that is not zero in the first or last MiB of a device, as a signature of type data
+func probeData(p *prober) ([]Signature, error) {
+	offsets := []int64{0}
+	if p.size > dataSpan {
+		offsets = append(offsets, p.size-dataSpan)
+	}
+	for _, offset := range offsets {
+		length := int64(dataSpan)
+		if p.size < length {
+			length = p.size
+		}
+		buf, err := p.read(offset, int(length))
+		if err != nil {
+			return nil, err
+		}
+		for i, b := range buf {
+			if b != 0 {
+				return []Signature{{Type: "data", Usage: UsageOther, Offset: offset + int64(i)}}, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// probeExt find an ext2, ext3 or ext4 filesystem, telling them apart by their features as blkid does
+func probeExt(p *prober) ([]Signature, error) {
+	found, err := p.matches(extMagicOffset, []byte{0x53, 0xef})
+	if err != nil || !found {
+		return nil, err
+	}
+	buf, err := p.read(extCompatOffset, 8)
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	compat := binary.LittleEndian.Uint32(buf[0:4])
+	incompat := binary.LittleEndian.Uint32(buf[4:8])
+	typ := "ext2"
+	switch {
+	case incompat&extIncompatExt4 != 0:
+		typ = "ext4"
+	case compat&extCompatHasJournal != 0:
+		typ = "ext3"
+	}
+	return []Signature{{Type: typ, Usage: UsageFilesystem, Offset: extMagicOffset}}, nil
+}
+
+// probeLVM find an LVM physical volume, whose label is in any of the first four sectors
+func probeLVM(p *prober) ([]Signature, error) {
+	for sector := int64(0); sector < 4; sector++ {
+		offset := sector * 512
+		label, err := p.matches(offset, []byte("LABELONE"))
+		if err != nil {
+			return nil, err
+		}
+		if !label {
+			continue
+		}
+		lvm, err := p.matches(offset+24, []byte("LVM2 001"))
+		if err != nil {
+			return nil, err
+		}
+		if lvm {
+			return []Signature{{Type: "LVM2_member", Usage: UsageRAID, Offset: offset}}, nil
+		}
+	}
+	return nil, nil
+}
+
+// probeMDAtEnd find a Linux software RAID superblock of metadata version 0.90 or 1.0, near the end of the device
+func probeMDAtEnd(p *prober) ([]Signature, error) {
+	offsets := []int64{
+		// 0.90 is in the last 64KiB aligned block of 64KiB
+		(p.size &^ (0x10000 - 1)) - 0x10000,
+		// 1.0 is 8KiB from the end, aligned to 4KiB
+		(p.size - 0x2000) &^ (0x1000 - 1),
+	}
+	for _, offset := range offsets {
+		found, err := p.matches(offset, mdMagic)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return []Signature{{Type: "linux_raid_member", Usage: UsageRAID, Offset: offset}}, nil
+		}
+	}
+	return nil, nil
+}
+
+// probeDOS find a DOS partition table with at least one valid partition
+func probeDOS(p *prober) ([]Signature, error) {
+	found, err := p.matches(510, []byte{0x55, 0xaa})
+	if err != nil || !found {
+		return nil, err
+	}
+	entries, err := p.read(446, 64)
+	if err != nil || entries == nil {
+		return nil, err
+	}
+	partitions := 0
+	for i := 0; i < 4; i++ {
+		entry := entries[i*16 : (i+1)*16]
+		// the boot indicator is all or nothing, anything else is not a partition table
+		if entry[0] != 0 && entry[0] != 0x80 {
+			return nil, nil
+		}
+		if entry[4] != 0 {
+			partitions++
+		}
+	}
+	if partitions == 0 {
+		return nil, nil
+	}
+	return []Signature{{Type: "dos", Usage: UsagePartitionTable, Offset: 510}}, nil
+}
@@ -0,0 +1,100 @@
+package blkid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// image a device of a given size with some bytes written into it
+func image(size int, writes map[int][]byte) *bytes.Reader {
+	buf := make([]byte, size)
+	for offset, value := range writes {
+		copy(buf[offset:], value)
+	}
+	return bytes.NewReader(buf)
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+// dosPartition an MBR partition entry of the given type
+func dosPartition(typ byte) []byte {
+	entry := make([]byte, 16)
+	entry[4] = typ
+	return entry
+}
+
+func TestProbe(t *testing.T) {
+	const size = 1 << 20
+	tests := []struct {
+		description string
+		writes      map[int][]byte
+		expected    []Signature
+	}{
+		{"blank", nil, nil},
+		{"ext2", map[int][]byte{extMagicOffset: {0x53, 0xef}}, []Signature{{"ext2", UsageFilesystem, extMagicOffset}}},
+		{"ext3", map[int][]byte{extMagicOffset: {0x53, 0xef}, extCompatOffset: le32(extCompatHasJournal)},
+			[]Signature{{"ext3", UsageFilesystem, extMagicOffset}}},
+		{"ext4", map[int][]byte{extMagicOffset: {0x53, 0xef}, extCompatOffset: le32(extCompatHasJournal), extIncompatOffset: le32(0x2c2)},
+			[]Signature{{"ext4", UsageFilesystem, extMagicOffset}}},
+		{"xfs", map[int][]byte{0: []byte("XFSB")}, []Signature{{"xfs", UsageFilesystem, 0}}},
+		{"btrfs", map[int][]byte{0x10040: []byte("_BHRfS_M")}, []Signature{{"btrfs", UsageFilesystem, 0x10040}}},
+		{"vfat with its boot sector magic", map[int][]byte{0x52: []byte("FAT32   "), 510: {0x55, 0xaa}, 446: {0xfa, 0x33}},
+			[]Signature{{"vfat", UsageFilesystem, 0x52}}},
+		{"luks", map[int][]byte{0: []byte("LUKS\xba\xbe")}, []Signature{{"crypto_LUKS", UsageCrypto, 0}}},
+		{"luks2 secondary header", map[int][]byte{0x4000: []byte("SKUL\xba\xbe")}, []Signature{{"crypto_LUKS", UsageCrypto, 0x4000}}},
+		{"lvm", map[int][]byte{512: []byte("LABELONE"), 512 + 24: []byte("LVM2 001")}, []Signature{{"LVM2_member", UsageRAID, 512}}},
+		{"not lvm", map[int][]byte{512: []byte("LABELONE")}, nil},
+		{"md 1.2", map[int][]byte{4096: mdMagic}, []Signature{{"linux_raid_member", UsageRAID, 4096}}},
+		{"md 0.90", map[int][]byte{size - 0x10000: mdMagic}, []Signature{{"linux_raid_member", UsageRAID, size - 0x10000}}},
+		{"md 1.0", map[int][]byte{size - 0x2000: mdMagic}, []Signature{{"linux_raid_member", UsageRAID, size - 0x2000}}},
+		{"swap", map[int][]byte{4086: []byte("SWAPSPACE2")}, []Signature{{"swap", UsageOther, 4086}}},
+		{"dos", map[int][]byte{446: dosPartition(0x83), 510: {0x55, 0xaa}}, []Signature{{"dos", UsagePartitionTable, 510}}},
+		{"empty dos", map[int][]byte{510: {0x55, 0xaa}}, nil},
+		{"gpt with its protective mbr", map[int][]byte{446: dosPartition(0xee), 510: {0x55, 0xaa}, 512: []byte("EFI PART")},
+			[]Signature{{"gpt", UsagePartitionTable, 512}}},
+	}
+	for _, tt := range tests {
+		result, err := Probe(image(size, tt.writes), size)
+		assert.Nil(t, err, tt.description)
+		assert.Equal(t, tt.expected, result.Signatures, tt.description)
+		assert.Equal(t, tt.expected == nil, result.Blank(), tt.description)
+	}
+}
+
+func TestProbeSmallDevice(t *testing.T) {
+	// nothing is beyond the end of the device, not even the ext superblock
+	result, err := Probe(image(1024, map[int][]byte{0: []byte("XFSB")}), 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, "xfs (filesystem) at 0", result.String())
+}
+
+type failingReader struct{}
+
+func (failingReader) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("input/output error")
+}
+
+func TestProbeReadError(t *testing.T) {
+	_, err := Probe(failingReader{}, 1<<20)
+	assert.NotNil(t, err)
+}
+
+func TestResult(t *testing.T) {
+	result := Result{Signatures: []Signature{
+		{"gpt", UsagePartitionTable, 512},
+		{"ext4", UsageFilesystem, extMagicOffset},
+	}}
+	assert.False(t, result.Blank())
+	assert.Equal(t, "ext4", result.Filesystem().Type)
+	assert.Equal(t, "gpt (partition table) at 512, ext4 (filesystem) at 1080", result.String())
+	assert.Nil(t, Result{}.Filesystem())
+	assert.Equal(t, "blank", Result{}.String())
+}
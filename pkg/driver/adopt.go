@@ -0,0 +1,92 @@
+package driver
+
+import (
+	"fmt"
+
+	"github.com/packethost/csi-packet/pkg/packet"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// defaultAdoptedFsType the filesystem an adopted volume is expected to have, when none is given
+	defaultAdoptedFsType = "ext4"
+	// annotationProvisionedBy the annotation the external-provisioner sets on the PersistentVolumes it creates
+	annotationProvisionedBy = "pv.kubernetes.io/provisioned-by"
+)
+
+// AdoptionOptions how to write the PersistentVolume for an adopted volume
+type AdoptionOptions struct {
+	// Name of the PersistentVolume, the name of the volume if empty
+	Name string
+	// StorageClassName of the PersistentVolume, none if empty
+	StorageClassName string
+	// FsType the filesystem on the volume, ext4 if empty
+	FsType string
+}
+
+// the subset of a kubernetes PersistentVolume needed to statically provision a volume
+type persistentVolume struct {
+	APIVersion string               `yaml:"apiVersion"`
+	Kind       string               `yaml:"kind"`
+	Metadata   persistentVolumeMeta `yaml:"metadata"`
+	Spec       persistentVolumeSpec `yaml:"spec"`
+}
+
+type persistentVolumeMeta struct {
+	Name        string            `yaml:"name"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+type persistentVolumeSpec struct {
+	Capacity                      map[string]string   `yaml:"capacity"`
+	AccessModes                   []string            `yaml:"accessModes"`
+	PersistentVolumeReclaimPolicy string              `yaml:"persistentVolumeReclaimPolicy"`
+	StorageClassName              string              `yaml:"storageClassName,omitempty"`
+	CSI                           persistentVolumeCSI `yaml:"csi"`
+}
+
+type persistentVolumeCSI struct {
+	Driver           string            `yaml:"driver"`
+	VolumeHandle     string            `yaml:"volumeHandle"`
+	FsType           string            `yaml:"fsType"`
+	VolumeAttributes map[string]string `yaml:"volumeAttributes,omitempty"`
+}
+
+// PersistentVolumeName the name of the PersistentVolume for an adopted volume
+func PersistentVolumeName(adoption packet.Adoption, options AdoptionOptions) string {
+	if options.Name != "" {
+		return options.Name
+	}
+	return adoption.Volume.Name
+}
+
+// PersistentVolumeManifest the yaml of a PersistentVolume that statically provisions an adopted volume.
+// It is retained when released, since the data on it predates the cluster.
+func PersistentVolumeManifest(adoption packet.Adoption, options AdoptionOptions) ([]byte, error) {
+	fsType := options.FsType
+	if fsType == "" {
+		fsType = defaultAdoptedFsType
+	}
+	pv := persistentVolume{
+		APIVersion: "v1",
+		Kind:       "PersistentVolume",
+		Metadata: persistentVolumeMeta{
+			Name:        PersistentVolumeName(adoption, options),
+			Annotations: map[string]string{annotationProvisionedBy: DriverName},
+		},
+		Spec: persistentVolumeSpec{
+			Capacity:                      map[string]string{"storage": fmt.Sprintf("%dGi", adoption.Volume.Size)},
+			AccessModes:                   []string{"ReadWriteOnce"},
+			PersistentVolumeReclaimPolicy: "Retain",
+			StorageClassName:              options.StorageClassName,
+			CSI: persistentVolumeCSI{
+				Driver:       DriverName,
+				VolumeHandle: adoption.Volume.ID,
+				FsType:       fsType,
+				// never format an adopted volume, it is expected to hold data already
+				VolumeAttributes: map[string]string{volumeContextAdopted: "true"},
+			},
+		},
+	}
+	return yaml.Marshal(pv)
+}
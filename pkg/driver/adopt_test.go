@@ -0,0 +1,43 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/packethost/packngo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistentVolumeManifest(t *testing.T) {
+	adoption := packet.Adoption{
+		Volume: packngo.Volume{ID: "9d9ba2f5-3b5b-4fa8-a2b2-0c8d6a1c3e01", Name: "volume-9d9ba2f5", Size: 250},
+	}
+
+	manifest, err := PersistentVolumeManifest(adoption, AdoptionOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `apiVersion: v1
+kind: PersistentVolume
+metadata:
+  name: volume-9d9ba2f5
+  annotations:
+    pv.kubernetes.io/provisioned-by: csi.packet.net
+spec:
+  capacity:
+    storage: 250Gi
+  accessModes:
+  - ReadWriteOnce
+  persistentVolumeReclaimPolicy: Retain
+  csi:
+    driver: csi.packet.net
+    volumeHandle: 9d9ba2f5-3b5b-4fa8-a2b2-0c8d6a1c3e01
+    fsType: ext4
+    volumeAttributes:
+      csi.packet.net/adopted: "true"
+`, string(manifest))
+
+	manifest, err = PersistentVolumeManifest(adoption, AdoptionOptions{Name: "postgres", StorageClassName: "csi-packet-standard", FsType: "xfs"})
+	assert.Nil(t, err)
+	assert.Contains(t, string(manifest), "  name: postgres\n")
+	assert.Contains(t, string(manifest), "  storageClassName: csi-packet-standard\n")
+	assert.Contains(t, string(manifest), "    fsType: xfs\n")
+}
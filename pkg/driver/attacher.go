@@ -1,154 +1,155 @@
 package driver
 
 import (
-	"bufio"
 	"context"
 	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"strings"
-	"time"
+	"sort"
+	"sync"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/packethost/csi-packet/pkg/iscsi"
 )
 
 const (
-	multipathTimeout  = 10 * time.Second
-	multipathExec     = "/sbin/multipath"
-	multipathBindings = "/etc/multipath/bindings"
-	iscsiIface        = "kubernetescsi0"
+	iscsiIface = "kubernetescsi0"
 )
 
 // IscsiAdm interface provides methods of executing iscsi admin commands
 type Attacher interface {
 	// these interact with iscsiadm and the iscsi target
 
-	// Discover also sets up the iface, so it requires the initiator
-	Discover(ip, initiator string) error
+	// Discover also sets up the iface, so it requires the initiator; CHAP credentials are optional
+	Discover(ip, initiator string, chap *ChapCredentials) error
 	HasSession(ip, targe string) (bool, error)
-	Login(ip, target string) error
+	Login(ip, target string, chap *ChapCredentials) error
 	Logout(ip, target string) error
+	// HasNode and DeleteNode the node record of the target at a portal, which discovery created
+	HasNode(ip, target string) (bool, error)
+	DeleteNode(ip, target string) error
+	// DeleteDiscovery the discovery record of a portal, which holds the CHAP credentials for discovery
+	DeleteDiscovery(ip string) error
 	// these check locally on the local host
-	GetScsiID(devicePath string) (string, error)
-	GetDevice(portal, target string) (string, error)
-	// these do multipath
-	MultipathReadBindings() (map[string]string, map[string]string, error)
-	MultipathWriteBindings(map[string]string) error
+
+	// GetDevice wait for the disk of the session with the target at a portal, until the context is done
+	GetDevice(ctx context.Context, portal, target string) (string, error)
+	// GetWWID the WWID of a disk, by which multipath maps it
+	GetWWID(device string) (string, error)
+	// Devices the disks of the session with the target at a portal, as they are now, none without a session
+	Devices(ctx context.Context, portal, target string) ([]string, error)
+	// DeleteDevice remove a disk from the host, once nothing uses it
+	DeleteDevice(device string) error
+	// RescanDevice have the host read the size of a disk again, after the volume grew
+	RescanDevice(device string) error
+	// FindSessions the target and portals of the sessions whose disks have the WWID
+	FindSessions(ctx context.Context, wwid string) (string, []string, error)
 }
 
 type AttacherImpl struct {
+	// Exec runs commands, on this host if nil
+	Exec executor.Executor
+	// FS has the device links, those of this host if nil
+	FS FS
+	// Iscsi runs iscsiadm, a client with the defaults that runs it with Exec if nil
+	Iscsi *iscsi.Client
+
+	// portals are attached concurrently, so the client is set up once, and only one of them creates the iface
+	once      sync.Once
+	ifaceLock sync.Mutex
 }
 
-func (i *AttacherImpl) GetScsiID(devicePath string) (string, error) {
-	args := []string{"-g", "-u", "-d", devicePath}
-	out, err := execCommand("/lib/udev/scsi_id", args...)
-	if err != nil {
-		return "", err
-	}
-	return string(out), nil
+func (i *AttacherImpl) iscsi() *iscsi.Client {
+	i.once.Do(func() {
+		if i.Iscsi == nil {
+			i.Iscsi = iscsi.NewClient()
+			i.Iscsi.Executor = orLocal(i.Exec)
+		}
+	})
+	return i.Iscsi
 }
 
-// look for file that matches portal, target, look up what it links to
-func (i *AttacherImpl) GetDevice(portal, target string) (string, error) {
-
-	pattern := fmt.Sprintf("%s*%s*%s*", "/dev/disk/by-path/", portal, target)
-
-	files, err := filepath.Glob(pattern)
-	if err != nil {
-		return "", err
-	}
-	if len(files) == 0 {
-		return "", fmt.Errorf("file not found for pattern %s", pattern)
+func (i *AttacherImpl) Discover(ip, initiator string, chap *ChapCredentials) error {
+	ctx := context.Background()
+	if err := i.ensureIface(ctx, initiator); err != nil {
+		return err
 	}
 
-	file := files[0]
-	finfo, err := os.Lstat(file)
-	if err != nil {
-		return "", err
+	var settings []iscsi.Setting
+	if chap != nil {
+		// discovery with authentication takes a discovery record to hold the credentials
+		settings = chap.settings("discovery.sendtargets.auth")
 	}
-	if finfo.Mode()&os.ModeSymlink == 0 {
-		return "", fmt.Errorf("file %s is not a link", file)
+	if _, err := i.iscsi().Discover(ctx, iscsiIface, ip, settings); err != nil {
+		return fmt.Errorf("unable to discover targets at %s: %v", ip, err)
 	}
-	source, err := filepath.EvalSymlinks(file)
-	if err != nil {
-		log.Errorf("cannot get symlink for %s", file)
-		return "", err
-	}
-	return source, nil
+	return nil
 }
 
-func (i *AttacherImpl) Discover(ip, initiator string) error {
+// ensureIface create the iface with the initiator name, unless it exists
+func (i *AttacherImpl) ensureIface(ctx context.Context, initiator string) error {
+	i.ifaceLock.Lock()
+	defer i.ifaceLock.Unlock()
 	// does the desired iface exist?
-	args := []string{"--mode", "iface", "-o", "show"}
-	out, err := execCommand("iscsiadm", args...)
-	// if an error was returned, we cannot do much
+	ifaces, err := i.iscsi().Ifaces(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to list all ifaces: %v", err)
 	}
-	// parse through them to find the one we want
-	pat, err := regexp.Compile(`(?m)^` + iscsiIface + ` .*`)
-	if err != nil {
-		return fmt.Errorf("error compiling pattern: %v", err)
+	found := false
+	for _, iface := range ifaces {
+		if iface.Name == iscsiIface {
+			found = true
+			break
+		}
 	}
-	found := pat.FindString(string(out))
 	// if the iface does not exist, we must create it
-	if found == "" {
-		args := []string{"-I", iscsiIface, "--mode", "iface", "-o", "new"}
-		_, err := execCommand("iscsiadm", args...)
-		if err != nil {
+	if !found {
+		if err := i.iscsi().CreateIface(ctx, iscsiIface); err != nil {
 			return fmt.Errorf("unable to create new iscsi iface %s: %v", iscsiIface, err)
 		}
 		// get the configs for the default, and then clone them, while overriding the initiator name
-		args = []string{"-I", "default", "--mode", "iface", "-o", "show"}
-		out, err := execCommand("iscsiadm", args...)
+		params, err := i.iscsi().Iface(ctx, "default")
 		if err != nil {
 			return fmt.Errorf("unable to get parameters for default iface: %v", err)
 		}
-		params, err := parseIscsiIfaceShow(string(out))
-		if err != nil {
-			return fmt.Errorf("unable to parse parameters for default iface: %v", err)
-		}
-		params["iface.initiatorname"] = initiator
-		// update new iface records
-		for key, val := range params {
-			args := []string{"-I", iscsiIface, "--mode", "iface", "-o", "update", "-n", key, "-v", val}
-			_, err = execCommand("iscsiadm", args...)
-			if err != nil {
-				return fmt.Errorf("unable to set parameter %s for iscsi iface %s: %v", key, iscsiIface, err)
-			}
+		if err := i.iscsi().UpdateIface(ctx, iscsiIface, ifaceSettings(params, initiator)); err != nil {
+			return fmt.Errorf("unable to set parameters for iscsi iface %s: %v", iscsiIface, err)
 		}
 		// now we can use it
 	}
+	return nil
+}
 
-	args = []string{"-I", iscsiIface, "--mode", "discovery", "--portal", ip, "--type", "sendtargets", "--discover"}
-	_, err = execCommand("iscsiadm", args...)
-	return err
+// ifaceSettings the settings of a new iface cloned from the record of the default one, with the initiator name;
+// settings that are not set are left out, and iscsi_ifacename is immutable once the iface is created
+func ifaceSettings(params iscsi.Record, initiator string) []iscsi.Setting {
+	names := make([]string, 0, len(params))
+	for name, value := range params {
+		if value != "" && name != "iface.iscsi_ifacename" && name != "iface.initiatorname" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	settings := make([]iscsi.Setting, 0, len(names)+1)
+	for _, name := range names {
+		settings = append(settings, iscsi.Setting{Name: name, Value: params[name]})
+	}
+	return append(settings, iscsi.Setting{Name: "iface.initiatorname", Value: initiator})
 }
 
-// HasSession checks to see if the session exists, may log an extraneous error if the seesion does not exist
+// HasSession checks to see if there is a session with the target at the portal
 func (i *AttacherImpl) HasSession(ip, target string) (bool, error) {
-	args := []string{"--mode", "session"}
-	out, err := execCommand("iscsiadm", args...)
-	if err != nil {
-		return false, nil // this is almost certainly "No active sessions"
-	}
-	pat, err := regexp.Compile(ip + ".*" + target)
+	sessions, err := i.iscsi().Sessions(context.Background())
 	if err != nil {
 		return false, err
 	}
-	lines := strings.Split(string(out[:]), "\n")
-	for _, line := range lines {
-		found := pat.FindString(line)
-		if found != "" {
+	for _, session := range sessions {
+		if session.Target == target && session.Portal.IP == ip {
 			return true, nil
 		}
 	}
 	return false, nil
 }
 
-func (i *AttacherImpl) Login(ip, target string) error {
+func (i *AttacherImpl) Login(ip, target string, chap *ChapCredentials) error {
 	hasSession, err := i.HasSession(ip, target)
 	if err != nil {
 		return err
@@ -156,9 +157,14 @@ func (i *AttacherImpl) Login(ip, target string) error {
 	if hasSession {
 		return nil
 	}
-	args := []string{"-I", iscsiIface, "--mode", "node", "--portal", ip, "--targetname", target, "--login"}
-	_, err = execCommand("iscsiadm", args...)
-	return err
+	ctx := context.Background()
+	if chap != nil {
+		// the credentials go in the node record, which discovery created, and are used for every login with it
+		if err := i.iscsi().UpdateNode(ctx, iscsiIface, ip, target, chap.settings("node.session.auth")); err != nil {
+			return fmt.Errorf("unable to set CHAP credentials for %s at %s: %v", target, ip, err)
+		}
+	}
+	return i.iscsi().Login(ctx, iscsiIface, ip, target)
 }
 
 func (i *AttacherImpl) Logout(ip, target string) error {
@@ -169,105 +175,42 @@ func (i *AttacherImpl) Logout(ip, target string) error {
 	if !hasSession {
 		return nil
 	}
-	args := []string{"-I", iscsiIface, "--mode", "node", "--portal", ip, "--targetname", target, "--logout"}
-	_, err = execCommand("iscsiadm", args...)
-	return err
+	return i.iscsi().Logout(context.Background(), iscsiIface, ip, target)
 }
 
-// read the bindings from /etc/multipath/bindings
-// separating into keep/discard sets
-// return elements map from volume name to scsi id
-func (i *AttacherImpl) MultipathReadBindings() (map[string]string, map[string]string, error) {
-
-	var bindings = map[string]string{}
-	var discard = map[string]string{}
-
-	if _, err := os.Stat(multipathBindings); err != nil {
-		if os.IsNotExist(err) {
-			// file does not exist
-			return bindings, discard, nil
-		}
-		return nil, nil, err
-	}
-
-	f, err := os.Open(multipathBindings)
+// HasNode checks to see if there is a node record of the target at the portal
+func (i *AttacherImpl) HasNode(ip, target string) (bool, error) {
+	nodes, err := i.iscsi().Nodes(context.Background())
 	if err != nil {
-		return nil, nil, err
+		return false, err
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) > 0 && line[0] != '#' {
-			elements := strings.Fields(line)
-			if len(elements) == 2 {
-
-				if strings.HasPrefix(elements[0], "mpath") {
-					discard[elements[0]] = elements[1]
-				} else {
-					bindings[elements[0]] = elements[1]
-				}
-			}
+	for _, node := range nodes {
+		if node.Target == target && node.Portal.IP == ip {
+			return true, nil
 		}
 	}
-
-	return bindings, discard, nil
+	return false, nil
 }
 
-// write the bindings to /etc/multipath/bindings
-func (i *AttacherImpl) MultipathWriteBindings(bindings map[string]string) error {
+// DeleteNode delete the node record of the target at the portal, and the CHAP credentials for logging in to it
+// that it holds, which are left over once its session is logged out of; there must be no session any more.
+// The credentials for discovery are in the discovery record, see DeleteDiscovery.
+func (i *AttacherImpl) DeleteNode(ip, target string) error {
+	return i.iscsi().DeleteNode(context.Background(), iscsiIface, ip, target)
+}
 
-	f, err := os.Create(multipathBindings)
+// DeleteDiscovery delete the discovery record of the portal, and the CHAP credentials for discovery that it holds.
+// Deleting it deletes the node records that were discovered with it too, so it is kept as long as any target
+// still has a session at the portal; the last one to be logged out of deletes it.
+func (i *AttacherImpl) DeleteDiscovery(ip string) error {
+	sessions, err := i.iscsi().Sessions(context.Background())
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	writer := bufio.NewWriter(f)
-	for name, id := range bindings {
-		writer.WriteString(fmt.Sprintf("%s %s\n", name, id))
-	}
-	writer.Flush()
-	return nil
-}
-
-// multipath hangs when run inside a container, but is safe to terminate
-func multipath(args ...string) (string, error) {
-
-	ctx, cancel := context.WithTimeout(context.Background(), multipathTimeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, multipathExec, args...)
-
-	output, err := cmd.Output()
-
-	if ctx.Err() == context.DeadlineExceeded {
-		log.WithFields(log.Fields{"timeout": multipathTimeout, "args": strings.Join(args, " ")}).Info("multipath timed out")
-		return string(output), nil
-	}
-
-	return string(output), err
-}
-
-// taken unabashedly from kubernetes kubelet iscsi volume driver, which is licensed Apache 2.0
-// see https://github.com/kubernetes/kubernetes/blob/ce42bc382e38dd7cd233b8a350723287f6e79f82/pkg/volume/iscsi/iscsi_util.go
-func parseIscsiIfaceShow(data string) (map[string]string, error) {
-	params := make(map[string]string)
-	slice := strings.Split(data, "\n")
-	for _, line := range slice {
-		if !strings.HasPrefix(line, "iface.") || strings.Contains(line, "<empty>") {
-			continue
-		}
-		iface := strings.Fields(line)
-		if len(iface) != 3 || iface[1] != "=" {
-			return nil, fmt.Errorf("Error: invalid iface setting: %v", iface)
-		}
-		// iscsi_ifacename is immutable once the iface is created
-		if iface[0] == "iface.iscsi_ifacename" {
-			continue
+	for _, session := range sessions {
+		if session.Portal.IP == ip {
+			return nil
 		}
-		params[iface[0]] = iface[2]
 	}
-	return params, nil
+	return i.iscsi().DeleteDiscovery(context.Background(), iscsiIface, ip)
 }
@@ -0,0 +1,342 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/packethost/csi-packet/pkg/iscsi"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testPortal = "10.144.144.226"
+	testTarget = "iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b"
+)
+
+// iscsiadmReply what a replayed iscsiadm call returns: the recorded output in testdata/iscsiadm, if any, and its exit code
+type iscsiadmReply struct {
+	output   string
+	exitCode int
+}
+
+// noSessions what iscsiadm --mode session exits with when there are none
+var noSessions = iscsiadmReply{exitCode: iscsi.ExitNoObjectsFound}
+
+// replayIscsiadm an attacher whose iscsiadm replays recorded output for the expected calls, by their arguments,
+// recording the calls
+func replayIscsiadm(t *testing.T, replies map[string]iscsiadmReply) (*AttacherImpl, *[]string) {
+	calls := []string{}
+	exec := executor.Func(func(ctx context.Context, stdin []byte, command string, args ...string) (executor.Result, error) {
+		call := strings.Join(args, " ")
+		calls = append(calls, call)
+		reply, ok := replies[call]
+		if !ok {
+			t.Errorf("unexpected iscsiadm %s", call)
+			return executor.Result{ExitCode: iscsi.ExitInvalidArgument}, nil
+		}
+		if reply.output == "" {
+			return executor.Result{ExitCode: reply.exitCode}, nil
+		}
+		out, err := ioutil.ReadFile(filepath.Join("testdata", "iscsiadm", reply.output))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return executor.Result{Stdout: out, ExitCode: reply.exitCode}, nil
+	})
+	return &AttacherImpl{Iscsi: &iscsi.Client{Path: "iscsiadm", Timeout: time.Second, Executor: exec}}, &calls
+}
+
+func TestLoginChap(t *testing.T) {
+	record := "-I kubernetescsi0 --mode node --portal " + testPortal + " --targetname " + testTarget
+	attacher, calls := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode session -P 3": noSessions,
+		record + " -o update -n node.session.auth.authmethod -v CHAP":         {},
+		record + " -o update -n node.session.auth.username -v initiator-user": {},
+		record + " -o update -n node.session.auth.password -v initiator-pass": {},
+		record + " -o update -n node.session.auth.username_in -v target-user": {},
+		record + " -o update -n node.session.auth.password_in -v target-pass": {},
+		record + " --login": {output: "login.txt"},
+	})
+
+	chap := &ChapCredentials{Username: "initiator-user", Password: "initiator-pass", MutualUsername: "target-user", MutualPassword: "target-pass"}
+	err := attacher.Login(testPortal, testTarget, chap)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, len(*calls))
+	assert.Equal(t, record+" --login", (*calls)[6])
+}
+
+func TestLoginWithoutChap(t *testing.T) {
+	attacher, calls := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode session -P 3": noSessions,
+		"-I kubernetescsi0 --mode node --portal " + testPortal + " --targetname " + testTarget + " --login": {output: "login.txt"},
+	})
+
+	assert.Nil(t, attacher.Login(testPortal, testTarget, nil))
+	assert.Equal(t, 2, len(*calls))
+}
+
+func TestLoginExistingSession(t *testing.T) {
+	attacher, calls := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode session -P 3": {output: "session.txt"},
+	})
+
+	// the credentials are not needed for a session that already is logged in
+	err := attacher.Login(testPortal, testTarget, &ChapCredentials{Username: "user", Password: "pass"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"--mode session -P 3"}, *calls)
+}
+
+func TestLoginSessionsError(t *testing.T) {
+	attacher, _ := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode session -P 3": {exitCode: iscsi.ExitIscsidNotConnected},
+	})
+
+	// not knowing the sessions is not the same as there being none
+	err := attacher.Login(testPortal, testTarget, nil)
+	assert.Equal(t, iscsi.ExitIscsidNotConnected, iscsi.ExitCode(err))
+}
+
+func TestLoginChapUpdateError(t *testing.T) {
+	record := "-I kubernetescsi0 --mode node --portal " + testPortal + " --targetname " + testTarget
+	attacher, _ := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode session -P 3": noSessions,
+		record + " -o update -n node.session.auth.authmethod -v CHAP": {},
+		record + " -o update -n node.session.auth.username -v user":   {exitCode: iscsi.ExitNoObjectsFound},
+	})
+
+	err := attacher.Login(testPortal, testTarget, &ChapCredentials{Username: "user", Password: "pass"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "node.session.auth.username")
+	// the name of the setting is fine to report, but never its value
+	assert.NotContains(t, err.Error(), "-v user")
+}
+
+func TestLogout(t *testing.T) {
+	attacher, calls := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode session -P 3": {output: "session.txt"},
+		"-I kubernetescsi0 --mode node --portal 10.144.145.66 --targetname " + testTarget + " --logout": {},
+	})
+
+	assert.Nil(t, attacher.Logout("10.144.145.66", testTarget))
+	assert.Equal(t, 2, len(*calls))
+	// no session for another target at the portal
+	assert.Nil(t, attacher.Logout("10.144.145.66", "iqn.2013-05.com.daterainc:tc:01:sn:4b4bd8fcc5b1d210"))
+	assert.Equal(t, 3, len(*calls))
+}
+
+func TestDiscoverChap(t *testing.T) {
+	record := "-I kubernetescsi0 --mode discoverydb --portal " + testPortal + " --type sendtargets"
+	attacher, calls := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode iface":     {output: "iface-show-kubernetescsi0.txt"},
+		record + " -o new": {},
+		record + " -o update -n discovery.sendtargets.auth.authmethod -v CHAP": {},
+		record + " -o update -n discovery.sendtargets.auth.username -v user":   {},
+		record + " -o update -n discovery.sendtargets.auth.password -v pass":   {},
+		record + " --discover": {output: "discovery.txt"},
+	})
+
+	err := attacher.Discover(testPortal, "iqn.2014-05.net.packet:device.7c8d0ba0", &ChapCredentials{Username: "user", Password: "pass"})
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(*calls))
+	assert.Equal(t, record+" --discover", (*calls)[5])
+}
+
+func TestDeleteDiscovery(t *testing.T) {
+	record := "-I kubernetescsi0 --mode discoverydb --portal 10.144.146.1 --type sendtargets"
+	attacher, calls := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode session -P 3": {output: "session.txt"},
+		record + " -o delete": {},
+	})
+
+	// a portal that others have sessions at keeps its record
+	assert.Nil(t, attacher.DeleteDiscovery(testPortal))
+	assert.Equal(t, []string{"--mode session -P 3"}, *calls)
+
+	assert.Nil(t, attacher.DeleteDiscovery("10.144.146.1"))
+	assert.Equal(t, []string{"--mode session -P 3", "--mode session -P 3", record + " -o delete"}, *calls)
+}
+
+func TestDiscoverCreatesIface(t *testing.T) {
+	iface := "-I kubernetescsi0 --mode iface -o update -n "
+	attacher, calls := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode iface":                          {output: "iface-show.txt"},
+		"-I kubernetescsi0 --mode iface -o new": {},
+		"-I default --mode iface -o show":       {output: "iface-default.txt"},
+		iface + "iface.transport_name -v tcp":   {},
+		iface + "iface.vlan_id -v 0":            {},
+		iface + "iface.vlan_priority -v 0":      {},
+		iface + "iface.iface_num -v 0":          {},
+		iface + "iface.mtu -v 0":                {},
+		iface + "iface.port -v 0":               {},
+		iface + "iface.initiatorname -v iqn.2014-05.net.packet:device.7c8d0ba0":                        {},
+		"-I kubernetescsi0 --mode discovery --portal " + testPortal + " --type sendtargets --discover": {output: "discovery.txt"},
+	})
+
+	err := attacher.Discover(testPortal, "iqn.2014-05.net.packet:device.7c8d0ba0", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(*calls))
+	// the initiator name is set last, after the settings cloned from the default iface
+	assert.Equal(t, iface+"iface.initiatorname -v iqn.2014-05.net.packet:device.7c8d0ba0", (*calls)[9])
+}
+
+func TestChapCredentials(t *testing.T) {
+	tests := []struct {
+		description string
+		secrets     map[string]string
+		expected    *ChapCredentials
+		valid       bool
+	}{
+		{"none", nil, nil, true},
+		{"chap", map[string]string{"chapUsername": "user", "chapPassword": "pass"}, &ChapCredentials{Username: "user", Password: "pass"}, true},
+		{"mutual chap", map[string]string{"chapUsername": "user", "chapPassword": "pass", "chapMutualUsername": "target", "chapMutualPassword": "secret"},
+			&ChapCredentials{Username: "user", Password: "pass", MutualUsername: "target", MutualPassword: "secret"}, true},
+		{"other secrets", map[string]string{"encryptionKey": "key"}, nil, true},
+		{"no password", map[string]string{"chapUsername": "user"}, nil, false},
+		{"mutual only", map[string]string{"chapMutualUsername": "target", "chapMutualPassword": "secret"}, nil, false},
+		{"mutual without password", map[string]string{"chapUsername": "user", "chapPassword": "pass", "chapMutualUsername": "target"}, nil, false},
+	}
+	for _, tt := range tests {
+		chap, err := chapCredentials(tt.secrets)
+		assert.Equal(t, tt.valid, err == nil, tt.description)
+		assert.Equal(t, tt.expected, chap, tt.description)
+	}
+}
+
+func TestChapCredentialsNotFormatted(t *testing.T) {
+	chap := &ChapCredentials{Username: "user", Password: "pass", MutualUsername: "target", MutualPassword: "secret"}
+	for _, format := range []string{"%v", "%+v", "%s", "%#v"} {
+		formatted := fmt.Sprintf(format, chap)
+		assert.NotContains(t, formatted, "pass", format)
+		assert.NotContains(t, formatted, "secret", format)
+	}
+}
+
+func TestExecCommandRedacted(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	_, err := execCommandRedacted(executor.Local{}, []string{"hunter2"}, "sh", "-c", "echo password hunter2 rejected; exit 1", "hunter2")
+	assert.NotNil(t, err)
+	entry := hook.LastEntry()
+	if assert.NotNil(t, entry) {
+		for _, value := range entry.Data {
+			assert.NotContains(t, value, "hunter2")
+		}
+		assert.Contains(t, entry.Data["out"], executor.Redacted)
+	}
+}
+
+func TestGetDeviceWaits(t *testing.T) {
+	root, err := ioutil.TempDir("", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	attacher, _ := replayIscsiadm(t, map[string]iscsiadmReply{"--mode session -P 3": {output: "session.txt"}})
+	attacher.FS = RootFS{Root: root}
+
+	// the disk appears a while after the login, and its device node after that
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		if err := os.MkdirAll(filepath.Join(root, "sys/class/iscsi_session/session2/device/target3:0:0/3:0:0:0/block/sdc"), 0755); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if err := os.MkdirAll(filepath.Join(root, "dev"), 0755); err != nil {
+			t.Error(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "dev/sdc"), nil, 0644); err != nil {
+			t.Error(err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	device, err := attacher.GetDevice(ctx, "10.144.145.66", testTarget)
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/sdc", device)
+}
+
+func TestGetDeviceNotFound(t *testing.T) {
+	attacher, _ := replayIscsiadm(t, map[string]iscsiadmReply{"--mode session -P 3": {output: "session.txt"}})
+	attacher.FS = newMemFS()
+
+	_, err := attacher.GetDevice(context.Background(), "10.144.144.227", testTarget)
+	assert.True(t, IsNoSession(err))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = attacher.GetDevice(ctx, testPortal, testTarget)
+	assert.True(t, IsDeviceNotFound(err))
+	assert.Equal(t, "no disk of session 1 with "+testTarget+" at "+testPortal+": context deadline exceeded", err.Error())
+}
+
+func TestGetWWID(t *testing.T) {
+	fs := newMemFS()
+	fs.files["/sys/block/sdb/device/vpd_pg83"] = testVPD(t, testScsiID)
+	// a kernel that does not expose the VPD pages
+	fs.files["/sys/block/sdc/device/wwid"] = []byte("naa.6001405b06f15a423fec58b000000001\n")
+	attacher := &AttacherImpl{FS: fs}
+
+	for _, device := range []string{"/dev/sdb", "/dev/sdc"} {
+		wwid, err := attacher.GetWWID(device)
+		assert.Nil(t, err, device)
+		assert.Equal(t, testScsiID, wwid, device)
+	}
+	_, err := attacher.GetWWID("/dev/sdd")
+	assert.NotNil(t, err)
+}
+
+func TestDevices(t *testing.T) {
+	attacher, _ := replayIscsiadm(t, map[string]iscsiadmReply{"--mode session -P 3": {output: "session.txt"}})
+	fs := attachedFS(t)
+	attacher.FS = fs
+
+	devices, err := attacher.Devices(context.Background(), "10.144.145.66", testTarget)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/dev/sdc"}, devices)
+	// no session, no disks
+	devices, err = attacher.Devices(context.Background(), "10.144.144.227", testTarget)
+	assert.Nil(t, err)
+	assert.Empty(t, devices)
+
+	assert.Nil(t, attacher.DeleteDevice("/dev/sdc"))
+	devices, err = attacher.Devices(context.Background(), "10.144.145.66", testTarget)
+	assert.Nil(t, err)
+	assert.Empty(t, devices)
+}
+
+func TestDeleteDeviceGone(t *testing.T) {
+	root, err := ioutil.TempDir("", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// the disk was removed already, and sysfs has no attribute to delete it with
+	attacher := &AttacherImpl{FS: RootFS{Root: root}}
+	assert.Nil(t, attacher.DeleteDevice("/dev/sdc"))
+}
+
+func TestNodeRecords(t *testing.T) {
+	record := "-I kubernetescsi0 --mode node --portal 10.144.145.66 --targetname " + testTarget
+	attacher, calls := replayIscsiadm(t, map[string]iscsiadmReply{
+		"--mode node":         {output: "discovery.txt"},
+		record + " -o delete": {},
+	})
+
+	hasNode, err := attacher.HasNode("10.144.145.66", testTarget)
+	assert.Nil(t, err)
+	assert.True(t, hasNode)
+	hasNode, err = attacher.HasNode("10.144.145.66", "iqn.2013-05.com.daterainc:tc:01:sn:4b4bd8fcc5b1d210")
+	assert.Nil(t, err)
+	assert.False(t, hasNode)
+	assert.Nil(t, attacher.DeleteNode("10.144.145.66", testTarget))
+	assert.Equal(t, []string{"--mode node", "--mode node", record + " -o delete"}, *calls)
+}
@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/multipath"
+)
+
+const (
+	// multipathBindings the bindings file, which multipath and multipathd flock exclusively to change it, and so
+	// does the driver
+	multipathBindings = "/etc/multipath/bindings"
+	// multipathBindingsLock serializes the changes of the bindings by every instance of the driver on the host; it is
+	// a file of its own, since the bindings file is replaced by every change
+	multipathBindingsLock = "/etc/multipath/bindings.lock"
+	// volumePrefix the prefix of the names of volumes, which tells their bindings from those of anything else
+	volumePrefix = "volume-"
+)
+
+// Bindings manages the multipath bindings of volumes, which give their maps the names of the volumes. Bindings
+// of anything else, and the comments of the file, are kept as they are.
+type Bindings interface {
+	// Bind bind the name of a volume to its WWID, removing any other binding of the WWID, and returning the
+	// aliases of those, whose maps must be removed for the map of the volume to get its name
+	Bind(name, wwid string) ([]string, error)
+	// Unbind remove the binding of a volume, if it has one
+	Unbind(name string) error
+	// WWID the WWID that the name of a volume is bound to, if it has a binding
+	WWID(name string) (string, bool, error)
+	// Collect remove the bindings of volumes that are not attached to the node, as attached lists them,
+	// returning the names of those volumes
+	Collect(attached func() ([]string, error)) ([]string, error)
+}
+
+// BindingsImpl manages the bindings file of the host, locking it for every change, and replacing it
+// atomically. multipathd writes the file only to bind a WWID that has no binding yet to an alias of its own,
+// which Bind replaces.
+type BindingsImpl struct {
+	// FS has the multipath bindings, those of this host if nil
+	FS FS
+}
+
+// update change the bindings while holding the locks, see locked and change
+func (b *BindingsImpl) update(change func(*multipath.Bindings) (bool, error)) error {
+	return b.locked(func() error {
+		return b.change(change)
+	})
+}
+
+// locked run f while holding the lock that serializes the changes of every instance of the driver on the host
+func (b *BindingsImpl) locked(f func() error) error {
+	lock, err := orOS(b.FS).Lock(multipathBindingsLock)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	return f()
+}
+
+// change read, change and write the bindings, if the change says it changed anything. The bindings file itself
+// stays locked from reading it until the new one replaces it, so that multipath does not add a binding in between
+// that the new one would lose; multipath waits for it meanwhile, so nothing else is done while it is held.
+func (b *BindingsImpl) change(change func(*multipath.Bindings) (bool, error)) error {
+	fs := orOS(b.FS)
+	fileLock, err := fs.Lock(multipathBindings)
+	if err != nil {
+		return err
+	}
+	defer fileLock.Close()
+
+	data, err := fs.ReadFile(multipathBindings)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	bindings := multipath.ParseBindings(data)
+	changed, err := change(bindings)
+	if err != nil || !changed {
+		return err
+	}
+	if err := fs.WriteFileAtomic(multipathBindings, bindings.Bytes(), 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %v", multipathBindings, err)
+	}
+	return nil
+}
+
+func (b *BindingsImpl) Bind(name, wwid string) ([]string, error) {
+	discards := []string{}
+	err := b.update(func(bindings *multipath.Bindings) (bool, error) {
+		changed := false
+		for _, alias := range bindings.Aliases(wwid) {
+			if alias != name {
+				bindings.Remove(alias)
+				discards = append(discards, alias)
+				changed = true
+			}
+		}
+		return bindings.Set(name, wwid) || changed, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return discards, nil
+}
+
+func (b *BindingsImpl) Unbind(name string) error {
+	return b.update(func(bindings *multipath.Bindings) (bool, error) {
+		return bindings.Remove(name), nil
+	})
+}
+
+// WWID read the bindings without locking them, since every change replaces the file as a whole
+func (b *BindingsImpl) WWID(name string) (string, bool, error) {
+	data, err := orOS(b.FS).ReadFile(multipathBindings)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	wwid, ok := multipath.ParseBindings(data).Get(name)
+	return wwid, ok, nil
+}
+
+func (b *BindingsImpl) Collect(attached func() ([]string, error)) ([]string, error) {
+	collected := []string{}
+	err := b.locked(func() error {
+		// what is attached is fetched while holding the lock of the driver, so that a volume that is bound after
+		// it was fetched is not collected, but not that of the bindings file, which multipath would wait for
+		names, err := attached()
+		if err != nil {
+			return err
+		}
+		keep := map[string]bool{}
+		for _, name := range names {
+			keep[name] = true
+		}
+		return b.change(func(bindings *multipath.Bindings) (bool, error) {
+			for _, binding := range bindings.Entries() {
+				if strings.HasPrefix(binding.Alias, volumePrefix) && !keep[binding.Alias] {
+					bindings.Remove(binding.Alias)
+					collected = append(collected, binding.Alias)
+				}
+			}
+			return len(collected) > 0, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return collected, nil
+}
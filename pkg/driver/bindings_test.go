@@ -0,0 +1,164 @@
+package driver
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/multipath"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// testBindingsFS the files of a host in a temporary directory, with the bindings given, if any
+func testBindingsFS(t *testing.T, bindings string) (RootFS, func()) {
+	root, err := ioutil.TempDir("", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, filepath.Dir(multipathBindings)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if bindings != "" {
+		if err := ioutil.WriteFile(filepath.Join(root, multipathBindings), []byte(bindings), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return RootFS{Root: root}, func() { os.RemoveAll(root) }
+}
+
+func TestBind(t *testing.T) {
+	fs, done := testBindingsFS(t, testBindings)
+	defer done()
+	b := &BindingsImpl{FS: fs}
+
+	discards, err := b.Bind(testVolumeName, testScsiID)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"mpathb"}, discards)
+	data, _ := fs.ReadFile(multipathBindings)
+	assert.Equal(t, multipath.BindingsHeader+"mpatha 36001405aaaa\nvolume-other 36001405bbbb\n"+testVolumeName+" "+testScsiID+"\n", string(data))
+
+	// binding it again changes nothing
+	discards, err = b.Bind(testVolumeName, testScsiID)
+	assert.Nil(t, err)
+	assert.Empty(t, discards)
+
+	assert.Nil(t, b.Unbind(testVolumeName))
+	assert.Nil(t, b.Unbind(testVolumeName))
+	data, _ = fs.ReadFile(multipathBindings)
+	assert.Equal(t, multipath.BindingsHeader+"mpatha 36001405aaaa\nvolume-other 36001405bbbb\n", string(data))
+	// nothing is left behind but the lock
+	files, _ := filepath.Glob(filepath.Join(fs.Root, filepath.Dir(multipathBindings), "*"))
+	assert.Equal(t, 2, len(files))
+}
+
+func TestBindNoFile(t *testing.T) {
+	fs, done := testBindingsFS(t, "")
+	defer done()
+
+	_, err := (&BindingsImpl{FS: fs}).Bind(testVolumeName, testScsiID)
+	assert.Nil(t, err)
+	data, _ := fs.ReadFile(multipathBindings)
+	assert.Equal(t, multipath.BindingsHeader+testVolumeName+" "+testScsiID+"\n", string(data))
+}
+
+func TestBindConcurrently(t *testing.T) {
+	fs, done := testBindingsFS(t, testBindings)
+	defer done()
+	b := &BindingsImpl{FS: fs}
+
+	names := []string{"volume-00000001", "volume-00000002", "volume-00000003", "volume-00000004", "volume-00000005"}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(name, wwid string) {
+			defer wg.Done()
+			if _, err := b.Bind(name, wwid); err != nil {
+				t.Error(err)
+			}
+		}(name, "3600140500000"+string(rune('0'+i)))
+	}
+	wg.Wait()
+	data, _ := fs.ReadFile(multipathBindings)
+	for _, name := range names {
+		assert.Contains(t, string(data), name)
+	}
+}
+
+func TestBindLockedByMultipath(t *testing.T) {
+	fs, done := testBindingsFS(t, testBindings)
+	defer done()
+	b := &BindingsImpl{FS: fs}
+
+	// multipath flocks the bindings file itself to add a binding
+	f, err := os.OpenFile(filepath.Join(fs.Root, multipathBindings), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	bound := make(chan error)
+	go func() {
+		_, err := b.Bind(testVolumeName, testScsiID)
+		bound <- err
+	}()
+	select {
+	case err := <-bound:
+		t.Fatalf("bound while multipath held the lock: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// what multipath adds meanwhile is kept
+	if _, err := f.WriteString("mpathc 36001405cccc\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	assert.Nil(t, <-bound)
+	data, _ := fs.ReadFile(multipathBindings)
+	assert.Equal(t, multipath.BindingsHeader+"mpatha 36001405aaaa\nvolume-other 36001405bbbb\nmpathc 36001405cccc\n"+testVolumeName+" "+testScsiID+"\n", string(data))
+}
+
+func TestCollect(t *testing.T) {
+	fs, done := testBindingsFS(t, testBindings+testVolumeName+" "+testScsiID+"\n")
+	defer done()
+	b := &BindingsImpl{FS: fs}
+
+	collected, err := b.Collect(func() ([]string, error) { return []string{testVolumeName}, nil })
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"volume-other"}, collected)
+	data, _ := fs.ReadFile(multipathBindings)
+	assert.Equal(t, multipath.BindingsHeader+"mpatha 36001405aaaa\nmpathb "+testScsiID+"\n"+testVolumeName+" "+testScsiID+"\n", string(data))
+
+	// nothing is collected when what is attached is not known
+	_, err = b.Collect(func() ([]string, error) { return nil, errors.New("metadata unavailable") })
+	assert.NotNil(t, err)
+	data, _ = fs.ReadFile(multipathBindings)
+	assert.Contains(t, string(data), testVolumeName)
+}
+
+func TestCollectFetchesUnlocked(t *testing.T) {
+	fs, done := testBindingsFS(t, testBindings)
+	defer done()
+	b := &BindingsImpl{FS: fs}
+
+	// multipath can lock the bindings file while what is attached is fetched, which may take long
+	_, err := b.Collect(func() ([]string, error) {
+		f, err := os.OpenFile(filepath.Join(fs.Root, multipathBindings), os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+			return nil, err
+		}
+		return nil, unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	})
+	assert.Nil(t, err)
+	data, _ := fs.ReadFile(multipathBindings)
+	assert.NotContains(t, string(data), "volume-other")
+}
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// supportedAccessModes the access modes the driver supports, and if each one allows a filesystem.
+// SINGLE_NODE_WRITER allows several writers on its node, the same as SINGLE_NODE_MULTI_WRITER.
+// Only a raw block volume can be written from several nodes, since none of the filesystems the
+// driver formats can be mounted read-write on more than one node at a time.
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:    true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:   false,
+}
+
+// checkVolumeCapability determine if the driver supports a capability, returning why if it does not
+func checkVolumeCapability(capability *csi.VolumeCapability) error {
+	if capability.GetAccessMode() == nil {
+		return fmt.Errorf("no access mode")
+	}
+	mode := capability.GetAccessMode().GetMode()
+	allowsFilesystem, ok := supportedAccessModes[mode]
+	if !ok {
+		return fmt.Errorf("access mode %s is not supported", mode)
+	}
+	if !allowsFilesystem && !isBlockCapability(capability) {
+		return fmt.Errorf("access mode %s is supported only for block volumes", mode)
+	}
+	return nil
+}
+
+// isBlockCapability determine if a capability is for a raw block volume; anything else is mounted
+func isBlockCapability(capability *csi.VolumeCapability) bool {
+	return capability.GetBlock() != nil
+}
+
+// isMultiNodeCapability determine if a capability allows a volume to be attached to several nodes at once
+func isMultiNodeCapability(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
+
+// isReadOnlyCapability determine if a capability only allows a volume to be read
+func isReadOnlyCapability(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"fmt"
+
+	"github.com/packethost/csi-packet/pkg/iscsi"
+)
+
+// secrets of NodeStageVolume with the CHAP credentials of a volume's iSCSI sessions
+const (
+	secretChapUsername       = "chapUsername"
+	secretChapPassword       = "chapPassword"
+	secretChapMutualUsername = "chapMutualUsername"
+	secretChapMutualPassword = "chapMutualPassword"
+)
+
+// ChapCredentials the credentials for CHAP authentication of iSCSI sessions: the initiator's, and, for mutual
+// CHAP, the target's. They are secrets, and never are logged; formatting them only says what kind they are.
+type ChapCredentials struct {
+	Username       string
+	Password       string
+	MutualUsername string
+	MutualPassword string
+}
+
+// Mutual determine if the target authenticates itself to the initiator too
+func (c *ChapCredentials) Mutual() bool {
+	return c.MutualUsername != ""
+}
+
+func (c *ChapCredentials) String() string {
+	if c.Mutual() {
+		return "mutual CHAP credentials"
+	}
+	return "CHAP credentials"
+}
+
+// GoString keep the credentials out of %#v too
+func (c *ChapCredentials) GoString() string {
+	return c.String()
+}
+
+// settings the iscsiadm record settings for the credentials, whose names start with prefix, which is
+// node.session.auth for sessions and discovery.sendtargets.auth for discovery
+func (c *ChapCredentials) settings(prefix string) []iscsi.Setting {
+	settings := []iscsi.Setting{
+		{Name: prefix + ".authmethod", Value: "CHAP"},
+		{Name: prefix + ".username", Value: c.Username, Secret: true},
+		{Name: prefix + ".password", Value: c.Password, Secret: true},
+	}
+	if c.Mutual() {
+		settings = append(settings,
+			iscsi.Setting{Name: prefix + ".username_in", Value: c.MutualUsername, Secret: true},
+			iscsi.Setting{Name: prefix + ".password_in", Value: c.MutualPassword, Secret: true},
+		)
+	}
+	return settings
+}
+
+// chapCredentials read the CHAP credentials from the secrets of NodeStageVolume, nil if there are none; they
+// cannot come from the metadata, whose volumes have only their name, IQN, portals and capacity
+func chapCredentials(secrets map[string]string) (*ChapCredentials, error) {
+	c := &ChapCredentials{
+		Username:       secrets[secretChapUsername],
+		Password:       secrets[secretChapPassword],
+		MutualUsername: secrets[secretChapMutualUsername],
+		MutualPassword: secrets[secretChapMutualPassword],
+	}
+	switch {
+	case *c == ChapCredentials{}:
+		return nil, nil
+	case c.Username == "" || c.Password == "":
+		return nil, fmt.Errorf("CHAP requires both %s and %s", secretChapUsername, secretChapPassword)
+	case (c.MutualUsername == "") != (c.MutualPassword == ""):
+		return nil, fmt.Errorf("mutual CHAP requires both %s and %s", secretChapMutualUsername, secretChapMutualPassword)
+	}
+	return c, nil
+}
@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/packethost/csi-packet/pkg/packet"
+)
+
+// conditionTracker the condition of each volume staged on this node, as last found when staging it, and whether
+// it is missing paths, for NodeGetVolumeStats to report
+type conditionTracker struct {
+	lock       sync.Mutex
+	conditions map[string]*csi.VolumeCondition
+	// degraded why each volume that is missing paths is degraded, by volume name, as volumes that were staged
+	// before the driver started are only known by it
+	degraded map[string]string
+}
+
+func newConditionTracker() *conditionTracker {
+	return &conditionTracker{
+		conditions: map[string]*csi.VolumeCondition{},
+		degraded:   map[string]string{},
+	}
+}
+
+// set record the condition of a volume
+func (t *conditionTracker) set(volumeID string, abnormal bool, message string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.conditions[volumeID] = &csi.VolumeCondition{Abnormal: abnormal, Message: message}
+}
+
+// setDegraded record why a volume is missing paths, or that it no longer is if the message is empty; this is kept
+// apart from its condition, which the paths do not change
+func (t *conditionTracker) setDegraded(volumeName, message string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if message == "" {
+		delete(t.degraded, volumeName)
+		return
+	}
+	t.degraded[volumeName] = message
+}
+
+// get the condition of a volume, normal if nothing was recorded for it, and abnormal while it is missing paths
+func (t *conditionTracker) get(volumeID string) *csi.VolumeCondition {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	condition, ok := t.conditions[volumeID]
+	degraded, isDegraded := t.degraded[packet.VolumeIDToName(volumeID)]
+	switch {
+	case isDegraded && ok:
+		return &csi.VolumeCondition{Abnormal: true, Message: degraded + "; " + condition.Message}
+	case isDegraded:
+		return &csi.VolumeCondition{Abnormal: true, Message: degraded}
+	case ok:
+		return &csi.VolumeCondition{Abnormal: condition.Abnormal, Message: condition.Message}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+// remove forget the condition of a volume, when it no longer is staged
+func (t *conditionTracker) remove(volumeID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.conditions, volumeID)
+	delete(t.degraded, packet.VolumeIDToName(volumeID))
+}
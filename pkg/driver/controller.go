@@ -38,20 +38,24 @@ var _ csi.ControllerServer = &PacketControllerServer{}
 // PacketControllerServer controller server to manage CSI
 type PacketControllerServer struct {
 	Provider packet.VolumeProvider
+	Plans    *packet.PlanCache
+	// ClusterID the cluster on whose behalf volumes are managed; volumes of other clusters are ignored
+	ClusterID string
 }
 
 // NewPacketControllerServer create new PacketControllerServer with the given provider
 func NewPacketControllerServer(provider packet.VolumeProvider) *PacketControllerServer {
 	return &PacketControllerServer{
 		Provider: provider,
+		Plans:    packet.NewPlanCache(provider, packet.DefaultPlanCacheTTL),
 	}
 }
 
-func getSizeRequest(capacityRange *csi.CapacityRange) int {
+func getSizeRequest(capacityRange *csi.CapacityRange, plan packet.StoragePlan) int {
 	// size request:
 	//   limit if specified
 	//   required otherwise
-	//   within restrictions of max, min
+	//   within restrictions of the plan's max, min and increment
 	//   default otherwise
 	var sizeRequestGiB int
 	if capacityRange == nil {
@@ -69,30 +73,19 @@ func getSizeRequest(capacityRange *csi.CapacityRange) int {
 			}
 		}
 	}
-	if sizeRequestGiB > packet.MaxVolumeSizeGi {
-		sizeRequestGiB = packet.MaxVolumeSizeGi
-	}
-	if sizeRequestGiB < packet.MinVolumeSizeGi {
-		sizeRequestGiB = packet.MinVolumeSizeGi
-	}
-	return sizeRequestGiB
+	return plan.SizeGi(sizeRequestGiB)
 }
 
-func getPlanID(parameters map[string]string) string {
-
-	var planID string
-
-	volumePlanRequest := parameters["plan"]
-	switch volumePlanRequest {
-	case packet.VolumePlanPerformance:
-		planID = packet.VolumePlanPerformanceID
-	case packet.VolumePlanStandard:
-		planID = packet.VolumePlanStandardID
-	default:
-		planID = packet.VolumePlanStandardID
-
+// getPlan find the requested storage plan by slug, ID or name
+func (controller *PacketControllerServer) getPlan(volumePlanRequest string) (packet.StoragePlan, error) {
+	plan, err := controller.Plans.Lookup(volumePlanRequest)
+	switch {
+	case err != nil && packet.IsUnknownPlan(err):
+		return plan, status.Errorf(codes.InvalidArgument, "invalid plan %s, %v", volumePlanRequest, err)
+	case err != nil:
+		return plan, status.Errorf(codes.Unavailable, "unable to look up plan %s, %v", volumePlanRequest, err)
 	}
-	return planID
+	return plan, nil
 }
 
 // CreateVolume create a volume in the given context
@@ -114,11 +107,24 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 	if in.VolumeCapabilities == nil {
 		return nil, status.Error(codes.InvalidArgument, "VolumeCapabilities unspecified for CreateVolume")
 	}
+	for _, capability := range in.VolumeCapabilities {
+		if err := checkVolumeCapability(capability); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported VolumeCapability for CreateVolume, %v", err)
+		}
+	}
 
-	sizeRequestGiB := getSizeRequest(in.CapacityRange)
-	planID := getPlanID(in.Parameters)
+	params, err := parseVolumeParameters(in.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := controller.getPlan(params.Plan)
+	if err != nil {
+		return nil, err
+	}
+	planID := plan.ID
+	sizeRequestGiB := getSizeRequest(in.CapacityRange, plan)
 
-	logger.WithFields(log.Fields{"planID": planID, "sizeRequestGiB": sizeRequestGiB}).Info("Volume requested")
+	logger.WithFields(log.Fields{"planID": planID, "plan": plan.Slug, "sizeRequestGiB": sizeRequestGiB}).Info("Volume requested")
 
 	// check for pre-existing volume
 	volumes, httpResponse, err := controller.Provider.ListVolumes(nil)
@@ -131,7 +137,7 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 	for _, volume := range volumes {
 
 		description, err := packet.ReadDescription(volume.Description)
-		if err == nil && description.Name == in.Name {
+		if err == nil && description.Name == in.Name && description.InCluster(controller.ClusterID) {
 			logger.Infof("Volume already exists with id %s", volume.ID)
 
 			if volume.Size != sizeRequestGiB {
@@ -145,6 +151,7 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 				Volume: &csi.Volume{
 					CapacityBytes: int64(volume.Size) * packet.Gibi,
 					VolumeId:      volume.ID,
+					VolumeContext: volumeContext(description, params),
 				},
 			}
 			return &out, nil
@@ -152,13 +159,17 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 	}
 
 	description := packet.NewVolumeDescription(in.Name)
+	description.Cluster = controller.ClusterID
+	description.UnlockOnDelete = params.UnlockOnDelete
+	description.Kubernetes = params.Kubernetes
 
 	volumeCreateRequest := packngo.VolumeCreateRequest{
-		Size:         sizeRequestGiB,       // int               `json:"size"`
-		BillingCycle: packet.BillingHourly, // string            `json:"billing_cycle"`
-		PlanID:       planID,               // string            `json:"plan_id"`
-		Description:  description.String(), // string            `json:"description,omitempty"`
-		// SnapshotPolicies // []*SnapshotPolicy `json:"snapshot_policies,omitempty"`
+		Size:             sizeRequestGiB,          // int               `json:"size"`
+		BillingCycle:     params.BillingCycle,     // string            `json:"billing_cycle"`
+		PlanID:           planID,                  // string            `json:"plan_id"`
+		Description:      description.String(),    // string            `json:"description,omitempty"`
+		Locked:           params.Locked,           // bool              `json:"locked,omitempty"`
+		SnapshotPolicies: params.SnapshotPolicies, // []*SnapshotPolicy `json:"snapshot_policies,omitempty"`
 	}
 	volume, httpResponse, err := controller.Provider.Create(&volumeCreateRequest)
 
@@ -170,7 +181,7 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 	}
 	description, err = packet.ReadDescription(volume.Description)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to read csi description from provider volume")
+		return nil, status.Errorf(codes.Internal, "volume %s was created, but its description was not returned intact, %v", volume.ID, err)
 	}
 
 	// as described in the description to this CreateVolume method, we must wait for success or failure
@@ -194,6 +205,7 @@ func (controller *PacketControllerServer) CreateVolume(ctx context.Context, in *
 		Volume: &csi.Volume{
 			CapacityBytes: int64(volume.Size) * packet.Gibi,
 			VolumeId:      volume.ID,
+			VolumeContext: volumeContext(description, params),
 		},
 	}
 
@@ -212,7 +224,33 @@ func (controller *PacketControllerServer) DeleteVolume(ctx context.Context, in *
 		return nil, status.Error(codes.InvalidArgument, "VolumeId unspecified for DeleteVolume")
 	}
 
-	httpResponse, err := controller.Provider.Delete(in.GetVolumeId())
+	// a locked volume cannot be deleted, unless it was created to be unlocked on delete
+	volume, httpResponse, err := controller.Provider.Get(in.GetVolumeId())
+	switch {
+	case httpResponse != nil && httpResponse.StatusCode == http.StatusNotFound:
+		logger.Info("volume not found, already deleted")
+		return &csi.DeleteVolumeResponse{}, nil
+	case err != nil:
+		return nil, status.Errorf(codes.Unknown, "error getting volume to delete, %v", err)
+	case httpResponse != nil && httpResponse.StatusCode != http.StatusOK:
+		return nil, status.Errorf(codes.Unknown, "bad status from get volume, %s", httpResponse.Status)
+	}
+	if volume.Locked {
+		description, err := packet.ReadDescription(volume.Description)
+		if err != nil || !description.UnlockOnDelete {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is locked", in.VolumeId)
+		}
+		logger.Info("unlocking volume to delete it")
+		httpResponse, err := controller.Provider.Unlock(in.GetVolumeId())
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "error unlocking volume, %v", err)
+		}
+		if httpResponse.StatusCode != http.StatusOK {
+			return nil, status.Errorf(codes.Unknown, "bad status from unlock volume, %s", httpResponse.Status)
+		}
+	}
+
+	httpResponse, err = controller.Provider.Delete(in.GetVolumeId())
 	if err != nil {
 		if httpResponse.StatusCode == http.StatusUnprocessableEntity {
 			return nil, status.Errorf(codes.FailedPrecondition, "delete should retry, %v", err)
@@ -242,6 +280,9 @@ func (controller *PacketControllerServer) ControllerPublishVolume(ctx context.Co
 	if in.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "VolumeCapability unspecified for ControllerPublishVolume")
 	}
+	if err := checkVolumeCapability(in.VolumeCapability); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported VolumeCapability for ControllerPublishVolume, %v", err)
+	}
 	logger := log.WithFields(log.Fields{"volume_id": in.VolumeId})
 	logger.Info("ControllerPublishVolume called")
 
@@ -255,6 +296,9 @@ func (controller *PacketControllerServer) ControllerPublishVolume(ctx context.Co
 		return nil, returnError
 	}
 
+	// a volume with a multi-node access mode may be attached to any number of nodes, one attachment each
+	shared := isMultiNodeCapability(in.VolumeCapability)
+
 	// it is possible to try to attach, and it already is attached, but has not yet disconnected
 	// we are willing to retry up to AttachRetryMax times, with AttachRetryDelay between each
 	count := 0
@@ -262,19 +306,19 @@ func (controller *PacketControllerServer) ControllerPublishVolume(ctx context.Co
 	var attachment *packngo.VolumeAttachment
 forloop:
 	for {
-		attachment, httpResponse, err = controller.Provider.Attach(volumeID, nodeID)
+		attachment, httpResponse, err = controller.Provider.Attach(volumeID, nodeID, shared)
 		switch {
 		case err != nil && httpResponse != nil && httpResponse.StatusCode == http.StatusNotFound:
 			return nil, status.Errorf(codes.NotFound, "node or volume not found attempting to attach %s to %s", volumeID, nodeID)
 		case err != nil && packet.IsWrongDeviceAttachment(err):
 			if count > AttachMaxRetries {
-				return nil, err
+				return nil, status.Errorf(codes.FailedPrecondition, "volume %s is published to another node, %v", volumeID, err)
 			}
 			count++
 			time.Sleep(AttachRetryInterval * time.Second)
 			continue forloop
 		case err != nil && packet.IsTooManyDevicesAttached(err):
-			return nil, err
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is published to other nodes, %v", volumeID, err)
 		case err != nil:
 			return nil, status.Errorf(codes.Unknown, "error attempting to attach %s to %s, %v", volumeID, nodeID, err)
 		case httpResponse.StatusCode != http.StatusOK && httpResponse.StatusCode != http.StatusCreated:
@@ -323,15 +367,11 @@ func (controller *PacketControllerServer) ControllerUnpublishVolume(ctx context.
 		return nil, status.Errorf(codes.Unknown, "bad status from get volume %s, %s", volumeID, httpResponse.Status)
 	}
 
-	// get all of the attachments
-	attachments := volume.Attachments
-	if attachments == nil {
-		return nil, status.Errorf(codes.Unknown, "cannot detach unattached volume %s", volumeID)
-	}
 	// go through each attachment. If its deviceID matches our desired nodeID, or if nodeID was blank,
-	//   add to the detach list. Else skip
+	//   add to the detach list. Else skip; a volume with a multi-node access mode stays attached to the
+	//   other nodes
 	attachmentIDs := []string{}
-	for _, attachment := range attachments {
+	for _, attachment := range volume.Attachments {
 		switch {
 		case nodeID == "":
 			logger.Infof("empty nodeID; detaching from node %s", attachment.Device.ID)
@@ -344,9 +384,10 @@ func (controller *PacketControllerServer) ControllerUnpublishVolume(ctx context.
 		}
 	}
 
-	// if no valid attachments found, report an error
+	// if not attached to the node, there is nothing to do
 	if len(attachmentIDs) == 0 {
-		return nil, status.Errorf(codes.Unknown, "no attachment ID found for volume %s", volumeID)
+		logger.Info("volume not attached to node, already detached")
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
 	count := 0
@@ -419,15 +460,9 @@ func (controller *PacketControllerServer) ValidateVolumeCapabilities(ctx context
 		return nil, returnError
 	}
 
-	// supported capabilities all defined here instead
-	supported := map[csi.VolumeCapability_AccessMode_Mode]bool{
-		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:      true,
-		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: true,
-	}
 	for _, cap := range in.VolumeCapabilities {
-		mode := cap.AccessMode.Mode
-		if !supported[mode] {
-			return &csi.ValidateVolumeCapabilitiesResponse{}, nil
+		if err := checkVolumeCapability(cap); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
 		}
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
@@ -466,6 +501,11 @@ func (controller *PacketControllerServer) ListVolumes(ctx context.Context, in *c
 	}
 	entries := []*csi.ListVolumesResponse_Entry{}
 	for _, volume := range volumes {
+		// volumes of other clusters are not ours to list; anything without a description belongs to no cluster
+		description, _ := packet.ReadDescription(volume.Description)
+		if !description.InCluster(controller.ClusterID) {
+			continue
+		}
 		entry := &csi.ListVolumesResponse_Entry{
 			Volume: &csi.Volume{
 				CapacityBytes: int64(volume.Size * 1024 * 1024 * 1024),
@@ -505,6 +545,8 @@ func (controller *PacketControllerServer) ControllerGetCapabilities(ctx context.
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 	} {
 		caps = append(caps, rpcCapMapper(rpcCap))
 	}
@@ -531,8 +573,61 @@ func (controller *PacketControllerServer) ListSnapshots(context.Context, *csi.Li
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-// ControllerExpandVolume expand a volume
-func (controller *PacketControllerServer) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+// ControllerExpandVolume grow a volume within the limits of its plan; the nodes it is staged on then grow what
+// they have of it, see NodeExpandVolume. A volume is never shrunk.
+func (controller *PacketControllerServer) ControllerExpandVolume(ctx context.Context, in *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if controller == nil || controller.Provider == nil {
+		return nil, status.Error(codes.Internal, "controller not configured")
+	}
+	logger := log.WithFields(log.Fields{"volume_id": in.VolumeId})
+	logger.Info("ControllerExpandVolume called")
+
+	if in.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumeId unspecified for ControllerExpandVolume")
+	}
+	if in.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "CapacityRange unspecified for ControllerExpandVolume")
+	}
+
+	volume, httpResponse, err := controller.Provider.Get(in.VolumeId)
+	if err := processGetError(in.VolumeId, httpResponse, err); err != nil {
+		return nil, err
+	}
+	if volume.Plan == nil {
+		return nil, status.Errorf(codes.Internal, "volume %s has no plan", in.VolumeId)
+	}
+	plan, err := controller.getPlan(volume.Plan.ID)
+	if err != nil {
+		return nil, err
+	}
+	sizeRequestGiB := getSizeRequest(in.CapacityRange, plan)
+	if int64(sizeRequestGiB)*packet.Gibi < in.CapacityRange.GetRequiredBytes() {
+		return nil, status.Errorf(codes.OutOfRange, "plan %s allows at most %d GiB, requested %d bytes", plan.Slug, sizeRequestGiB, in.CapacityRange.GetRequiredBytes())
+	}
+
+	response := &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         int64(volume.Size) * packet.Gibi,
+		NodeExpansionRequired: true,
+	}
+	if sizeRequestGiB <= volume.Size {
+		logger.WithFields(log.Fields{"sizeGiB": volume.Size, "sizeRequestGiB": sizeRequestGiB}).Info("volume already is as big as requested")
+		return response, nil
+	}
+
+	logger.WithFields(log.Fields{"sizeGiB": volume.Size, "sizeRequestGiB": sizeRequestGiB}).Info("resizing volume")
+	_, httpResponse, err = controller.Provider.Update(volume.ID, &packngo.VolumeUpdateRequest{Size: &sizeRequestGiB})
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, "error resizing volume, %v", err)
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, status.Errorf(codes.Unknown, "bad status from update volume, %s", httpResponse.Status)
+	}
+	response.CapacityBytes = int64(sizeRequestGiB) * packet.Gibi
+	return response, nil
+}
+
+// ControllerGetVolume get the current state of a volume
+func (controller *PacketControllerServer) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
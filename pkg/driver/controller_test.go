@@ -13,16 +13,29 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/packethost/packngo"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	attachmentID     = "60bf5425-e59d-42c3-b9b9-ac0d8cfc86a2"
-	providerVolumeID = "9b03a6ea-42fb-40c7-abaa-247445b36890"
-	csiNodeIP        = "10.88.52.133"
-	csiNodeName      = "spcfoobar-worker-1"
-	nodeID           = "262c173c-c24d-4ad6-be1a-13fd9a523cfa"
+	attachmentID      = "60bf5425-e59d-42c3-b9b9-ac0d8cfc86a2"
+	providerVolumeID  = "9b03a6ea-42fb-40c7-abaa-247445b36890"
+	csiNodeIP         = "10.88.52.133"
+	csiNodeName       = "spcfoobar-worker-1"
+	nodeID            = "262c173c-c24d-4ad6-be1a-13fd9a523cfa"
+	standardPlanID    = "87728148-3155-4992-a730-8d1e6aca8a32"
+	performancePlanID = "d6570cfb-38fa-4467-92b3-e45d059bb249"
 )
 
+// storagePlans the plans as returned by the API, including non-storage ones that must be ignored
+func storagePlans() []packngo.Plan {
+	return []packngo.Plan{
+		{ID: "e69c0169-4726-46ea-98f1-939c9e8a3607", Slug: "t1.small.x86", Name: "t1.small.x86", Line: "baremetal"},
+		{ID: standardPlanID, Slug: "storage_1", Name: "Standard", Line: packet.StoragePlanLine},
+		{ID: performancePlanID, Slug: "storage_2", Name: "Performance", Line: packet.StoragePlanLine},
+	}
+}
+
 func TestCreateVolume(t *testing.T) {
 	csiVolumeName := "kubernetes-volume-request-0987654321"
 
@@ -42,6 +55,7 @@ func TestCreateVolume(t *testing.T) {
 		},
 		Rate: packngo.Rate{},
 	}
+	provider.EXPECT().ListPlans().Return(storagePlans(), &resp, nil)
 	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
 	provider.EXPECT().Create(gomock.Any()).Return(&volume, &resp, nil)
 
@@ -109,6 +123,7 @@ func runTestCreateVolume(t *testing.T, description string, volumeRequest csi.Cre
 		},
 		Rate: packngo.Rate{},
 	}
+	provider.EXPECT().ListPlans().Return(storagePlans(), &resp, nil)
 	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
 	// provider.EXPECT().Create(gomock.Any()).Return(&providerVolume, &resp, nil)
 	provider.EXPECT().
@@ -178,7 +193,7 @@ func TestCreateVolumes(t *testing.T) {
 				Description:  packet.NewVolumeDescription("pv-qT2QXcwbqPB3BAurt1ccs7g6SDVT0qLv").String(),
 				Locked:       false,
 				Size:         173,
-				PlanID:       packet.VolumePlanStandardID,
+				PlanID:       standardPlanID,
 			},
 			providerVolume: packngo.Volume{
 				Size:        173,
@@ -210,7 +225,7 @@ func TestCreateVolumes(t *testing.T) {
 				Description:  packet.NewVolumeDescription("pv-61C4yMq09WV1ZpNIOBKHRQDKoZzyK7ZF").String(),
 				Locked:       false,
 				Size:         packet.MaxVolumeSizeGi,
-				PlanID:       packet.VolumePlanStandardID,
+				PlanID:       standardPlanID,
 			},
 			providerVolume: packngo.Volume{
 				Size:        packet.DefaultVolumeSizeGi,
@@ -242,7 +257,7 @@ func TestCreateVolumes(t *testing.T) {
 				Description:  packet.NewVolumeDescription("pv-61C4yMq09WV1ZpNIOBKHRQDKoZzyK7ZF").String(),
 				Locked:       false,
 				Size:         packet.MinVolumeSizeGi,
-				PlanID:       packet.VolumePlanStandardID,
+				PlanID:       standardPlanID,
 			},
 			providerVolume: packngo.Volume{
 				Size:        packet.DefaultVolumeSizeGi,
@@ -271,7 +286,7 @@ func TestCreateVolumes(t *testing.T) {
 				Description:  packet.NewVolumeDescription("pv-61C4yMq09WV1ZpNIOBKHRQDKoZzyK7ZF").String(),
 				Locked:       false,
 				Size:         packet.DefaultVolumeSizeGi,
-				PlanID:       packet.VolumePlanPerformanceID,
+				PlanID:       performancePlanID,
 			},
 			providerVolume: packngo.Volume{
 				Size:        packet.DefaultVolumeSizeGi,
@@ -300,7 +315,7 @@ func TestCreateVolumes(t *testing.T) {
 				Description:  packet.NewVolumeDescription("pv-succeedin5").String(),
 				Locked:       false,
 				Size:         packet.DefaultVolumeSizeGi,
-				PlanID:       packet.VolumePlanPerformanceID,
+				PlanID:       performancePlanID,
 			},
 			providerVolume: packngo.Volume{
 				Size:        packet.DefaultVolumeSizeGi,
@@ -329,7 +344,7 @@ func TestCreateVolumes(t *testing.T) {
 				Description:  packet.NewVolumeDescription("pv-failfail123").String(),
 				Locked:       false,
 				Size:         packet.DefaultVolumeSizeGi,
-				PlanID:       packet.VolumePlanPerformanceID,
+				PlanID:       performancePlanID,
 			},
 			providerVolume: packngo.Volume{
 				Size:        packet.DefaultVolumeSizeGi,
@@ -340,6 +355,62 @@ func TestCreateVolumes(t *testing.T) {
 			success:        false,
 			delayToSuccess: 1000,
 		},
+		VolumeTestCase{
+			description: "plan requested by slug",
+			volumeRequest: csi.CreateVolumeRequest{
+				Name:       "pv-byslug",
+				Parameters: map[string]string{"plan": "storage_2"},
+				VolumeCapabilities: []*csi.VolumeCapability{
+					&csi.VolumeCapability{
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+			},
+			providerRequest: packngo.VolumeCreateRequest{
+				BillingCycle: packet.BillingHourly,
+				Description:  packet.NewVolumeDescription("pv-byslug").String(),
+				Size:         packet.DefaultVolumeSizeGi,
+				PlanID:       performancePlanID,
+			},
+			providerVolume: packngo.Volume{
+				Size:        packet.DefaultVolumeSizeGi,
+				ID:          "5b0b2b8c-8ba4-4dbb-b0b8-2a3e7c6f3f11",
+				Description: packet.NewVolumeDescription("pv-byslug").String(),
+				State:       "active",
+			},
+			success:        true,
+			delayToSuccess: 0,
+		},
+		VolumeTestCase{
+			description: "plan requested by ID",
+			volumeRequest: csi.CreateVolumeRequest{
+				Name:       "pv-byid",
+				Parameters: map[string]string{"plan": standardPlanID},
+				VolumeCapabilities: []*csi.VolumeCapability{
+					&csi.VolumeCapability{
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+						},
+					},
+				},
+			},
+			providerRequest: packngo.VolumeCreateRequest{
+				BillingCycle: packet.BillingHourly,
+				Description:  packet.NewVolumeDescription("pv-byid").String(),
+				Size:         packet.DefaultVolumeSizeGi,
+				PlanID:       standardPlanID,
+			},
+			providerVolume: packngo.Volume{
+				Size:        packet.DefaultVolumeSizeGi,
+				ID:          "0c7e6bd4-0c55-4b55-a1f4-3a8c4c0d2e7a",
+				Description: packet.NewVolumeDescription("pv-byid").String(),
+				State:       "active",
+			},
+			success:        true,
+			delayToSuccess: 0,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -347,6 +418,91 @@ func TestCreateVolumes(t *testing.T) {
 	}
 }
 
+func TestCreateVolumeUnknownPlan(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	provider.EXPECT().ListPlans().Return(storagePlans(), &resp, nil)
+
+	controller := NewPacketControllerServer(provider)
+	volumeRequest := csi.CreateVolumeRequest{
+		Name:       "pv-typo",
+		Parameters: map[string]string{"plan": "performnce"},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	csiResp, err := controller.CreateVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, csiResp)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestCreateVolumeParameters(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	volume := packngo.Volume{
+		Size:        packet.DefaultVolumeSizeGi,
+		ID:          providerVolumeID,
+		Description: packet.NewVolumeDescription("pv-params").String(),
+		State:       "active",
+	}
+	var createRequest *packngo.VolumeCreateRequest
+	provider.EXPECT().ListPlans().Return(storagePlans(), &resp, nil)
+	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
+	provider.EXPECT().Create(gomock.Any()).Do(func(request *packngo.VolumeCreateRequest) {
+		createRequest = request
+	}).Return(&volume, &resp, nil)
+
+	controller := NewPacketControllerServer(provider)
+	volumeRequest := csi.CreateVolumeRequest{
+		Name: "pv-params",
+		Parameters: map[string]string{
+			"billingCycle":      "monthly",
+			"snapshotFrequency": "1day",
+			"snapshotCount":     "7",
+			"locked":            "true",
+			"unlockOnDelete":    "true",
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	_, err := controller.CreateVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, packet.BillingMonthly, createRequest.BillingCycle)
+	assert.Equal(t, standardPlanID, createRequest.PlanID)
+	assert.True(t, createRequest.Locked)
+	assert.Equal(t, []*packngo.SnapshotPolicy{{SnapshotFrequency: "1day", SnapshotCount: 7}}, createRequest.SnapshotPolicies)
+	description, err := packet.ReadDescription(createRequest.Description)
+	assert.Nil(t, err)
+	assert.True(t, description.UnlockOnDelete)
+}
+
 func TestIdempotentCreateVolume(t *testing.T) {
 
 	csiVolumeName := "kubernetes-volume-request-0987654321"
@@ -361,7 +517,7 @@ func TestIdempotentCreateVolume(t *testing.T) {
 		Description: packet.NewVolumeDescription(csiVolumeName).String(),
 		Plan: &packngo.Plan{
 			Name: packet.VolumePlanStandard,
-			ID:   packet.VolumePlanStandardID,
+			ID:   standardPlanID,
 		},
 	}
 	resp := packngo.Response{
@@ -370,6 +526,7 @@ func TestIdempotentCreateVolume(t *testing.T) {
 		},
 		Rate: packngo.Rate{},
 	}
+	provider.EXPECT().ListPlans().Return(storagePlans(), &resp, nil)
 	provider.EXPECT().ListVolumes().Return([]packngo.Volume{volumeAlreadyExisting}, &resp, nil)
 
 	controller := NewPacketControllerServer(provider)
@@ -396,6 +553,164 @@ func TestIdempotentCreateVolume(t *testing.T) {
 	assert.Equal(t, volumeAlreadyExisting.ID, csiResp.GetVolume().VolumeId)
 }
 
+func TestCreateVolumeKubernetesMetadata(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	var createRequest *packngo.VolumeCreateRequest
+	provider.EXPECT().ListPlans().Return(storagePlans(), &resp, nil)
+	provider.EXPECT().ListVolumes().Return([]packngo.Volume{}, &resp, nil)
+	provider.EXPECT().Create(gomock.Any()).DoAndReturn(func(request *packngo.VolumeCreateRequest) (*packngo.Volume, *packngo.Response, error) {
+		createRequest = request
+		return &packngo.Volume{
+			Size:        request.Size,
+			ID:          providerVolumeID,
+			Description: request.Description,
+			State:       "active",
+		}, &resp, nil
+	})
+
+	controller := NewPacketControllerServer(provider)
+	volumeRequest := csi.CreateVolumeRequest{
+		Name: "pvc-7b0c3a2e-5f5e-4c4b-9d0e-1d2c3b4a5f6e",
+		Parameters: map[string]string{
+			"csi.storage.k8s.io/pvc/name":      "data-postgres-0",
+			"csi.storage.k8s.io/pvc/namespace": "billing",
+			"csi.storage.k8s.io/pv/name":       "pvc-7b0c3a2e-5f5e-4c4b-9d0e-1d2c3b4a5f6e",
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	csiResp, err := controller.CreateVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	description, err := packet.ReadDescription(createRequest.Description)
+	assert.Nil(t, err)
+	assert.Equal(t, packet.VolumeDescriptionVersion, description.Version)
+	assert.Equal(t, &packet.KubernetesMetadata{
+		PVCName:      "data-postgres-0",
+		PVCNamespace: "billing",
+		PVName:       "pvc-7b0c3a2e-5f5e-4c4b-9d0e-1d2c3b4a5f6e",
+	}, description.Kubernetes)
+	assert.Equal(t, map[string]string{
+		"csi.packet.net/pvc-name":      "data-postgres-0",
+		"csi.packet.net/pvc-namespace": "billing",
+		"csi.packet.net/pv-name":       "pvc-7b0c3a2e-5f5e-4c4b-9d0e-1d2c3b4a5f6e",
+	}, csiResp.GetVolume().GetVolumeContext())
+}
+
+func TestCreateVolumeOtherCluster(t *testing.T) {
+
+	csiVolumeName := "kubernetes-volume-request-0987654321"
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	otherDescription := packet.NewVolumeDescription(csiVolumeName)
+	otherDescription.Cluster = "other-cluster"
+	otherClusterVolume := packngo.Volume{
+		Size:        packet.DefaultVolumeSizeGi,
+		ID:          "2d0c0c8b-52a1-4c53-8b51-7b8e5d6a4a58",
+		Description: otherDescription.String(),
+		Plan: &packngo.Plan{
+			ID: standardPlanID,
+		},
+	}
+	volume := packngo.Volume{
+		Size:        packet.DefaultVolumeSizeGi,
+		ID:          providerVolumeID,
+		Description: packet.NewVolumeDescription(csiVolumeName).String(),
+		State:       "active",
+	}
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	var createRequest *packngo.VolumeCreateRequest
+	provider.EXPECT().ListPlans().Return(storagePlans(), &resp, nil)
+	provider.EXPECT().ListVolumes().Return([]packngo.Volume{otherClusterVolume}, &resp, nil)
+	provider.EXPECT().Create(gomock.Any()).Do(func(request *packngo.VolumeCreateRequest) {
+		createRequest = request
+	}).Return(&volume, &resp, nil)
+
+	controller := NewPacketControllerServer(provider)
+	controller.ClusterID = "this-cluster"
+	volumeRequest := csi.CreateVolumeRequest{
+		Name: csiVolumeName,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}
+
+	csiResp, err := controller.CreateVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, providerVolumeID, csiResp.GetVolume().VolumeId)
+	description, err := packet.ReadDescription(createRequest.Description)
+	assert.Nil(t, err)
+	assert.Equal(t, "this-cluster", description.Cluster)
+}
+
+func TestListVolumesInCluster(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	ours := packet.NewVolumeDescription("pv-ours")
+	ours.Cluster = "this-cluster"
+	theirs := packet.NewVolumeDescription("pv-theirs")
+	theirs.Cluster = "other-cluster"
+	volumes := []packngo.Volume{
+		{ID: "2b7f8f3e-0a5a-4a49-9d0f-4f3b4c9a8a01", Size: 10, Description: ours.String()},
+		{ID: "e1c9a6a4-8e0e-4d89-b0a9-7b1e9a5f2c02", Size: 10, Description: theirs.String()},
+		{ID: "6f0a3a8e-1b55-4c2c-9f4e-2a0b8c7d6e03", Size: 10, Description: packet.NewVolumeDescription("pv-unclustered").String()},
+		{ID: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c04", Size: 10, Description: "created by hand"},
+	}
+	provider.EXPECT().ListVolumes().Return(volumes, &resp, nil).Times(2)
+
+	controller := NewPacketControllerServer(provider)
+
+	// without a cluster ID, only volumes that belong to no cluster
+	csiResp, err := controller.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(csiResp.Entries))
+	assert.Equal(t, volumes[2].ID, csiResp.Entries[0].Volume.VolumeId)
+	assert.Equal(t, volumes[3].ID, csiResp.Entries[1].Volume.VolumeId)
+
+	// with a cluster ID, only volumes of that cluster
+	controller.ClusterID = "this-cluster"
+	csiResp, err = controller.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(csiResp.Entries))
+	assert.Equal(t, volumes[0].ID, csiResp.Entries[0].Volume.VolumeId)
+}
+
 func TestListVolumes(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
@@ -434,6 +749,7 @@ func TestDeleteVolume(t *testing.T) {
 		},
 		Rate: packngo.Rate{},
 	}
+	provider.EXPECT().Get(providerVolumeID).Return(&packngo.Volume{ID: providerVolumeID}, &resp, nil)
 	provider.EXPECT().Delete(providerVolumeID).Return(&resp, nil)
 
 	controller := NewPacketControllerServer(provider)
@@ -447,6 +763,112 @@ func TestDeleteVolume(t *testing.T) {
 
 }
 
+func TestDeleteLockedVolume(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	lockedVolume := packngo.Volume{
+		ID:          providerVolumeID,
+		Locked:      true,
+		Description: packet.NewVolumeDescription("pv-locked").String(),
+	}
+	provider.EXPECT().Get(providerVolumeID).Return(&lockedVolume, &resp, nil)
+
+	controller := NewPacketControllerServer(provider)
+	volumeRequest := csi.DeleteVolumeRequest{
+		VolumeId: providerVolumeID,
+	}
+
+	csiResp, err := controller.DeleteVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, csiResp)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestDeleteLockedVolumeUnlockOnDelete(t *testing.T) {
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	description := packet.NewVolumeDescription("pv-unlock")
+	description.UnlockOnDelete = true
+	lockedVolume := packngo.Volume{
+		ID:          providerVolumeID,
+		Locked:      true,
+		Description: description.String(),
+	}
+	gomock.InOrder(
+		provider.EXPECT().Get(providerVolumeID).Return(&lockedVolume, &resp, nil),
+		provider.EXPECT().Unlock(providerVolumeID).Return(&resp, nil),
+		provider.EXPECT().Delete(providerVolumeID).Return(&resp, nil),
+	)
+
+	controller := NewPacketControllerServer(provider)
+	volumeRequest := csi.DeleteVolumeRequest{
+		VolumeId: providerVolumeID,
+	}
+
+	csiResp, err := controller.DeleteVolume(context.TODO(), &volumeRequest)
+	assert.Nil(t, err)
+	assert.NotNil(t, csiResp)
+}
+
+func TestExpandVolume(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{Response: &http.Response{StatusCode: http.StatusOK}}
+	volume := packngo.Volume{ID: providerVolumeID, Size: 10, Plan: &packngo.Plan{ID: standardPlanID}}
+	provider.EXPECT().ListPlans().Return(storagePlans(), &resp, nil)
+	provider.EXPECT().Get(providerVolumeID).Return(&volume, &resp, nil).Times(3)
+	var resized *int
+	provider.EXPECT().Update(providerVolumeID, gomock.Any()).Do(func(volumeID string, request *packngo.VolumeUpdateRequest) {
+		resized = request.Size
+	}).Return(&volume, &resp, nil)
+
+	controller := NewPacketControllerServer(provider)
+	csiResp, err := controller.ControllerExpandVolume(context.TODO(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      providerVolumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * packet.Gibi},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 20, *resized)
+	assert.Equal(t, int64(20*packet.Gibi), csiResp.CapacityBytes)
+	assert.True(t, csiResp.NodeExpansionRequired)
+
+	// a volume that is as big already is not shrunk
+	csiResp, err = controller.ControllerExpandVolume(context.TODO(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      providerVolumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 * packet.Gibi},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10*packet.Gibi), csiResp.CapacityBytes)
+
+	// nor grown past the maximum of its plan
+	_, err = controller.ControllerExpandVolume(context.TODO(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      providerVolumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: (packet.MaxVolumeSizeGi + 1) * packet.Gibi},
+	})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
 func TestPublishVolume(t *testing.T) {
 
 	providerVolumeName := "name-assigned-by-provider"
@@ -485,13 +907,15 @@ func TestPublishVolume(t *testing.T) {
 
 	provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil)
 
-	provider.EXPECT().Attach(providerVolumeID, nodeID).Return(&attachResp, &resp, nil)
+	provider.EXPECT().Attach(providerVolumeID, nodeID, false).Return(&attachResp, &resp, nil)
 
 	controller := NewPacketControllerServer(provider)
 	volumeRequest := csi.ControllerPublishVolumeRequest{
-		VolumeId:         providerVolumeID,
-		NodeId:           nodeID,
-		VolumeCapability: &csi.VolumeCapability{},
+		VolumeId: providerVolumeID,
+		NodeId:   nodeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
 	}
 
 	csiResp, err := controller.ControllerPublishVolume(context.TODO(), &volumeRequest)
@@ -504,6 +928,72 @@ func TestPublishVolume(t *testing.T) {
 
 }
 
+func TestPublishVolumeMultiNode(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	// already attached to another node, which is fine when it may be shared
+	volumeResp := packngo.Volume{
+		ID:   providerVolumeID,
+		Name: "name-assigned-by-provider",
+		Attachments: []*packngo.VolumeAttachment{
+			{
+				ID:     "other-attachment",
+				Volume: packngo.Volume{ID: providerVolumeID},
+				Device: packngo.Device{DeviceRaw: packngo.DeviceRaw{ID: "other-node"}},
+			},
+		},
+	}
+	attachResp := packngo.VolumeAttachment{
+		ID:     attachmentID,
+		Volume: volumeResp,
+		Device: packngo.Device{DeviceRaw: packngo.DeviceRaw{ID: nodeID}},
+	}
+
+	readOnlyMount := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+	multiWriterBlock := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+	}
+	multiWriterMount := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+
+	provider.EXPECT().Get(providerVolumeID).Return(&volumeResp, &resp, nil).Times(2)
+	provider.EXPECT().Attach(providerVolumeID, nodeID, true).Return(&attachResp, &resp, nil).Times(2)
+
+	controller := NewPacketControllerServer(provider)
+	for _, capability := range []*csi.VolumeCapability{readOnlyMount, multiWriterBlock} {
+		csiResp, err := controller.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         providerVolumeID,
+			NodeId:           nodeID,
+			VolumeCapability: capability,
+		})
+		assert.Nil(t, err, capability.String())
+		assert.Equal(t, attachmentID, csiResp.PublishContext["AttachmentId"], capability.String())
+	}
+
+	// a filesystem cannot be written from several nodes
+	_, err := controller.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         providerVolumeID,
+		NodeId:           nodeID,
+		VolumeCapability: multiWriterMount,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
 func TestUnpublishVolume(t *testing.T) {
 
 	mockCtrl := gomock.NewController(t)
@@ -545,6 +1035,41 @@ func TestUnpublishVolume(t *testing.T) {
 
 }
 
+func TestUnpublishVolumeOtherNode(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+
+	resp := packngo.Response{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+		},
+		Rate: packngo.Rate{},
+	}
+	// attached only to another node, which keeps its attachment
+	attachedVolume := packngo.Volume{
+		ID: providerVolumeID,
+		Attachments: []*packngo.VolumeAttachment{
+			{
+				ID:     "other-attachment",
+				Volume: packngo.Volume{ID: providerVolumeID},
+				Device: packngo.Device{DeviceRaw: packngo.DeviceRaw{ID: "other-node"}},
+			},
+		},
+	}
+
+	provider.EXPECT().Get(providerVolumeID).Return(&attachedVolume, &resp, nil)
+
+	controller := NewPacketControllerServer(provider)
+	csiResp, err := controller.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: providerVolumeID,
+		NodeId:   nodeID,
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, csiResp)
+}
+
 func TestGetCapacity(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -580,6 +1105,10 @@ func getVolumeCapabilityTestCases() []volumeCapabilityTestCase {
 	mnswCap := csi.VolumeCapability{
 		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER},
 	}
+	mnmwBlockCap := csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+	}
 
 	return []volumeCapabilityTestCase{
 
@@ -603,7 +1132,12 @@ func getVolumeCapabilityTestCases() []volumeCapabilityTestCase {
 		},
 		{
 			capabilitySet: []*csi.VolumeCapability{&mnroCap},
-			description:   "multi node read only",
+			packetSupported: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+				VolumeCapabilities: []*csi.VolumeCapability{
+					&mnroCap,
+				},
+			},
+			description: "multi node read only",
 		},
 		{
 			capabilitySet: []*csi.VolumeCapability{&mnswCap},
@@ -613,6 +1147,15 @@ func getVolumeCapabilityTestCases() []volumeCapabilityTestCase {
 			capabilitySet: []*csi.VolumeCapability{&mnmwCap},
 			description:   "multi node multi writer",
 		},
+		{
+			capabilitySet: []*csi.VolumeCapability{&mnmwBlockCap},
+			packetSupported: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+				VolumeCapabilities: []*csi.VolumeCapability{
+					&mnmwBlockCap,
+				},
+			},
+			description: "multi node multi writer block",
+		},
 		{
 			capabilitySet: []*csi.VolumeCapability{&mnmwCap, &mnroCap, &mnswCap, &snroCap, &snwCap},
 			description:   "all capabilities",
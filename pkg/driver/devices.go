@@ -0,0 +1,207 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/iscsi"
+	"github.com/packethost/csi-packet/pkg/scsi"
+)
+
+const (
+	// sysIscsiSession where the kernel lists the iSCSI sessions, each with the SCSI target and disks it attaches
+	sysIscsiSession = "/sys/class/iscsi_session"
+	// sysBlock where the kernel lists the disks, with the attributes of their SCSI devices
+	sysBlock = "/sys/block"
+	// deviceWaitTimeout how long staging a volume waits for the disk of each of its sessions to appear
+	deviceWaitTimeout = 30 * time.Second
+	// deviceWaitInterval and deviceWaitMaxInterval the backoff between checks for a disk that has not appeared yet
+	deviceWaitInterval    = 100 * time.Millisecond
+	deviceWaitMaxInterval = 2 * time.Second
+)
+
+// NoSessionError a portal that has no session with a target, so there is no disk to wait for
+type NoSessionError struct {
+	Portal string
+	Target string
+}
+
+// Error return the error string
+func (e *NoSessionError) Error() string {
+	return fmt.Sprintf("no session with %s at %s", e.Target, e.Portal)
+}
+
+// DeviceNotFoundError the disk of a session that did not appear in time
+type DeviceNotFoundError struct {
+	Portal string
+	Target string
+	SID    int
+	// Err why the wait ended
+	Err error
+}
+
+// Error return the error string
+func (e *DeviceNotFoundError) Error() string {
+	return fmt.Sprintf("no disk of session %d with %s at %s: %v", e.SID, e.Target, e.Portal, e.Err)
+}
+
+// IsNoSession check if an error is of a portal without a session
+func IsNoSession(err error) bool {
+	switch err.(type) {
+	case *NoSessionError:
+		return true
+	}
+	return false
+}
+
+// IsDeviceNotFound check if an error is of a disk that did not appear in time
+func IsDeviceNotFound(err error) bool {
+	switch err.(type) {
+	case *DeviceNotFoundError:
+		return true
+	}
+	return false
+}
+
+// GetDevice wait for the disk that the session with the target at a portal attaches, polling sysfs with a
+// growing interval until the kernel lists it and its device node exists, or the context is done
+func (i *AttacherImpl) GetDevice(ctx context.Context, portal, target string) (string, error) {
+	session, err := i.session(ctx, portal, target)
+	if err != nil {
+		return "", err
+	}
+	fs := orOS(i.FS)
+	pattern := sessionDisks(session.SID)
+	interval := deviceWaitInterval
+	for {
+		disks, err := fs.Glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		// a volume is a single disk, its LUN 0, which sorts first
+		if len(disks) > 0 {
+			device := filepath.Join("/dev", filepath.Base(disks[0]))
+			if _, err := fs.Lstat(device); err == nil {
+				return device, nil
+			} else if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", &DeviceNotFoundError{Portal: portal, Target: target, SID: session.SID, Err: ctx.Err()}
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > deviceWaitMaxInterval {
+			interval = deviceWaitMaxInterval
+		}
+	}
+}
+
+// sessionDisks the pattern of the disks of a session in sysfs, e.g. session1/device/target2:0:0/2:0:0:0/block/sdb
+func sessionDisks(sid int) string {
+	return filepath.Join(sysIscsiSession, fmt.Sprintf("session%d", sid), "device", "target*", "*:*:*:*", "block", "*")
+}
+
+// Devices the disks that the session with the target at a portal attaches, as sysfs lists them now
+func (i *AttacherImpl) Devices(ctx context.Context, portal, target string) ([]string, error) {
+	session, err := i.session(ctx, portal, target)
+	if IsNoSession(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	disks, err := orOS(i.FS).Glob(sessionDisks(session.SID))
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]string, 0, len(disks))
+	for _, disk := range disks {
+		devices = append(devices, filepath.Join("/dev", filepath.Base(disk)))
+	}
+	return devices, nil
+}
+
+// FindSessions the target and the portals of the sessions whose disks have a WWID, by which the sessions of a volume
+// are found once the metadata does not list it any more; sessions without disks are not found
+func (i *AttacherImpl) FindSessions(ctx context.Context, wwid string) (string, []string, error) {
+	sessions, err := i.iscsi().Sessions(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	var target string
+	portals := []string{}
+	for _, session := range sessions {
+		disks, err := orOS(i.FS).Glob(sessionDisks(session.SID))
+		if err != nil {
+			return "", nil, err
+		}
+		for _, disk := range disks {
+			id, err := i.GetWWID(disk)
+			if err != nil {
+				return "", nil, err
+			}
+			if id == wwid {
+				target = session.Target
+				portals = append(portals, session.Portal.IP)
+				break
+			}
+		}
+	}
+	return target, portals, nil
+}
+
+// DeleteDevice have the kernel remove a disk, through its delete attribute in sysfs, so that it is not left behind
+// once its session is logged out of; a disk that is gone already is fine
+func (i *AttacherImpl) DeleteDevice(device string) error {
+	err := orOS(i.FS).WriteFile(filepath.Join(sysBlock, filepath.Base(device), "device", "delete"), []byte("1"), 0200)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to delete %s: %v", device, err)
+	}
+	return nil
+}
+
+// RescanDevice have the kernel read the capacity of a disk again, through its rescan attribute in sysfs
+func (i *AttacherImpl) RescanDevice(device string) error {
+	if err := orOS(i.FS).WriteFile(filepath.Join(sysBlock, filepath.Base(device), "device", "rescan"), []byte("1"), 0200); err != nil {
+		return fmt.Errorf("unable to rescan %s: %v", device, err)
+	}
+	return nil
+}
+
+// session the session with the target at a portal
+func (i *AttacherImpl) session(ctx context.Context, portal, target string) (*iscsi.Session, error) {
+	sessions, err := i.iscsi().Sessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if session.Target == target && session.Portal.IP == portal {
+			return &session, nil
+		}
+	}
+	return nil, &NoSessionError{Portal: portal, Target: target}
+}
+
+// GetWWID the WWID of a disk, as multipath identifies it, from its device identification VPD page in sysfs, or
+// from its wwid attribute if the kernel does not expose the page
+func (i *AttacherImpl) GetWWID(device string) (string, error) {
+	fs := orOS(i.FS)
+	attrs := filepath.Join(sysBlock, filepath.Base(device), "device")
+	vpd, err := fs.ReadFile(filepath.Join(attrs, "vpd_pg83"))
+	switch {
+	case err == nil:
+		return scsi.WWID(vpd)
+	case !os.IsNotExist(err):
+		return "", err
+	}
+	attr, err := fs.ReadFile(filepath.Join(attrs, "wwid"))
+	if err != nil {
+		return "", fmt.Errorf("no WWID of %s: %v", device, err)
+	}
+	return scsi.ParseWWID(string(attr))
+}
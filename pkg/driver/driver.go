@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/packethost/csi-packet/pkg/packet"
@@ -25,10 +26,15 @@ type PacketDriver struct {
 	Attacher    Attacher
 	Mounter     Mounter
 	Initializer Initializer
+	Encryptor   Encryptor
+	Multipath   Multipath
+	Bindings    Bindings
+	// RequireFormatOptIn format a blank volume only if its StorageClass allows it
+	RequireFormatOptIn bool
 }
 
-// NewPacketDriver create a new PacketDriver
-func NewPacketDriver(endpoint, nodeID string, config packet.Config) (*PacketDriver, error) {
+// NewPacketDriver create a new PacketDriver, which runs the tools and uses the files of the host as given
+func NewPacketDriver(endpoint, nodeID string, config packet.Config, host Host) (*PacketDriver, error) {
 	// if the nodeID was not specified, we retrieve it from metadata
 	var err error
 	nid := nodeID
@@ -39,6 +45,9 @@ func NewPacketDriver(endpoint, nodeID string, config packet.Config) (*PacketDriv
 			return nil, fmt.Errorf("unable to get node ID from metadata: %v", err)
 		}
 	}
+	// everything runs commands on, and reads and writes the files of, the host the same way
+	exec := orLocal(host.Exec)
+	fs := orOS(host.FS)
 	return &PacketDriver{
 		// name https://github.com/container-storage-interface/spec/blob/master/spec.md#getplugininfo
 		name:     DriverName, // this could be configurable, but must match a plugin directory name for kubelet to use
@@ -47,9 +56,13 @@ func NewPacketDriver(endpoint, nodeID string, config packet.Config) (*PacketDriv
 		config:   config,
 		Logger:   log.WithFields(log.Fields{"node": nid, "endpoint": endpoint}),
 		// default attacher and mounter
-		Attacher:    &AttacherImpl{},
-		Mounter:     &MounterImpl{},
-		Initializer: &InitializerImpl{},
+		Attacher:    &AttacherImpl{Exec: exec, FS: fs},
+		Mounter:     &MounterImpl{Exec: exec, FS: fs},
+		Initializer: &InitializerImpl{FS: fs, Services: host.Services, Multipath: host.Multipath},
+		Encryptor:   &EncryptorImpl{Exec: exec},
+		// multipathd is reached over its socket, in the network namespace that the driver shares with the host
+		Multipath: &MultipathImpl{},
+		Bindings:  &BindingsImpl{FS: fs},
 	}, nil
 }
 
@@ -65,12 +78,24 @@ func (d *PacketDriver) Run() {
 			d.Logger.Fatalf("Unable to create controller %+v", err)
 		}
 		controller = NewPacketControllerServer(p)
+		controller.Plans.Limits = d.config.StoragePlanLimits
+		controller.ClusterID = d.config.ClusterID
 	}
 	node, err := NewPacketNodeServer(d, &metadataDriver)
 	if err != nil {
 		d.Logger.Fatalf("Unable to create node server %+v", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if controller == nil {
+		// without credentials the driver runs as a node, which is ready only once it is initialized
+		identity.Node = node
+		go node.Initialize(ctx)
+		// volumes that were staged with some of their paths down get the others once they are back
+		go node.RepairPaths(ctx, pathRepairInterval)
+	}
+
 	d.Logger.Info("Starting server")
 	server.Start(d.endpoint,
 		identity,
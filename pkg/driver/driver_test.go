@@ -1,15 +1,28 @@
 package driver
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"github.com/kubernetes-csi/csi-test/v4/pkg/sanity"
+	"github.com/packethost/csi-packet/pkg/blkid"
+	"github.com/packethost/csi-packet/pkg/fsck"
+	"github.com/packethost/csi-packet/pkg/mount"
+	"github.com/packethost/csi-packet/pkg/multipath"
 	"github.com/packethost/csi-packet/pkg/packet"
 	packetServer "github.com/packethost/packet-api-server/pkg/server"
 	"github.com/packethost/packet-api-server/pkg/store"
@@ -56,7 +69,46 @@ func TestPacketDriver(t *testing.T) {
 		},
 		MetadataDevice: dev.ID,
 	}
-	ts := httptest.NewServer(fake.CreateHandler())
+	// the api server does not know about plans, so we serve the storage plans ourselves
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plans", func(w http.ResponseWriter, r *http.Request) {
+		var resp = struct {
+			Plans []packngo.Plan `json:"plans"`
+		}{
+			Plans: storagePlans(),
+		}
+		if err := json.NewEncoder(w).Encode(&resp); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// nor about resizing volumes
+	api := fake.CreateHandler()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || !strings.HasPrefix(r.URL.Path, "/storage/") {
+			api.ServeHTTP(w, r)
+			return
+		}
+		volume, err := backend.GetVolume(strings.TrimPrefix(r.URL.Path, "/storage/"))
+		if err != nil || volume == nil {
+			http.NotFound(w, r)
+			return
+		}
+		var update packngo.VolumeUpdateRequest
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if update.Size != nil {
+			volume.Size = *update.Size
+		}
+		if update.Description != nil {
+			volume.Description = *update.Description
+		}
+		if err := json.NewEncoder(w).Encode(volume); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ts := httptest.NewServer(mux)
 	defer ts.Close()
 
 	url, _ := url.Parse(ts.URL)
@@ -79,7 +131,6 @@ func TestPacketDriver(t *testing.T) {
 		Logger:   log.WithFields(log.Fields{"node": nodeName, "endpoint": endpoint}),
 		Attacher: &AttacherMock{
 			sessions:  map[string]iscsiSession{},
-			bindings:  map[string]string{},
 			maxDevice: 0,
 		},
 		Mounter: &MounterMock{
@@ -87,6 +138,9 @@ func TestPacketDriver(t *testing.T) {
 			blockmounts: map[string]string{},
 		},
 		Initializer: &InitializerMock{},
+		Encryptor:   &EncryptorMock{mappings: map[string]string{}},
+		Multipath:   &MultipathMock{maps: map[string]string{}},
+		Bindings:    &BindingsImpl{FS: newMemFS()},
 	}
 	defer driver.Stop()
 
@@ -109,11 +163,10 @@ func TestPacketDriver(t *testing.T) {
 	os.RemoveAll(mntStageDir)
 	defer os.RemoveAll(mntStageDir)
 
-	sanityConfig := &sanity.Config{
-		TargetPath:  mntDir,
-		StagingPath: mntStageDir,
-		Address:     endpoint,
-	}
+	sanityConfig := sanity.NewTestConfig()
+	sanityConfig.TargetPath = mntDir
+	sanityConfig.StagingPath = mntStageDir
+	sanityConfig.Address = endpoint
 
 	// call the test suite
 	sanity.Test(t, sanityConfig)
@@ -129,15 +182,20 @@ type iscsiSession struct {
 	id  string
 }
 type AttacherMock struct {
+	// lock the portals of a volume are attached concurrently
+	lock      sync.Mutex
 	sessions  map[string]iscsiSession
 	maxDevice int
-	bindings  map[string]string
+	// nodes the node records, by session name, which logging in creates
+	nodes map[string]bool
 }
 
 func (a *AttacherMock) sessionName(ip, iqn string) string {
 	return fmt.Sprintf("%s %s", ip, iqn)
 }
-func (a *AttacherMock) GetScsiID(devicePath string) (string, error) {
+func (a *AttacherMock) GetWWID(devicePath string) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 	for _, v := range a.sessions {
 		if v.dev == devicePath {
 			return v.id, nil
@@ -145,78 +203,374 @@ func (a *AttacherMock) GetScsiID(devicePath string) (string, error) {
 	}
 	return "", fmt.Errorf("device %s not found", devicePath)
 }
-func (a *AttacherMock) GetDevice(portal, iqn string) (string, error) {
+func (a *AttacherMock) GetDevice(ctx context.Context, portal, iqn string) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 	if v, ok := a.sessions[a.sessionName(portal, iqn)]; ok {
 		return v.dev, nil
 	}
 	return "", fmt.Errorf("device %s %s not found", portal, iqn)
 }
-func (a *AttacherMock) Discover(ip, initiator string) error {
+func (a *AttacherMock) Devices(ctx context.Context, portal, iqn string) ([]string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if v, ok := a.sessions[a.sessionName(portal, iqn)]; ok && v.dev != "" {
+		return []string{v.dev}, nil
+	}
+	return nil, nil
+}
+func (a *AttacherMock) DeleteDevice(device string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for name, v := range a.sessions {
+		if v.dev == device {
+			v.dev = ""
+			a.sessions[name] = v
+		}
+	}
+	return nil
+}
+func (a *AttacherMock) FindSessions(ctx context.Context, wwid string) (string, []string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var target string
+	portals := []string{}
+	for _, v := range a.sessions {
+		if v.id == wwid && v.dev != "" {
+			target = v.iqn
+			portals = append(portals, v.ip)
+		}
+	}
+	return target, portals, nil
+}
+func (a *AttacherMock) RescanDevice(device string) error {
+	return nil
+}
+func (a *AttacherMock) HasNode(ip, iqn string) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.nodes[a.sessionName(ip, iqn)], nil
+}
+func (a *AttacherMock) DeleteNode(ip, iqn string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.nodes, a.sessionName(ip, iqn))
+	return nil
+}
+func (a *AttacherMock) DeleteDiscovery(ip string) error {
+	return nil
+}
+func (a *AttacherMock) Discover(ip, initiator string, chap *ChapCredentials) error {
 	return nil
 }
 func (a *AttacherMock) HasSession(ip, iqn string) (bool, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 	if _, ok := a.sessions[a.sessionName(ip, iqn)]; ok {
 		return true, nil
 	}
 	return false, nil
 }
-func (a *AttacherMock) Login(ip, iqn string) error {
+func (a *AttacherMock) Login(ip, iqn string, chap *ChapCredentials) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// like the real one, an existing session is kept, with its device
+	if _, ok := a.sessions[a.sessionName(ip, iqn)]; ok {
+		return nil
+	}
+	// the disk of each portal is the same volume, with the same WWID
+	id := uuid.New().String()
+	for _, v := range a.sessions {
+		if v.iqn == iqn {
+			id = v.id
+		}
+	}
 	a.maxDevice++
+	if a.nodes == nil {
+		a.nodes = map[string]bool{}
+	}
+	a.nodes[a.sessionName(ip, iqn)] = true
 	a.sessions[a.sessionName(ip, iqn)] = iscsiSession{
 		ip:  ip,
 		iqn: iqn,
 		dev: fmt.Sprintf("/dev/%d", a.maxDevice), // create a device for it
-		id:  uuid.New().String(),
+		id:  id,
 	}
 	return nil
 }
 func (a *AttacherMock) Logout(ip, iqn string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 	delete(a.sessions, a.sessionName(ip, iqn))
 	return nil
 }
-func (a *AttacherMock) MultipathReadBindings() (map[string]string, map[string]string, error) {
-	return a.bindings, map[string]string{}, nil
-}
-func (a *AttacherMock) MultipathWriteBindings(bindings map[string]string) error {
-	a.bindings = bindings
-	return nil
-}
 
 type MounterMock struct {
 	bindmounts  map[string]string // maps target to src
 	blockmounts map[string]string // maps target to device
+	// probed and checked the devices that were probed and checked, in order
+	probed  []string
+	checked []string
+	// resized the devices whose filesystems were resized
+	resized []string
 }
 
-func (m *MounterMock) Bindmount(src, target string) error {
+func (m *MounterMock) Bindmount(src, target string, readOnly bool) error {
+	// like the real one, create the target
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
 	m.bindmounts[target] = src
 	return nil
 }
+func (m *MounterMock) BindmountMappedDevice(device, target string, readOnly bool) error {
+	m.blockmounts[target] = device
+	return nil
+}
 func (m *MounterMock) Unmount(path string) error {
 	delete(m.bindmounts, path)
 	delete(m.blockmounts, path)
 	return nil
 }
-func (m *MounterMock) MountMappedDevice(device, target string) error {
+func (m *MounterMock) RemoveMountPoint(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+func (m *MounterMock) MountsOf(path string) ([]mount.MountInfo, error) {
+	var mounts []mount.MountInfo
+	for target, src := range m.bindmounts {
+		if src == path {
+			mounts = append(mounts, mount.MountInfo{MountPoint: target, Options: []string{"rw"}})
+		}
+	}
+	for target, device := range m.blockmounts {
+		if filepath.Join("/dev/mapper", device) == path {
+			mounts = append(mounts, mount.MountInfo{MountPoint: target, Options: []string{"rw"}})
+		}
+	}
+	return mounts, nil
+}
+func (m *MounterMock) MountMappedDevice(device, target string, options []string) error {
 	m.blockmounts[target] = device
 	return nil
 }
+func (m *MounterMock) MappedDeviceMounted(device, target string, readOnly bool) (bool, error) {
+	mounted, ok := m.blockmounts[target]
+	if ok && mounted != device {
+		return false, &mount.ConflictError{Target: target, State: mount.MountedOther, Info: mount.MountInfo{MountPoint: target, Source: "/dev/mapper/" + mounted}}
+	}
+	return ok, nil
+}
 func (m *MounterMock) FormatMappedDevice(device string) error {
 	// we do not do anything here
 	return nil
 }
-func (m *MounterMock) GetMappedDevice(device string) (BlockInfo, error) {
-	return BlockInfo{
-		Name:       "name",
-		FsType:     "ext4",
-		Label:      "label",
-		UUID:       uuid.New().String(),
-		Mountpoint: "/mnt/foo",
-	}, nil
+func (m *MounterMock) ResizeMappedDevice(device string) error {
+	m.resized = append(m.resized, device)
+	return nil
+}
+func (m *MounterMock) ProbeMappedDevice(device string) (blkid.Result, error) {
+	m.probed = append(m.probed, device)
+	return blkid.Result{Signatures: []blkid.Signature{{Type: "ext4", Usage: blkid.UsageFilesystem, Offset: 1080}}}, nil
+}
+func (m *MounterMock) CheckMappedDevice(device string, mode fsck.Mode) (fsck.Result, error) {
+	m.checked = append(m.checked, device)
+	return fsck.Result{}, nil
 }
 
 type InitializerMock struct {
+	// failures how many times NodeInit fails before it succeeds
+	failures int
+	// calls how many times NodeInit was called
+	calls int
+	// status what Check finds, a ready host if nil
+	status *NodeStatus
 }
 
 func (i *InitializerMock) NodeInit(initiatorName string) error {
+	i.calls++
+	if i.calls <= i.failures {
+		return fmt.Errorf("multipathd is not healthy")
+	}
 	return nil
 }
+
+func (i *InitializerMock) Check(initiatorName string) *NodeStatus {
+	if i.status != nil {
+		status := *i.status
+		return &status
+	}
+	return &NodeStatus{Modules: map[string]bool{"iscsi_tcp": true, "dm_multipath": true}, Initiator: initiatorName, Expected: initiatorName}
+}
+
+type EncryptorMock struct {
+	// mappings open mappings by name, to the device each one decrypts
+	mappings  map[string]string
+	formatted []string
+	resized   []string
+}
+
+func (e *EncryptorMock) Format(device string, key []byte) error {
+	e.formatted = append(e.formatted, device)
+	return nil
+}
+func (e *EncryptorMock) Open(device, name string, key []byte, readOnly bool) error {
+	e.mappings[name] = device
+	return nil
+}
+func (e *EncryptorMock) Close(name string) error {
+	delete(e.mappings, name)
+	return nil
+}
+func (e *EncryptorMock) IsOpen(name string) (bool, error) {
+	_, ok := e.mappings[name]
+	return ok, nil
+}
+func (e *EncryptorMock) Resize(name string, key []byte) error {
+	e.resized = append(e.resized, name)
+	return nil
+}
+
+type MultipathMock struct {
+	// maps by name, to the WWID of each one
+	maps    map[string]string
+	removed []string
+	// busy maps that are in use, and cannot be removed
+	busy map[string]bool
+	// resized the maps that were resized
+	resized []string
+	// active the number of active paths that every map gets
+	active int
+}
+
+func (m *MultipathMock) EnsureMap(ctx context.Context, name, wwid string, paths int) error {
+	if actual, ok := m.maps[name]; ok && actual != wwid {
+		return &WrongMapError{Name: name, Expected: wwid, Actual: actual}
+	}
+	m.maps[name] = wwid
+	if m.active > 0 && m.active < paths {
+		return &MapNotReadyError{Name: name, Paths: paths, Active: m.active}
+	}
+	return nil
+}
+func (m *MultipathMock) Maps(ctx context.Context) (map[string]string, error) {
+	maps := make(map[string]string, len(m.maps))
+	for name, wwid := range m.maps {
+		maps[name] = wwid
+	}
+	return maps, nil
+}
+func (m *MultipathMock) RemoveMap(ctx context.Context, name string) error {
+	if m.busy[name] {
+		return &multipath.Error{Command: "remove map " + name, Reply: "fail"}
+	}
+	delete(m.maps, name)
+	m.removed = append(m.removed, name)
+	return nil
+}
+func (m *MultipathMock) ResizeMap(ctx context.Context, name string) error {
+	m.resized = append(m.resized, name)
+	return nil
+}
+
+// memFS an FS of files and symlinks in memory
+type memFS struct {
+	files map[string][]byte
+	links map[string]string
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string][]byte{}, links: map[string]string{}}
+}
+
+// memFileInfo what Lstat tells of a file or symlink in a memFS
+type memFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (f *memFS) ReadFile(name string) ([]byte, error) {
+	data, ok := f.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte{}, data...), nil
+}
+func (f *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	// like the kernel, a disk that is deleted through sysfs is removed, with its device node
+	if disk := strings.TrimSuffix(strings.TrimPrefix(name, "/sys/block/"), "/device/delete"); disk != name && !strings.Contains(disk, "/") {
+		for file := range f.files {
+			if strings.HasSuffix(file, "/block/"+disk) || strings.HasPrefix(file, "/sys/block/"+disk+"/") || file == "/dev/"+disk {
+				delete(f.files, file)
+			}
+		}
+		return nil
+	}
+	f.files[name] = append([]byte{}, data...)
+	return nil
+}
+func (f *memFS) WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return f.WriteFile(name, data, perm)
+}
+func (f *memFS) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+func (f *memFS) Lock(name string) (io.Closer, error) {
+	return ioutil.NopCloser(nil), nil
+}
+func (f *memFS) Lstat(name string) (os.FileInfo, error) {
+	if _, ok := f.links[name]; ok {
+		return memFileInfo{name: filepath.Base(name), mode: os.ModeSymlink | 0777}, nil
+	}
+	if data, ok := f.files[name]; ok {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(data)), mode: 0644}, nil
+	}
+	return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+}
+func (f *memFS) Glob(pattern string) ([]string, error) {
+	names := []string{}
+	for name := range f.files {
+		names = append(names, name)
+	}
+	for name := range f.links {
+		names = append(names, name)
+	}
+	matches := []string{}
+	for _, name := range names {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+func (f *memFS) EvalSymlinks(path string) (string, error) {
+	for i := 0; i < 8; i++ {
+		target, ok := f.links[path]
+		if !ok {
+			if _, ok := f.files[path]; !ok {
+				return "", &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+			}
+			return path, nil
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return "", fmt.Errorf("too many links at %s", path)
+}
@@ -0,0 +1,66 @@
+package driver
+
+import (
+	"path/filepath"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/packethost/csi-packet/pkg/luks"
+)
+
+// Encryptor sets up dm-crypt/LUKS2 mappings of mapped devices, for volumes that are encrypted on the node
+type Encryptor interface {
+	Format(string, []byte) error
+	Open(string, string, []byte, bool) error
+	Close(string) error
+	IsOpen(string) (bool, error)
+	Resize(string, []byte) error
+}
+
+type EncryptorImpl struct {
+	// Exec runs cryptsetup, on this host if nil
+	Exec executor.Executor
+}
+
+// Format write a LUKS2 header to a mapped device, which loses everything on it
+func (e *EncryptorImpl) Format(device string, key []byte) error {
+	return luks.Format(orLocal(e.Exec), filepath.Join("/dev/mapper/", device), key)
+}
+
+// Open open an encrypted mapped device as another mapped device, which is the decrypted view of it
+func (e *EncryptorImpl) Open(device, name string, key []byte, readOnly bool) error {
+	return luks.Open(orLocal(e.Exec), filepath.Join("/dev/mapper/", device), name, key, readOnly)
+}
+
+// Close close the decrypted view of an encrypted mapped device, if it is open
+func (e *EncryptorImpl) Close(name string) error {
+	return luks.Close(orLocal(e.Exec), name)
+}
+
+// IsOpen check if a mapping is open, which for that of a volume means that the volume is encrypted and staged
+func (e *EncryptorImpl) IsOpen(name string) (bool, error) {
+	status, err := luks.GetStatus(orLocal(e.Exec), name)
+	return status != nil, err
+}
+
+// Resize grow the decrypted view of an encrypted mapped device, after the mapped device grew
+func (e *EncryptorImpl) Resize(name string, key []byte) error {
+	return luks.Resize(orLocal(e.Exec), name, key)
+}
+
+// cryptMappingName the name of the mapping that decrypts an encrypted volume
+func cryptMappingName(volumeName string) string {
+	return volumeName + "-crypt"
+}
+
+// isEncrypted determine if a volume is encrypted on the node, from its VolumeContext
+func isEncrypted(volumeContext map[string]string) bool {
+	return volumeContext[volumeContextEncrypted] == "true"
+}
+
+// mappedDeviceName the mapped device that holds the data of a volume: the decrypted view of it if it is encrypted
+func mappedDeviceName(volumeName string, volumeContext map[string]string) string {
+	if isEncrypted(volumeContext) {
+		return cryptMappingName(volumeName)
+	}
+	return volumeName
+}
@@ -0,0 +1,40 @@
+package driver
+
+import (
+	"github.com/packethost/csi-packet/pkg/mount"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mountErrorCode the gRPC code for an error mounting or unmounting, by why it failed
+func mountErrorCode(err error) codes.Code {
+	if mount.IsConflict(err) {
+		// CSI calls for ALREADY_EXISTS when a volume is published at a path in an incompatible way
+		return codes.AlreadyExists
+	}
+	errno, ok := mount.Errno(err)
+	if !ok {
+		return codes.Unknown
+	}
+	switch errno {
+	case unix.ENOENT, unix.ENOTDIR, unix.ENXIO:
+		return codes.NotFound
+	case unix.EPERM, unix.EACCES:
+		return codes.PermissionDenied
+	case unix.EINVAL, unix.ENODEV, unix.ENOTBLK:
+		return codes.InvalidArgument
+	case unix.EBUSY, unix.EROFS:
+		return codes.FailedPrecondition
+	case unix.ENOMEM, unix.ENOSPC, unix.EMFILE, unix.ENFILE:
+		return codes.ResourceExhausted
+	case unix.EIO, unix.EUCLEAN:
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// mountStatus a gRPC status for an error mounting or unmounting, with a message saying what failed
+func mountStatus(err error, message string) error {
+	return status.Errorf(mountErrorCode(err), "%s, %+v", message, err)
+}
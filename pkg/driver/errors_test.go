@@ -0,0 +1,32 @@
+package driver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/packethost/csi-packet/pkg/mount"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMountErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code codes.Code
+	}{
+		{&mount.Error{Op: "mount", Target: "/mnt", Err: unix.ENOENT}, codes.NotFound},
+		{&mount.Error{Op: "mount", Target: "/mnt", Err: unix.EPERM}, codes.PermissionDenied},
+		{&mount.Error{Op: "mount", Target: "/mnt", Err: unix.ENODEV}, codes.InvalidArgument},
+		{&mount.Error{Op: "unmount", Target: "/mnt", Err: unix.EBUSY}, codes.FailedPrecondition},
+		{&mount.Error{Op: "mount", Target: "/mnt", Err: unix.EIO}, codes.Internal},
+		{&mount.Error{Op: "mount", Target: "/mnt", Err: errors.New("exit status 32")}, codes.Unknown},
+		{&mount.ConflictError{Target: "/mnt", State: mount.MountedOther}, codes.AlreadyExists},
+		{errors.New("something else"), codes.Unknown},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, mountErrorCode(tt.err), tt.err.Error())
+		assert.Equal(t, tt.code, status.Code(mountStatus(tt.err, "mount error")), tt.err.Error())
+	}
+}
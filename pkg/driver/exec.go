@@ -1,18 +1,42 @@
 package driver
 
 import (
-	"os/exec"
+	"context"
 	"strings"
 
+	"github.com/packethost/csi-packet/pkg/executor"
 	log "github.com/sirupsen/logrus"
 )
 
 // generic execCommand function which logs on error
-func execCommand(command string, args ...string) ([]byte, error) {
-	out, err := exec.Command(command, args...).CombinedOutput()
+func execCommand(e executor.Executor, command string, args ...string) ([]byte, error) {
+	return execCommandRedacted(e, nil, command, args...)
+}
+
+// execCommandRedacted execCommand for commands with secrets in their arguments, which are replaced in what is logged
+func execCommandRedacted(e executor.Executor, secrets []string, command string, args ...string) ([]byte, error) {
+	out, err := executor.CombinedOutput(executor.WithSecrets(context.Background(), secrets...), e, command, args...)
 	if err != nil {
-		log.WithFields(log.Fields{"command": command, "args": strings.Join(args, " "), "out": string(out[:]), "error": err.Error()}).Error("Error")
+		log.WithFields(log.Fields{"command": command, "args": redact(strings.Join(args, " "), secrets), "out": redact(string(out[:]), secrets), "error": redact(err.Error(), secrets)}).Error("Error")
 		return nil, err
 	}
 	return out, nil
 }
+
+// redact replace every secret in a string
+func redact(s string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.Replace(s, secret, executor.Redacted, -1)
+		}
+	}
+	return s
+}
+
+// orLocal the executor, or one that runs commands on this host if it is nil
+func orLocal(e executor.Executor) executor.Executor {
+	if e == nil {
+		return executor.Local{}
+	}
+	return e
+}
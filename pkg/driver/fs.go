@@ -0,0 +1,222 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/packethost/csi-packet/pkg/service"
+	"golang.org/x/sys/unix"
+)
+
+// FS the files of the host that the driver reads and writes, such as the device links under /dev and the
+// iSCSI and multipath configuration under /etc
+type FS interface {
+	ReadFile(string) ([]byte, error)
+	WriteFile(string, []byte, os.FileMode) error
+	// WriteFileAtomic write a file so that readers see either its old contents or the new ones, never a part
+	WriteFileAtomic(string, []byte, os.FileMode) error
+	MkdirAll(string, os.FileMode) error
+	// Lock lock a file exclusively, creating it if need be, until the lock is closed
+	Lock(string) (io.Closer, error)
+	Lstat(string) (os.FileInfo, error)
+	Glob(string) ([]string, error)
+	EvalSymlinks(string) (string, error)
+}
+
+// OSFS the files of this host
+type OSFS struct{}
+
+func (OSFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (OSFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (OSFS) WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(name, data, perm)
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFS) Lock(name string) (io.Closer, error) {
+	return lockFile(name)
+}
+
+func (OSFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (OSFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (OSFS) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+// writeFileAtomic write a temporary file next to a file, and rename it over it, syncing both the file and the
+// directory so that the new contents survive a crash
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	temp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, name)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// lockFile take an exclusive flock of a file, which is released when it is closed; every call opens the
+// file anew, so that it excludes other calls of this process as well as other processes. A file that was
+// replaced while waiting for the lock is locked again, since the lock of the one it replaced excludes nobody.
+func lockFile(name string) (io.Closer, error) {
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("unable to lock %s: %v", name, err)
+		}
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := os.Stat(name)
+		if err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// orOS the files, or those of this host if it is nil
+func orOS(fs FS) FS {
+	if fs == nil {
+		return OSFS{}
+	}
+	return fs
+}
+
+// RootFS the files of the host under a directory of this one where its root is mounted, such as /host or,
+// sharing its PID namespace, /proc/1/root; paths are those on the host, both given and returned
+type RootFS struct {
+	Root string
+}
+
+func (r RootFS) path(name string) string {
+	return filepath.Join(r.Root, name)
+}
+
+// unroot the path on the host of one under the root
+func (r RootFS) unroot(path string) string {
+	rel, err := filepath.Rel(r.Root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
+
+func (r RootFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(r.path(name))
+}
+
+func (r RootFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(r.path(name), data, perm)
+}
+
+func (r RootFS) WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(r.path(name), data, perm)
+}
+
+func (r RootFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(r.path(path), perm)
+}
+
+func (r RootFS) Lock(name string) (io.Closer, error) {
+	return lockFile(r.path(name))
+}
+
+func (r RootFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(r.path(name))
+}
+
+func (r RootFS) Glob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(r.path(pattern))
+	for i := range matches {
+		matches[i] = r.unroot(matches[i])
+	}
+	return matches, err
+}
+
+// EvalSymlinks resolve the links under the root, which works for relative links such as those under
+// /dev/disk, but not absolute ones, which resolve outside it
+func (r RootFS) EvalSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(r.path(path))
+	if err != nil {
+		return "", err
+	}
+	return r.unroot(resolved), nil
+}
+
+// Host how the driver runs the tools, reads and writes the files, and manages the daemons, of the host
+type Host struct {
+	Exec executor.Executor
+	FS   FS
+	// Services manages the daemons, which are left alone if nil
+	Services service.Manager
+	// Multipath the blacklist and devices of the multipath configuration of the host, the driver's own where not set
+	Multipath MultipathConfig
+}
+
+// NewHost the Host for a mode of running tools, as for executor.New; in the container mode the driver uses
+// its own tools, and the files of the host that are mounted into the container, and otherwise those of the host
+func NewHost(mode, hostRoot string) (Host, error) {
+	exec, err := executor.New(mode, hostRoot)
+	if err != nil {
+		return Host{}, err
+	}
+	switch e := exec.(type) {
+	case executor.NSEnter:
+		return Host{Exec: e, FS: RootFS{Root: "/proc/1/root"}}, nil
+	case executor.Chroot:
+		return Host{Exec: e, FS: RootFS{Root: e.Root}}, nil
+	}
+	return Host{Exec: exec, FS: OSFS{}}, nil
+}
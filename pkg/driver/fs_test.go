@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootFS(t *testing.T) {
+	root, err := ioutil.TempDir("", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"dev/disk/by-path", "etc/multipath"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dev/sdb"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := "/dev/disk/by-path/ip-10.144.144.226:3260-iscsi-" + testTarget + "-lun-0"
+	if err := os.Symlink("../../sdb", filepath.Join(root, link)); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := RootFS{Root: root}
+	matches, err := fs.Glob("/dev/disk/by-path/*10.144.144.226*")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{link}, matches)
+	device, err := fs.EvalSymlinks(link)
+	assert.Nil(t, err)
+	assert.Equal(t, "/dev/sdb", device)
+
+	assert.Nil(t, fs.WriteFile(multipathBindings, []byte("volume 36001405\n"), 0644))
+	data, err := ioutil.ReadFile(filepath.Join(root, multipathBindings))
+	assert.Nil(t, err)
+	assert.Equal(t, "volume 36001405\n", string(data))
+}
+
+func TestNewHost(t *testing.T) {
+	host, err := NewHost(executor.ModeChroot, "/host")
+	assert.Nil(t, err)
+	assert.Equal(t, Host{Exec: executor.Chroot{Root: "/host"}, FS: RootFS{Root: "/host"}}, host)
+	host, err = NewHost(executor.ModeNsenter, "")
+	assert.Nil(t, err)
+	assert.Equal(t, RootFS{Root: "/proc/1/root"}, host.FS)
+	host, err = NewHost(executor.ModeContainer, "")
+	assert.Nil(t, err)
+	assert.Equal(t, Host{Exec: executor.Local{}, FS: OSFS{}}, host)
+}
@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/packethost/csi-packet/pkg/blkid"
+	"github.com/packethost/csi-packet/pkg/fsck"
+	"github.com/packethost/csi-packet/pkg/packet"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fsck policies, as the fsck StorageClass parameter
+const (
+	// fsckNever mount the filesystem without checking it
+	fsckNever = "never"
+	// fsckPreen check the filesystem if it was not unmounted cleanly, fixing what is safe to fix, as at boot
+	fsckPreen = "preen"
+	// fsckFull check the whole filesystem every time, up to a size, and preen any bigger than that
+	fsckFull = "full"
+)
+
+// defaultFsckPolicy the policy for volumes that do not set one, including statically provisioned ones
+const defaultFsckPolicy = fsckPreen
+
+// fsckPolicy how to check the filesystem of a volume before mounting it
+type fsckPolicy struct {
+	policy string
+	// fullMaxSize the size in bytes up to which a full check is done, or 0 for any size
+	fullMaxSize int64
+}
+
+// parseFsckPolicy read the fsck policy of a volume from its VolumeContext
+func parseFsckPolicy(volumeContext map[string]string) (fsckPolicy, error) {
+	p := fsckPolicy{policy: volumeContext[volumeContextFsck]}
+	switch p.policy {
+	case "":
+		p.policy = defaultFsckPolicy
+	case fsckNever, fsckPreen, fsckFull:
+	default:
+		return p, fmt.Errorf("unknown fsck policy %s", p.policy)
+	}
+	if maxSize := volumeContext[volumeContextFsckFullMaxSize]; maxSize != "" {
+		size, err := strconv.Atoi(maxSize)
+		if err != nil || size <= 0 {
+			return p, fmt.Errorf("fsck full check maximum size %s is not a positive integer", maxSize)
+		}
+		p.fullMaxSize = int64(size) * packet.Gibi
+	}
+	return p, nil
+}
+
+// mode how to check a filesystem on a device of the given size, and whether to check it at all
+func (p fsckPolicy) mode(size int64) (fsck.Mode, bool) {
+	switch p.policy {
+	case fsckNever:
+		return fsck.Preen, false
+	case fsckFull:
+		if p.fullMaxSize == 0 || size <= p.fullMaxSize {
+			return fsck.Full, true
+		}
+	}
+	return fsck.Preen, true
+}
+
+// checkFilesystem check the filesystem on a staged volume before it is mounted, as its fsck policy says,
+// recording the condition of the volume. A filesystem that still has errors after the check is not
+// mounted, since it takes someone to repair it.
+func (nodeServer *PacketNodeServer) checkFilesystem(logger *log.Entry, in *csi.NodeStageVolumeRequest, volumeName string, probe blkid.Result) error {
+	policy, err := parseFsckPolicy(in.VolumeContext)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid fsck policy for volume %s, %v", in.VolumeId, err)
+	}
+	mode, check := policy.mode(probe.Size)
+	logger = logger.WithFields(log.Fields{"fsck_policy": policy.policy, "fsck_mode": mode.String()})
+	if !check {
+		logger.Info("not checking filesystem")
+		return nil
+	}
+
+	logger.Info("checking filesystem")
+	result, err := nodeServer.Driver.Mounter.CheckMappedDevice(volumeName, mode)
+	if err != nil {
+		logger.Errorf("fsck error, %+v", err)
+		return status.Errorf(codes.Unknown, "fsck error, %+v", err)
+	}
+	logger = logger.WithFields(log.Fields{"fsck_exit_code": result.ExitCode, "fsck_output": result.Output})
+	switch {
+	case result.NeedsRepair():
+		message := fmt.Sprintf("filesystem needs manual repair, fsck exited with %d: %s", result.ExitCode, result.Problem())
+		logger.Error(message)
+		nodeServer.conditions.set(in.VolumeId, true, message)
+		return status.Errorf(codes.FailedPrecondition, "volume %s %s", in.VolumeId, message)
+	case result.Corrected():
+		logger.Warn("filesystem errors were corrected")
+		nodeServer.conditions.set(in.VolumeId, false, fmt.Sprintf("filesystem errors were corrected by a %s fsck", mode))
+	default:
+		logger.Info("filesystem is clean")
+		nodeServer.conditions.set(in.VolumeId, false, "filesystem is clean")
+	}
+	return nil
+}
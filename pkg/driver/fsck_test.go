@@ -0,0 +1,87 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/packethost/csi-packet/pkg/blkid"
+	"github.com/packethost/csi-packet/pkg/fsck"
+	"github.com/packethost/csi-packet/pkg/packet"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fsckMounter a mounter whose filesystem check finds what it is told to
+type fsckMounter struct {
+	MounterMock
+	result fsck.Result
+	modes  []fsck.Mode
+}
+
+func (m *fsckMounter) CheckMappedDevice(device string, mode fsck.Mode) (fsck.Result, error) {
+	m.modes = append(m.modes, mode)
+	return m.result, nil
+}
+
+func TestFsckPolicyMode(t *testing.T) {
+	tests := []struct {
+		description   string
+		volumeContext map[string]string
+		size          int64
+		mode          fsck.Mode
+		check         bool
+	}{
+		{"default", nil, 10 * packet.Gibi, fsck.Preen, true},
+		{"never", map[string]string{volumeContextFsck: fsckNever}, 10 * packet.Gibi, fsck.Preen, false},
+		{"full", map[string]string{volumeContextFsck: fsckFull}, 1000 * packet.Gibi, fsck.Full, true},
+		{"full under the threshold", map[string]string{volumeContextFsck: fsckFull, volumeContextFsckFullMaxSize: "100"}, 100 * packet.Gibi, fsck.Full, true},
+		{"full over the threshold", map[string]string{volumeContextFsck: fsckFull, volumeContextFsckFullMaxSize: "100"}, 101 * packet.Gibi, fsck.Preen, true},
+	}
+	for _, tt := range tests {
+		policy, err := parseFsckPolicy(tt.volumeContext)
+		assert.Nil(t, err, tt.description)
+		mode, check := policy.mode(tt.size)
+		assert.Equal(t, tt.check, check, tt.description)
+		if check {
+			assert.Equal(t, tt.mode, mode, tt.description)
+		}
+	}
+
+	_, err := parseFsckPolicy(map[string]string{volumeContextFsck: "sometimes"})
+	assert.NotNil(t, err)
+	_, err = parseFsckPolicy(map[string]string{volumeContextFsckFullMaxSize: "-1"})
+	assert.NotNil(t, err)
+}
+
+func TestCheckFilesystem(t *testing.T) {
+	tests := []struct {
+		description string
+		exitCode    int
+		code        codes.Code
+		abnormal    bool
+	}{
+		{"clean", 0, codes.OK, false},
+		{"corrected", 1, codes.OK, false},
+		{"uncorrected", 4, codes.FailedPrecondition, true},
+		{"operational error", 8, codes.FailedPrecondition, true},
+	}
+	for _, tt := range tests {
+		mounter := &fsckMounter{result: fsck.Result{ExitCode: tt.exitCode}}
+		nodeServer := &PacketNodeServer{Driver: &PacketDriver{Mounter: mounter}, conditions: newConditionTracker()}
+		in := &csi.NodeStageVolumeRequest{VolumeId: "volume-id"}
+		err := nodeServer.checkFilesystem(log.WithFields(log.Fields{}), in, "volume-name", blkid.Result{Size: packet.Gibi})
+		assert.Equal(t, tt.code, status.Code(err), tt.description)
+		assert.Equal(t, []fsck.Mode{fsck.Preen}, mounter.modes, tt.description)
+		assert.Equal(t, tt.abnormal, nodeServer.conditions.get("volume-id").Abnormal, tt.description)
+	}
+
+	// never checking leaves the condition as it was
+	mounter := &fsckMounter{}
+	nodeServer := &PacketNodeServer{Driver: &PacketDriver{Mounter: mounter}, conditions: newConditionTracker()}
+	in := &csi.NodeStageVolumeRequest{VolumeId: "volume-id", VolumeContext: map[string]string{volumeContextFsck: fsckNever}}
+	assert.Nil(t, nodeServer.checkFilesystem(log.WithFields(log.Fields{}), in, "volume-name", blkid.Result{}))
+	assert.Nil(t, mounter.modes)
+	assert.Equal(t, "volume is healthy", nodeServer.conditions.get("volume-id").Message)
+}
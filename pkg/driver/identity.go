@@ -1,7 +1,10 @@
 package driver
 
 import (
+	"strings"
+
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/packethost/csi-packet/pkg/version"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
@@ -14,11 +17,13 @@ var _ csi.IdentityServer = &PacketIdentityServer{}
 // PacketIdentityServer represent the identity server for Packet
 type PacketIdentityServer struct {
 	Driver *PacketDriver
+	// Node the node server whose readiness Probe reports, nil if the driver does not run as a node
+	Node *PacketNodeServer
 }
 
 // NewPacketIdentityServer create a new PacketIdentityServer
 func NewPacketIdentityServer(driver *PacketDriver) *PacketIdentityServer {
-	return &PacketIdentityServer{driver}
+	return &PacketIdentityServer{Driver: driver}
 }
 
 // GetPluginInfo get information about the plugin
@@ -47,6 +52,13 @@ func (packetIdentity *PacketIdentityServer) GetPluginCapabilities(ctx context.Co
 					},
 				},
 			},
+			&csi.PluginCapability{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -54,5 +66,17 @@ func (packetIdentity *PacketIdentityServer) GetPluginCapabilities(ctx context.Co
 // Probe probe the identity server
 func (packetIdentity *PacketIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	log.Infof("PacketIdentityServer.Probe called with args: %#v", req)
-	return &csi.ProbeResponse{}, nil
+	if packetIdentity.Node == nil {
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+	}
+	nodeStatus := packetIdentity.Node.Status()
+	if nodeStatus.Ready() {
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+	}
+	log.WithFields(statusFields(nodeStatus)).Warn("node is not ready")
+	// a node that is still starting up, or retrying it, is not ready yet, one that lacks what it needs has failed
+	if failures := nodeStatus.Failures(); len(failures) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "node is not ready: %s", strings.Join(failures, "; "))
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
 }
@@ -1,14 +1,33 @@
 package driver
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/iscsi"
+	"github.com/packethost/csi-packet/pkg/multipath"
+	"github.com/packethost/csi-packet/pkg/service"
+	log "github.com/sirupsen/logrus"
 )
 
 const (
 	initiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+	initiatorNameKey  = "InitiatorName="
 	mpathConfigFile   = "/etc/multipath.conf"
-	mpathConfig       = `
+	// mpathDropIn the file of the driver in the config_dir of multipath
+	mpathDropIn = "csi-packet.conf"
+	// mpathSectionBegin and mpathSectionEnd mark the section of multipath.conf that is the driver's, when
+	// multipath has no config_dir
+	mpathSectionBegin = "# BEGIN csi-packet: managed by the Equinix Metal CSI driver, changes are overwritten"
+	mpathSectionEnd   = "# END csi-packet"
+	// mpathLegacyConfig the whole of multipath.conf as releases of the driver before the marked section wrote it,
+	// which is replaced as the driver's own, unless it was changed since
+	mpathLegacyConfig = `
 defaults {
        polling_interval       3
        fast_io_fail_tmo 5
@@ -48,52 +67,365 @@ devices {
                 hardware_handler "1 alua"
         }
 }
+`
+	// servicesTimeout how long reconfiguring the daemons may take, until they are healthy
+	servicesTimeout = time.Minute
+	// backupSuffix the suffix of the copy of a file of the host as it was before the driver first changed it
+	backupSuffix = ".csi-packet.orig"
+
+	// the driver's configuration of multipath that is global; volumes are named by their bindings, so it needs
+	// user_friendly_names whatever device stanzas are configured, and the rest is in the stanza of the volumes
+	mpathDefaults = `defaults {
+	polling_interval 3
+	user_friendly_names yes
+}
+`
+	mpathBlacklist = `	devnode "^(ram|raw|loop|fd|md|dm-|sr|scd|st)[0-9]*"
+	devnode "^hd[a-z][[0-9]*]"
+	devnode "^vd[a-z]"
+	devnode "^cciss!c[0-9]d[0-9]*[p[0-9]*]"
+	device {
+		vendor "Micron"
+		product ".*"
+	}
+	device {
+		vendor "Intel"
+		product ".*"
+	}
+	device {
+		vendor "DELL"
+		product ".*"
+	}
+`
+	mpathDevices = `	device {
+		vendor "DATERA"
+		product "IBLOCK"
+		path_grouping_policy group_by_prio
+		path_selector "round-robin 0"
+		path_checker tur
+		hardware_handler "1 alua"
+		rr_min_io 100
+		rr_weight priorities
+		failback immediate
+		no_path_retry queue
+		fast_io_fail_tmo 5
+	}
 `
 )
 
 type Initializer interface {
 	NodeInit(string) error
+	// Check check whether the host is ready to attach volumes, with the given initiator name if it is known
+	Check(initiatorName string) *NodeStatus
 }
 
 type InitializerImpl struct {
+	// FS has the iSCSI and multipath configuration, and the kernel modules, of this host if nil
+	FS FS
+	// Iscsi connects to iscsid to check that it can be reached, a client with the defaults if nil
+	Iscsi *iscsi.Client
+	// Services reconfigures the daemons whose configuration changed, which are left alone if nil
+	Services service.Manager
+	// Multipath the blacklist and devices of the multipath configuration, the driver's own where not set
+	Multipath MultipathConfig
+}
+
+// MultipathConfig the bodies of sections of the multipath configuration that the node writes
+type MultipathConfig struct {
+	Blacklist string
+	Devices   string
 }
 
 // NodeInit does all node initialization necessary for iscsi to be configured correctly
 func (n *InitializerImpl) NodeInit(initiatorName string) error {
-	if err := n.SetIscsiInitiator(initiatorName); err != nil {
+	iscsid, err := n.SetIscsiInitiator(initiatorName)
+	if err != nil {
 		return err
 	}
-	if err := n.ConfigureMultipath(); err != nil {
+	multipathd, err := n.ConfigureMultipath()
+	if err != nil {
 		return err
 	}
-	if err := n.RestartServices(); err != nil {
+	if err := n.RestartServices(iscsid, multipathd); err != nil {
 		return err
 	}
 	return nil
 }
 
-// SetIscsiInitiator sets the name of the iscsi initiator
-func (n *InitializerImpl) SetIscsiInitiator(initiatorName string) error {
-	// get the name of our initiator
-	// update the file
-	contents := []byte(fmt.Sprintf("InitiatorName=%s\n", initiatorName))
-	err := ioutil.WriteFile(initiatorNameFile, contents, 0644)
+// Check check that the kernel modules that the driver needs are loaded, that iscsid can be reached, and what the
+// initiator name of the host is
+func (n *InitializerImpl) Check(initiatorName string) *NodeStatus {
+	fs := orOS(n.FS)
+	status := &NodeStatus{Modules: map[string]bool{}, Expected: initiatorName}
+	for _, module := range nodeModules {
+		_, err := fs.Lstat(filepath.Join(sysModule, module))
+		status.Modules[module] = err == nil
+	}
+
+	client := n.Iscsi
+	if client == nil {
+		client = iscsi.NewClient()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), nodeCheckTimeout)
+	defer cancel()
+	if err := client.Ping(ctx); err != nil {
+		status.IscsidError = err.Error()
+	}
+
+	data, err := readIfExists(fs, initiatorNameFile)
 	if err != nil {
-		return err
+		status.Initiator = fmt.Sprintf("<%v>", err)
+		return status
 	}
-	return nil
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, initiatorNameKey) {
+			// iscsid uses the first name, as it is the one that SetIscsiInitiator sets
+			status.Initiator = strings.TrimPrefix(line, initiatorNameKey)
+			break
+		}
+	}
+	return status
 }
 
-func (n *InitializerImpl) ConfigureMultipath() error {
-	contents := []byte(mpathConfig)
-	err := ioutil.WriteFile(mpathConfigFile, contents, 0644)
+// SetIscsiInitiator sets the name of the iscsi initiator, keeping the rest of the file, and returns whether it changed it
+func (n *InitializerImpl) SetIscsiInitiator(initiatorName string) (bool, error) {
+	fs := orOS(n.FS)
+	data, err := readIfExists(fs, initiatorNameFile)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	lines := []string{}
+	found := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), initiatorNameKey) {
+			if line != "" || len(lines) > 0 {
+				lines = append(lines, line)
+			}
+			continue
+		}
+		if existing := strings.TrimPrefix(strings.TrimSpace(line), initiatorNameKey); existing != initiatorName {
+			log.WithFields(log.Fields{"file": initiatorNameFile, "existing": existing, "initiator": initiatorName}).Warn("replacing the iSCSI initiator name of the host")
+		}
+		// the name is set once, where it was first set
+		if !found {
+			lines = append(lines, initiatorNameKey+initiatorName)
+			found = true
+		}
+	}
+	if !found {
+		lines = append(lines, initiatorNameKey+initiatorName)
+	}
+	return writeHostFile(fs, initiatorNameFile, data, []byte(strings.Join(lines, "\n")+"\n"), true)
+}
+
+// multipathConfig the driver's multipath configuration
+func (n *InitializerImpl) multipathConfig() string {
+	blacklist, devices := mpathBlacklist, mpathDevices
+	if n.Multipath.Blacklist != "" {
+		blacklist = indentStanza(n.Multipath.Blacklist)
+	}
+	if n.Multipath.Devices != "" {
+		devices = indentStanza(n.Multipath.Devices)
+	}
+	return mpathDefaults + "blacklist {\n" + blacklist + "}\n" + "devices {\n" + devices + "}\n"
+}
+
+// indentStanza the body of a section, each of its lines indented, and ending with a newline
+func indentStanza(body string) string {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(strings.TrimRight(body, "\n"), "\n") {
+		buf.WriteString("\t" + strings.TrimRight(line, " \t") + "\n")
+	}
+	return buf.String()
+}
+
+// ConfigureMultipath writes the driver's multipath configuration to a file of its own in the config_dir of multipath,
+// or to a marked section of multipath.conf if there is no config_dir, leaving the rest of the host's configuration
+// alone; settings of it that the driver's override are logged. A multipath.conf that an earlier release of the driver
+// wrote whole, and its section of multipath.conf once there is a config_dir, are removed. It returns whether it
+// changed anything.
+func (n *InitializerImpl) ConfigureMultipath() (bool, error) {
+	fs := orOS(n.FS)
+	data, err := readIfExists(fs, mpathConfigFile)
+	if err != nil {
+		return false, err
+	}
+	content := n.multipathConfig()
+	config, err := multipath.ParseConfig([]byte(content))
+	if err != nil {
+		return false, fmt.Errorf("invalid multipath configuration: %v", err)
+	}
+	others, section := removeSection(data)
+	legacy := isLegacyConfig(others)
+	if legacy {
+		log.WithFields(log.Fields{"file": mpathConfigFile}).Info("replacing the multipath configuration of an earlier release of the driver")
+		others = nil
+	}
+	existing, err := multipath.ParseConfig(others)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse %s: %v", mpathConfigFile, err)
+	}
+
+	dir := existing.ConfigDir()
+	if dir == "" {
+		logConflicts(mpathConfigFile, existing, config)
+		base := data
+		if legacy {
+			base = nil
+		}
+		return writeHostFile(fs, mpathConfigFile, data, replaceSection(base, content), true)
+	}
+
+	logConflicts(mpathConfigFile, existing, config)
+	path := filepath.Join(dir, mpathDropIn)
+	files, err := fs.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if file == path {
+			continue
+		}
+		other, err := fs.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		if section, err := multipath.ParseConfig(other); err == nil {
+			logConflicts(file, section, config)
+		}
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	current, err := readIfExists(fs, path)
+	if err != nil {
+		return false, err
+	}
+	changed, err := writeHostFile(fs, path, current, []byte(mpathSectionBegin+"\n"+content+mpathSectionEnd+"\n"), false)
+	if err != nil || !(section || legacy) {
+		return changed, err
+	}
+	// the drop-in is written first, so that multipath.conf never lacks the driver's configuration
+	removed, err := writeHostFile(fs, mpathConfigFile, data, others, true)
+	return changed || removed, err
+}
+
+// isLegacyConfig whether a multipath.conf is the one that earlier releases of the driver wrote, however it is indented
+func isLegacyConfig(data []byte) bool {
+	return normalizeConfig(string(data)) == normalizeConfig(mpathLegacyConfig)
 }
 
-// RestartServices should restart services, but we have no way to do that yet
-func (n *InitializerImpl) RestartServices() error {
+// normalizeConfig the lines of a configuration that are not blank, with their fields separated by single spaces
+func normalizeConfig(text string) string {
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines = append(lines, strings.Join(fields, " "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// logConflicts log the settings of a file that the driver's configuration overrides
+func logConflicts(file string, existing, config *multipath.Section) {
+	for _, conflict := range multipath.Conflicts(existing, config) {
+		log.WithFields(log.Fields{"file": file, "conflict": conflict.String()}).Warn("the multipath configuration of the driver overrides a setting of the host")
+	}
+}
+
+// removeSection the contents of a file without the driver's section, and whether it had one
+func removeSection(data []byte) ([]byte, bool) {
+	text := string(data)
+	begin := strings.Index(text, mpathSectionBegin)
+	if begin < 0 {
+		return data, false
+	}
+	end := strings.Index(text[begin:], mpathSectionEnd)
+	if end < 0 {
+		return data, false
+	}
+	end += begin + len(mpathSectionEnd)
+	if end < len(text) && text[end] == '\n' {
+		end++
+	}
+	return []byte(text[:begin] + text[end:]), true
+}
+
+// replaceSection the contents of a file with the driver's section in place of the one it had, or at its end
+func replaceSection(data []byte, content string) []byte {
+	section := mpathSectionBegin + "\n" + content + mpathSectionEnd + "\n"
+	text := string(data)
+	if begin := strings.Index(text, mpathSectionBegin); begin >= 0 {
+		if end := strings.Index(text[begin:], mpathSectionEnd); end >= 0 {
+			end += begin + len(mpathSectionEnd)
+			if end < len(text) && text[end] == '\n' {
+				end++
+			}
+			return []byte(text[:begin] + section + text[end:])
+		}
+	}
+	if len(text) > 0 && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return []byte(text + section)
+}
+
+// readIfExists read a file, which is empty if it does not exist
+func readIfExists(fs FS, name string) ([]byte, error) {
+	data, err := fs.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeHostFile write a file of the host with new contents, unless it has them already, returning whether it did;
+// a file that is not only the driver's is backed up the first time it is changed
+func writeHostFile(fs FS, name string, current, data []byte, backup bool) (bool, error) {
+	if bytes.Equal(current, data) {
+		return false, nil
+	}
+	if backup && len(current) > 0 {
+		if _, err := fs.Lstat(name + backupSuffix); os.IsNotExist(err) {
+			if err := fs.WriteFileAtomic(name+backupSuffix, current, 0644); err != nil {
+				return false, fmt.Errorf("unable to back up %s: %v", name, err)
+			}
+			log.WithFields(log.Fields{"file": name, "backup": name + backupSuffix}).Info("backed up host file")
+		}
+	}
+	if err := fs.WriteFileAtomic(name, data, 0644); err != nil {
+		return false, err
+	}
+	log.WithFields(log.Fields{"file": name}).Info("updated host file")
+	return true, nil
+}
+
+// RestartServices make the daemons whose configuration changed read it again, and check that they still are healthy
+func (n *InitializerImpl) RestartServices(iscsid, multipathd bool) error {
+	changed := map[service.Daemon]bool{service.Iscsid: iscsid, service.Multipathd: multipathd}
+	ctx, cancel := context.WithTimeout(context.Background(), servicesTimeout)
+	defer cancel()
+	for _, daemon := range []service.Daemon{service.Iscsid, service.Multipathd} {
+		if !changed[daemon] {
+			continue
+		}
+		logger := log.WithFields(log.Fields{"daemon": daemon})
+		if n.Services == nil {
+			logger.Warn("the configuration of the daemon changed, and it uses it only once it is restarted")
+			continue
+		}
+		err := n.Services.Reconfigure(ctx, daemon)
+		switch {
+		case err == service.ErrNotSupported:
+			logger.Warn("the configuration of the daemon changed, and it uses it only once it is restarted")
+			continue
+		case err != nil:
+			return fmt.Errorf("unable to reconfigure %s: %v", daemon, err)
+		}
+		if err := n.Services.Healthy(ctx, daemon); err != nil && err != service.ErrNotSupported {
+			return fmt.Errorf("%s is not healthy after it was reconfigured: %v", daemon, err)
+		}
+		logger.Info("reconfigured daemon")
+	}
 	return nil
 }
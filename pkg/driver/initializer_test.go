@@ -0,0 +1,237 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/iscsi"
+	"github.com/packethost/csi-packet/pkg/multipath"
+	"github.com/packethost/csi-packet/pkg/service"
+	"github.com/stretchr/testify/assert"
+)
+
+const testInitiator = "iqn.2014-05.net.packet:device.7c8d0ba0"
+
+func TestSetIscsiInitiator(t *testing.T) {
+	fs := newMemFS()
+	fs.files[initiatorNameFile] = []byte("## DO NOT EDIT OR REMOVE THIS FILE!\nInitiatorName=iqn.1993-08.org.debian:01:abcdef\n")
+	n := &InitializerImpl{FS: fs}
+
+	changed, err := n.SetIscsiInitiator(testInitiator)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "## DO NOT EDIT OR REMOVE THIS FILE!\nInitiatorName="+testInitiator+"\n", string(fs.files[initiatorNameFile]))
+	assert.Equal(t, "## DO NOT EDIT OR REMOVE THIS FILE!\nInitiatorName=iqn.1993-08.org.debian:01:abcdef\n", string(fs.files[initiatorNameFile+backupSuffix]))
+
+	// nothing changes once the name is set, and the original is kept as it was
+	fs.files[initiatorNameFile+backupSuffix] = []byte("original")
+	changed, err = n.SetIscsiInitiator(testInitiator)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	changed, _ = n.SetIscsiInitiator("iqn.2014-05.net.packet:device.other")
+	assert.True(t, changed)
+	assert.Equal(t, "original", string(fs.files[initiatorNameFile+backupSuffix]))
+}
+
+func TestSetIscsiInitiatorNoFile(t *testing.T) {
+	fs := newMemFS()
+	changed, err := (&InitializerImpl{FS: fs}).SetIscsiInitiator(testInitiator)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "InitiatorName="+testInitiator+"\n", string(fs.files[initiatorNameFile]))
+	assert.NotContains(t, fs.files, initiatorNameFile+backupSuffix)
+}
+
+func TestConfigureMultipathDropIn(t *testing.T) {
+	fs := newMemFS()
+	hostConfig := "defaults {\n\tuser_friendly_names no\n}\n"
+	fs.files[mpathConfigFile] = []byte(hostConfig)
+	n := &InitializerImpl{FS: fs}
+
+	changed, err := n.ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	// the host's own configuration is left alone
+	assert.Equal(t, hostConfig, string(fs.files[mpathConfigFile]))
+	dropIn := string(fs.files[multipath.DefaultConfigDir+"/"+mpathDropIn])
+	config, err := multipath.ParseConfig([]byte(dropIn))
+	assert.Nil(t, err)
+	defaults := config.Find("defaults")[0]
+	value, _ := defaults.Get("user_friendly_names")
+	assert.Equal(t, "yes", value)
+	// what is of the volumes is in their device stanza, so that the host's other devices keep their defaults
+	for _, keyword := range []string{"no_path_retry", "failback", "path_selector", "rr_min_io", "rr_weight", "fast_io_fail_tmo"} {
+		_, ok := defaults.Get(keyword)
+		assert.False(t, ok, keyword)
+	}
+	devices := config.Devices()
+	assert.Equal(t, 1, len(devices))
+	for keyword, expected := range map[string]string{
+		"vendor":        "DATERA",
+		"product":       "IBLOCK",
+		"no_path_retry": "queue",
+		"failback":      "immediate",
+		"path_selector": "round-robin 0",
+		"rr_min_io":     "100",
+		"rr_weight":     "priorities",
+	} {
+		value, _ = devices[0].Get(keyword)
+		assert.Equal(t, expected, value, keyword)
+	}
+
+	changed, err = n.ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+}
+
+func TestConfigureMultipathLegacy(t *testing.T) {
+	fs := newMemFS()
+	// as earlier releases wrote it, however it was reindented since
+	legacy := strings.Replace(mpathLegacyConfig, "       polling_interval       3", "\tpolling_interval 3", 1)
+	fs.files[mpathConfigFile] = []byte(legacy)
+	n := &InitializerImpl{FS: fs}
+
+	changed, err := n.ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "", string(fs.files[mpathConfigFile]))
+	assert.Equal(t, legacy, string(fs.files[mpathConfigFile+backupSuffix]))
+	assert.Contains(t, fs.files, multipath.DefaultConfigDir+"/"+mpathDropIn)
+
+	// a multipath.conf that was changed since is the host's
+	edited := legacy + "defaults {\n\tfind_multipaths yes\n}\n"
+	fs = newMemFS()
+	fs.files[mpathConfigFile] = []byte(edited)
+	_, err = (&InitializerImpl{FS: fs}).ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.Equal(t, edited, string(fs.files[mpathConfigFile]))
+}
+
+func TestConfigureMultipathRemovesSection(t *testing.T) {
+	fs := newMemFS()
+	// the section of a host that had no config_dir when it was written
+	hostConfig := "defaults {\n\tfind_multipaths yes\n}\n"
+	fs.files[mpathConfigFile] = []byte(hostConfig + mpathSectionBegin + "\n" + mpathDefaults + mpathSectionEnd + "\n")
+	n := &InitializerImpl{FS: fs}
+
+	changed, err := n.ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, hostConfig, string(fs.files[mpathConfigFile]))
+	assert.Contains(t, fs.files, multipath.DefaultConfigDir+"/"+mpathDropIn)
+
+	changed, err = n.ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+}
+
+func TestConfigureMultipathStanzas(t *testing.T) {
+	fs := newMemFS()
+	n := &InitializerImpl{FS: fs, Multipath: MultipathConfig{
+		Blacklist: "devnode \"^nvme[0-9]\"\n",
+		Devices:   "device {\n\tvendor \"DATERA\"\n\tproduct \"IBLOCK\"\n\tno_path_retry 12\n}",
+	}}
+	_, err := n.ConfigureMultipath()
+	assert.Nil(t, err)
+	config, err := multipath.ParseConfig(fs.files[multipath.DefaultConfigDir+"/"+mpathDropIn])
+	assert.Nil(t, err)
+	value, _ := config.Find("blacklist")[0].Get("devnode")
+	assert.Equal(t, "^nvme[0-9]", value)
+	value, _ = config.Devices()[0].Get("no_path_retry")
+	assert.Equal(t, "12", value)
+}
+
+func TestConfigureMultipathSection(t *testing.T) {
+	fs := newMemFS()
+	// without a config_dir, the driver's configuration goes into a section of multipath.conf of its own
+	hostConfig := "defaults {\n\tconfig_dir \"\"\n}\n"
+	fs.files[mpathConfigFile] = []byte(hostConfig)
+	n := &InitializerImpl{FS: fs}
+
+	changed, err := n.ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	content := string(fs.files[mpathConfigFile])
+	assert.True(t, strings.HasPrefix(content, hostConfig+mpathSectionBegin+"\n"))
+	assert.True(t, strings.HasSuffix(content, mpathSectionEnd+"\n"))
+	assert.Equal(t, hostConfig, string(fs.files[mpathConfigFile+backupSuffix]))
+
+	// the section is replaced in place, and the rest kept
+	fs.files[mpathConfigFile] = []byte(strings.Replace(content, "polling_interval 3", "polling_interval 10", 1) + "# added later\n")
+	changed, err = n.ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, content+"# added later\n", string(fs.files[mpathConfigFile]))
+
+	changed, err = n.ConfigureMultipath()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, strings.Count(string(fs.files[mpathConfigFile]), mpathSectionBegin))
+}
+
+func TestNodeInitServices(t *testing.T) {
+	fs := newMemFS()
+	services := &service.Fake{}
+	n := &InitializerImpl{FS: fs, Services: services}
+
+	assert.Nil(t, n.NodeInit(testInitiator))
+	assert.Equal(t, []service.Daemon{service.Iscsid, service.Multipathd}, services.Reconfigured)
+
+	// nothing changed, so nothing is reconfigured
+	services.Reconfigured = nil
+	assert.Nil(t, n.NodeInit(testInitiator))
+	assert.Nil(t, services.Reconfigured)
+
+	// only iscsid has a new configuration
+	assert.Nil(t, n.NodeInit("iqn.2014-05.net.packet:device.other"))
+	assert.Equal(t, []service.Daemon{service.Iscsid}, services.Reconfigured)
+}
+
+func TestNodeInitUnhealthy(t *testing.T) {
+	services := &service.Fake{Unhealthy: map[service.Daemon]string{service.Multipathd: "failed"}}
+	n := &InitializerImpl{FS: newMemFS(), Services: services}
+
+	err := n.NodeInit(testInitiator)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "multipathd is not healthy")
+}
+
+func TestNodeInitNotSupported(t *testing.T) {
+	// a backend that cannot manage a daemon leaves it to be restarted by hand
+	services := &service.Fake{Err: service.ErrNotSupported}
+	assert.Nil(t, (&InitializerImpl{FS: newMemFS(), Services: services}).NodeInit(testInitiator))
+	assert.Nil(t, (&InitializerImpl{FS: newMemFS()}).NodeInit(testInitiator))
+}
+
+func TestCheck(t *testing.T) {
+	fs := newMemFS()
+	fs.files["/sys/module/iscsi_tcp"] = nil
+	fs.files[initiatorNameFile] = []byte("## DO NOT EDIT OR REMOVE THIS FILE!\nInitiatorName=" + testInitiator + "\n")
+	// a socket of its own that iscsid listens on
+	socket := fmt.Sprintf("@csi-packet-test-iscsid-%d", os.Getpid())
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &InitializerImpl{FS: fs, Iscsi: &iscsi.Client{Socket: socket, Timeout: time.Second}}
+
+	status := n.Check(testInitiator)
+	assert.Equal(t, map[string]bool{"iscsi_tcp": true, "dm_multipath": false}, status.Modules)
+	assert.Equal(t, "", status.IscsidError)
+	assert.Equal(t, testInitiator, status.Initiator)
+	assert.Equal(t, []string{"node is not initialized yet", "kernel module dm_multipath is not loaded"}, status.Problems())
+
+	// iscsid is gone, which listing the sessions would not tell without any
+	listener.Close()
+	fs.files["/sys/module/dm_multipath"] = nil
+	status = n.Check("iqn.2014-05.net.packet:device.other")
+	status.Initialized = true
+	assert.Contains(t, status.IscsidError, fmt.Sprintf("exit code %d (cannot connect to iscsid)", iscsi.ExitIscsidNotConnected))
+	assert.Equal(t, 2, len(status.Problems()))
+	assert.Contains(t, status.Problems()[1], "initiator name of the host is")
+	assert.False(t, status.Ready())
+}
@@ -1,78 +1,251 @@
 package driver
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 
+	"github.com/packethost/csi-packet/pkg/blkid"
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/packethost/csi-packet/pkg/fsck"
+	"github.com/packethost/csi-packet/pkg/mount"
 	"golang.org/x/sys/unix"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// represents the lsblk info
-type BlockInfo struct {
-	Name       string `json:"name"`
-	FsType     string `json:"fstype"`
-	Label      string `json:"label"`
-	UUID       string `json:"uuid"`
-	Mountpoint string `json:"mountpoint"`
-}
-
-// represents the lsblk info
-type Deviceset struct {
-	BlockDevices []BlockInfo `json:"blockdevices"`
-}
-
 type Mounter interface {
-	Bindmount(string, string) error
+	Bindmount(string, string, bool) error
+	BindmountMappedDevice(string, string, bool) error
 	Unmount(string) error
-	MountMappedDevice(string, string) error
+	RemoveMountPoint(string) error
+	MountsOf(string) ([]mount.MountInfo, error)
+	MountMappedDevice(string, string, []string) error
+	MappedDeviceMounted(string, string, bool) (bool, error)
 	FormatMappedDevice(string) error
-	GetMappedDevice(string) (BlockInfo, error)
+	ResizeMappedDevice(string) error
+	ProbeMappedDevice(string) (blkid.Result, error)
+	CheckMappedDevice(string, fsck.Mode) (fsck.Result, error)
 }
 
 type MounterImpl struct {
+	// MountTable where to find what is mounted, the mount table of this process if nil
+	MountTable *mount.Table
+	// Exec runs mkfs, fsck and mount helpers, on this host if nil
+	Exec executor.Executor
+	// FS has the mount helpers that Exec runs, the files of this host if nil
+	FS FS
+}
+
+// maxStackedMounts how many mounts Unmount removes from a single path, at most
+const maxStackedMounts = 16
+
+func (m *MounterImpl) table() *mount.Table {
+	if m.MountTable == nil {
+		return mount.NewTable()
+	}
+	return m.MountTable
 }
 
 // Methods to format and mount
 
-func (m *MounterImpl) Bindmount(src, target string) error {
+func (m *MounterImpl) Bindmount(src, target string, readOnly bool) error {
+	source, err := m.table().SourceOf(src)
+	if err != nil {
+		log.Errorf("source of %s, %v", src, err)
+		return err
+	}
+	mounted, err := m.prepareMount(target, source, readOnly, true)
+	if err != nil || mounted {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		log.Errorf("mkdir %s, %v", target, err)
+		return err
+	}
+	return mount.BindMount(m.table(), src, target, readOnly)
+}
 
-	if _, err := os.Stat(target); err != nil {
-		if os.IsNotExist(err) {
-			os.MkdirAll(target, 0755)
-		} else {
-			log.Errorf("stat %s, %v", target, err)
-			return err
-		}
+// bind mount a mapped device to a file, for a raw block volume
+func (m *MounterImpl) BindmountMappedDevice(device, target string, readOnly bool) error {
+	devicePath := filepath.Join("/dev/mapper/", device)
+	source, err := m.table().SourceOf(devicePath)
+	if err != nil {
+		log.Errorf("source of %s, %v", devicePath, err)
+		return err
 	}
-	_, err := os.Stat(target)
+	mounted, err := m.prepareMount(target, source, readOnly, true)
+	if err != nil || mounted {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		log.Errorf("mkdir %s, %v", filepath.Dir(target), err)
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE, 0644)
 	if err != nil {
-		log.Errorf("stat %s, %v", target, err)
+		log.Errorf("create %s, %v", target, err)
 		return err
 	}
-	args := []string{"--bind", src, target}
-	_, err = execCommand("mount", args...)
-	return err
+	file.Close()
+	return mount.BindMount(m.table(), devicePath, target, readOnly)
+}
+
+// MountsOf list the mounts of what is at a path elsewhere, such as the bind mounts of a staged volume or of a
+// mapped device, but not the mount at the path itself
+func (m *MounterImpl) MountsOf(path string) ([]mount.MountInfo, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	source, err := m.table().SourceOf(resolved)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := m.table().MountsOf(source)
+	if err != nil {
+		return nil, err
+	}
+	var elsewhere []mount.MountInfo
+	for _, info := range mounts {
+		if info.MountPoint != resolved {
+			elsewhere = append(elsewhere, info)
+		}
+	}
+	return elsewhere, nil
+}
+
+// prepareMount check what already is mounted at a target, reporting if the source is mounted there as
+// expected, so there is nothing left to do. A mount of the source in the wrong mode is fixed in place
+// if it is a bind mount, and a corrupted mount is removed, so that it can be mounted again. Anything
+// else mounted there is an error, since it is not ours to replace.
+func (m *MounterImpl) prepareMount(target string, source mount.Source, readOnly, bind bool) (bool, error) {
+	logger := log.WithFields(log.Fields{"target": target, "source": source.String(), "read_only": readOnly})
+	state, info, err := m.table().Check(target, source, readOnly)
+	if err != nil {
+		logger.Errorf("checking mount, %v", err)
+		return false, err
+	}
+	switch state {
+	case mount.Mounted:
+		logger.Info("already mounted")
+		return true, nil
+	case mount.MountedWrongMode:
+		if !bind {
+			return false, &mount.ConflictError{Target: target, State: state, Info: *info}
+		}
+		logger.Info("already mounted, remounting to change mode")
+		err := mount.Remount(target, mount.WithMode(info.Options, readOnly))
+		return err == nil, err
+	case mount.MountedOther:
+		return false, &mount.ConflictError{Target: target, State: state, Info: *info}
+	case mount.Corrupted:
+		logger.Warn("corrupted mount, unmounting it to mount again")
+		if err := m.Unmount(target); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
 }
 
+// Unmount remove every mount at a path, including any stacked on each other by repeated mounts, and
+// detaching any that are corrupted. What is cached of the volume is written out first, which failing fails
+// the unmount, and nothing is written out of a corrupted mount. A path that is not mounted, or does not exist,
+// is fine.
 func (m *MounterImpl) Unmount(path string) error {
-	err := unix.Unmount(path, 0)
-	// we are willing to pass on a directory that is not mounted any more
-	if err != nil && err != unix.EINVAL {
-		return err
+	for i := 0; i < maxStackedMounts; i++ {
+		_, statErr := os.Stat(path)
+		corrupted := mount.IsCorruptedMount(statErr)
+		if statErr != nil && !corrupted {
+			if os.IsNotExist(statErr) {
+				return nil
+			}
+			return statErr
+		}
+		info, err := m.table().Lookup(path)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			return nil
+		}
+		if !corrupted {
+			if err := mount.Sync(path); err != nil {
+				return err
+			}
+		}
+		err = mount.Unmount(path, false)
+		if err != nil && corrupted {
+			// the filesystem is gone, so all that is left is to take it out of the tree
+			log.WithFields(log.Fields{"path": path}).Warnf("unmount of corrupted mount failed, detaching it, %v", err)
+			err = mount.Unmount(path, true)
+		}
+		// we are willing to pass on a directory that is not mounted any more
+		if errno, ok := mount.Errno(err); ok && errno == unix.EINVAL {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	return fmt.Errorf("%s still is mounted after unmounting it %d times", path, maxStackedMounts)
 }
 
-func (m *MounterImpl) MountMappedDevice(device, target string) error {
+// RemoveMountPoint remove a file or empty directory that was the target of a mount. A directory that is
+// not empty holds data that is not ours, and is left in place.
+func (m *MounterImpl) RemoveMountPoint(path string) error {
+	err := os.Remove(path)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	if pathErr, ok := err.(*os.PathError); ok && (pathErr.Err == unix.ENOTEMPTY || pathErr.Err == unix.EEXIST) {
+		log.WithFields(log.Fields{"path": path}).Warn("not removing mount point, it is not empty")
+		return nil
+	}
+	return err
+}
+
+// MappedDeviceMounted check if a mapped device is mounted at a target already, in the given mode, so that it
+// is in use and must not be probed, checked or formatted. A corrupted mount is removed, and anything else
+// mounted there is a ConflictError.
+func (m *MounterImpl) MappedDeviceMounted(device, target string, readOnly bool) (bool, error) {
+	devicePath := filepath.Join("/dev/mapper/", device)
+	source, err := mount.DeviceSource(devicePath)
+	if err != nil {
+		log.Errorf("source of %s, %v", devicePath, err)
+		return false, err
+	}
+	return m.prepareMount(target, source, readOnly, false)
+}
+
+func (m *MounterImpl) MountMappedDevice(device, target string, options []string) error {
 	devicePath := filepath.Join("/dev/mapper/", device)
+	source, err := mount.DeviceSource(devicePath)
+	if err != nil {
+		log.Errorf("source of %s, %v", devicePath, err)
+		return err
+	}
+	readOnly := false
+	for _, option := range options {
+		if option == "ro" {
+			readOnly = true
+		}
+	}
+	mounted, err := m.prepareMount(target, source, readOnly, false)
+	if err != nil || mounted {
+		return err
+	}
 	os.MkdirAll(target, os.ModeDir)
-	args := []string{"-t", "ext4", "--source", devicePath, "--target", target}
-	_, err := execCommand("mount", args...)
-	return err
+	return mountFilesystem(orLocal(m.Exec), orOS(m.FS), devicePath, target, "ext4", options)
+}
+
+// mountFilesystem mount a filesystem with mount(2), unless its type needs a helper that only mount(8) runs
+func mountFilesystem(e executor.Executor, fs FS, source, target, fsType string, options []string) error {
+	if mount.NeedsHelper(fsType, fs.Lstat) {
+		log.WithFields(log.Fields{"source": source, "target": target, "fs_type": fsType}).Info("mounting with helper")
+		return mount.MountWithHelper(e, source, target, fsType, options)
+	}
+	return mount.Mount(source, target, fsType, options)
 }
 
 // ext4 format
@@ -81,33 +254,23 @@ func (m *MounterImpl) FormatMappedDevice(device string) error {
 	args := []string{"-F", devicePath}
 	fstype := "ext4"
 	command := "mkfs." + fstype
-	_, err := execCommand(command, args...)
+	_, err := execCommand(orLocal(m.Exec), command, args...)
 	return err
 }
 
-// get info
-func (m *MounterImpl) GetMappedDevice(device string) (BlockInfo, error) {
-	devicePath := filepath.Join("/dev/mapper/", device)
+// ResizeMappedDevice grow the filesystem on a mapped device to the size of the device, which it may be mounted
+// while; ext4 is the only filesystem the driver formats
+func (m *MounterImpl) ResizeMappedDevice(device string) error {
+	_, err := execCommand(orLocal(m.Exec), "resize2fs", filepath.Join("/dev/mapper/", device))
+	return err
+}
 
-	// testing issue: must mock out call to Stat as well as to exec.Command
-	if _, err := os.Stat(devicePath); os.IsNotExist(err) {
-		return BlockInfo{}, err
-	}
+// ProbeMappedDevice find the signatures on a mapped device, to tell if it has a filesystem, or something else, or is blank
+func (m *MounterImpl) ProbeMappedDevice(device string) (blkid.Result, error) {
+	return blkid.ProbeDevice(orLocal(m.Exec), filepath.Join("/dev/mapper/", device))
+}
 
-	// use -J json output so we can parse it into a BlockInfo struct
-	out, err := execCommand("lsblk", "-J", "-i", "--output", "NAME,FSTYPE,LABEL,UUID,MOUNTPOINT", devicePath)
-	if err != nil {
-		return BlockInfo{}, err
-	}
-	devices := Deviceset{}
-	err = json.Unmarshal(out, &devices)
-	if err != nil {
-		return BlockInfo{}, err
-	}
-	for _, info := range devices.BlockDevices {
-		if info.Name == device {
-			return info, nil
-		}
-	}
-	return BlockInfo{}, fmt.Errorf("device %s not found", device)
+// CheckMappedDevice check and repair the filesystem on a mapped device, which must not be mounted
+func (m *MounterImpl) CheckMappedDevice(device string, mode fsck.Mode) (fsck.Result, error) {
+	return fsck.Check(orLocal(m.Exec), filepath.Join("/dev/mapper/", device), mode)
 }
@@ -0,0 +1,154 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/multipath"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// multipathMapTimeout how long staging a volume waits for its map to have all of its paths
+	multipathMapTimeout = 30 * time.Second
+	// multipathMapInterval between checks of a map that does not have all of its paths yet
+	multipathMapInterval = time.Second
+)
+
+// Multipath manages the multipath maps of volumes, through multipathd
+type Multipath interface {
+	// EnsureMap create the map of a volume, named as its binding says, if there is none, and wait until it is
+	// of the volume's WWID and has as many active paths as the volume has portals
+	EnsureMap(ctx context.Context, name, wwid string, paths int) error
+	// RemoveMap flush the map of a volume, which fails if it is in use, and is not an error if there is none
+	RemoveMap(ctx context.Context, name string) error
+	// Maps the maps by name, to the WWID of each one
+	Maps(ctx context.Context) (map[string]string, error)
+	// ResizeMap grow the map of a volume to the size of its disks, after the volume grew and they were rescanned
+	ResizeMap(ctx context.Context, name string) error
+}
+
+// MultipathImpl manages maps through the control socket of multipathd
+type MultipathImpl struct {
+	// Client of multipathd, one of the multipathd of this host if nil
+	Client *multipath.Client
+	// Interval between checks of a map that is not ready, multipathMapInterval if 0
+	Interval time.Duration
+
+	// once the client is set up, by whichever of the concurrent calls comes first
+	once sync.Once
+}
+
+func (m *MultipathImpl) client() *multipath.Client {
+	m.once.Do(func() {
+		if m.Client == nil {
+			m.Client = multipath.NewClient()
+		}
+	})
+	return m.Client
+}
+
+// WrongMapError a map that is of another device than the volume it is named for, as when its binding is stale
+type WrongMapError struct {
+	Name     string
+	Expected string
+	Actual   string
+}
+
+// Error return the error string
+func (e *WrongMapError) Error() string {
+	return fmt.Sprintf("multipath map %s is of WWID %s, not %s", e.Name, e.Actual, e.Expected)
+}
+
+// MapNotReadyError a map that did not get all of its paths in time
+type MapNotReadyError struct {
+	Name   string
+	Paths  int
+	Active int
+	// Err the last error creating or reading the map, if any
+	Err error
+}
+
+// Error return the error string
+func (e *MapNotReadyError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("multipath map %s has %d of %d active paths: %v", e.Name, e.Active, e.Paths, e.Err)
+	}
+	return fmt.Sprintf("multipath map %s has %d of %d active paths", e.Name, e.Active, e.Paths)
+}
+
+// IsWrongMap check if an error is of a map that is of another device
+func IsWrongMap(err error) bool {
+	switch err.(type) {
+	case *WrongMapError:
+		return true
+	}
+	return false
+}
+
+// IsMapNotReady check if an error is of a map that did not get all of its paths in time
+func IsMapNotReady(err error) bool {
+	switch err.(type) {
+	case *MapNotReadyError:
+		return true
+	}
+	return false
+}
+
+// EnsureMap create the map and wait for its paths, until the context is done
+func (m *MultipathImpl) EnsureMap(ctx context.Context, name, wwid string, paths int) error {
+	interval := m.Interval
+	if interval == 0 {
+		interval = multipathMapInterval
+	}
+	notReady := &MapNotReadyError{Name: name, Paths: paths}
+	for {
+		current, err := m.client().Map(ctx, name)
+		switch {
+		case err != nil:
+			notReady.Err = err
+		case current == nil:
+			// multipathd may not know of all the paths yet, so the map is created again until it does
+			notReady.Err = m.client().AddMap(ctx, wwid)
+		case current.WWID != wwid:
+			return &WrongMapError{Name: name, Expected: wwid, Actual: current.WWID}
+		default:
+			notReady.Active = current.ActivePaths()
+			notReady.Err = nil
+			if notReady.Active >= paths {
+				return nil
+			}
+			log.WithFields(log.Fields{"map": name, "active": notReady.Active, "paths": paths, "devices": current.Devices()}).Debug("waiting for multipath paths")
+		}
+		select {
+		case <-ctx.Done():
+			return notReady
+		case <-time.After(interval):
+		}
+	}
+}
+
+// RemoveMap remove the map through multipathd
+func (m *MultipathImpl) RemoveMap(ctx context.Context, name string) error {
+	return m.client().RemoveMap(ctx, name)
+}
+
+// ResizeMap resize the map through multipathd
+func (m *MultipathImpl) ResizeMap(ctx context.Context, name string) error {
+	return m.client().ResizeMap(ctx, name)
+}
+
+// Maps the maps that multipathd has, by name, to the WWID of each one
+func (m *MultipathImpl) Maps(ctx context.Context) (map[string]string, error) {
+	current, err := m.client().Maps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	maps := make(map[string]string, len(current))
+	for _, mp := range current {
+		maps[mp.Name] = mp.WWID
+	}
+	return maps, nil
+}
@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/multipath"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMultipathd a multipathd whose maps, and whether they can be added or removed, a test sets up
+type fakeMultipathd struct {
+	t    *testing.T
+	lock sync.Mutex
+	// maps by name
+	maps map[string]multipath.Map
+	// adds how many times to fail add map before the map appears, with its paths
+	adds int
+	// added the map that add map creates, once it does
+	added multipath.Map
+	// busy maps that are in use, and cannot be removed
+	busy map[string]bool
+}
+
+// testMap a map of the volume with paths in the given dm_st states, all of which the checker finds ready
+func testMap(wwid string, states ...string) multipath.Map {
+	var paths []multipath.Path
+	for _, state := range states {
+		paths = append(paths, multipath.Path{DMState: state, CheckerState: multipath.CheckerStateReady})
+	}
+	return multipath.Map{Name: testVolumeName, WWID: wwid, Paths: len(paths), PathGroups: []multipath.PathGroup{{Paths: paths}}}
+}
+
+func (f *fakeMultipathd) reply(command string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch command {
+	case "show maps json":
+		maps := []multipath.Map{}
+		for _, m := range f.maps {
+			maps = append(maps, m)
+		}
+		out, err := json.Marshal(map[string]interface{}{"major_version": 0, "minor_version": 1, "maps": maps})
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		return string(out)
+	case "add map " + f.added.WWID:
+		if f.adds > 0 {
+			f.adds--
+			return "fail\n"
+		}
+		f.maps[f.added.Name] = f.added
+		return "ok\n"
+	case "remove map " + testVolumeName:
+		if f.busy[testVolumeName] {
+			return "fail\n"
+		}
+		delete(f.maps, testVolumeName)
+		return "ok\n"
+	}
+	return "multipathd: unknown command\n"
+}
+
+// serveMultipathd a MultipathImpl of a fake multipathd
+func serveMultipathd(t *testing.T, f *fakeMultipathd) (*MultipathImpl, *multipath.FakeServer) {
+	f.t = t
+	if f.maps == nil {
+		f.maps = map[string]multipath.Map{}
+	}
+	server, err := multipath.NewFakeServer(f.reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MultipathImpl{Client: server.Client, Interval: time.Millisecond}, server
+}
+
+func TestEnsureMap(t *testing.T) {
+	f := &fakeMultipathd{maps: map[string]multipath.Map{testVolumeName: testMap(testScsiID, "active", "active")}}
+	m, server := serveMultipathd(t, f)
+	defer server.Close()
+
+	assert.Nil(t, m.EnsureMap(context.Background(), testVolumeName, testScsiID, 2))
+	assert.Equal(t, []string{"show maps json"}, server.Commands())
+}
+
+func TestEnsureMapAdded(t *testing.T) {
+	// multipathd does not know of all the paths at first, so the map is added again until it appears
+	f := &fakeMultipathd{adds: 2, added: testMap(testScsiID, "active", "active")}
+	m, server := serveMultipathd(t, f)
+	defer server.Close()
+
+	assert.Nil(t, m.EnsureMap(context.Background(), testVolumeName, testScsiID, 2))
+	assert.Equal(t, []string{
+		"show maps json", "add map " + testScsiID,
+		"show maps json", "add map " + testScsiID,
+		"show maps json", "add map " + testScsiID,
+		"show maps json",
+	}, server.Commands())
+}
+
+func TestEnsureMapWrongWWID(t *testing.T) {
+	f := &fakeMultipathd{maps: map[string]multipath.Map{testVolumeName: testMap("36001405aaaa", "active", "active")}}
+	m, server := serveMultipathd(t, f)
+	defer server.Close()
+
+	err := m.EnsureMap(context.Background(), testVolumeName, testScsiID, 2)
+	assert.True(t, IsWrongMap(err))
+	assert.Equal(t, &WrongMapError{Name: testVolumeName, Expected: testScsiID, Actual: "36001405aaaa"}, err)
+}
+
+func TestEnsureMapNotReady(t *testing.T) {
+	f := &fakeMultipathd{maps: map[string]multipath.Map{testVolumeName: testMap(testScsiID, "active", "failed")}}
+	m, server := serveMultipathd(t, f)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := m.EnsureMap(ctx, testVolumeName, testScsiID, 2)
+	if assert.True(t, IsMapNotReady(err)) {
+		notReady := err.(*MapNotReadyError)
+		assert.Equal(t, testVolumeName, notReady.Name)
+		assert.Equal(t, 2, notReady.Paths)
+		assert.Equal(t, 1, notReady.Active)
+	}
+
+	// a map that never appears is not ready either, with why it could not be added
+	f = &fakeMultipathd{adds: 1 << 20, added: testMap(testScsiID)}
+	m, server = serveMultipathd(t, f)
+	defer server.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = m.EnsureMap(ctx, testVolumeName, testScsiID, 2)
+	if assert.True(t, IsMapNotReady(err)) {
+		assert.Equal(t, 0, err.(*MapNotReadyError).Active)
+		assert.NotNil(t, err.(*MapNotReadyError).Err)
+	}
+	assert.Contains(t, server.Commands(), "add map "+testScsiID)
+}
+
+func TestRemoveMapInUse(t *testing.T) {
+	f := &fakeMultipathd{maps: map[string]multipath.Map{testVolumeName: testMap(testScsiID, "active", "active")}, busy: map[string]bool{testVolumeName: true}}
+	m, server := serveMultipathd(t, f)
+	defer server.Close()
+
+	// a map that is in use is kept
+	err := m.RemoveMap(context.Background(), testVolumeName)
+	assert.True(t, multipath.IsFailed(err))
+	assert.Contains(t, f.maps, testVolumeName)
+
+	// and removed once it is not
+	f.lock.Lock()
+	f.busy[testVolumeName] = false
+	f.lock.Unlock()
+	assert.Nil(t, m.RemoveMap(context.Background(), testVolumeName))
+	assert.NotContains(t, f.maps, testVolumeName)
+	// one that is gone is fine
+	assert.Nil(t, m.RemoveMap(context.Background(), testVolumeName))
+	assert.Equal(t, []string{"show maps json", "remove map " + testVolumeName, "show maps json", "remove map " + testVolumeName, "show maps json"}, server.Commands())
+}
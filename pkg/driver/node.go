@@ -1,6 +1,14 @@
 package driver
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/blkid"
+	"github.com/packethost/csi-packet/pkg/luks"
+	"github.com/packethost/csi-packet/pkg/multipath"
 	"github.com/packethost/csi-packet/pkg/packet"
 	log "github.com/sirupsen/logrus"
 
@@ -17,19 +25,23 @@ var _ csi.NodeServer = &PacketNodeServer{}
 type PacketNodeServer struct {
 	Driver         *PacketDriver
 	MetadataDriver *packet.MetadataDriver
-	Initialized    bool
-	initiator      string
+	state          nodeState
+	publications   *publicationTracker
+	conditions     *conditionTracker
+	repairs        *repairTracker
 }
 
 // NewPacketNodeServer create a new PacketNodeServer
 func NewPacketNodeServer(driver *PacketDriver, metadata *packet.MetadataDriver) (*PacketNodeServer, error) {
 	// we do NOT initialize here, since NewPacketNodeServer is called in all cases of this program
 	//  even on a controller
-	//  we wait until our first legitimate call for a Node*() func
+	//  the driver starts initializing when it runs as a node, and else the first call of NodeGetInfo does
 	return &PacketNodeServer{
 		Driver:         driver,
 		MetadataDriver: metadata,
-		Initialized:    false,
+		publications:   newPublicationTracker(),
+		conditions:     newConditionTracker(),
+		repairs:        newRepairTracker(),
 	}, nil
 }
 
@@ -44,13 +56,10 @@ func (nodeServer *PacketNodeServer) NodeStageVolume(ctx context.Context, in *csi
 	}
 
 	// do we know our initiator?
-	if nodeServer.initiator == "" {
-		initiatorName, err := nodeServer.MetadataDriver.GetInitiator()
-		if err != nil {
-			nodeServer.Driver.Logger.Errorf("NodeGetInfo: metadata error %v", err)
-			return nil, status.Errorf(codes.Unknown, "metadata error, %s", err.Error())
-		}
-		nodeServer.initiator = initiatorName
+	initiatorName, err := nodeServer.initiatorName()
+	if err != nil {
+		nodeServer.Driver.Logger.Errorf("NodeStageVolume: %v", err)
+		return nil, status.Error(codes.Unknown, err.Error())
 	}
 	volumeMetaData, err := nodeServer.MetadataDriver.GetVolumeMetadata(volumeName)
 	if err != nil {
@@ -65,96 +74,275 @@ func (nodeServer *PacketNodeServer) NodeStageVolume(ctx context.Context, in *csi
 	if in.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "VolumeCapability unspecified for NodeStageVolume")
 	}
+	if err := checkVolumeCapability(in.VolumeCapability); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported VolumeCapability for NodeStageVolume, %v", err)
+	}
+	// a raw block volume has no filesystem, and nothing to mount
+	block := isBlockCapability(in.VolumeCapability)
 	mnt := in.VolumeCapability.GetMount()
 	// options := mnt.MountFlags
 
-	if mnt.FsType != "" {
-		if mnt.FsType != "ext4" {
-			return nil, status.Errorf(codes.InvalidArgument, "fs type %s not supported", mnt.FsType)
+	if mnt.GetFsType() != "" {
+		if mnt.GetFsType() != "ext4" {
+			return nil, status.Errorf(codes.InvalidArgument, "fs type %s not supported", mnt.GetFsType())
 		}
 	}
 
+	chap, err := chapCredentials(in.Secrets)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid CHAP secrets for NodeStageVolume, %v", err)
+	}
+	encrypted := isEncrypted(in.VolumeContext)
+	if encrypted && in.Secrets[secretEncryptionKey] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "encrypted volume requires the %s secret for NodeStageVolume", secretEncryptionKey)
+	}
+
 	logger := nodeServer.Driver.Logger.WithFields(log.Fields{
 		"volume_id":           in.VolumeId,
 		"volume_name":         volumeName,
 		"staging_target_path": in.StagingTargetPath,
-		"fsType":              mnt.FsType,
+		"fsType":              mnt.GetFsType(),
+		"block":               block,
+		"encrypted":           encrypted,
+		"chap":                chap != nil,
 		"method":              "NodeStageVolume",
 	})
 
-	// discover and log in to iscsiadmin
+	// discover and log in to every portal at once, and find the disk of each session, which all must be the same
+	// volume, identified by its WWID; the volume is staged as long as one of them is up
+	portals := make([]string, 0, len(volumeMetaData.IPs))
 	for _, ip := range volumeMetaData.IPs {
-		err = nodeServer.Driver.Attacher.Discover(ip.String(), nodeServer.initiator) // iscsiadm --mode discovery --type sendtargets --portal 10.144.144.226 --discover
-		if err != nil {
-			logger.Infof("iscsiadmin discover error, %+v", err)
-			return nil, status.Errorf(codes.Unknown, "iscsiadmin discover error, %+v", err)
+		portals = append(portals, ip.String())
+	}
+	pathCtx, cancelPaths := context.WithTimeout(ctx, deviceWaitTimeout)
+	defer cancelPaths()
+	paths := nodeServer.attachPortals(pathCtx, portals, volumeMetaData.IQN, initiatorName, chap)
+	var scsiID string
+	var failures []string
+	code := codes.Unknown
+	for _, path := range paths {
+		if path.err != nil {
+			logger.Infof("%s", path)
+			failures = append(failures, path.String())
+			if IsDeviceNotFound(path.err) {
+				code = codes.Unavailable
+			}
+			continue
 		}
-		err = nodeServer.Driver.Attacher.Login(ip.String(), volumeMetaData.IQN)
-		if err != nil {
-			logger.Infof("iscsiadmin login error, %+v", err)
-			return nil, status.Errorf(codes.Unknown, "iscsiadmin login error, %+v", err)
+		if scsiID != "" && path.wwid != scsiID {
+			logger.Errorf("disk %s at %s is of WWID %s, not %s", path.device, path.portal, path.wwid, scsiID)
+			return nil, status.Errorf(codes.FailedPrecondition, "disk %s at portal %s is of WWID %s, not %s", path.device, path.portal, path.wwid, scsiID)
 		}
+		scsiID = path.wwid
 	}
+	if scsiID == "" {
+		return nil, status.Errorf(code, "no path to volume %s is up, %s", volumeName, strings.Join(failures, "; "))
+	}
+	up := len(paths) - len(failures)
 
-	// configure multimap
-	devicePath, err := nodeServer.Driver.Attacher.GetDevice(volumeMetaData.IPs[0].String(), volumeMetaData.IQN)
+	discards, err := nodeServer.Driver.Bindings.Bind(volumeName, scsiID)
 	if err != nil {
-		logger.Infof("devicePath error, %+v", err)
-		return nil, status.Errorf(codes.Unknown, "devicePath error, %+v", err)
+		logger.Infof("bind error, %+v", err)
+		return nil, status.Errorf(codes.Unknown, "multipath bindings error, %+v", err)
+	}
+	// multipath may have named the map of the volume itself, before it was bound, and the map only gets the
+	// name of the volume once that one is gone
+	for _, alias := range discards {
+		logger.Infof("removing multipath map %s of %s", alias, scsiID)
+		err := nodeServer.Driver.Multipath.RemoveMap(ctx, alias)
+		switch {
+		case multipath.IsFailed(err):
+			return nil, status.Errorf(codes.FailedPrecondition, "multipath map %s of volume %s is in use, %v", alias, in.VolumeId, err)
+		case err != nil:
+			return nil, status.Errorf(codes.Unknown, "multipath error, %v", err)
+		}
 	}
-	scsiID, err := nodeServer.Driver.Attacher.GetScsiID(devicePath)
-	if err != nil {
-		logger.Infof("scsiID error, path %s, %+v", devicePath, err)
-		return nil, status.Errorf(codes.Unknown, "scsiIDerror, %+v", err)
+	mapCtx, cancel := context.WithTimeout(ctx, multipathMapTimeout)
+	defer cancel()
+	err = nodeServer.Driver.Multipath.EnsureMap(mapCtx, volumeName, scsiID, up)
+	switch {
+	case IsWrongMap(err):
+		logger.Errorf("multipath map error, %v", err)
+		return nil, status.Errorf(codes.FailedPrecondition, "multipath map error, %v", err)
+	case IsMapNotReady(err):
+		logger.Infof("multipath map error, %v", err)
+		return nil, status.Errorf(codes.Unavailable, "multipath map error, %v", err)
+	case err != nil:
+		return nil, status.Errorf(codes.Unknown, "multipath map error, %v", err)
+	}
+	logger.Infof("multipath map %s of %s has %d of %d paths", volumeName, scsiID, up, len(paths))
+	// a volume that is missing paths is degraded, until the missing ones are repaired
+	if up < len(paths) {
+		message := degradedMessage(up, len(paths), failures)
+		logger.Warnf("volume is degraded, %s", message)
+		nodeServer.repairs.add(volumeName, degradedVolume{name: volumeName, target: volumeMetaData.IQN, wwid: scsiID, chap: chap})
+		nodeServer.conditions.setDegraded(volumeName, message)
+	} else {
+		nodeServer.repairs.remove(volumeName)
+		nodeServer.conditions.setDegraded(volumeName, "")
+	}
+
+	// a volume that other nodes read at the same time must not be written at all, not even to
+	// replay its journal, and so it cannot be formatted either
+	var mountOptions []string
+	sharedReadOnly := in.VolumeCapability.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+	if sharedReadOnly {
+		mountOptions = []string{"ro", "noload"}
+	}
+
+	// the data of an encrypted volume is on the mapping that decrypts it, whether it is mounted or a raw block volume
+	deviceName := volumeName
+	if encrypted {
+		if err := nodeServer.openEncrypted(logger, in, volumeName, sharedReadOnly); err != nil {
+			return nil, err
+		}
+		deviceName = cryptMappingName(volumeName)
 	}
-	bindings, discards, err := nodeServer.Driver.Attacher.MultipathReadBindings()
-	if err != nil {
-		logger.Infof("readBindings error, %+v", err)
-		return nil, status.Errorf(codes.Unknown, "readBindings error, %+v", err)
+
+	if block {
+		logger.Infof("NodeStageVolume complete, block device mapped")
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
-	bindings[volumeName] = scsiID
-	err = nodeServer.Driver.Attacher.MultipathWriteBindings(bindings)
+
+	// a volume that is mounted already is in use, so it is not probed, checked or formatted again
+	mounted, err := nodeServer.Driver.Mounter.MappedDeviceMounted(deviceName, in.StagingTargetPath, sharedReadOnly)
 	if err != nil {
-		logger.Infof("writeBindings error, %+v", err)
-		return nil, status.Errorf(codes.Unknown, "writeBindings error, %+v", err)
-	}
-	for mappingName := range discards {
-		multipath("-f", mappingName)
+		logger.Errorf("checking staging path failed, %v", err)
+		return nil, mountStatus(err, "staging path check error")
 	}
-	// for some reason, you have to do it twice for it to work
-	multipath(volumeName)
-	multipath(volumeName)
-
-	check, err := multipath("-ll", devicePath)
-	logger.Infof("multipath check for %s: %s", devicePath, check)
-	if check == "" {
-		logger.Infof("empty multipath check for %s", devicePath)
+	if mounted {
+		logger.Info("NodeStageVolume complete, mapped device already mounted")
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	blockInfo, err := nodeServer.Driver.Mounter.GetMappedDevice(volumeName)
+	// only a volume that is known to be blank is formatted; one that cannot be probed could have anything on it
+	probe, err := nodeServer.Driver.Mounter.ProbeMappedDevice(deviceName)
 	if err != nil {
-		logger.Infof("getMappedDevice error, %+v", err)
-		return nil, status.Errorf(codes.Unknown, "getMappedDevice error, %+v", err)
+		logger.Errorf("probing mapped device failed, not formatting it, %+v", err)
+		return nil, status.Errorf(codes.Unavailable, "probeMappedDevice error, %+v", err)
+	}
+	if err := nodeServer.checkFormat(logger, in, probe, sharedReadOnly); err != nil {
+		return nil, err
 	}
-	if blockInfo.FsType == "" {
-		err = nodeServer.Driver.Mounter.FormatMappedDevice(volumeName)
+	if probe.Blank() {
+		err = nodeServer.Driver.Mounter.FormatMappedDevice(deviceName)
 		if err != nil {
 			logger.Infof("formatMappedDevice error, %+v", err)
 			return nil, status.Errorf(codes.Unknown, "formatMappedDevice error, %+v", err)
 		}
+	} else if !sharedReadOnly {
+		// a volume that other nodes read at the same time cannot be repaired, so it is not checked either
+		if err := nodeServer.checkFilesystem(logger, in, deviceName, probe); err != nil {
+			return nil, err
+		}
 	}
 
 	logger.Info("mounting mapped device")
-	err = nodeServer.Driver.Mounter.MountMappedDevice(volumeName, in.StagingTargetPath)
+	err = nodeServer.Driver.Mounter.MountMappedDevice(deviceName, in.StagingTargetPath, mountOptions)
 	if err != nil {
 		logger.Infof("mountMappedDevice error, %v", err)
-		return nil, status.Errorf(codes.Unknown, "mountMappedDevice error, %+v", err)
+		if mountErrorCode(err) == codes.Internal {
+			nodeServer.conditions.set(in.VolumeId, true, fmt.Sprintf("filesystem cannot be mounted: %v", err))
+		}
+		return nil, mountStatus(err, "mountMappedDevice error")
 	}
 
 	logger.Infof("NodeStageVolume complete")
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// checkFormat decide if a staged volume can be mounted as it is, or formatted first if it is blank, returning
+// why not if neither. Every decision is logged as an audit event, since formatting the wrong volume loses its data.
+func (nodeServer *PacketNodeServer) checkFormat(logger *log.Entry, in *csi.NodeStageVolumeRequest, probe blkid.Result, sharedReadOnly bool) error {
+	audit := func(decision, reason string) {
+		logger.WithFields(log.Fields{
+			"audit":      "format",
+			"decision":   decision,
+			"reason":     reason,
+			"signatures": probe.String(),
+		}).Info("format decision")
+	}
+
+	if fs := probe.Filesystem(); fs != nil {
+		switch fs.Type {
+		case "ext2", "ext3", "ext4":
+			audit("mount", "has a filesystem")
+			return nil
+		}
+		audit("refuse", "has an unsupported filesystem")
+		return status.Errorf(codes.FailedPrecondition, "volume %s has a %s filesystem, which is not supported", in.VolumeId, fs.Type)
+	}
+	if !probe.Blank() {
+		audit("refuse", "has signatures other than a filesystem")
+		return status.Errorf(codes.FailedPrecondition, "volume %s is not blank, it has %s, refusing to format it", in.VolumeId, probe)
+	}
+	// an adopted volume had its data before the driver knew it, so a missing filesystem is a
+	// problem to look into, not a blank volume
+	if in.VolumeContext[volumeContextAdopted] == "true" {
+		audit("refuse", "adopted")
+		return status.Errorf(codes.FailedPrecondition, "adopted volume %s has no filesystem, refusing to format it", in.VolumeId)
+	}
+	if sharedReadOnly {
+		audit("refuse", "read-only")
+		return status.Errorf(codes.FailedPrecondition, "volume %s has no filesystem, and cannot be formatted for read-only access", in.VolumeId)
+	}
+	if nodeServer.Driver.RequireFormatOptIn && in.VolumeContext[volumeContextAllowFormat] != "true" {
+		audit("refuse", "not allowed by the StorageClass")
+		return status.Errorf(codes.FailedPrecondition, "volume %s has no filesystem, and its StorageClass does not set %s", in.VolumeId, parameterAllowFormat)
+	}
+	audit("format", "blank")
+	return nil
+}
+
+// openEncrypted open the mapping that decrypts an encrypted volume, with the key from the NodeStageVolume
+// secrets. A blank volume is formatted with LUKS first, if it may be formatted at all, but anything else
+// that is not LUKS is refused, rather than being used unencrypted or formatted over.
+func (nodeServer *PacketNodeServer) openEncrypted(logger *log.Entry, in *csi.NodeStageVolumeRequest, volumeName string, readOnly bool) error {
+	key := []byte(in.Secrets[secretEncryptionKey])
+	probe, err := nodeServer.Driver.Mounter.ProbeMappedDevice(volumeName)
+	if err != nil {
+		logger.Errorf("probing encrypted device failed, not formatting it, %+v", err)
+		return status.Errorf(codes.Unavailable, "probeMappedDevice error, %+v", err)
+	}
+	formatted := false
+	for _, signature := range probe.Signatures {
+		if signature.Type == "crypto_LUKS" {
+			formatted = true
+		}
+	}
+	switch {
+	case formatted:
+	case probe.Blank():
+		if err := nodeServer.checkFormat(logger, in, probe, readOnly); err != nil {
+			return err
+		}
+		logger.Info("formatting LUKS")
+		if err := nodeServer.Driver.Encryptor.Format(volumeName, key); err != nil {
+			logger.Errorf("LUKS format error, %v", err)
+			return status.Errorf(codes.Unknown, "LUKS format error, %v", err)
+		}
+	default:
+		logger.WithFields(log.Fields{
+			"audit":      "format",
+			"decision":   "refuse",
+			"reason":     "encrypted volume is not LUKS",
+			"signatures": probe.String(),
+		}).Info("format decision")
+		return status.Errorf(codes.FailedPrecondition, "volume %s is to be encrypted, but has %s, refusing to format it", in.VolumeId, probe)
+	}
+
+	logger.Info("opening LUKS mapping")
+	err = nodeServer.Driver.Encryptor.Open(volumeName, cryptMappingName(volumeName), key, readOnly)
+	switch {
+	case luks.IsBadKey(err):
+		return status.Errorf(codes.PermissionDenied, "the %s secret does not open encrypted volume %s", secretEncryptionKey, in.VolumeId)
+	case err != nil:
+		logger.Errorf("LUKS open error, %v", err)
+		return status.Errorf(codes.Unknown, "LUKS open error, %v", err)
+	}
+	return nil
+}
+
 // NodeUnstageVolume ~ iscisadmin, multipath
 func (nodeServer *PacketNodeServer) NodeUnstageVolume(ctx context.Context, in *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 
@@ -179,48 +367,91 @@ func (nodeServer *PacketNodeServer) NodeUnstageVolume(ctx context.Context, in *c
 
 	err := nodeServer.Driver.Mounter.Unmount(in.StagingTargetPath)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "unmounting error, %v", err)
+		return nil, mountStatus(err, "unmounting error")
 	}
 	logger.Infof("Unmounted staging target")
-
+	nodeServer.repairs.remove(volumeName)
+	nodeServer.conditions.remove(in.VolumeId)
+
+	// the request does not say if the volume is encrypted, so any mapping that decrypts it is closed,
+	// which has to happen before the device under it goes away
+	err = nodeServer.Driver.Encryptor.Close(cryptMappingName(volumeName))
+	switch {
+	case luks.IsBusy(err):
+		return nil, status.Errorf(codes.FailedPrecondition, "LUKS mapping of volume %s still is in use, %v", in.VolumeId, err)
+	case err != nil:
+		return nil, status.Errorf(codes.Unknown, "LUKS close error, %v", err)
+	}
+
+	// a volume that is detached from the node already, as when it was detached from the node's device
+	// before it was unstaged, is not in the metadata any more, but its sessions are only logged out of here
+	var target string
+	var portals []string
 	volumeMetaData, err := nodeServer.MetadataDriver.GetVolumeMetadata(volumeName)
-	if err != nil {
+	switch {
+	case packet.IsVolumeNotInMetadata(err):
+		target, portals, err = nodeServer.findSessions(ctx, volumeName)
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "%v", err)
+		}
+		logger.WithFields(log.Fields{"iqn": target, "portals": portals}).Info("volume not attached to node, tearing down the sessions of its WWID")
+	case err != nil:
 		return nil, status.Errorf(codes.Unknown, "metadata access error, %v ", err)
-	}
-
-	if len(volumeMetaData.IPs) == 0 {
+	case len(volumeMetaData.IPs) == 0:
 		return nil, status.Errorf(codes.Unknown, "volume %s has no portals", volumeName)
+	default:
+		target = volumeMetaData.IQN
+		for _, ip := range volumeMetaData.IPs {
+			portals = append(portals, ip.String())
+		}
 	}
 
 	// remove multipath
-	bindings, discards, err := nodeServer.Driver.Attacher.MultipathReadBindings()
-	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "multipath error, %v", err)
-	}
-	delete(bindings, volumeName)
-	err = nodeServer.Driver.Attacher.MultipathWriteBindings(bindings)
-	if err != nil {
+	logger.Info("multipath flush")
+	err = nodeServer.Driver.Multipath.RemoveMap(ctx, volumeName)
+	switch {
+	case multipath.IsFailed(err):
+		return nil, status.Errorf(codes.FailedPrecondition, "multipath map of volume %s cannot be removed, it may still be in use, %v", in.VolumeId, err)
+	case err != nil:
 		return nil, status.Errorf(codes.Unknown, "multipath error, %v", err)
 	}
-	logger.Info("multipath flush")
-	for mappingName := range discards {
-		multipath("-f", mappingName)
+
+	// the disks, sessions and node records of the volume, of which nothing must be left to confuse later stages
+	err = nodeServer.detachVolume(ctx, logger, volumeName, target, portals)
+	switch {
+	case IsLeftover(err):
+		logger.Errorf("%v", err)
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	case err != nil:
+		return nil, status.Errorf(codes.Unknown, "%v", err)
 	}
-	multipath("-f", volumeName)
 
-	for _, ip := range volumeMetaData.IPs {
-		logger.WithFields(log.Fields{"ip": ip, "iqn": volumeMetaData.IQN}).Info("iscsiadmin logout")
-		err = nodeServer.Driver.Attacher.Logout(ip.String(), volumeMetaData.IQN)
-		if err != nil {
-			return nil, status.Errorf(codes.Unknown, "iscsiadminLogout error, %v", err)
-		}
+	// the binding goes last, so that a retry after a failed teardown still finds the WWID of a volume that is
+	// not in the metadata
+	if err := nodeServer.Driver.Bindings.Unbind(volumeName); err != nil {
+		return nil, status.Errorf(codes.Unknown, "multipath bindings error, %v", err)
 	}
 
+	nodeServer.collectBindings()
+
 	logger.Info("NodeUnstageVolume complete")
 	response := &csi.NodeUnstageVolumeResponse{}
 	return response, nil
 }
 
+// collectBindings remove the bindings of volumes that are not attached to the node any more, as when a node
+// crashed before it could unstage them; it only cleans up, so failing is only logged
+func (nodeServer *PacketNodeServer) collectBindings() {
+	collected, err := nodeServer.Driver.Bindings.Collect(nodeServer.MetadataDriver.GetVolumeNames)
+	if err != nil {
+		nodeServer.Driver.Logger.Warnf("unable to collect multipath bindings, %v", err)
+		return
+	}
+	if len(collected) > 0 {
+		nodeServer.Driver.Logger.WithFields(log.Fields{"volumes": collected}).Info("collected multipath bindings of volumes not attached to node")
+	}
+}
+
 // NodePublishVolume ~ mount
 func (nodeServer *PacketNodeServer) NodePublishVolume(ctx context.Context, in *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 
@@ -235,22 +466,84 @@ func (nodeServer *PacketNodeServer) NodePublishVolume(ctx context.Context, in *c
 	if in.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "StagingTargetPath unspecified for NodeStageVolume")
 	}
+	if in.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "VolumeCapability unspecified for NodePublishVolume")
+	}
+	if err := checkVolumeCapability(in.VolumeCapability); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported VolumeCapability for NodePublishVolume, %v", err)
+	}
+
+	// the capability may allow only reading, even if the request does not ask for it
+	readOnly := in.Readonly || isReadOnlyCapability(in.VolumeCapability)
 
 	logger := nodeServer.Driver.Logger.WithFields(log.Fields{
 		"volume_id":           in.VolumeId,
 		"target_path":         in.TargetPath,
 		"staging_target_path": in.StagingTargetPath,
+		"read_only":           readOnly,
 		"method":              "NodePublishVolume",
 	})
 
-	err := nodeServer.Driver.Mounter.Bindmount(in.GetStagingTargetPath(), in.GetTargetPath())
+	// a raw block volume is the mapped device itself, and a filesystem is the staged volume
+	block := isBlockCapability(in.GetVolumeCapability())
+	source := in.GetStagingTargetPath()
+	var mappedDevice string
+	if block {
+		volumeName := in.PublishContext["VolumeName"]
+		if volumeName == "" {
+			return nil, status.Error(codes.InvalidArgument, "VolumeName unspecified for NodePublishVolume")
+		}
+		mappedDevice = mappedDeviceName(volumeName, in.VolumeContext)
+		source = filepath.Join("/dev/mapper", mappedDevice)
+	}
+
+	mode := in.VolumeCapability.GetAccessMode().GetMode()
+	if err := nodeServer.adoptPublications(in.VolumeId, source, mode); err != nil {
+		logger.Errorf("unable to find the publications of the volume, %v", err)
+		return nil, mountStatus(err, "unable to find the publications of the volume")
+	}
+	err := nodeServer.publications.add(in.VolumeId, in.TargetPath, publication{
+		readOnly: readOnly,
+		mode:     mode,
+	})
+	if err != nil {
+		logger.Infof("publication rejected, %v", err)
+		return nil, err
+	}
+
+	// a raw block volume is bound to a file
+	if block {
+		if err := nodeServer.Driver.Mounter.BindmountMappedDevice(mappedDevice, in.GetTargetPath(), readOnly); err != nil {
+			nodeServer.publications.remove(in.VolumeId, in.TargetPath)
+			return nil, mountStatus(err, "bind mount error")
+		}
+		logger.Info("block device bind mount complete")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	err = nodeServer.Driver.Mounter.Bindmount(in.GetStagingTargetPath(), in.GetTargetPath(), readOnly)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "bind mount error, %+v", err)
+		nodeServer.publications.remove(in.VolumeId, in.TargetPath)
+		return nil, mountStatus(err, "bind mount error")
 	}
 	logger.Info("bind mount complete")
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// adoptPublications add the publications of a volume that are mounted but that the tracker does not know, as
+// after a restart of the plugin, so that single writer access modes still are enforced. The mount table has no
+// access modes, so they are taken to be the one asked for, which is the same for every publication of a volume.
+func (nodeServer *PacketNodeServer) adoptPublications(volumeID, source string, mode csi.VolumeCapability_AccessMode_Mode) error {
+	mounts, err := nodeServer.Driver.Mounter.MountsOf(source)
+	if err != nil {
+		return err
+	}
+	for _, info := range mounts {
+		nodeServer.publications.adopt(volumeID, info.MountPoint, publication{readOnly: info.ReadOnly(), mode: mode})
+	}
+	return nil
+}
+
 // NodeUnpublishVolume ~ unmount
 func (nodeServer *PacketNodeServer) NodeUnpublishVolume(ctx context.Context, in *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 
@@ -271,8 +564,13 @@ func (nodeServer *PacketNodeServer) NodeUnpublishVolume(ctx context.Context, in
 
 	err := nodeServer.Driver.Mounter.Unmount(in.GetTargetPath())
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, "unmount error, %+v", err)
+		return nil, mountStatus(err, "unmount error")
 	}
+	// the target path was created when publishing, so it is ours to remove
+	if err := nodeServer.Driver.Mounter.RemoveMountPoint(in.GetTargetPath()); err != nil {
+		return nil, mountStatus(err, "unable to remove target path")
+	}
+	nodeServer.publications.remove(in.VolumeId, in.TargetPath)
 	logger.Info("unmount complete")
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -281,28 +579,37 @@ func (nodeServer *PacketNodeServer) NodeUnpublishVolume(ctx context.Context, in
 // NodeGetVolumeStats gets the usage stats of the volume
 func (nodeServer *PacketNodeServer) NodeGetVolumeStats(ctx context.Context, in *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	nodeServer.Driver.Logger.Info("NodeGetVolumeStats called")
-	// TODO: get info from packet about the usage of this volume
+
+	if in.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumeId unspecified for NodeGetVolumeStats")
+	}
+	if in.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumePath unspecified for NodeGetVolumeStats")
+	}
+
+	usage, err := volumeUsage(in.VolumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s not found", in.VolumePath)
+		}
+		// a volume that cannot even be looked at is reported as such, rather than as a failed call
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume cannot be accessed: %v", err)},
+		}, nil
+	}
 	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{},
+		Usage:           usage,
+		VolumeCondition: nodeServer.conditions.get(in.VolumeId),
 	}, nil
 }
 
 // NodeGetInfo get info for a given node
 func (nodeServer *PacketNodeServer) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	nodeServer.Driver.Logger.Info("NodeGetInfo called")
-	// initialize
-	if !nodeServer.Initialized {
-		initiatorName, err := nodeServer.MetadataDriver.GetInitiator()
-		if err != nil {
-			nodeServer.Driver.Logger.Errorf("NodeGetInfo: metadata error %v", err)
-			return nil, status.Errorf(codes.Unknown, "metadata error, %s", err.Error())
-		}
-		err = nodeServer.Driver.Initializer.NodeInit(initiatorName)
-		if err != nil {
-			nodeServer.Driver.Logger.Errorf("NodeGetInfo: NodeInit error %v", err)
-			return nil, status.Errorf(codes.Unknown, "NodeInit error, %s", err.Error())
-		}
-		nodeServer.Initialized = true
+	// initialize, unless the node already did when it started
+	if err := nodeServer.initialize(); err != nil {
+		nodeServer.Driver.Logger.Errorf("NodeGetInfo: %v", err)
+		return nil, status.Error(codes.Unknown, err.Error())
 	}
 	return &csi.NodeGetInfoResponse{
 		NodeId: nodeServer.Driver.nodeID,
@@ -318,6 +625,10 @@ func (nodeServer *PacketNodeServer) NodeGetCapabilities(ctx context.Context, in
 	// define
 	nsCapabilitySet := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 	}
 	// transform
 	var nsc []*csi.NodeServiceCapability
@@ -336,7 +647,92 @@ func (nodeServer *PacketNodeServer) NodeGetCapabilities(ctx context.Context, in
 	}, nil
 }
 
-// NodeExpandVolume expand a volume
-func (nodeServer *PacketNodeServer) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// NodeExpandVolume grow what the node has of a staged volume to the size of the volume, after it grew: the disk of
+// each of its sessions, then its multipath map, the mapping that decrypts it, if it is encrypted, and the
+// filesystem on top, unless it is a raw block volume
+func (nodeServer *PacketNodeServer) NodeExpandVolume(ctx context.Context, in *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+
+	nodeServer.Driver.Logger.Info("NodeExpandVolume called")
+
+	if in.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumeId unspecified for NodeExpandVolume")
+	}
+	if in.VolumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "VolumePath unspecified for NodeExpandVolume")
+	}
+
+	volumeName := packet.VolumeIDToName(in.VolumeId)
+	logger := nodeServer.Driver.Logger.WithFields(log.Fields{
+		"volume_id":   in.VolumeId,
+		"volume_name": volumeName,
+		"volume_path": in.VolumePath,
+		"method":      "NodeExpandVolume",
+	})
+
+	// a raw block volume is published as its device, not as a directory
+	info, err := os.Stat(in.VolumePath)
+	switch {
+	case os.IsNotExist(err):
+		return nil, status.Errorf(codes.NotFound, "volume path %s not found", in.VolumePath)
+	case err != nil:
+		return nil, status.Errorf(codes.Unknown, "volume path %s cannot be accessed, %v", in.VolumePath, err)
+	}
+	block := !info.IsDir() || isBlockCapability(in.VolumeCapability)
+
+	volumeMetaData, err := nodeServer.MetadataDriver.GetVolumeMetadata(volumeName)
+	switch {
+	case packet.IsVolumeNotInMetadata(err):
+		return nil, status.Errorf(codes.NotFound, "volume %s is not attached to node", in.VolumeId)
+	case err != nil:
+		return nil, status.Errorf(codes.Unknown, "metadata access error, %v ", err)
+	}
+
+	for _, ip := range volumeMetaData.IPs {
+		devices, err := nodeServer.Driver.Attacher.Devices(ctx, ip.String(), volumeMetaData.IQN)
+		if err != nil {
+			return nil, status.Errorf(codes.Unknown, "iscsiadmin session error, %v", err)
+		}
+		for _, device := range devices {
+			logger.WithFields(log.Fields{"ip": ip.String(), "device": device}).Info("rescanning disk")
+			if err := nodeServer.Driver.Attacher.RescanDevice(device); err != nil {
+				return nil, status.Errorf(codes.Unknown, "%v", err)
+			}
+		}
+	}
+	logger.Info("resizing multipath map")
+	if err := nodeServer.Driver.Multipath.ResizeMap(ctx, volumeName); err != nil {
+		return nil, status.Errorf(codes.Unknown, "multipath error, %v", err)
+	}
+
+	// the request does not say if the volume is encrypted, but a staged encrypted volume has its mapping open
+	deviceName := volumeName
+	encrypted, err := nodeServer.Driver.Encryptor.IsOpen(cryptMappingName(volumeName))
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, "LUKS status error, %v", err)
+	}
+	if encrypted {
+		key := in.Secrets[secretEncryptionKey]
+		if key == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "encrypted volume requires the %s secret for NodeExpandVolume", secretEncryptionKey)
+		}
+		logger.Info("resizing LUKS mapping")
+		err := nodeServer.Driver.Encryptor.Resize(cryptMappingName(volumeName), []byte(key))
+		switch {
+		case luks.IsBadKey(err):
+			return nil, status.Errorf(codes.PermissionDenied, "the %s secret does not open encrypted volume %s", secretEncryptionKey, in.VolumeId)
+		case err != nil:
+			return nil, status.Errorf(codes.Unknown, "LUKS resize error, %v", err)
+		}
+		deviceName = cryptMappingName(volumeName)
+	}
+
+	if !block {
+		logger.Info("resizing filesystem")
+		if err := nodeServer.Driver.Mounter.ResizeMappedDevice(deviceName); err != nil {
+			return nil, status.Errorf(codes.Unknown, "resizeMappedDevice error, %v", err)
+		}
+	}
+
+	logger.Info("NodeExpandVolume complete")
+	return &csi.NodeExpandVolumeResponse{}, nil
 }
@@ -1,33 +1,744 @@
 package driver
 
-//
-//  three steps to mocking a single os/exec.Command call
-
-// func TestGetMappedDevice(t *testing.T) {
-// 	execCommand = fakeExecLsblk
-// 	defer func() { execCommand = exec.Command }()
-
-// 	blockInfo, err := getMappedDevice("md126")
-// 	assert.Nil(t, err)
-// 	assert.NotNil(t, blockInfo)
-// 	assert.Equal(t, "md126", blockInfo.Name)
-// 	assert.Equal(t, "ext4", blockInfo.FsType)
-// }
-
-// func TestMockOfLsblk(*testing.T) {
-// 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
-// 		return
-// 	}
-// 	defer os.Exit(0)
-
-// 	lsblkStdout := `{"blockdevices":[{"name":"md126","fstype":"ext4","label":"ROOT","uuid":"afbc32b3-d258-4553-bd1b-4da06768c63f","mountpoint":"/"}]}`
-// 	fmt.Println(lsblkStdout)
-// }
-
-// func fakeExecLsblk(command string, args ...string) *exec.Cmd {
-// 	cs := []string{"-test.run=TestMockOfLsblk", "--", command}
-// 	cs = append(cs, args...)
-// 	cmd := exec.Command(os.Args[0], cs...)
-// 	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
-// 	return cmd
-// }
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/packethost/csi-packet/pkg/blkid"
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/packethost/csi-packet/pkg/iscsi"
+	"github.com/packethost/csi-packet/pkg/multipath"
+	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/packethost/packngo/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckFormat(t *testing.T) {
+	ext4 := blkid.Result{Signatures: []blkid.Signature{{Type: "ext4", Usage: blkid.UsageFilesystem, Offset: 1080}}}
+	xfs := blkid.Result{Signatures: []blkid.Signature{{Type: "xfs", Usage: blkid.UsageFilesystem}}}
+	luks := blkid.Result{Signatures: []blkid.Signature{{Type: "crypto_LUKS", Usage: blkid.UsageCrypto}}}
+	gpt := blkid.Result{Signatures: []blkid.Signature{{Type: "gpt", Usage: blkid.UsagePartitionTable, Offset: 512}}}
+	blank := blkid.Result{}
+	adopted := map[string]string{volumeContextAdopted: "true"}
+	allowed := map[string]string{volumeContextAllowFormat: "true"}
+
+	tests := []struct {
+		description    string
+		probe          blkid.Result
+		volumeContext  map[string]string
+		sharedReadOnly bool
+		requireOptIn   bool
+		code           codes.Code
+	}{
+		{"filesystem", ext4, nil, false, false, codes.OK},
+		{"filesystem, read-only", ext4, nil, true, true, codes.OK},
+		{"unsupported filesystem", xfs, nil, false, false, codes.FailedPrecondition},
+		{"encrypted", luks, allowed, false, false, codes.FailedPrecondition},
+		{"partitioned", gpt, allowed, false, false, codes.FailedPrecondition},
+		{"blank", blank, nil, false, false, codes.OK},
+		{"blank, adopted", blank, adopted, false, false, codes.FailedPrecondition},
+		{"blank, read-only", blank, nil, true, false, codes.FailedPrecondition},
+		{"blank, opt-in required", blank, nil, false, true, codes.FailedPrecondition},
+		{"blank, opted in", blank, allowed, false, true, codes.OK},
+	}
+	for _, tt := range tests {
+		nodeServer := &PacketNodeServer{Driver: &PacketDriver{RequireFormatOptIn: tt.requireOptIn}}
+		in := &csi.NodeStageVolumeRequest{VolumeId: "volume-id", VolumeContext: tt.volumeContext}
+		err := nodeServer.checkFormat(log.WithFields(log.Fields{}), in, tt.probe, tt.sharedReadOnly)
+		assert.Equal(t, tt.code, status.Code(err), tt.description)
+	}
+}
+
+// probeMounter a mounter whose mapped devices have the given signatures
+type probeMounter struct {
+	MounterMock
+	probes map[string]blkid.Result
+}
+
+func (m *probeMounter) ProbeMappedDevice(device string) (blkid.Result, error) {
+	return m.probes[device], nil
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	luks := blkid.Result{Signatures: []blkid.Signature{{Type: "crypto_LUKS", Usage: blkid.UsageCrypto}}}
+	ext4 := blkid.Result{Signatures: []blkid.Signature{{Type: "ext4", Usage: blkid.UsageFilesystem, Offset: 1080}}}
+	blank := blkid.Result{}
+
+	tests := []struct {
+		description   string
+		probe         blkid.Result
+		volumeContext map[string]string
+		formatted     []string
+		code          codes.Code
+	}{
+		{"already formatted", luks, nil, nil, codes.OK},
+		{"blank", blank, nil, []string{"volume-name"}, codes.OK},
+		{"blank, adopted", blank, map[string]string{volumeContextAdopted: "true"}, nil, codes.FailedPrecondition},
+		{"unencrypted filesystem", ext4, nil, nil, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		encryptor := &EncryptorMock{mappings: map[string]string{}}
+		nodeServer := &PacketNodeServer{Driver: &PacketDriver{
+			Mounter:   &probeMounter{probes: map[string]blkid.Result{"volume-name": tt.probe}},
+			Encryptor: encryptor,
+		}}
+		in := &csi.NodeStageVolumeRequest{
+			VolumeId:      "volume-id",
+			VolumeContext: tt.volumeContext,
+			Secrets:       map[string]string{secretEncryptionKey: "passphrase"},
+		}
+		err := nodeServer.openEncrypted(log.WithFields(log.Fields{}), in, "volume-name", false)
+		assert.Equal(t, tt.code, status.Code(err), tt.description)
+		assert.Equal(t, tt.formatted, encryptor.formatted, tt.description)
+		if tt.code == codes.OK {
+			assert.Equal(t, map[string]string{"volume-name-crypt": "volume-name"}, encryptor.mappings, tt.description)
+		} else {
+			assert.Empty(t, encryptor.mappings, tt.description)
+		}
+	}
+}
+
+func TestMappedDeviceName(t *testing.T) {
+	assert.Equal(t, "volume-name", mappedDeviceName("volume-name", nil))
+	assert.Equal(t, "volume-name-crypt", mappedDeviceName("volume-name", map[string]string{volumeContextEncrypted: "true"}))
+}
+
+const (
+	testVolumeName = "volume-3ee59355"
+	testVolumeID   = "3ee59355-a51a-42a8-b848-86626cc532f0"
+	testScsiID     = "36001405b06f15a423fec58b000000001"
+)
+
+// metadataServer serve the metadata of this node, with the volumes attached to it
+func metadataServer(t *testing.T, volumes ...metadata.VolumeInfo) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		device := metadata.CurrentDevice{ID: "node-id", IQN: "iqn.2014-05.net.packet:device.7c8d0ba0", Volumes: volumes}
+		if err := json.NewEncoder(w).Encode(&device); err != nil {
+			t.Fatal(err)
+		}
+	}))
+}
+
+// testNodeServer a node server that runs commands with an executor, on files in memory, for a volume attached
+// to the node at two portals
+func testNodeServer(t *testing.T, exec executor.Executor, fs *memFS, attached bool) (*PacketNodeServer, *MounterMock, *MultipathMock, func()) {
+	var volumes []metadata.VolumeInfo
+	if attached {
+		volumes = []metadata.VolumeInfo{{Name: testVolumeName, IQN: testTarget, IPs: []net.IP{net.ParseIP(testPortal), net.ParseIP("10.144.145.66")}}}
+	}
+	server := metadataServer(t, volumes...)
+	mounter := &MounterMock{bindmounts: map[string]string{}, blockmounts: map[string]string{}}
+	mpath := &MultipathMock{maps: map[string]string{"mpatha": "36001405aaaa", "mpathb": testScsiID}, busy: map[string]bool{}}
+	driver := &PacketDriver{
+		Logger:      log.WithFields(log.Fields{}),
+		Attacher:    &AttacherImpl{Exec: exec, FS: fs},
+		Mounter:     mounter,
+		Initializer: &InitializerMock{},
+		Encryptor:   &EncryptorMock{mappings: map[string]string{}},
+		Multipath:   mpath,
+		Bindings:    &BindingsImpl{FS: fs},
+	}
+	nodeServer, err := NewPacketNodeServer(driver, &packet.MetadataDriver{BaseURL: &server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nodeServer, mounter, mpath, server.Close
+}
+
+// testdataFile the contents of a file in testdata
+func testdataFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// fakeIscsiadm the iscsiadm of a node that logs in to and out of the target of the volume at its portals, which
+// any number of them may do at once, and which lists the sessions as in testdata/iscsiadm/session.txt
+type fakeIscsiadm struct {
+	t    *testing.T
+	lock sync.Mutex
+	// sessions the portals that have a session with the target
+	sessions map[string]bool
+	// down the portals that cannot be reached
+	down map[string]bool
+	// denied the portals that refuse the credentials of the login
+	denied map[string]bool
+	// nodes the portals that have a node record of the target, which discovery creates
+	nodes map[string]bool
+	// discoveries the portals that have a discovery record, which discovery creates too
+	discoveries map[string]bool
+	// stuck the portals whose sessions are not logged out of, though logging out seems to succeed
+	stuck map[string]bool
+}
+
+func newFakeIscsiadm(t *testing.T) *fakeIscsiadm {
+	return &fakeIscsiadm{t: t, sessions: map[string]bool{}, down: map[string]bool{}, denied: map[string]bool{}, nodes: map[string]bool{}, discoveries: map[string]bool{}, stuck: map[string]bool{}}
+}
+
+// Run run one of the iscsiadm commands that attach and detach the volume
+func (f *fakeIscsiadm) Run(ctx context.Context, stdin []byte, command string, args ...string) (executor.Result, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	call := strings.Join(append([]string{command}, args...), " ")
+	var portal string
+	if len(args) > 5 && args[4] == "--portal" {
+		portal = args[5]
+	}
+	switch {
+	case call == "iscsiadm --mode iface":
+		return executor.Result{Stdout: []byte(testdataFile(f.t, "iscsiadm/iface-show-kubernetescsi0.txt"))}, nil
+	case call == "iscsiadm --mode session -P 3":
+		return f.sessionList(), nil
+	case call == "iscsiadm -I kubernetescsi0 --mode discovery --portal "+portal+" --type sendtargets --discover":
+		if f.down[portal] {
+			return executor.Result{Stderr: []byte("iscsiadm: cannot make connection to " + portal + ": No route to host\n"), ExitCode: iscsi.ExitTransport}, nil
+		}
+		f.nodes[portal] = true
+		f.discoveries[portal] = true
+		return executor.Result{Stdout: []byte(testdataFile(f.t, "iscsiadm/discovery.txt"))}, nil
+	case call == "iscsiadm -I kubernetescsi0 --mode node --portal "+portal+" --targetname "+testTarget+" --login":
+		if f.denied[portal] {
+			return executor.Result{Stderr: []byte("iscsiadm: Login failed to authenticate with target\n"), ExitCode: iscsi.ExitLoginAuthFailed}, nil
+		}
+		f.sessions[portal] = true
+		return executor.Result{Stdout: []byte(testdataFile(f.t, "iscsiadm/login.txt"))}, nil
+	case call == "iscsiadm -I kubernetescsi0 --mode node --portal "+portal+" --targetname "+testTarget+" --logout":
+		if !f.stuck[portal] {
+			delete(f.sessions, portal)
+		}
+		return executor.Result{}, nil
+	case call == "iscsiadm --mode node":
+		var list strings.Builder
+		for portal := range f.nodes {
+			fmt.Fprintf(&list, "%s:3260,1 %s\n", portal, testTarget)
+		}
+		if list.Len() == 0 {
+			return executor.Result{Stderr: []byte("iscsiadm: No records found\n"), ExitCode: iscsi.ExitNoObjectsFound}, nil
+		}
+		return executor.Result{Stdout: []byte(list.String())}, nil
+	case call == "iscsiadm -I kubernetescsi0 --mode node --portal "+portal+" --targetname "+testTarget+" -o delete":
+		if !f.nodes[portal] {
+			return executor.Result{Stderr: []byte("iscsiadm: No records found\n"), ExitCode: iscsi.ExitNoObjectsFound}, nil
+		}
+		delete(f.nodes, portal)
+		return executor.Result{}, nil
+	case call == "iscsiadm -I kubernetescsi0 --mode discoverydb --portal "+portal+" --type sendtargets -o delete":
+		if !f.discoveries[portal] {
+			return executor.Result{Stderr: []byte("iscsiadm: No records found\n"), ExitCode: iscsi.ExitNoObjectsFound}, nil
+		}
+		// the node records that were discovered go with it
+		delete(f.discoveries, portal)
+		delete(f.nodes, portal)
+		return executor.Result{}, nil
+	}
+	f.t.Errorf("unexpected command %s", call)
+	return executor.Result{ExitCode: iscsi.ExitGeneric}, nil
+}
+
+// sessionList the sessions with the target at the portals that were logged in to, each of them as
+// testdata/iscsiadm/session.txt lists it
+func (f *fakeIscsiadm) sessionList() executor.Result {
+	if len(f.sessions) == 0 {
+		return executor.Result{Stderr: []byte("iscsiadm: No active sessions.\n"), ExitCode: iscsi.ExitNoObjectsFound}
+	}
+	var list strings.Builder
+	// the header is kept, and so is the target, as long as any of its portals is
+	target, keep := false, true
+	for _, line := range strings.SplitAfter(testdataFile(f.t, "iscsiadm/session.txt"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "Target: "):
+			target = strings.HasPrefix(line, "Target: "+testTarget+" ")
+			keep = target
+		case strings.HasPrefix(line, "\tCurrent Portal: "):
+			address := strings.TrimPrefix(line, "\tCurrent Portal: ")
+			keep = target && f.sessions[address[:strings.LastIndex(address, ":")]]
+		}
+		if keep {
+			list.WriteString(line)
+		}
+	}
+	return executor.Result{Stdout: []byte(list.String())}
+}
+
+func stageRequest() *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          testVolumeID,
+		PublishContext:    map[string]string{"VolumeName": testVolumeName},
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+}
+
+// testBindings the multipath bindings of a node with a map that multipath named itself, another of the volume
+// that it named itself before the volume was bound, and that of another volume, which is not attached any more
+const testBindings = multipath.BindingsHeader + "mpatha 36001405aaaa\nmpathb " + testScsiID + "\nvolume-other 36001405bbbb\n"
+
+// testVPD the device identification VPD page of a disk of a WWID that is an NAA
+func testVPD(t *testing.T, wwid string) []byte {
+	naa, err := hex.DecodeString(strings.TrimPrefix(wwid, "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	designator := append([]byte{1, 3, 0, byte(len(naa))}, naa...)
+	return append([]byte{0, 0x83, 0, byte(len(designator))}, designator...)
+}
+
+// addDisk add the disk that a session attaches, as sysfs lists it, with its WWID
+func addDisk(t *testing.T, fs *memFS, sid, host int, disk, wwid string) {
+	fs.files[fmt.Sprintf("/sys/class/iscsi_session/session%d/device/target%d:0:0/%d:0:0:0/block/%s", sid, host, host, disk)] = nil
+	fs.files["/sys/block/"+disk+"/device/vpd_pg83"] = testVPD(t, wwid)
+	fs.files["/dev/"+disk] = []byte{}
+}
+
+// attachedFS the files of a node with the volume's disk at each of its portals, as in testdata/iscsiadm/session.txt,
+// and its multipath bindings
+func attachedFS(t *testing.T) *memFS {
+	fs := newMemFS()
+	addDisk(t, fs, 1, 2, "sdb", testScsiID)
+	addDisk(t, fs, 2, 3, "sdc", testScsiID)
+	fs.files[multipathBindings] = []byte(testBindings)
+	return fs
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	iscsiadm := newFakeIscsiadm(t)
+	fs := attachedFS(t)
+	nodeServer, mounter, mpath, done := testNodeServer(t, iscsiadm, fs, true)
+	defer done()
+
+	in := stageRequest()
+	_, err := nodeServer.NodeStageVolume(context.Background(), in)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{testPortal: true, "10.144.145.66": true}, iscsiadm.sessions)
+	// the volume is bound by its name, in place of the name that multipath gave it, and everything else is kept
+	assert.Equal(t, multipath.BindingsHeader+"mpatha 36001405aaaa\nvolume-other 36001405bbbb\n"+testVolumeName+" "+testScsiID+"\n", string(fs.files[multipathBindings]))
+	assert.Equal(t, map[string]string{"mpatha": "36001405aaaa", testVolumeName: testScsiID}, mpath.maps)
+	assert.Equal(t, map[string]string{in.StagingTargetPath: testVolumeName}, mounter.blockmounts)
+	assert.False(t, nodeServer.conditions.get(in.VolumeId).Abnormal)
+	assert.Empty(t, nodeServer.repairs.list())
+}
+
+func TestNodeStageVolumeStaged(t *testing.T) {
+	nodeServer, mounter, _, done := testNodeServer(t, newFakeIscsiadm(t), attachedFS(t), true)
+	defer done()
+
+	in := stageRequest()
+	_, err := nodeServer.NodeStageVolume(context.Background(), in)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testVolumeName}, mounter.probed)
+	assert.Equal(t, []string{testVolumeName}, mounter.checked)
+
+	// the volume is in use once it is mounted, so staging it again does not probe or check it
+	_, err = nodeServer.NodeStageVolume(context.Background(), in)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testVolumeName}, mounter.probed)
+	assert.Equal(t, []string{testVolumeName}, mounter.checked)
+	assert.Equal(t, map[string]string{in.StagingTargetPath: testVolumeName}, mounter.blockmounts)
+
+	// anything else mounted at the staging path is not ours
+	mounter.blockmounts[in.StagingTargetPath] = "volume-other"
+	_, err = nodeServer.NodeStageVolume(context.Background(), in)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	assert.Equal(t, []string{testVolumeName}, mounter.probed)
+}
+
+func TestNodeStageVolumeMultipath(t *testing.T) {
+	tests := []struct {
+		description string
+		maps        map[string]string
+		active      int
+		code        codes.Code
+	}{
+		{"a map of another device has the name of the volume", map[string]string{testVolumeName: "36001405bbbb"}, 0, codes.FailedPrecondition},
+		{"only one of the two paths is active", map[string]string{}, 1, codes.Unavailable},
+	}
+	for _, tt := range tests {
+		nodeServer, mounter, mpath, done := testNodeServer(t, newFakeIscsiadm(t), attachedFS(t), true)
+		mpath.maps = tt.maps
+		mpath.active = tt.active
+
+		_, err := nodeServer.NodeStageVolume(context.Background(), stageRequest())
+		assert.Equal(t, tt.code, status.Code(err), tt.description)
+		assert.Empty(t, mounter.blockmounts, tt.description)
+		done()
+	}
+}
+
+func TestNodeStageVolumeDegraded(t *testing.T) {
+	// the second portal cannot be reached, and the volume is staged with the path of the first
+	iscsiadm := newFakeIscsiadm(t)
+	iscsiadm.down["10.144.145.66"] = true
+	nodeServer, mounter, mpath, done := testNodeServer(t, iscsiadm, attachedFS(t), true)
+	defer done()
+	// the map must have the one path that is up, not both
+	mpath.active = 1
+
+	in := stageRequest()
+	_, err := nodeServer.NodeStageVolume(context.Background(), in)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{testPortal: true}, iscsiadm.sessions)
+	assert.Equal(t, testScsiID, mpath.maps[testVolumeName])
+	assert.Equal(t, map[string]string{in.StagingTargetPath: testVolumeName}, mounter.blockmounts)
+	condition := nodeServer.conditions.get(in.VolumeId)
+	assert.True(t, condition.Abnormal)
+	assert.Contains(t, condition.Message, "1 of 2 paths are up")
+	assert.Contains(t, condition.Message, "10.144.145.66")
+	assert.Contains(t, nodeServer.repairs.list(), testVolumeName)
+
+	// once the portal is back, the missing path is repaired
+	iscsiadm.down["10.144.145.66"] = false
+	mpath.active = 0
+	nodeServer.repairPaths(context.Background())
+	assert.Equal(t, map[string]bool{testPortal: true, "10.144.145.66": true}, iscsiadm.sessions)
+	assert.False(t, nodeServer.conditions.get(in.VolumeId).Abnormal)
+	assert.Empty(t, nodeServer.repairs.list())
+}
+
+func TestRepairPathsStillDown(t *testing.T) {
+	iscsiadm := newFakeIscsiadm(t)
+	iscsiadm.sessions[testPortal] = true
+	iscsiadm.down["10.144.145.66"] = true
+	nodeServer, _, _, done := testNodeServer(t, iscsiadm, attachedFS(t), true)
+	defer done()
+	nodeServer.repairs.add(testVolumeName, degradedVolume{name: testVolumeName, target: testTarget, wwid: testScsiID})
+	nodeServer.conditions.setDegraded(testVolumeName, "1 of 2 paths are up")
+
+	// the portal that has a session is left alone, and the volume stays degraded for the other
+	nodeServer.repairPaths(context.Background())
+	assert.Equal(t, map[string]bool{testPortal: true}, iscsiadm.sessions)
+	condition := nodeServer.conditions.get(testVolumeID)
+	assert.True(t, condition.Abnormal)
+	assert.Contains(t, condition.Message, "iscsiadmin discover error at 10.144.145.66")
+	assert.Contains(t, nodeServer.repairs.list(), testVolumeName)
+
+	// an unstaged volume is not repaired any more
+	nodeServer.repairs.remove(testVolumeName)
+	iscsiadm.down["10.144.145.66"] = false
+	nodeServer.repairPaths(context.Background())
+	assert.Equal(t, map[string]bool{testPortal: true}, iscsiadm.sessions)
+}
+
+func TestRepairPathsUnstagedMeanwhile(t *testing.T) {
+	// the volume was unstaged while its missing path was repaired, after the binding was removed, so the
+	// map that the repair added again is named by multipath, and must go before the new path does
+	volume := degradedVolume{name: testVolumeName, target: testTarget, wwid: testScsiID}
+	for _, busy := range []bool{false, true} {
+		iscsiadm := newFakeIscsiadm(t)
+		iscsiadm.sessions[testPortal] = true
+		nodeServer, _, mpath, done := testNodeServer(t, iscsiadm, attachedFS(t), true)
+		mpath.busy["mpathb"] = busy
+
+		assert.Nil(t, nodeServer.repairVolume(context.Background(), nodeServer.Driver.Logger, volume))
+		assert.Equal(t, "36001405aaaa", mpath.maps["mpatha"])
+		assert.True(t, iscsiadm.sessions[testPortal])
+		if busy {
+			// the paths of a map that cannot be removed are kept
+			assert.Contains(t, mpath.maps, "mpathb")
+			assert.True(t, iscsiadm.sessions["10.144.145.66"])
+		} else {
+			assert.NotContains(t, mpath.maps, "mpathb")
+			assert.NotContains(t, mpath.maps, testVolumeName)
+			assert.False(t, iscsiadm.sessions["10.144.145.66"])
+		}
+		done()
+	}
+}
+
+func TestSeedRepairs(t *testing.T) {
+	// the driver restarted while a volume that is staged was missing a path
+	iscsiadm := newFakeIscsiadm(t)
+	iscsiadm.sessions[testPortal] = true
+	iscsiadm.down["10.144.145.66"] = true
+	nodeServer, _, mpath, done := testNodeServer(t, iscsiadm, attachedFS(t), true)
+	defer done()
+	mpath.maps = map[string]string{testVolumeName: testScsiID, "volume-other": "36001405bbbb", "mpatha": "36001405aaaa"}
+
+	nodeServer.seedRepairs(context.Background())
+	// the map of a volume that is not attached any more is not
+	assert.Equal(t, map[string]degradedVolume{testVolumeName: {name: testVolumeName, target: testTarget, wwid: testScsiID}}, nodeServer.repairs.list())
+	condition := nodeServer.conditions.get(testVolumeID)
+	assert.True(t, condition.Abnormal)
+	assert.Contains(t, condition.Message, "1 of 2 paths are up, no session at 10.144.145.66")
+
+	iscsiadm.down["10.144.145.66"] = false
+	nodeServer.repairPaths(context.Background())
+	assert.Equal(t, map[string]bool{testPortal: true, "10.144.145.66": true}, iscsiadm.sessions)
+	assert.False(t, nodeServer.conditions.get(testVolumeID).Abnormal)
+	assert.Empty(t, nodeServer.repairs.list())
+
+	// a volume that has all of its paths is not
+	nodeServer.seedRepairs(context.Background())
+	assert.Empty(t, nodeServer.repairs.list())
+}
+
+func TestNodeStageVolumeLoginError(t *testing.T) {
+	// the volume is not staged if no path is up
+	iscsiadm := newFakeIscsiadm(t)
+	iscsiadm.denied[testPortal] = true
+	iscsiadm.denied["10.144.145.66"] = true
+	nodeServer, mounter, _, done := testNodeServer(t, iscsiadm, attachedFS(t), true)
+	defer done()
+
+	_, err := nodeServer.NodeStageVolume(context.Background(), stageRequest())
+	assert.Equal(t, codes.Unknown, status.Code(err))
+	assert.Contains(t, err.Error(), "login authentication failed")
+	assert.Empty(t, iscsiadm.sessions)
+	assert.Empty(t, mounter.blockmounts)
+	assert.Empty(t, nodeServer.repairs.list())
+}
+
+func TestNodeStageVolumeNoDevice(t *testing.T) {
+	iscsiadm := newFakeIscsiadm(t)
+	nodeServer, _, _, done := testNodeServer(t, iscsiadm, newMemFS(), true)
+	defer done()
+
+	// the disk never appears, and staging waits for it only as long as the request may take
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := nodeServer.NodeStageVolume(ctx, stageRequest())
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), "devicePath error")
+}
+
+func TestNodeStageVolumeOtherDisk(t *testing.T) {
+	// the disk at the second portal is of another volume
+	fs := attachedFS(t)
+	addDisk(t, fs, 2, 3, "sdc", "36001405bbbbbbbbbbbbbbbbbbbbbbbbb")
+	nodeServer, mounter, _, done := testNodeServer(t, newFakeIscsiadm(t), fs, true)
+	defer done()
+
+	_, err := nodeServer.NodeStageVolume(context.Background(), stageRequest())
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "36001405bbbbbbbbbbbbbbbbbbbbbbbbb")
+	assert.Empty(t, mounter.blockmounts)
+}
+
+// attachedIscsiadm the iscsiadm of a node that has logged in to the volume at both of its portals
+func attachedIscsiadm(t *testing.T) *fakeIscsiadm {
+	iscsiadm := newFakeIscsiadm(t)
+	for _, portal := range []string{testPortal, "10.144.145.66"} {
+		iscsiadm.sessions[portal] = true
+		iscsiadm.nodes[portal] = true
+		iscsiadm.discoveries[portal] = true
+	}
+	return iscsiadm
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	iscsiadm := attachedIscsiadm(t)
+	fs := attachedFS(t)
+	fs.files[multipathBindings] = append(fs.files[multipathBindings], []byte(testVolumeName+" "+testScsiID+"\n")...)
+	nodeServer, mounter, mpath, done := testNodeServer(t, iscsiadm, fs, true)
+	defer done()
+	mounter.blockmounts["/staging"] = testVolumeName
+	mpath.maps[testVolumeName] = testScsiID
+
+	_, err := nodeServer.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: "/staging"})
+	assert.Nil(t, err)
+	assert.Empty(t, mounter.blockmounts)
+	assert.NotContains(t, mpath.maps, testVolumeName)
+	// the disks, sessions, node records and discovery records of the volume are all gone
+	for _, disk := range []string{"sdb", "sdc"} {
+		assert.NotContains(t, fs.files, "/dev/"+disk)
+		assert.NotContains(t, fs.files, "/sys/block/"+disk+"/device/vpd_pg83")
+	}
+	assert.Empty(t, iscsiadm.sessions)
+	assert.Empty(t, iscsiadm.nodes)
+	assert.Empty(t, iscsiadm.discoveries)
+	// the binding of the volume is removed, and so is that of the volume that is not attached any more
+	assert.Equal(t, multipath.BindingsHeader+"mpatha 36001405aaaa\nmpathb "+testScsiID+"\n", string(fs.files[multipathBindings]))
+}
+
+func TestNodeUnstageVolumeLeftover(t *testing.T) {
+	// the session at the second portal stays, though logging out of it seemed to work
+	iscsiadm := attachedIscsiadm(t)
+	iscsiadm.stuck["10.144.145.66"] = true
+	nodeServer, _, mpath, done := testNodeServer(t, iscsiadm, attachedFS(t), true)
+	defer done()
+	mpath.maps[testVolumeName] = testScsiID
+
+	_, err := nodeServer.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: "/staging"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Contains(t, err.Error(), "session at 10.144.145.66")
+	assert.NotContains(t, err.Error(), testPortal)
+	// the discovery record of a portal with a session is kept, since it would take the node record with it
+	assert.Equal(t, map[string]bool{"10.144.145.66": true}, iscsiadm.discoveries)
+}
+
+func TestNodeUnstageVolumeMapBusy(t *testing.T) {
+	// the sessions and the binding are kept while the map is in use
+	fs := attachedFS(t)
+	fs.files[multipathBindings] = append(fs.files[multipathBindings], []byte(testVolumeName+" "+testScsiID+"\n")...)
+	nodeServer, _, mpath, done := testNodeServer(t, executor.NewScript(), fs, true)
+	defer done()
+	mpath.maps[testVolumeName] = testScsiID
+	mpath.busy[testVolumeName] = true
+
+	_, err := nodeServer.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: "/staging"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "may still be in use")
+	assert.Contains(t, string(fs.files[multipathBindings]), testVolumeName)
+}
+
+func TestNodeStageVolumeDiscardBusy(t *testing.T) {
+	// the map of the volume cannot get its name while multipath's own name for it is in use
+	nodeServer, mounter, mpath, done := testNodeServer(t, newFakeIscsiadm(t), attachedFS(t), true)
+	defer done()
+	mpath.busy["mpathb"] = true
+
+	_, err := nodeServer.NodeStageVolume(context.Background(), stageRequest())
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "mpathb")
+	assert.Empty(t, mounter.blockmounts)
+}
+
+func TestNodeUnstageVolumeNotAttached(t *testing.T) {
+	// a volume that is not attached any more and has no sessions left has its multipath map flushed all the same
+	iscsiadm := newFakeIscsiadm(t)
+	nodeServer, _, mpath, done := testNodeServer(t, iscsiadm, attachedFS(t), false)
+	defer done()
+	mpath.maps[testVolumeName] = testScsiID
+
+	_, err := nodeServer.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: "/staging"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{testVolumeName}, mpath.removed)
+}
+
+func TestNodeUnstageVolumeDetachedMeanwhile(t *testing.T) {
+	// a volume that was detached from the device before it was unstaged still has its sessions, which are found
+	// by the WWID of its map, or of its binding once a failed unstage removed the map
+	for _, mapped := range []bool{true, false} {
+		iscsiadm := attachedIscsiadm(t)
+		fs := attachedFS(t)
+		fs.files[multipathBindings] = append(fs.files[multipathBindings], []byte(testVolumeName+" "+testScsiID+"\n")...)
+		nodeServer, _, mpath, done := testNodeServer(t, iscsiadm, fs, false)
+		if mapped {
+			mpath.maps[testVolumeName] = testScsiID
+		}
+
+		_, err := nodeServer.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: "/staging"})
+		assert.Nil(t, err)
+		assert.Empty(t, iscsiadm.sessions)
+		assert.Empty(t, iscsiadm.nodes)
+		assert.Empty(t, iscsiadm.discoveries)
+		assert.NotContains(t, string(fs.files[multipathBindings]), testVolumeName)
+		done()
+	}
+}
+
+func TestNodeUnstageVolumeDetachedMeanwhileLeftover(t *testing.T) {
+	// the binding is kept while sessions of the volume are left, so that a retry finds them again
+	iscsiadm := attachedIscsiadm(t)
+	iscsiadm.stuck["10.144.145.66"] = true
+	fs := attachedFS(t)
+	fs.files[multipathBindings] = append(fs.files[multipathBindings], []byte(testVolumeName+" "+testScsiID+"\n")...)
+	nodeServer, _, mpath, done := testNodeServer(t, iscsiadm, fs, false)
+	defer done()
+	mpath.maps[testVolumeName] = testScsiID
+
+	_, err := nodeServer.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: testVolumeID, StagingTargetPath: "/staging"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Contains(t, err.Error(), "session at 10.144.145.66")
+	assert.Contains(t, string(fs.files[multipathBindings]), testVolumeName)
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "expand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	block := filepath.Join(dir, "block")
+	if err := ioutil.WriteFile(block, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		path        string
+		encrypted   bool
+		secrets     map[string]string
+		resizedFS   []string
+		code        codes.Code
+	}{
+		{"filesystem", dir, false, nil, []string{testVolumeName}, codes.OK},
+		{"encrypted filesystem", dir, true, map[string]string{secretEncryptionKey: "passphrase"}, []string{testVolumeName + "-crypt"}, codes.OK},
+		{"encrypted without key", dir, true, nil, nil, codes.InvalidArgument},
+		{"raw block", block, false, nil, nil, codes.OK},
+		{"not published", filepath.Join(dir, "missing"), false, nil, nil, codes.NotFound},
+	}
+	for _, tt := range tests {
+		fs := attachedFS(t)
+		nodeServer, mounter, mpath, done := testNodeServer(t, attachedIscsiadm(t), fs, true)
+		encryptor := nodeServer.Driver.Encryptor.(*EncryptorMock)
+		if tt.encrypted {
+			encryptor.mappings[testVolumeName+"-crypt"] = testVolumeName
+		}
+
+		_, err := nodeServer.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{VolumeId: testVolumeID, VolumePath: tt.path, Secrets: tt.secrets})
+		assert.Equal(t, tt.code, status.Code(err), tt.description)
+		assert.Equal(t, tt.resizedFS, mounter.resized, tt.description)
+		if tt.code == codes.OK {
+			// the disks at both portals, and then the map and the LUKS mapping on top of them, learn the new size
+			assert.Equal(t, []byte("1"), fs.files["/sys/block/sdb/device/rescan"], tt.description)
+			assert.Equal(t, []byte("1"), fs.files["/sys/block/sdc/device/rescan"], tt.description)
+			assert.Equal(t, []string{testVolumeName}, mpath.resized, tt.description)
+		}
+		if tt.encrypted && tt.code == codes.OK {
+			assert.Equal(t, []string{testVolumeName + "-crypt"}, encryptor.resized, tt.description)
+		}
+		done()
+	}
+}
+
+func TestNodePublishVolumeAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	nodeServer, mounter, _, done := testNodeServer(t, executor.NewScript(), newMemFS(), true)
+	defer done()
+
+	publish := func(target string) error {
+		_, err := nodeServer.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          testVolumeID,
+			PublishContext:    map[string]string{"VolumeName": testVolumeName},
+			StagingTargetPath: "/staging",
+			TargetPath:        filepath.Join(dir, target),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER},
+			},
+		})
+		return err
+	}
+	assert.Nil(t, publish("a"))
+
+	// the publications of the plugin before it restarted are found in the mount table
+	nodeServer.publications = newPublicationTracker()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(publish("b")))
+	assert.Nil(t, publish("a"))
+	assert.Equal(t, map[string]string{filepath.Join(dir, "a"): "/staging"}, mounter.bindmounts)
+}
@@ -0,0 +1,228 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/packethost/packngo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StorageClass parameters understood by CreateVolume
+const (
+	parameterPlan              = "plan"
+	parameterBillingCycle      = "billingCycle"
+	parameterSnapshotFrequency = "snapshotFrequency"
+	parameterSnapshotCount     = "snapshotCount"
+	parameterLocked            = "locked"
+	parameterUnlockOnDelete    = "unlockOnDelete"
+	parameterAllowFormat       = "allowFormat"
+	parameterFsck              = "fsck"
+	parameterFsckFullMaxSize   = "fsckFullMaxSize"
+	parameterEncrypted         = "encrypted"
+)
+
+// secrets understood by NodeStageVolume
+const (
+	// secretEncryptionKey the key, or passphrase, of an encrypted volume
+	secretEncryptionKey = "encryptionKey"
+)
+
+// parameters added by the external-provisioner when run with --extra-create-metadata
+const (
+	parameterPVCName      = "csi.storage.k8s.io/pvc/name"
+	parameterPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	parameterPVName       = "csi.storage.k8s.io/pv/name"
+)
+
+// keys of the metadata about a volume returned in its VolumeContext
+const (
+	volumeContextPVCName      = DriverName + "/pvc-name"
+	volumeContextPVCNamespace = DriverName + "/pvc-namespace"
+	volumeContextPVName       = DriverName + "/pv-name"
+	// volumeContextAdopted set on volumes that were created outside of the driver
+	volumeContextAdopted = DriverName + "/adopted"
+	// volumeContextAllowFormat set on volumes whose StorageClass allows formatting them, for nodes that require it
+	volumeContextAllowFormat = DriverName + "/allow-format"
+	// volumeContextFsck how to check the filesystem of a volume before mounting it, see fsckPolicy
+	volumeContextFsck = DriverName + "/fsck"
+	// volumeContextFsckFullMaxSize the size in GiB up to which a volume is checked fully, when the policy is full
+	volumeContextFsckFullMaxSize = DriverName + "/fsck-full-max-size"
+	// volumeContextEncrypted set on volumes that are encrypted with LUKS on the nodes
+	volumeContextEncrypted = DriverName + "/encrypted"
+)
+
+// parameterValidator checks a single parameter value, returning a description of the problem if it is invalid
+type parameterValidator func(value string) error
+
+// volumeParameterSchema every parameter CreateVolume accepts, and how to validate it; anything else is rejected
+var volumeParameterSchema = map[string]parameterValidator{
+	parameterPlan:              validateNotEmpty,
+	parameterBillingCycle:      validateOneOf(packet.BillingHourly, packet.BillingMonthly),
+	parameterSnapshotFrequency: validateOneOf(packet.SnapshotFrequencies...),
+	parameterSnapshotCount:     validatePositiveInt,
+	parameterLocked:            validateBool,
+	parameterUnlockOnDelete:    validateBool,
+	parameterAllowFormat:       validateBool,
+	parameterFsck:              validateOneOf(fsckNever, fsckPreen, fsckFull),
+	parameterFsckFullMaxSize:   validatePositiveInt,
+	parameterEncrypted:         validateBool,
+	parameterPVCName:           validateAny,
+	parameterPVCNamespace:      validateAny,
+	parameterPVName:            validateAny,
+}
+
+// volumeParameters the validated form of the parameters to CreateVolume
+type volumeParameters struct {
+	Plan             string
+	BillingCycle     string
+	SnapshotPolicies []*packngo.SnapshotPolicy
+	Locked           bool
+	UnlockOnDelete   bool
+	AllowFormat      bool
+	// Fsck the fsck policy and its size threshold, passed on to the nodes as they were given
+	Fsck            string
+	FsckFullMaxSize string
+	Encrypted       bool
+	// Kubernetes the objects being provisioned for, if the provisioner told us
+	Kubernetes *packet.KubernetesMetadata
+}
+
+// parseVolumeParameters validate the parameters to CreateVolume against the schema and convert them
+func parseVolumeParameters(parameters map[string]string) (volumeParameters, error) {
+	params := volumeParameters{
+		Plan:         packet.VolumePlanStandard,
+		BillingCycle: packet.BillingHourly,
+	}
+
+	// check them in a consistent order, so the same request always gets the same error
+	keys := make([]string, 0, len(parameters))
+	for key := range parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		validate, ok := volumeParameterSchema[key]
+		if !ok {
+			return params, status.Errorf(codes.InvalidArgument, "unknown parameter %s", key)
+		}
+		if err := validate(parameters[key]); err != nil {
+			return params, status.Errorf(codes.InvalidArgument, "invalid parameter %s, %v", key, err)
+		}
+	}
+
+	if plan := parameters[parameterPlan]; plan != "" {
+		params.Plan = plan
+	}
+	if billingCycle := parameters[parameterBillingCycle]; billingCycle != "" {
+		params.BillingCycle = billingCycle
+	}
+	// both of these already were validated, so the errors can be ignored
+	params.Locked, _ = strconv.ParseBool(parameters[parameterLocked])
+	params.UnlockOnDelete, _ = strconv.ParseBool(parameters[parameterUnlockOnDelete])
+	params.AllowFormat, _ = strconv.ParseBool(parameters[parameterAllowFormat])
+	params.Encrypted, _ = strconv.ParseBool(parameters[parameterEncrypted])
+	params.Fsck = parameters[parameterFsck]
+	params.FsckFullMaxSize = parameters[parameterFsckFullMaxSize]
+	if params.FsckFullMaxSize != "" && params.Fsck != fsckFull {
+		return params, status.Errorf(codes.InvalidArgument, "parameter %s requires %s %s", parameterFsckFullMaxSize, parameterFsck, fsckFull)
+	}
+
+	pvcName, hasPVCName := parameters[parameterPVCName]
+	pvcNamespace, hasPVCNamespace := parameters[parameterPVCNamespace]
+	pvName, hasPVName := parameters[parameterPVName]
+	if hasPVCName || hasPVCNamespace || hasPVName {
+		params.Kubernetes = &packet.KubernetesMetadata{
+			PVCName:      pvcName,
+			PVCNamespace: pvcNamespace,
+			PVName:       pvName,
+		}
+	}
+
+	// a snapshot policy needs both its frequency and its count
+	frequency, hasFrequency := parameters[parameterSnapshotFrequency]
+	count, hasCount := parameters[parameterSnapshotCount]
+	switch {
+	case hasFrequency && hasCount:
+		snapshotCount, _ := strconv.Atoi(count)
+		params.SnapshotPolicies = []*packngo.SnapshotPolicy{
+			{SnapshotFrequency: frequency, SnapshotCount: snapshotCount},
+		}
+	case hasFrequency:
+		return params, status.Errorf(codes.InvalidArgument, "parameter %s requires %s", parameterSnapshotFrequency, parameterSnapshotCount)
+	case hasCount:
+		return params, status.Errorf(codes.InvalidArgument, "parameter %s requires %s", parameterSnapshotCount, parameterSnapshotFrequency)
+	}
+	return params, nil
+}
+
+// volumeContext the VolumeContext for a volume with the given description, created with the given parameters
+func volumeContext(description packet.VolumeDescription, params volumeParameters) map[string]string {
+	values := map[string]string{
+		volumeContextFsck:            params.Fsck,
+		volumeContextFsckFullMaxSize: params.FsckFullMaxSize,
+	}
+	if params.AllowFormat {
+		values[volumeContextAllowFormat] = "true"
+	}
+	if params.Encrypted {
+		values[volumeContextEncrypted] = "true"
+	}
+	if description.Kubernetes != nil {
+		values[volumeContextPVCName] = description.Kubernetes.PVCName
+		values[volumeContextPVCNamespace] = description.Kubernetes.PVCNamespace
+		values[volumeContextPVName] = description.Kubernetes.PVName
+	}
+	var volumeContext map[string]string
+	for key, value := range values {
+		if value == "" {
+			continue
+		}
+		if volumeContext == nil {
+			volumeContext = map[string]string{}
+		}
+		volumeContext[key] = value
+	}
+	return volumeContext
+}
+
+func validateAny(value string) error {
+	return nil
+}
+
+func validateNotEmpty(value string) error {
+	if value == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func validateOneOf(allowed ...string) parameterValidator {
+	return func(value string) error {
+		for _, a := range allowed {
+			if value == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not one of %s", value, strings.Join(allowed, ", "))
+	}
+}
+
+func validatePositiveInt(value string) error {
+	i, err := strconv.Atoi(value)
+	if err != nil || i <= 0 {
+		return fmt.Errorf("%s is not a positive integer", value)
+	}
+	return nil
+}
+
+func validateBool(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("%s is not true or false", value)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/packethost/csi-packet/pkg/packet"
+	"github.com/packethost/packngo"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseVolumeParameters(t *testing.T) {
+	tests := []struct {
+		description string
+		parameters  map[string]string
+		expected    volumeParameters
+		code        codes.Code
+	}{
+		{
+			description: "defaults",
+			parameters:  nil,
+			expected:    volumeParameters{Plan: packet.VolumePlanStandard, BillingCycle: packet.BillingHourly},
+		},
+		{
+			description: "all parameters",
+			parameters: map[string]string{
+				"plan":              "performance",
+				"billingCycle":      "monthly",
+				"snapshotFrequency": "1week",
+				"snapshotCount":     "4",
+				"locked":            "true",
+				"unlockOnDelete":    "false",
+				"allowFormat":       "true",
+			},
+			expected: volumeParameters{
+				Plan:             "performance",
+				BillingCycle:     packet.BillingMonthly,
+				SnapshotPolicies: []*packngo.SnapshotPolicy{{SnapshotFrequency: "1week", SnapshotCount: 4}},
+				Locked:           true,
+				AllowFormat:      true,
+			},
+		},
+		{
+			description: "unknown parameter",
+			parameters:  map[string]string{"plna": "performance"},
+			code:        codes.InvalidArgument,
+		},
+		{
+			description: "invalid billing cycle",
+			parameters:  map[string]string{"billingCycle": "yearly"},
+			code:        codes.InvalidArgument,
+		},
+		{
+			description: "invalid snapshot frequency",
+			parameters:  map[string]string{"snapshotFrequency": "2days", "snapshotCount": "1"},
+			code:        codes.InvalidArgument,
+		},
+		{
+			description: "invalid snapshot count",
+			parameters:  map[string]string{"snapshotFrequency": "1day", "snapshotCount": "0"},
+			code:        codes.InvalidArgument,
+		},
+		{
+			description: "snapshot frequency without count",
+			parameters:  map[string]string{"snapshotFrequency": "1day"},
+			code:        codes.InvalidArgument,
+		},
+		{
+			description: "invalid locked",
+			parameters:  map[string]string{"locked": "yes please"},
+			code:        codes.InvalidArgument,
+		},
+		{
+			description: "full fsck up to a size",
+			parameters:  map[string]string{"fsck": "full", "fsckFullMaxSize": "500"},
+			expected:    volumeParameters{Plan: packet.VolumePlanStandard, BillingCycle: packet.BillingHourly, Fsck: fsckFull, FsckFullMaxSize: "500"},
+		},
+		{
+			description: "encrypted",
+			parameters:  map[string]string{"encrypted": "true"},
+			expected:    volumeParameters{Plan: packet.VolumePlanStandard, BillingCycle: packet.BillingHourly, Encrypted: true},
+		},
+		{
+			description: "invalid fsck",
+			parameters:  map[string]string{"fsck": "sometimes"},
+			code:        codes.InvalidArgument,
+		},
+		{
+			description: "fsck size without full fsck",
+			parameters:  map[string]string{"fsck": "preen", "fsckFullMaxSize": "500"},
+			code:        codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		params, err := parseVolumeParameters(tt.parameters)
+		assert.Equal(t, tt.code, status.Code(err), tt.description)
+		if tt.code == codes.OK {
+			assert.Equal(t, tt.expected, params, tt.description)
+		}
+	}
+}
+
+func TestVolumeContext(t *testing.T) {
+	assert.Nil(t, volumeContext(packet.VolumeDescription{}, volumeParameters{}))
+	assert.Equal(t, map[string]string{
+		volumeContextAllowFormat: "true",
+	}, volumeContext(packet.VolumeDescription{}, volumeParameters{AllowFormat: true}))
+	assert.Equal(t, map[string]string{
+		volumeContextAllowFormat: "true",
+		volumeContextPVCName:     "data",
+	}, volumeContext(packet.VolumeDescription{Kubernetes: &packet.KubernetesMetadata{PVCName: "data"}}, volumeParameters{AllowFormat: true}))
+	assert.Equal(t, map[string]string{
+		volumeContextFsck:            fsckFull,
+		volumeContextFsckFullMaxSize: "500",
+	}, volumeContext(packet.VolumeDescription{}, volumeParameters{Fsck: fsckFull, FsckFullMaxSize: "500"}))
+}
@@ -0,0 +1,307 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/packet"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// pathRepairInterval between attempts to log in to the portals that degraded volumes are missing
+const pathRepairInterval = 30 * time.Second
+
+// portalPath what attaching a volume at one of its portals came to: the disk of its session, or why it has none
+type portalPath struct {
+	portal string
+	device string
+	wwid   string
+	// step what failed, if anything did
+	step string
+	err  error
+}
+
+// String what failed at the portal
+func (p portalPath) String() string {
+	return fmt.Sprintf("%s error at %s, %v", p.step, p.portal, p.err)
+}
+
+// attachPortal discover and log in to the target at a portal, and wait for the disk of the session
+func (nodeServer *PacketNodeServer) attachPortal(ctx context.Context, portal, target, initiator string, chap *ChapCredentials) portalPath {
+	attacher := nodeServer.Driver.Attacher
+	path := portalPath{portal: portal}
+	// iscsiadm --mode discovery --type sendtargets --portal 10.144.144.226 --discover
+	if path.err = attacher.Discover(portal, initiator, chap); path.err != nil {
+		path.step = "iscsiadmin discover"
+		return path
+	}
+	if path.err = attacher.Login(portal, target, chap); path.err != nil {
+		path.step = "iscsiadmin login"
+		return path
+	}
+	if path.device, path.err = attacher.GetDevice(ctx, portal, target); path.err != nil {
+		path.step = "devicePath"
+		return path
+	}
+	if path.wwid, path.err = attacher.GetWWID(path.device); path.err != nil {
+		path.step = "scsiID"
+	}
+	return path
+}
+
+// attachPortals attach a volume at each of the portals concurrently, returning what became of each of them, in order;
+// only waiting for the disks stops when the context is done, as discovery and login run until iscsiadm gives up
+func (nodeServer *PacketNodeServer) attachPortals(ctx context.Context, portals []string, target, initiator string, chap *ChapCredentials) []portalPath {
+	paths := make([]portalPath, len(portals))
+	var wg sync.WaitGroup
+	for i, portal := range portals {
+		wg.Add(1)
+		go func(i int, portal string) {
+			defer wg.Done()
+			paths[i] = nodeServer.attachPortal(ctx, portal, target, initiator, chap)
+		}(i, portal)
+	}
+	wg.Wait()
+	return paths
+}
+
+// degradedVolume a staged volume that is missing paths, with what it takes to attach it at the other portals
+type degradedVolume struct {
+	name   string
+	target string
+	wwid   string
+	chap   *ChapCredentials
+}
+
+// repairTracker the staged volumes that are missing paths, by volume name, for the missing ones to be repaired
+type repairTracker struct {
+	lock    sync.Mutex
+	volumes map[string]degradedVolume
+}
+
+func newRepairTracker() *repairTracker {
+	return &repairTracker{
+		volumes: map[string]degradedVolume{},
+	}
+}
+
+// add record that a volume is missing paths
+func (t *repairTracker) add(volumeName string, volume degradedVolume) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.volumes[volumeName] = volume
+}
+
+// addIfAbsent record that a volume is missing paths, unless staging it already did, returning whether it was added
+func (t *repairTracker) addIfAbsent(volumeName string, volume degradedVolume) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.volumes[volumeName]; ok {
+		return false
+	}
+	t.volumes[volumeName] = volume
+	return true
+}
+
+// remove forget a volume, once it has all of its paths or no longer is staged
+func (t *repairTracker) remove(volumeName string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.volumes, volumeName)
+}
+
+// list the volumes that are missing paths, by volume name
+func (t *repairTracker) list() map[string]degradedVolume {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	volumes := make(map[string]degradedVolume, len(t.volumes))
+	for name, volume := range t.volumes {
+		volumes[name] = volume
+	}
+	return volumes
+}
+
+// do run f if the volume still is missing paths, returning whether it did, and forget the volume if f says it has
+// all of them now; nothing removes the volume meanwhile
+func (t *repairTracker) do(volumeName string, f func() bool) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.volumes[volumeName]; !ok {
+		return false
+	}
+	if f() {
+		delete(t.volumes, volumeName)
+	}
+	return true
+}
+
+// degradedMessage why a volume is degraded, as its condition says
+func degradedMessage(up, portals int, failures []string) string {
+	return fmt.Sprintf("%d of %d paths are up, %s", up, portals, strings.Join(failures, "; "))
+}
+
+// RepairPaths retry the missing paths of degraded volumes at every interval, until the context is done, starting
+// with those of the volumes that were staged before the driver started
+func (nodeServer *PacketNodeServer) RepairPaths(ctx context.Context, interval time.Duration) {
+	nodeServer.seedRepairs(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			nodeServer.repairPaths(ctx)
+		}
+	}
+}
+
+// repairPaths try once to attach each degraded volume at the portals it has no session with, as the metadata
+// lists them now, and to get all of them into its multipath map
+func (nodeServer *PacketNodeServer) repairPaths(ctx context.Context) {
+	for _, volume := range nodeServer.repairs.list() {
+		logger := nodeServer.Driver.Logger.WithFields(log.Fields{"volume_name": volume.name, "method": "repairPaths"})
+		if err := nodeServer.repairVolume(ctx, logger, volume); err != nil {
+			logger.Warnf("unable to repair paths, %v", err)
+		}
+	}
+}
+
+// missingPortals the portals of a volume, as the metadata lists them now, that it has no session with; a portal that
+// has a session is left alone, discovering it again could change the record the session uses
+func (nodeServer *PacketNodeServer) missingPortals(volumeMetaData packet.VolumeMetadata) ([]string, error) {
+	var missing []string
+	for _, ip := range volumeMetaData.IPs {
+		hasSession, err := nodeServer.Driver.Attacher.HasSession(ip.String(), volumeMetaData.IQN)
+		if err != nil {
+			return nil, fmt.Errorf("iscsiadmin session error, %v", err)
+		}
+		if !hasSession {
+			missing = append(missing, ip.String())
+		}
+	}
+	return missing, nil
+}
+
+// seedRepairs track the volumes that were staged before the driver started, as their maps tell, and that are
+// missing paths, so that those are repaired even if the volumes are not staged again. Their CHAP credentials are
+// not known until they are, so the portals of a volume that needs them cannot be logged in to until then.
+func (nodeServer *PacketNodeServer) seedRepairs(ctx context.Context) {
+	logger := nodeServer.Driver.Logger.WithFields(log.Fields{"method": "seedRepairs"})
+	maps, err := nodeServer.Driver.Multipath.Maps(ctx)
+	if err != nil {
+		logger.Warnf("unable to list multipath maps, %v", err)
+		return
+	}
+	for name, wwid := range maps {
+		if !strings.HasPrefix(name, volumePrefix) {
+			continue
+		}
+		volumeMetaData, err := nodeServer.MetadataDriver.GetVolumeMetadata(name)
+		switch {
+		case packet.IsVolumeNotInMetadata(err):
+			// a map that is left over of a volume that is detached has nothing to repair
+			continue
+		case err != nil:
+			logger.WithFields(log.Fields{"volume_name": name}).Warnf("metadata error, %v", err)
+			continue
+		}
+		missing, err := nodeServer.missingPortals(volumeMetaData)
+		if err != nil {
+			logger.WithFields(log.Fields{"volume_name": name}).Warnf("%v", err)
+			continue
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		message := degradedMessage(len(volumeMetaData.IPs)-len(missing), len(volumeMetaData.IPs), []string{fmt.Sprintf("no session at %s", strings.Join(missing, ", "))})
+		if nodeServer.repairs.addIfAbsent(name, degradedVolume{name: name, target: volumeMetaData.IQN, wwid: wwid}) {
+			nodeServer.conditions.setDegraded(name, message)
+			logger.WithFields(log.Fields{"volume_name": name}).Warnf("staged volume is degraded, %s", message)
+		}
+	}
+}
+
+func (nodeServer *PacketNodeServer) repairVolume(ctx context.Context, logger *log.Entry, volume degradedVolume) error {
+	volumeMetaData, err := nodeServer.MetadataDriver.GetVolumeMetadata(volume.name)
+	if err != nil {
+		return fmt.Errorf("metadata error, %v", err)
+	}
+	initiatorName, err := nodeServer.initiatorName()
+	if err != nil {
+		return err
+	}
+	missing, err := nodeServer.missingPortals(volumeMetaData)
+	if err != nil {
+		return err
+	}
+
+	pathCtx, cancel := context.WithTimeout(ctx, deviceWaitTimeout)
+	paths := nodeServer.attachPortals(pathCtx, missing, volume.target, initiatorName, volume.chap)
+	cancel()
+	var failures []string
+	for _, path := range paths {
+		switch {
+		case path.err != nil:
+			failures = append(failures, path.String())
+		case path.wwid != volume.wwid:
+			failures = append(failures, fmt.Sprintf("disk %s at portal %s is of WWID %s, not %s", path.device, path.portal, path.wwid, volume.wwid))
+		}
+	}
+	up := len(volumeMetaData.IPs) - len(failures)
+	if len(failures) == 0 {
+		mapCtx, cancel := context.WithTimeout(ctx, multipathMapTimeout)
+		err = nodeServer.Driver.Multipath.EnsureMap(mapCtx, volume.name, volume.wwid, len(volumeMetaData.IPs))
+		cancel()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("multipath map error, %v", err))
+		}
+	}
+
+	tracked := nodeServer.repairs.do(volume.name, func() bool {
+		if len(failures) > 0 {
+			nodeServer.conditions.setDegraded(volume.name, degradedMessage(up, len(volumeMetaData.IPs), failures))
+			return false
+		}
+		nodeServer.conditions.setDegraded(volume.name, "")
+		return true
+	})
+	if !tracked {
+		// the volume was unstaged meanwhile, and what was attached of it since is not wanted any more; the map
+		// goes first, which EnsureMap may have added again after unstaging removed it, named by multipath itself
+		// if the binding was gone by then, and whose paths must not be deleted under it
+		if err := nodeServer.removeMapsOf(ctx, volume.wwid); err != nil {
+			logger.Warnf("unable to remove multipath map of unstaged volume, %v", err)
+			return nil
+		}
+		if err := nodeServer.detachVolume(ctx, logger, volume.name, volume.target, missing); err != nil {
+			logger.Warnf("unable to detach new paths of unstaged volume, %v", err)
+		}
+		return nil
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", degradedMessage(up, len(volumeMetaData.IPs), failures))
+	}
+	logger.Infof("all %d paths are up", len(volumeMetaData.IPs))
+	return nil
+}
+
+// removeMapsOf remove every map of a WWID, whatever it is named
+func (nodeServer *PacketNodeServer) removeMapsOf(ctx context.Context, wwid string) error {
+	maps, err := nodeServer.Driver.Multipath.Maps(ctx)
+	if err != nil {
+		return err
+	}
+	for name, mapWWID := range maps {
+		if mapWWID != wwid {
+			continue
+		}
+		if err := nodeServer.Driver.Multipath.RemoveMap(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package driver
+
+import (
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// publication a single NodePublishVolume of a staged volume
+type publication struct {
+	readOnly bool
+	mode     csi.VolumeCapability_AccessMode_Mode
+}
+
+// singleWriter determine if the publication allows only one writer at a time
+func (p publication) singleWriter() bool {
+	return p.mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+}
+
+// publicationTracker the target paths at which each volume is published on this node, so that
+// single writer access modes can be enforced across the publications of a volume
+type publicationTracker struct {
+	lock sync.Mutex
+	// volumes publications by volume ID, then by target path
+	volumes map[string]map[string]publication
+}
+
+func newPublicationTracker() *publicationTracker {
+	return &publicationTracker{
+		volumes: map[string]map[string]publication{},
+	}
+}
+
+// add record a publication of a volume at a target path. Publishing the same way at the same path
+// again is fine, but anything that conflicts with the existing publications is rejected:
+//
+//   - a different publication at the same target path, with AlreadyExists
+//   - a second writer when a single writer access mode is involved, with FailedPrecondition
+func (t *publicationTracker) add(volumeID, targetPath string, p publication) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	publications := t.volumes[volumeID]
+	if existing, ok := publications[targetPath]; ok {
+		if existing != p {
+			return status.Errorf(codes.AlreadyExists, "volume %s already is published at %s with a different capability or readonly flag", volumeID, targetPath)
+		}
+		return nil
+	}
+	if !p.readOnly {
+		for path, existing := range publications {
+			if !existing.readOnly && (p.singleWriter() || existing.singleWriter()) {
+				return status.Errorf(codes.FailedPrecondition, "volume %s already is published for writing at %s, and allows a single writer", volumeID, path)
+			}
+		}
+	}
+	if publications == nil {
+		publications = map[string]publication{}
+		t.volumes[volumeID] = publications
+	}
+	publications[targetPath] = p
+	return nil
+}
+
+// adopt record a publication of a volume that was made before the tracker was created, unless one
+// already is known at the target path; it is not checked, since it exists whether it conflicts or not
+func (t *publicationTracker) adopt(volumeID, targetPath string, p publication) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	publications := t.volumes[volumeID]
+	if _, ok := publications[targetPath]; ok {
+		return
+	}
+	if publications == nil {
+		publications = map[string]publication{}
+		t.volumes[volumeID] = publications
+	}
+	publications[targetPath] = p
+}
+
+// remove forget a publication of a volume, if there was one
+func (t *publicationTracker) remove(volumeID, targetPath string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.volumes[volumeID], targetPath)
+	if len(t.volumes[volumeID]) == 0 {
+		delete(t.volumes, volumeID)
+	}
+}
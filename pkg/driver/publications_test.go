@@ -0,0 +1,51 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPublicationTracker(t *testing.T) {
+	singleWriter := publication{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER}
+	singleWriterReader := publication{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER, readOnly: true}
+	multiWriter := publication{mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER}
+
+	tests := []struct {
+		description string
+		existing    map[string]publication
+		path        string
+		publication publication
+		code        codes.Code
+	}{
+		{"first writer", nil, "/a", singleWriter, codes.OK},
+		{"same publication again", map[string]publication{"/a": singleWriter}, "/a", singleWriter, codes.OK},
+		{"different publication at the same path", map[string]publication{"/a": singleWriter}, "/a", singleWriterReader, codes.AlreadyExists},
+		{"second single writer", map[string]publication{"/a": singleWriter}, "/b", singleWriter, codes.FailedPrecondition},
+		{"multi writer after a single writer", map[string]publication{"/a": singleWriter}, "/b", multiWriter, codes.FailedPrecondition},
+		{"single writer after a multi writer", map[string]publication{"/a": multiWriter}, "/b", singleWriter, codes.FailedPrecondition},
+		{"reader after a single writer", map[string]publication{"/a": singleWriter}, "/b", singleWriterReader, codes.OK},
+		{"single writer after a reader", map[string]publication{"/a": singleWriterReader}, "/b", singleWriter, codes.OK},
+		{"second multi writer", map[string]publication{"/a": multiWriter}, "/b", multiWriter, codes.OK},
+	}
+	for _, tt := range tests {
+		tracker := newPublicationTracker()
+		for path, p := range tt.existing {
+			assert.Nil(t, tracker.add("volume", path, p), tt.description)
+		}
+		err := tracker.add("volume", tt.path, tt.publication)
+		assert.Equal(t, tt.code, status.Code(err), tt.description)
+	}
+
+	// once unpublished, another writer may publish
+	tracker := newPublicationTracker()
+	assert.Nil(t, tracker.add("volume", "/a", singleWriter))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(tracker.add("volume", "/b", singleWriter)))
+	tracker.remove("volume", "/a")
+	assert.Nil(t, tracker.add("volume", "/b", singleWriter))
+	// other volumes are not affected
+	assert.Nil(t, tracker.add("other", "/c", singleWriter))
+}
@@ -0,0 +1,208 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// sysModule where the kernel lists the modules that are loaded
+	sysModule = "/sys/module"
+	// nodeInitInterval and nodeInitMaxInterval the backoff between attempts to initialize the node
+	nodeInitInterval    = 5 * time.Second
+	nodeInitMaxInterval = 2 * time.Minute
+	// nodeCheckTimeout how long checking that iscsid can be reached may take
+	nodeCheckTimeout = 10 * time.Second
+)
+
+// nodeModules the kernel modules that attaching volumes needs
+var nodeModules = []string{"iscsi_tcp", "dm_multipath"}
+
+// NodeStatus whether the node is ready to attach volumes, and what it lacks if it is not
+type NodeStatus struct {
+	// Initialized whether the iSCSI and multipath configuration of the host was set up
+	Initialized bool
+	// InitError why setting it up last failed, empty if it did not
+	InitError string
+	// Modules whether each of the kernel modules that the driver needs is loaded
+	Modules map[string]bool
+	// IscsidError why iscsid cannot be reached, empty if it can
+	IscsidError string
+	// Initiator the iSCSI initiator name of the host
+	Initiator string
+	// Expected the initiator name that Equinix Metal assigned to the node, empty if it is not known yet
+	Expected string
+}
+
+// Problems what keeps the node from attaching volumes, none if it is ready
+func (s *NodeStatus) Problems() []string {
+	problems := []string{}
+	switch {
+	case s.InitError != "":
+		problems = append(problems, fmt.Sprintf("node initialization failed: %s", s.InitError))
+	case !s.Initialized:
+		problems = append(problems, "node is not initialized yet")
+	}
+	problems = append(problems, s.moduleProblems()...)
+	if s.IscsidError != "" {
+		problems = append(problems, fmt.Sprintf("iscsid cannot be reached: %s", s.IscsidError))
+	}
+	if s.Expected != "" && s.Initiator != s.Expected {
+		problems = append(problems, s.initiatorProblem())
+	}
+	return problems
+}
+
+// Failures the problems that keep the node from attaching volumes however long it waits: the kernel modules
+// that are not loaded, and an initiator name that was changed after the node was initialized, which
+// Initialize does not set again. Initialization that is still being retried, and iscsid that cannot be reached
+// yet, may well be fixed.
+func (s *NodeStatus) Failures() []string {
+	failures := s.moduleProblems()
+	if s.Initialized && s.Expected != "" && s.Initiator != s.Expected {
+		failures = append(failures, s.initiatorProblem())
+	}
+	return failures
+}
+
+func (s *NodeStatus) moduleProblems() []string {
+	modules := make([]string, 0, len(s.Modules))
+	for module, loaded := range s.Modules {
+		if !loaded {
+			modules = append(modules, module)
+		}
+	}
+	sort.Strings(modules)
+	problems := []string{}
+	for _, module := range modules {
+		problems = append(problems, fmt.Sprintf("kernel module %s is not loaded", module))
+	}
+	return problems
+}
+
+func (s *NodeStatus) initiatorProblem() string {
+	return fmt.Sprintf("iSCSI initiator name of the host is %q, not %q", s.Initiator, s.Expected)
+}
+
+// Ready whether the node can attach volumes
+func (s *NodeStatus) Ready() bool {
+	return len(s.Problems()) == 0
+}
+
+// nodeState the initialization of the node, which is safe for concurrent use
+type nodeState struct {
+	// running serializes initializing the node, which lock is not held for, so the state can be read meanwhile
+	running     sync.Mutex
+	lock        sync.Mutex
+	initialized bool
+	initiator   string
+	err         error
+}
+
+// Initialize initialize the node, retrying with a backoff until it succeeds or the context is done
+func (nodeServer *PacketNodeServer) Initialize(ctx context.Context) error {
+	interval := nodeInitInterval
+	for {
+		err := nodeServer.initialize()
+		if err == nil {
+			return nil
+		}
+		nodeServer.Driver.Logger.WithFields(log.Fields{"retry": interval.String()}).Errorf("unable to initialize node, %v", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > nodeInitMaxInterval {
+			interval = nodeInitMaxInterval
+		}
+	}
+}
+
+// initialize set up the iSCSI and multipath configuration of the host, unless it was already; concurrent calls wait
+// for the one that is running
+func (nodeServer *PacketNodeServer) initialize() error {
+	state := &nodeServer.state
+	state.running.Lock()
+	defer state.running.Unlock()
+	if nodeServer.Initialized() {
+		return nil
+	}
+	err := nodeServer.nodeInit()
+	state.lock.Lock()
+	state.initialized, state.err = err == nil, err
+	state.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	nodeServer.Driver.Logger.Info("node initialized")
+	nodeServer.collectBindings()
+	return nil
+}
+
+func (nodeServer *PacketNodeServer) nodeInit() error {
+	initiatorName, err := nodeServer.initiatorName()
+	if err != nil {
+		return err
+	}
+	if err := nodeServer.Driver.Initializer.NodeInit(initiatorName); err != nil {
+		return fmt.Errorf("NodeInit error, %v", err)
+	}
+	return nil
+}
+
+// Initialized whether the node was initialized
+func (nodeServer *PacketNodeServer) Initialized() bool {
+	nodeServer.state.lock.Lock()
+	defer nodeServer.state.lock.Unlock()
+	return nodeServer.state.initialized
+}
+
+// initiatorName the initiator name that Equinix Metal assigned to the node, which is looked up the first time
+func (nodeServer *PacketNodeServer) initiatorName() (string, error) {
+	state := &nodeServer.state
+	state.lock.Lock()
+	initiator := state.initiator
+	state.lock.Unlock()
+	if initiator != "" {
+		return initiator, nil
+	}
+	initiator, err := nodeServer.MetadataDriver.GetInitiator()
+	if err != nil {
+		return "", fmt.Errorf("metadata error, %v", err)
+	}
+	state.lock.Lock()
+	state.initiator = initiator
+	state.lock.Unlock()
+	return initiator, nil
+}
+
+// Status check whether the node is ready to attach volumes
+func (nodeServer *PacketNodeServer) Status() *NodeStatus {
+	state := &nodeServer.state
+	state.lock.Lock()
+	initialized, initiator, err := state.initialized, state.initiator, state.err
+	state.lock.Unlock()
+	status := nodeServer.Driver.Initializer.Check(initiator)
+	status.Initialized = initialized
+	if err != nil {
+		status.InitError = err.Error()
+	}
+	return status
+}
+
+// statusFields the status of the node, for logging
+func statusFields(status *NodeStatus) log.Fields {
+	return log.Fields{
+		"initialized": status.Initialized,
+		"modules":     status.Modules,
+		"initiator":   status.Initiator,
+		"problems":    strings.Join(status.Problems(), "; "),
+	}
+}
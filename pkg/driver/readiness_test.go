@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNodeStatusProblems(t *testing.T) {
+	nodeStatus := &NodeStatus{
+		Initialized: true,
+		Modules:     map[string]bool{"iscsi_tcp": true, "dm_multipath": true},
+		Initiator:   testInitiator,
+		Expected:    testInitiator,
+	}
+	assert.True(t, nodeStatus.Ready())
+
+	// the name is not checked until it is known
+	nodeStatus.Expected = ""
+	nodeStatus.Initiator = ""
+	assert.True(t, nodeStatus.Ready())
+
+	nodeStatus.Initialized = false
+	nodeStatus.InitError = "NodeInit error, multipathd is not healthy"
+	nodeStatus.Modules["dm_multipath"] = false
+	nodeStatus.IscsidError = "cannot connect to iscsid"
+	assert.Equal(t, []string{
+		"node initialization failed: NodeInit error, multipathd is not healthy",
+		"kernel module dm_multipath is not loaded",
+		"iscsid cannot be reached: cannot connect to iscsid",
+	}, nodeStatus.Problems())
+	assert.Equal(t, []string{"kernel module dm_multipath is not loaded"}, nodeStatus.Failures())
+
+	// the initiator name is set by initializing the node, and is only wrong once that is done
+	nodeStatus.Modules["dm_multipath"] = true
+	nodeStatus.Expected = testInitiator
+	assert.Empty(t, nodeStatus.Failures())
+	nodeStatus.Initialized = true
+	nodeStatus.InitError = ""
+	assert.Equal(t, []string{`iSCSI initiator name of the host is "", not "` + testInitiator + `"`}, nodeStatus.Failures())
+}
+
+func TestInitializeConcurrently(t *testing.T) {
+	nodeServer, _, _, done := testNodeServer(t, nil, newMemFS(), false)
+	defer done()
+	initializer := nodeServer.Driver.Initializer.(*InitializerMock)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := nodeServer.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, initializer.calls)
+	assert.True(t, nodeServer.Initialized())
+}
+
+func TestInitializeRetries(t *testing.T) {
+	nodeServer, _, _, done := testNodeServer(t, nil, newMemFS(), false)
+	defer done()
+	initializer := nodeServer.Driver.Initializer.(*InitializerMock)
+	initializer.failures = 1
+
+	// the first attempt fails, and there is no time for another
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := nodeServer.Initialize(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, initializer.calls)
+	assert.False(t, nodeServer.Initialized())
+	assert.Equal(t, err.Error(), nodeServer.Status().InitError)
+
+	// NodeGetInfo tries again
+	_, err = nodeServer.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.Nil(t, err)
+	assert.Nil(t, nodeServer.Initialize(context.Background()))
+	assert.Equal(t, 2, initializer.calls)
+	assert.Equal(t, "", nodeServer.Status().InitError)
+}
+
+func TestProbe(t *testing.T) {
+	nodeServer, _, _, done := testNodeServer(t, nil, newMemFS(), false)
+	defer done()
+	initializer := nodeServer.Driver.Initializer.(*InitializerMock)
+	identity := &PacketIdentityServer{Driver: nodeServer.Driver, Node: nodeServer}
+
+	// not ready while it is starting up
+	resp, err := identity.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.False(t, resp.Ready.Value)
+
+	// nor while it retries after it failed
+	initializer.failures = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, nodeServer.Initialize(ctx))
+	assert.NotEqual(t, "", nodeServer.Status().InitError)
+	resp, err = identity.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.False(t, resp.Ready.Value)
+
+	// or while iscsid cannot be reached yet
+	initializer.status = &NodeStatus{Modules: map[string]bool{"iscsi_tcp": true, "dm_multipath": true}, IscsidError: "cannot connect to iscsid"}
+	resp, err = identity.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.False(t, resp.Ready.Value)
+	initializer.status = nil
+
+	assert.Nil(t, nodeServer.Initialize(context.Background()))
+	resp, err = identity.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.True(t, resp.Ready.Value)
+
+	// failed once the host lacks what it needs
+	initializer.status = &NodeStatus{Modules: map[string]bool{"iscsi_tcp": false, "dm_multipath": true}}
+	_, err = identity.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "kernel module iscsi_tcp is not loaded")
+
+	// a driver that does not run as a node is always ready
+	resp, err = (&PacketIdentityServer{Driver: nodeServer.Driver}).Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Nil(t, err)
+	assert.True(t, resp.Ready.Value)
+}
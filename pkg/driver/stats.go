@@ -0,0 +1,52 @@
+package driver
+
+import (
+	"io"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+)
+
+// volumeUsage the usage of a published volume: the space and inodes of a mounted filesystem,
+// or just the size of a raw block volume, which is all that is known about it
+func volumeUsage(path string) ([]*csi.VolumeUsage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		return []*csi.VolumeUsage{
+			{Unit: csi.VolumeUsage_BYTES, Total: size},
+		}, nil
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(path, &statfs); err != nil {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	blockSize := int64(statfs.Bsize)
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * blockSize,
+			Available: int64(statfs.Bavail) * blockSize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}, nil
+}
@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// LeftoverError what was left of a volume on the node after detaching it
+type LeftoverError struct {
+	Volume    string
+	Leftovers []string
+}
+
+// Error return the error string
+func (e *LeftoverError) Error() string {
+	return fmt.Sprintf("volume %s still is attached after detaching it: %s", e.Volume, strings.Join(e.Leftovers, "; "))
+}
+
+// IsLeftover check if an error is of a volume that is not entirely detached
+func IsLeftover(err error) bool {
+	switch err.(type) {
+	case *LeftoverError:
+		return true
+	}
+	return false
+}
+
+// detachVolume remove what attaches a volume at its portals, once its multipath map is gone: the disks of its
+// sessions, which are deleted before the sessions are logged out of, so that none is left behind, the sessions,
+// the node records that discovery created for them, and the discovery records; and then check that nothing is left
+func (nodeServer *PacketNodeServer) detachVolume(ctx context.Context, logger *log.Entry, volumeName, target string, portals []string) error {
+	attacher := nodeServer.Driver.Attacher
+	leftover := &LeftoverError{Volume: volumeName}
+	for _, portal := range portals {
+		devices, err := attacher.Devices(ctx, portal, target)
+		if err != nil {
+			return fmt.Errorf("iscsiadmin session error, %v", err)
+		}
+		for _, device := range devices {
+			logger.WithFields(log.Fields{"ip": portal, "device": device}).Info("deleting disk")
+			if err := attacher.DeleteDevice(device); err != nil {
+				return err
+			}
+		}
+		// the kernel removes a disk as it is deleted
+		devices, err = attacher.Devices(ctx, portal, target)
+		if err != nil {
+			return fmt.Errorf("iscsiadmin session error, %v", err)
+		}
+		for _, device := range devices {
+			leftover.Leftovers = append(leftover.Leftovers, fmt.Sprintf("disk %s at %s", device, portal))
+		}
+	}
+	if len(leftover.Leftovers) > 0 {
+		return leftover
+	}
+
+	for _, portal := range portals {
+		logger.WithFields(log.Fields{"ip": portal, "iqn": target}).Info("iscsiadmin logout")
+		if err := attacher.Logout(portal, target); err != nil {
+			return fmt.Errorf("iscsiadminLogout error, %v", err)
+		}
+		if err := attacher.DeleteNode(portal, target); err != nil {
+			return fmt.Errorf("iscsiadmin node record error, %v", err)
+		}
+		if err := attacher.DeleteDiscovery(portal); err != nil {
+			return fmt.Errorf("iscsiadmin discovery record error, %v", err)
+		}
+	}
+	for _, portal := range portals {
+		hasSession, err := attacher.HasSession(portal, target)
+		if err != nil {
+			return fmt.Errorf("iscsiadmin session error, %v", err)
+		}
+		if hasSession {
+			leftover.Leftovers = append(leftover.Leftovers, fmt.Sprintf("session at %s", portal))
+		}
+		hasNode, err := attacher.HasNode(portal, target)
+		if err != nil {
+			return fmt.Errorf("iscsiadmin node record error, %v", err)
+		}
+		if hasNode {
+			leftover.Leftovers = append(leftover.Leftovers, fmt.Sprintf("node record at %s", portal))
+		}
+	}
+	if len(leftover.Leftovers) > 0 {
+		return leftover
+	}
+	return nil
+}
+
+// findSessions the target and portals of the sessions of a volume that is not in the metadata, by the WWID of its
+// multipath map, or of its binding once the map is gone; a volume with neither has none that can be found
+func (nodeServer *PacketNodeServer) findSessions(ctx context.Context, volumeName string) (string, []string, error) {
+	maps, err := nodeServer.Driver.Multipath.Maps(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("multipath error, %v", err)
+	}
+	wwid, ok := maps[volumeName]
+	if !ok {
+		if wwid, ok, err = nodeServer.Driver.Bindings.WWID(volumeName); err != nil {
+			return "", nil, fmt.Errorf("multipath bindings error, %v", err)
+		}
+	}
+	if !ok {
+		return "", nil, nil
+	}
+	target, portals, err := nodeServer.Driver.Attacher.FindSessions(ctx, wwid)
+	if err != nil {
+		return "", nil, fmt.Errorf("iscsiadmin session error, %v", err)
+	}
+	return target, portals, nil
+}
@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Result what a command wrote, and how it exited
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Output what the command wrote to stdout, followed by what it wrote to stderr
+func (r Result) Output() []byte {
+	return append(append([]byte{}, r.Stdout...), r.Stderr...)
+}
+
+// Executor runs commands. An error means that a command could not be run, or did not finish; a command
+// that ran and failed has its exit code in the Result.
+type Executor interface {
+	Run(ctx context.Context, stdin []byte, command string, args ...string) (Result, error)
+}
+
+// Redacted what secrets are replaced with where commands are recorded
+const Redacted = "<redacted>"
+
+type secretsKey struct{}
+
+// WithSecrets a context for running commands with arguments that are secrets, as iscsiadm takes CHAP passwords
+// on its command line, for want of any other way; a Recorder records them as Redacted
+func WithSecrets(ctx context.Context, secrets ...string) context.Context {
+	return context.WithValue(ctx, secretsKey{}, append(append([]string{}, Secrets(ctx)...), secrets...))
+}
+
+// Secrets the secrets of the commands run with the context
+func Secrets(ctx context.Context) []string {
+	secrets, _ := ctx.Value(secretsKey{}).([]string)
+	return secrets
+}
+
+// Func an ordinary function as an Executor
+type Func func(ctx context.Context, stdin []byte, command string, args ...string) (Result, error)
+
+// Run call the function
+func (f Func) Run(ctx context.Context, stdin []byte, command string, args ...string) (Result, error) {
+	return f(ctx, stdin, command, args...)
+}
+
+// Local runs commands as child processes
+type Local struct{}
+
+// Run run a command as a child process, which is killed when the context is done
+func (Local) Run(ctx context.Context, stdin []byte, command string, args ...string) (Result, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	result := Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+	if ctx.Err() != nil {
+		result.ExitCode = -1
+		return result, ctx.Err()
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+		return result, nil
+	}
+	return result, err
+}
+
+// ExitError a command that exited with a status other than 0
+type ExitError struct {
+	Command  string
+	Args     []string
+	ExitCode int
+	Output   string
+}
+
+// Error return the error string
+func (e ExitError) Error() string {
+	return fmt.Sprintf("%s %s: exit status %d: %s", e.Command, strings.Join(e.Args, " "), e.ExitCode, e.Output)
+}
+
+// CombinedOutput run a command and return what it wrote, with an *ExitError if it did not exit with 0,
+// as os/exec does
+func CombinedOutput(ctx context.Context, e Executor, command string, args ...string) ([]byte, error) {
+	result, err := e.Run(ctx, nil, command, args...)
+	out := result.Output()
+	if err != nil {
+		return out, err
+	}
+	if result.ExitCode != 0 {
+		return out, &ExitError{Command: command, Args: args, ExitCode: result.ExitCode, Output: strings.TrimSpace(string(out))}
+	}
+	return out, nil
+}
+
+// ExitCode the exit code of a command for an error from CombinedOutput, 0 if there is none, or -1 if the
+// command did not exit
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	switch e := err.(type) {
+	case *ExitError:
+		return e.ExitCode
+	}
+	return -1
+}
@@ -0,0 +1,156 @@
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocal(t *testing.T) {
+	result, err := Local{}.Run(context.Background(), []byte("secret"), "sh", "-c", "cat; echo; echo failed >&2; exit 3")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret\n", string(result.Stdout))
+	assert.Equal(t, "failed\n", string(result.Stderr))
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, "secret\nfailed\n", string(result.Output()))
+}
+
+func TestLocalNotFound(t *testing.T) {
+	_, err := Local{}.Run(context.Background(), nil, "/nonexistent/command")
+	assert.NotNil(t, err)
+}
+
+func TestLocalTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	result, err := Local{}.Run(ctx, nil, "sleep", "10")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, -1, result.ExitCode)
+}
+
+func TestCombinedOutput(t *testing.T) {
+	script := NewScript(
+		Expect("mkfs.ext4", "-F", "/dev/mapper/volume").Returns("done", 0),
+		Expect("mkfs.ext4", "-F", "/dev/mapper/volume").Returns("device busy", 1),
+		Expect("mkfs.ext4", "-F", "/dev/mapper/volume").Fails("signal: killed"),
+	)
+	out, err := CombinedOutput(context.Background(), script, "mkfs.ext4", "-F", "/dev/mapper/volume")
+	assert.Nil(t, err)
+	assert.Equal(t, "done", string(out))
+
+	_, err = CombinedOutput(context.Background(), script, "mkfs.ext4", "-F", "/dev/mapper/volume")
+	assert.Equal(t, 1, ExitCode(err))
+	assert.Contains(t, err.Error(), "device busy")
+
+	_, err = CombinedOutput(context.Background(), script, "mkfs.ext4", "-F", "/dev/mapper/volume")
+	assert.Equal(t, -1, ExitCode(err))
+	assert.Nil(t, script.Done())
+}
+
+func TestScript(t *testing.T) {
+	script := NewScript(
+		Expect("multipath", "-f", "volume"),
+		Expect("multipath", "-ll", "/dev/sdb").Returns("volume (36001405) dm-0", 0),
+	)
+	_, err := script.Run(context.Background(), nil, "multipath", "-f", "volume")
+	assert.Nil(t, err)
+	assert.NotNil(t, script.Done(), "a command of the script was not run")
+
+	result, err := script.Run(context.Background(), []byte("key"), "multipath", "-ll", "/dev/sdb")
+	assert.Nil(t, err)
+	assert.Equal(t, "volume (36001405) dm-0", string(result.Stdout))
+	assert.Equal(t, []byte("key"), script.Stdin(1))
+	assert.Nil(t, script.Done())
+	assert.Equal(t, []string{"multipath -f volume", "multipath -ll /dev/sdb"}, script.Calls())
+}
+
+func TestScriptUnexpected(t *testing.T) {
+	script := NewScript(Expect("multipath", "-f", "volume"))
+	_, err := script.Run(context.Background(), nil, "multipath", "-f", "other")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "expected multipath -f volume")
+	// the script stays where it was, but it is not done, since something else was run
+	_, err = script.Run(context.Background(), nil, "multipath", "-f", "volume")
+	assert.Nil(t, err)
+	assert.NotNil(t, script.Done())
+
+	_, err = NewScript().Run(context.Background(), nil, "multipath")
+	assert.NotNil(t, err)
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recorder := &Recorder{Executor: Local{}}
+	_, err = recorder.Run(context.Background(), nil, "sh", "-c", "echo out; echo err >&2; exit 21")
+	assert.Nil(t, err)
+	_, err = recorder.Run(context.Background(), nil, "/nonexistent/command")
+	assert.NotNil(t, err)
+	path := filepath.Join(dir, "script.json")
+	assert.Nil(t, recorder.WriteScript(path))
+
+	script, err := ReadScript(path)
+	if !assert.Nil(t, err) {
+		return
+	}
+	result, err := script.Run(context.Background(), nil, "sh", "-c", "echo out; echo err >&2; exit 21")
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Stdout: []byte("out\n"), Stderr: []byte("err\n"), ExitCode: 21}, result)
+	_, err = script.Run(context.Background(), nil, "/nonexistent/command")
+	assert.NotNil(t, err)
+	assert.Nil(t, script.Done())
+}
+
+func TestRecordSecrets(t *testing.T) {
+	recorder := &Recorder{Executor: Local{}}
+	ctx := WithSecrets(context.Background(), "hunter2")
+	_, err := recorder.Run(ctx, nil, "sh", "-c", "echo $0; echo $0 >&2", "hunter2")
+	assert.Nil(t, err)
+	assert.Equal(t, []Exchange{{
+		Command: "sh",
+		Args:    []string{"-c", "echo $0; echo $0 >&2", Redacted},
+		Stdout:  Redacted + "\n",
+		Stderr:  Redacted + "\n",
+	}}, recorder.Exchanges())
+}
+
+func TestNew(t *testing.T) {
+	e, err := New("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, Local{}, e)
+	e, err = New(ModeNsenter, "")
+	assert.Nil(t, err)
+	assert.Equal(t, NSEnter{}, e)
+	e, err = New(ModeChroot, "")
+	assert.Nil(t, err)
+	assert.Equal(t, Chroot{Root: DefaultHostRoot}, e)
+	_, err = New("docker", "")
+	assert.NotNil(t, err)
+}
+
+func TestNSEnter(t *testing.T) {
+	script := NewScript(
+		Expect("nsenter", "--target", "1", "--mount", "--uts", "--ipc", "--net", "--", "iscsiadm", "--mode", "session").Returns("", 21),
+	)
+	result, err := NSEnter{Executor: script}.Run(context.Background(), []byte("key"), "iscsiadm", "--mode", "session")
+	assert.Nil(t, err)
+	assert.Equal(t, 21, result.ExitCode)
+	assert.Equal(t, []byte("key"), script.Stdin(0))
+	assert.Nil(t, script.Done())
+}
+
+func TestChroot(t *testing.T) {
+	script := NewScript(Expect("chroot", "/host", "/sbin/multipath", "-f", "volume"))
+	_, err := Chroot{Executor: script, Root: "/host"}.Run(context.Background(), nil, "/sbin/multipath", "-f", "volume")
+	assert.Nil(t, err)
+	assert.Nil(t, script.Done())
+}
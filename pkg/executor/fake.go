@@ -0,0 +1,213 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Exchange a command that was run, or is expected to be, with what it returned. It never includes what was
+// written to the command's stdin, since that is how secrets are passed.
+type Exchange struct {
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Stdout   string   `json:"stdout,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	ExitCode int      `json:"exitCode,omitempty"`
+	// Err an error running the command, if it could not be run or did not finish
+	Err string `json:"err,omitempty"`
+}
+
+// String the command line of the exchange
+func (x Exchange) String() string {
+	return strings.TrimSpace(x.Command + " " + strings.Join(x.Args, " "))
+}
+
+// redact replace the secrets in the exchange, the arguments that are one, and wherever they appear in what
+// the command wrote
+func (x Exchange) redact(secrets []string) Exchange {
+	args := make([]string, 0, len(x.Args))
+	for _, arg := range x.Args {
+		for _, secret := range secrets {
+			if secret != "" && arg == secret {
+				arg = Redacted
+			}
+		}
+		args = append(args, arg)
+	}
+	x.Args = args
+	for _, secret := range secrets {
+		if secret != "" {
+			x.Stdout = strings.Replace(x.Stdout, secret, Redacted, -1)
+			x.Stderr = strings.Replace(x.Stderr, secret, Redacted, -1)
+			x.Err = strings.Replace(x.Err, secret, Redacted, -1)
+		}
+	}
+	return x
+}
+
+// Expect an exchange for a command line, which succeeds without any output unless changed
+func Expect(command string, args ...string) Exchange {
+	return Exchange{Command: command, Args: args}
+}
+
+// Returns the exchange with output and an exit code
+func (x Exchange) Returns(stdout string, exitCode int) Exchange {
+	x.Stdout = stdout
+	x.ExitCode = exitCode
+	return x
+}
+
+// Fails the exchange with an error running the command, as when it does not finish
+func (x Exchange) Fails(err string) Exchange {
+	x.Err = err
+	return x
+}
+
+// Script a fake Executor that expects a script of commands, in order, and replays what each returned
+type Script struct {
+	lock     sync.Mutex
+	expected []Exchange
+	// calls every command that was run, in order, whether it was expected or not
+	calls  []Exchange
+	stdins [][]byte
+	// unexpected the first command that did not match the script
+	unexpected error
+}
+
+// NewScript create a Script that expects the exchanges, in order
+func NewScript(exchanges ...Exchange) *Script {
+	return &Script{expected: exchanges}
+}
+
+// ReadScript read a Script from a file of JSON exchanges, as written by a Recorder
+func ReadScript(path string) (*Script, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var exchanges []Exchange
+	if err := json.Unmarshal(data, &exchanges); err != nil {
+		return nil, fmt.Errorf("invalid script %s: %v", path, err)
+	}
+	return NewScript(exchanges...), nil
+}
+
+// Expect add exchanges to the end of the script
+func (s *Script) Expect(exchanges ...Exchange) *Script {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expected = append(s.expected, exchanges...)
+	return s
+}
+
+// Run replay the next exchange of the script, if the command matches it; one that does not is an error
+func (s *Script) Run(ctx context.Context, stdin []byte, command string, args ...string) (Result, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	call := Exchange{Command: command, Args: args}
+	s.calls = append(s.calls, call)
+	s.stdins = append(s.stdins, stdin)
+	if len(s.expected) == 0 {
+		return s.fail(fmt.Errorf("unexpected command %s, the script is done", call))
+	}
+	next := s.expected[0]
+	if next.String() != call.String() {
+		return s.fail(fmt.Errorf("unexpected command %s, expected %s", call, next))
+	}
+	s.expected = s.expected[1:]
+	result := Result{Stdout: []byte(next.Stdout), Stderr: []byte(next.Stderr), ExitCode: next.ExitCode}
+	if next.Err != "" {
+		return result, errors.New(next.Err)
+	}
+	return result, nil
+}
+
+// fail record the first command that did not match the script, and fail it
+func (s *Script) fail(err error) (Result, error) {
+	if s.unexpected == nil {
+		s.unexpected = err
+	}
+	return Result{ExitCode: -1}, err
+}
+
+// Calls the command lines that were run, in order
+func (s *Script) Calls() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	calls := make([]string, 0, len(s.calls))
+	for _, call := range s.calls {
+		calls = append(calls, call.String())
+	}
+	return calls
+}
+
+// Stdin what was written to the stdin of the i-th command that was run
+func (s *Script) Stdin(i int) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stdins[i]
+}
+
+// Done check that every command of the script was run, and nothing else
+func (s *Script) Done() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.unexpected != nil {
+		return s.unexpected
+	}
+	if len(s.expected) > 0 {
+		return fmt.Errorf("%d commands of the script were not run, starting with %s", len(s.expected), s.expected[0])
+	}
+	return nil
+}
+
+// Recorder an Executor that records every command that another one runs, with what it returned, to
+// replay them with a Script. The secrets of the context a command is run with are not recorded, so a
+// command with any is replayed only by a Script that expects them as Redacted.
+type Recorder struct {
+	Executor Executor
+
+	lock      sync.Mutex
+	exchanges []Exchange
+}
+
+// Run run the command, and record it
+func (r *Recorder) Run(ctx context.Context, stdin []byte, command string, args ...string) (Result, error) {
+	result, err := r.Executor.Run(ctx, stdin, command, args...)
+	exchange := Exchange{
+		Command:  command,
+		Args:     append([]string{}, args...),
+		Stdout:   string(result.Stdout),
+		Stderr:   string(result.Stderr),
+		ExitCode: result.ExitCode,
+	}
+	if err != nil {
+		exchange.Err = err.Error()
+	}
+	exchange = exchange.redact(Secrets(ctx))
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.exchanges = append(r.exchanges, exchange)
+	return result, err
+}
+
+// Exchanges the commands that were run, in order
+func (r *Recorder) Exchanges() []Exchange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Exchange{}, r.exchanges...)
+}
+
+// WriteScript write the commands that were run as JSON, for ReadScript
+func (r *Recorder) WriteScript(path string) error {
+	data, err := json.MarshalIndent(r.Exchanges(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
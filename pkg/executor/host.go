@@ -0,0 +1,87 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// Modes of running the tools that the driver needs, such as iscsiadm, mkfs and cryptsetup
+const (
+	// ModeContainer run the tools that are in the driver's image
+	ModeContainer = "container"
+	// ModeNsenter run the tools of the host, in its namespaces, which requires the host's PID namespace
+	ModeNsenter = "nsenter"
+	// ModeChroot run the tools of the host, in the driver's namespaces but chrooted into a mount of the host's root
+	ModeChroot = "chroot"
+
+	// DefaultHostRoot where the host's root is mounted, for ModeChroot
+	DefaultHostRoot = "/host"
+)
+
+// Modes the modes of running tools, for usage messages
+var Modes = []string{ModeContainer, ModeNsenter, ModeChroot}
+
+// New an Executor that runs commands in a mode; hostRoot is where the host's root is mounted, for ModeChroot
+func New(mode, hostRoot string) (Executor, error) {
+	switch mode {
+	case "", ModeContainer:
+		return Local{}, nil
+	case ModeNsenter:
+		return NSEnter{}, nil
+	case ModeChroot:
+		if hostRoot == "" {
+			hostRoot = DefaultHostRoot
+		}
+		return Chroot{Root: hostRoot}, nil
+	}
+	return nil, fmt.Errorf("unknown mode %q, must be one of %v", mode, Modes)
+}
+
+// NSEnter runs commands in the mount, UTS, IPC and network namespaces of a process of the host, normally
+// its init, so that they are the host's own tools, working with its configuration and daemons
+type NSEnter struct {
+	// Executor runs nsenter, Local if nil
+	Executor Executor
+	// Path of nsenter, found in the PATH if empty
+	Path string
+	// Target the process whose namespaces to enter, 1 if 0; it is the host's only if the driver shares its PID namespace
+	Target int
+}
+
+// Run run the command with nsenter
+func (n NSEnter) Run(ctx context.Context, stdin []byte, command string, args ...string) (Result, error) {
+	path := n.Path
+	if path == "" {
+		path = "nsenter"
+	}
+	target := n.Target
+	if target == 0 {
+		target = 1
+	}
+	nsargs := []string{"--target", strconv.Itoa(target), "--mount", "--uts", "--ipc", "--net", "--", command}
+	return orLocal(n.Executor).Run(ctx, stdin, path, append(nsargs, args...)...)
+}
+
+// Chroot runs commands chrooted into a directory, normally a mount of the host's root, so that they are the
+// host's own tools, working with its configuration; they still share the driver's namespaces, so /dev, /sys
+// and /run must be mounted under the root, as they are on the host
+type Chroot struct {
+	// Executor runs chroot, Local if nil
+	Executor Executor
+	// Root the directory to chroot into
+	Root string
+}
+
+// Run run the command with chroot
+func (c Chroot) Run(ctx context.Context, stdin []byte, command string, args ...string) (Result, error) {
+	return orLocal(c.Executor).Run(ctx, stdin, "chroot", append([]string{c.Root, command}, args...)...)
+}
+
+// orLocal the executor, or Local if it is nil
+func orLocal(e Executor) Executor {
+	if e == nil {
+		return Local{}
+	}
+	return e
+}
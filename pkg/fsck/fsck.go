@@ -0,0 +1,96 @@
+package fsck
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+)
+
+// Mode how thoroughly to check a filesystem
+type Mode int
+
+const (
+	// Preen check the filesystem only if it is not marked clean, and fix only what is safe to fix without
+	// asking, as at boot; this is quick for a filesystem that was unmounted cleanly
+	Preen Mode = iota
+	// Full check the whole filesystem, even if it is marked clean, fixing everything it finds
+	Full
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Preen:
+		return "preen"
+	case Full:
+		return "full"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// the bits of the exit code of fsck, see fsck(8) and e2fsck(8)
+const (
+	exitCorrected        = 1
+	exitRebootRequired   = 2
+	exitUncorrected      = 4
+	exitOperationalError = 8
+	exitUsageError       = 16
+	exitCancelled        = 32
+	exitLibraryError     = 128
+)
+
+// Result the outcome of checking a filesystem
+type Result struct {
+	ExitCode int
+	// Output what the check wrote, which says what it found
+	Output string
+}
+
+// Clean determine if the check found nothing wrong
+func (r Result) Clean() bool {
+	return r.ExitCode == 0
+}
+
+// Corrected determine if the check found errors and corrected them
+func (r Result) Corrected() bool {
+	return r.ExitCode&(exitCorrected|exitRebootRequired) != 0
+}
+
+// NeedsRepair determine if the filesystem still has errors after the check, or the check could not finish,
+// so that it takes someone to look at it before it is used
+func (r Result) NeedsRepair() bool {
+	return r.ExitCode&(exitUncorrected|exitOperationalError|exitUsageError|exitCancelled|exitLibraryError) != 0
+}
+
+// Problem describe what the exit code says, for someone to act on
+func (r Result) Problem() string {
+	problems := []string{}
+	for _, bit := range []struct {
+		code        int
+		description string
+	}{
+		{exitUncorrected, "errors left uncorrected"},
+		{exitOperationalError, "operational error"},
+		{exitUsageError, "usage or syntax error"},
+		{exitCancelled, "cancelled"},
+		{exitLibraryError, "shared library error"},
+	} {
+		if r.ExitCode&bit.code != 0 {
+			problems = append(problems, bit.description)
+		}
+	}
+	return strings.Join(problems, ", ")
+}
+
+// Check check and repair the ext2, ext3 or ext4 filesystem on a device, which must not be mounted. An error
+// is returned only if the check could not be run at all; what it found is in the Result.
+func Check(e executor.Executor, device string, mode Mode) (Result, error) {
+	args := []string{"-p"}
+	if mode == Full {
+		args = []string{"-f", "-y"}
+	}
+	args = append(args, device)
+	run, err := e.Run(context.Background(), nil, "e2fsck", args...)
+	return Result{ExitCode: run.ExitCode, Output: strings.TrimSpace(string(run.Output()))}, err
+}
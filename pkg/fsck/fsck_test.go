@@ -0,0 +1,58 @@
+package fsck
+
+import (
+	"testing"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResult(t *testing.T) {
+	tests := []struct {
+		exitCode    int
+		clean       bool
+		corrected   bool
+		needsRepair bool
+		problem     string
+	}{
+		{0, true, false, false, ""},
+		{1, false, true, false, ""},
+		{2, false, true, false, ""},
+		{3, false, true, false, ""},
+		{4, false, false, true, "errors left uncorrected"},
+		{5, false, true, true, "errors left uncorrected"},
+		{8, false, false, true, "operational error"},
+		{12, false, false, true, "errors left uncorrected, operational error"},
+		{32, false, false, true, "cancelled"},
+	}
+	for _, tt := range tests {
+		result := Result{ExitCode: tt.exitCode}
+		assert.Equal(t, tt.clean, result.Clean(), "exit code %d", tt.exitCode)
+		assert.Equal(t, tt.corrected, result.Corrected(), "exit code %d", tt.exitCode)
+		assert.Equal(t, tt.needsRepair, result.NeedsRepair(), "exit code %d", tt.exitCode)
+		assert.Equal(t, tt.problem, result.Problem(), "exit code %d", tt.exitCode)
+	}
+}
+
+func TestMode(t *testing.T) {
+	assert.Equal(t, "preen", Preen.String())
+	assert.Equal(t, "full", Full.String())
+	assert.Equal(t, "Mode(7)", Mode(7).String())
+}
+
+func TestCheck(t *testing.T) {
+	script := executor.NewScript(
+		executor.Expect("e2fsck", "-p", "/dev/mapper/volume").Returns("volume: clean, 11/65536 files\n", 0),
+		executor.Expect("e2fsck", "-f", "-y", "/dev/mapper/volume").Returns("volume: ***** FILE SYSTEM WAS MODIFIED *****\n", 1),
+	)
+	result, err := Check(script, "/dev/mapper/volume", Preen)
+	assert.Nil(t, err)
+	assert.True(t, result.Clean())
+	assert.Equal(t, "volume: clean, 11/65536 files", result.Output)
+
+	result, err = Check(script, "/dev/mapper/volume", Full)
+	assert.Nil(t, err)
+	assert.True(t, result.Corrected())
+	assert.Nil(t, script.Done())
+}
@@ -0,0 +1,320 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+)
+
+// DefaultTimeout how long a single iscsiadm command may run; a login that retries an unreachable
+// portal can take a while, but iscsiadm hanging on iscsid must not hang the driver with it
+const DefaultTimeout = 2 * time.Minute
+
+// redacted what secrets are replaced with in errors
+const redacted = executor.Redacted
+
+// IscsidSocket the abstract unix socket that iscsid listens on for iscsiadm, in the network namespace of the host
+const IscsidSocket = "@ISCSIADM_ABSTRACT_NAMESPACE"
+
+// Setting a single setting of an iface, discovery or node record
+type Setting struct {
+	Name  string
+	Value string
+	// Secret the value must not be shown, e.g. in errors
+	Secret bool
+}
+
+// Client runs iscsiadm and parses what it reports
+type Client struct {
+	// Path of iscsiadm
+	Path string
+	// Timeout of each command
+	Timeout time.Duration
+	// Executor runs the commands, on this host if nil
+	Executor executor.Executor
+	// Socket the socket of iscsid that Ping connects to, IscsidSocket if empty
+	Socket string
+}
+
+// NewClient create a Client that runs the iscsiadm on the PATH
+func NewClient() *Client {
+	return &Client{
+		Path:     "iscsiadm",
+		Timeout:  DefaultTimeout,
+		Executor: executor.Local{},
+	}
+}
+
+// run run iscsiadm, with any secrets hidden in the error if it fails
+func (c *Client) run(ctx context.Context, secrets []string, args ...string) ([]byte, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	e := c.Executor
+	if e == nil {
+		e = executor.Local{}
+	}
+	path := c.Path
+	if path == "" {
+		path = "iscsiadm"
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if len(secrets) > 0 {
+		ctx = executor.WithSecrets(ctx, secrets...)
+	}
+
+	result, err := e.Run(ctx, nil, path, args...)
+	out := result.Output()
+	if err != nil || result.ExitCode != 0 {
+		return out, &Error{
+			Args:     redactArgs(args, secrets),
+			ExitCode: result.ExitCode,
+			Output:   redact(strings.TrimSpace(string(out)), secrets),
+			Err:      err,
+		}
+	}
+	return out, nil
+}
+
+// redactArgs replace the arguments that are secrets; only whole arguments are, so that the names of
+// settings stay readable even when a secret happens to be part of one
+func redactArgs(args []string, secrets []string) []string {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		for _, secret := range secrets {
+			if secret != "" && arg == secret {
+				arg = redacted
+			}
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+// redact replace every secret in the output of iscsiadm
+func redact(out string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			out = strings.Replace(out, secret, redacted, -1)
+		}
+	}
+	return out
+}
+
+// update set each of the settings on the record selected by the arguments
+func (c *Client) update(ctx context.Context, record []string, settings []Setting) error {
+	for _, setting := range settings {
+		var secrets []string
+		if setting.Secret {
+			secrets = []string{setting.Value}
+		}
+		args := append(append([]string{}, record...), "-o", "update", "-n", setting.Name, "-v", setting.Value)
+		if _, err := c.run(ctx, secrets, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sessions list the active sessions, with their portals, ifaces and devices
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	out, err := c.run(ctx, nil, "--mode", "session", "-P", "3")
+	if ExitCode(err) == ExitNoObjectsFound {
+		return []Session{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseSessions(string(out))
+}
+
+// Ifaces list the ifaces
+func (c *Client) Ifaces(ctx context.Context) ([]Iface, error) {
+	out, err := c.run(ctx, nil, "--mode", "iface")
+	if ExitCode(err) == ExitNoObjectsFound {
+		return []Iface{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseIfaces(string(out))
+}
+
+// Iface the record of an iface
+func (c *Client) Iface(ctx context.Context, name string) (Record, error) {
+	out, err := c.run(ctx, nil, "-I", name, "--mode", "iface", "-o", "show")
+	if err != nil {
+		return nil, err
+	}
+	return ParseRecord(string(out))
+}
+
+// CreateIface create an iface, with default settings
+func (c *Client) CreateIface(ctx context.Context, name string) error {
+	_, err := c.run(ctx, nil, "-I", name, "--mode", "iface", "-o", "new")
+	return err
+}
+
+// UpdateIface change settings of an iface
+func (c *Client) UpdateIface(ctx context.Context, name string, settings []Setting) error {
+	return c.update(ctx, []string{"-I", name, "--mode", "iface"}, settings)
+}
+
+// Discover discover the targets at a portal with sendtargets, creating or updating their node records for the
+// iface. Settings, such as CHAP credentials for discovery, are set on the discovery record first.
+func (c *Client) Discover(ctx context.Context, iface, portal string, settings []Setting) ([]Node, error) {
+	var args []string
+	if len(settings) == 0 {
+		args = []string{"-I", iface, "--mode", "discovery", "--portal", portal, "--type", "sendtargets", "--discover"}
+	} else {
+		// discovery with settings takes a discovery record to hold them
+		record := []string{"-I", iface, "--mode", "discoverydb", "--portal", portal, "--type", "sendtargets"}
+		if _, err := c.run(ctx, nil, append(record, "-o", "new")...); err != nil {
+			return nil, err
+		}
+		if err := c.update(ctx, record, settings); err != nil {
+			return nil, err
+		}
+		args = append(record, "--discover")
+	}
+	out, err := c.run(ctx, nil, args...)
+	if ExitCode(err) == ExitNoObjectsFound {
+		return []Node{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodes(string(out))
+}
+
+// Nodes list the node records
+func (c *Client) Nodes(ctx context.Context) ([]Node, error) {
+	out, err := c.run(ctx, nil, "--mode", "node")
+	if ExitCode(err) == ExitNoObjectsFound {
+		return []Node{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseNodes(string(out))
+}
+
+// nodeRecord the arguments that select the node record of a target at a portal for an iface
+func nodeRecord(iface, portal, target string) []string {
+	return []string{"-I", iface, "--mode", "node", "--portal", portal, "--targetname", target}
+}
+
+// Node the node record of a target at a portal for an iface
+func (c *Client) Node(ctx context.Context, iface, portal, target string) (Record, error) {
+	out, err := c.run(ctx, nil, append(nodeRecord(iface, portal, target), "-o", "show")...)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRecord(string(out))
+}
+
+// UpdateNode change settings of a node record, which are used for every later login with it
+func (c *Client) UpdateNode(ctx context.Context, iface, portal, target string, settings []Setting) error {
+	return c.update(ctx, nodeRecord(iface, portal, target), settings)
+}
+
+// Login log in to a target at a portal; a session that already exists is fine
+func (c *Client) Login(ctx context.Context, iface, portal, target string) error {
+	_, err := c.run(ctx, nil, append(nodeRecord(iface, portal, target), "--login")...)
+	if ExitCode(err) == ExitSessionExists {
+		return nil
+	}
+	return err
+}
+
+// Logout log out of a target at a portal; no session to log out of is fine
+func (c *Client) Logout(ctx context.Context, iface, portal, target string) error {
+	_, err := c.run(ctx, nil, append(nodeRecord(iface, portal, target), "--logout")...)
+	switch ExitCode(err) {
+	case ExitNoObjectsFound, ExitSessionNotFound:
+		return nil
+	}
+	return err
+}
+
+// DeleteNode delete the node record of a target at a portal, with any settings it holds; no record is fine
+func (c *Client) DeleteNode(ctx context.Context, iface, portal, target string) error {
+	_, err := c.run(ctx, nil, append(nodeRecord(iface, portal, target), "-o", "delete")...)
+	if ExitCode(err) == ExitNoObjectsFound {
+		return nil
+	}
+	return err
+}
+
+// DeleteDiscovery delete the sendtargets discovery record of a portal, with any settings it holds, such as CHAP
+// credentials for discovery, and the node records that were discovered with it; no record is fine
+func (c *Client) DeleteDiscovery(ctx context.Context, iface, portal string) error {
+	_, err := c.run(ctx, nil, "-I", iface, "--mode", "discoverydb", "--portal", portal, "--type", "sendtargets", "-o", "delete")
+	if ExitCode(err) == ExitNoObjectsFound {
+		return nil
+	}
+	return err
+}
+
+// Ping connect to iscsid, as iscsiadm does for every operation that iscsid carries out, failing with
+// ExitIscsidNotConnected as iscsiadm would if it cannot. Listing sessions does not tell, since iscsiadm reads
+// them from sysfs, and asks iscsid about them only if there are any.
+func (c *Client) Ping(ctx context.Context) error {
+	socket := c.Socket
+	if socket == "" {
+		socket = IscsidSocket
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return &Error{ExitCode: ExitIscsidNotConnected, Output: err.Error()}
+	}
+	return conn.Close()
+}
+
+// Error an iscsiadm command that failed
+type Error struct {
+	// Args the arguments, with any secrets hidden
+	Args     []string
+	ExitCode int
+	Output   string
+	// Err the error running iscsiadm, if it could not be run or did not finish
+	Err error
+}
+
+// Error return the error string
+func (e Error) Error() string {
+	command := strings.Join(append([]string{"iscsiadm"}, e.Args...), " ")
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", command, e.Err)
+	}
+	return fmt.Sprintf("%s: exit code %d (%s): %s", command, e.ExitCode, exitCodeDescription(e.ExitCode), e.Output)
+}
+
+// ExitCode the exit code of iscsiadm for an error, 0 if there is none, or -1 if the error is not from iscsiadm
+// or it did not finish
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	switch e := err.(type) {
+	case *Error:
+		if e.Err != nil {
+			return -1
+		}
+		return e.ExitCode
+	}
+	return -1
+}
@@ -0,0 +1,205 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+// reply what a replayed iscsiadm call returns: the recorded output in testdata, if any, and its exit code
+type reply struct {
+	output   string
+	exitCode int
+}
+
+// replay a client that replays recorded output for the expected calls, by their arguments, recording the calls
+func replay(t *testing.T, replies map[string]reply) (*Client, *[]string) {
+	calls := []string{}
+	client := &Client{
+		Path:    "iscsiadm",
+		Timeout: time.Second,
+		Executor: executor.Func(func(ctx context.Context, stdin []byte, command string, args ...string) (executor.Result, error) {
+			call := strings.Join(args, " ")
+			calls = append(calls, call)
+			r, ok := replies[call]
+			if !ok {
+				t.Errorf("unexpected iscsiadm %s", call)
+				return executor.Result{ExitCode: ExitInvalidArgument}, nil
+			}
+			if r.output == "" {
+				return executor.Result{ExitCode: r.exitCode}, nil
+			}
+			out, err := ioutil.ReadFile(filepath.Join("testdata", r.output))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return executor.Result{Stdout: out, ExitCode: r.exitCode}, nil
+		}),
+	}
+	return client, &calls
+}
+
+const (
+	testPortal = "10.144.144.226:3260"
+	testTarget = "iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b"
+	testNode   = "-I kubernetescsi0 --mode node --portal " + testPortal + " --targetname " + testTarget
+)
+
+func TestSessionsNoObjectsFound(t *testing.T) {
+	client, _ := replay(t, map[string]reply{"--mode session -P 3": {exitCode: ExitNoObjectsFound}})
+	sessions, err := client.Sessions(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Session{}, sessions)
+}
+
+func TestSessions(t *testing.T) {
+	client, _ := replay(t, map[string]reply{"--mode session -P 3": {output: "sessions.txt"}})
+	sessions, err := client.Sessions(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(sessions))
+}
+
+func TestPing(t *testing.T) {
+	// an abstract socket of its own, so that the iscsid of the host, if any, is left alone
+	socket := fmt.Sprintf("@csi-packet-test-iscsid-%d", os.Getpid())
+	client := &Client{Socket: socket, Timeout: time.Second}
+
+	err := client.Ping(context.Background())
+	assert.Equal(t, ExitIscsidNotConnected, ExitCode(err))
+	assert.Contains(t, err.Error(), "exit code 20 (cannot connect to iscsid)")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	assert.Nil(t, client.Ping(context.Background()))
+}
+
+func TestSessionsIscsidDown(t *testing.T) {
+	client, _ := replay(t, map[string]reply{"--mode session -P 3": {exitCode: ExitIscsidNotConnected}})
+	_, err := client.Sessions(context.Background())
+	assert.Equal(t, ExitIscsidNotConnected, ExitCode(err))
+	assert.Contains(t, err.Error(), "cannot connect to iscsid")
+}
+
+func TestLoginSessionExists(t *testing.T) {
+	client, _ := replay(t, map[string]reply{testNode + " --login": {exitCode: ExitSessionExists}})
+	assert.Nil(t, client.Login(context.Background(), "kubernetescsi0", testPortal, testTarget))
+}
+
+func TestLoginAuthFailed(t *testing.T) {
+	client, _ := replay(t, map[string]reply{testNode + " --login": {exitCode: ExitLoginAuthFailed}})
+	err := client.Login(context.Background(), "kubernetescsi0", testPortal, testTarget)
+	assert.Equal(t, ExitLoginAuthFailed, ExitCode(err))
+}
+
+func TestLogoutNoSession(t *testing.T) {
+	for _, code := range []int{ExitNoObjectsFound, ExitSessionNotFound} {
+		client, _ := replay(t, map[string]reply{testNode + " --logout": {exitCode: code}})
+		assert.Nil(t, client.Logout(context.Background(), "kubernetescsi0", testPortal, testTarget))
+	}
+}
+
+func TestDeleteNode(t *testing.T) {
+	for _, code := range []int{ExitSuccess, ExitNoObjectsFound} {
+		client, calls := replay(t, map[string]reply{testNode + " -o delete": {exitCode: code}})
+		assert.Nil(t, client.DeleteNode(context.Background(), "kubernetescsi0", testPortal, testTarget))
+		assert.Equal(t, []string{testNode + " -o delete"}, *calls)
+	}
+	client, _ := replay(t, map[string]reply{testNode + " -o delete": {exitCode: ExitDatabase}})
+	err := client.DeleteNode(context.Background(), "kubernetescsi0", testPortal, testTarget)
+	assert.Equal(t, ExitDatabase, ExitCode(err))
+}
+
+func TestDeleteDiscovery(t *testing.T) {
+	record := "-I kubernetescsi0 --mode discoverydb --portal " + testPortal + " --type sendtargets"
+	for _, code := range []int{ExitSuccess, ExitNoObjectsFound} {
+		client, calls := replay(t, map[string]reply{record + " -o delete": {exitCode: code}})
+		assert.Nil(t, client.DeleteDiscovery(context.Background(), "kubernetescsi0", testPortal))
+		assert.Equal(t, []string{record + " -o delete"}, *calls)
+	}
+	client, _ := replay(t, map[string]reply{record + " -o delete": {exitCode: ExitDatabase}})
+	err := client.DeleteDiscovery(context.Background(), "kubernetescsi0", testPortal)
+	assert.Equal(t, ExitDatabase, ExitCode(err))
+}
+
+func TestDiscoverWithSettings(t *testing.T) {
+	record := "-I kubernetescsi0 --mode discoverydb --portal " + testPortal + " --type sendtargets"
+	client, calls := replay(t, map[string]reply{
+		record + " -o new": {},
+		record + " -o update -n discovery.sendtargets.auth.authmethod -v CHAP": {},
+		record + " -o update -n discovery.sendtargets.auth.password -v pass":   {},
+		record + " --discover": {output: "nodes.txt"},
+	})
+	nodes, err := client.Discover(context.Background(), "kubernetescsi0", testPortal, []Setting{
+		{Name: "discovery.sendtargets.auth.authmethod", Value: "CHAP"},
+		{Name: "discovery.sendtargets.auth.password", Value: "pass", Secret: true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(*calls))
+	assert.Equal(t, 2, len(nodes))
+	assert.Equal(t, testTarget, nodes[0].Target)
+}
+
+func TestUpdateRedactsSecrets(t *testing.T) {
+	client, _ := replay(t, map[string]reply{
+		testNode + " -o update -n node.session.auth.password -v hunter2": {exitCode: ExitDatabase},
+	})
+	err := client.UpdateNode(context.Background(), "kubernetescsi0", testPortal, testTarget, []Setting{
+		{Name: "node.session.auth.password", Value: "hunter2", Secret: true},
+	})
+	assert.Equal(t, ExitDatabase, ExitCode(err))
+	assert.NotContains(t, err.Error(), "hunter2")
+	assert.Contains(t, err.Error(), "node.session.auth.password")
+}
+
+func TestUpdateRecordsRedacted(t *testing.T) {
+	client, _ := replay(t, map[string]reply{
+		testNode + " -o update -n node.session.auth.password -v hunter2": {},
+	})
+	recorder := &executor.Recorder{Executor: client.Executor}
+	client.Executor = recorder
+	err := client.UpdateNode(context.Background(), "kubernetescsi0", testPortal, testTarget, []Setting{
+		{Name: "node.session.auth.password", Value: "hunter2", Secret: true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "iscsiadm "+testNode+" -o update -n node.session.auth.password -v <redacted>", recorder.Exchanges()[0].String())
+}
+
+func TestNode(t *testing.T) {
+	client, _ := replay(t, map[string]reply{testNode + " -o show": {output: "node-record.txt"}})
+	record, err := client.Node(context.Background(), "kubernetescsi0", testPortal, testTarget)
+	assert.Nil(t, err)
+	assert.Equal(t, "CHAP", record["node.session.auth.authmethod"])
+	assert.Equal(t, "", record["node.session.auth.username_in"])
+}
+
+func TestRunTimeout(t *testing.T) {
+	client := &Client{
+		Timeout: time.Millisecond,
+		Executor: executor.Func(func(ctx context.Context, stdin []byte, command string, args ...string) (executor.Result, error) {
+			<-ctx.Done()
+			return executor.Result{ExitCode: -1}, ctx.Err()
+		}),
+	}
+	_, err := client.Ifaces(context.Background())
+	assert.Equal(t, -1, ExitCode(err))
+	assert.Contains(t, err.Error(), "deadline exceeded")
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, -1, ExitCode(errors.New("other")))
+	assert.Equal(t, ExitNoObjectsFound, ExitCode(&Error{ExitCode: ExitNoObjectsFound}))
+}
@@ -0,0 +1,84 @@
+package iscsi
+
+import "fmt"
+
+// the exit codes of iscsiadm, see iscsiadm(8)
+const (
+	ExitSuccess               = 0
+	ExitGeneric               = 1
+	ExitSessionNotFound       = 2
+	ExitNoMemory              = 3
+	ExitTransport             = 4
+	ExitLogin                 = 5
+	ExitDatabase              = 6
+	ExitInvalidArgument       = 7
+	ExitTransportTimeout      = 8
+	ExitInternal              = 9
+	ExitLogout                = 10
+	ExitPDUTimeout            = 11
+	ExitTransportNotFound     = 12
+	ExitAccess                = 13
+	ExitTransportCapabilities = 14
+	ExitSessionExists         = 15
+	ExitInvalidRequest        = 16
+	ExitISNSUnavailable       = 17
+	ExitIscsidCommunication   = 18
+	ExitFatalLogin            = 19
+	ExitIscsidNotConnected    = 20
+	ExitNoObjectsFound        = 21
+	ExitSysfsLookup           = 22
+	ExitHostNotFound          = 23
+	ExitLoginAuthFailed       = 24
+	ExitISNSQuery             = 25
+	ExitISNSRegistration      = 26
+	ExitOperationNotSupported = 27
+	ExitBusy                  = 28
+	ExitAgain                 = 29
+	ExitUnknownDiscoveryType  = 30
+	ExitChildTerminated       = 31
+	ExitSessionNotConnected   = 32
+)
+
+var exitCodeDescriptions = map[int]string{
+	ExitSuccess:               "success",
+	ExitGeneric:               "generic error",
+	ExitSessionNotFound:       "session not found",
+	ExitNoMemory:              "out of memory",
+	ExitTransport:             "transport error",
+	ExitLogin:                 "login failed",
+	ExitDatabase:              "record database error",
+	ExitInvalidArgument:       "invalid argument",
+	ExitTransportTimeout:      "transport timeout",
+	ExitInternal:              "internal iscsid error",
+	ExitLogout:                "logout failed",
+	ExitPDUTimeout:            "PDU timeout",
+	ExitTransportNotFound:     "transport not found",
+	ExitAccess:                "access denied",
+	ExitTransportCapabilities: "transport capabilities missing",
+	ExitSessionExists:         "session exists",
+	ExitInvalidRequest:        "invalid request",
+	ExitISNSUnavailable:       "iSNS unavailable",
+	ExitIscsidCommunication:   "iscsid communication error",
+	ExitFatalLogin:            "fatal login error",
+	ExitIscsidNotConnected:    "cannot connect to iscsid",
+	ExitNoObjectsFound:        "no objects found",
+	ExitSysfsLookup:           "sysfs lookup failed",
+	ExitHostNotFound:          "host not found",
+	ExitLoginAuthFailed:       "login authentication failed",
+	ExitISNSQuery:             "iSNS query failed",
+	ExitISNSRegistration:      "iSNS registration failed",
+	ExitOperationNotSupported: "operation not supported",
+	ExitBusy:                  "device or resource busy",
+	ExitAgain:                 "try again",
+	ExitUnknownDiscoveryType:  "unknown discovery type",
+	ExitChildTerminated:       "child process terminated",
+	ExitSessionNotConnected:   "session not connected",
+}
+
+// exitCodeDescription what an exit code of iscsiadm means
+func exitCodeDescription(code int) string {
+	if description, ok := exitCodeDescriptions[code]; ok {
+		return description
+	}
+	return fmt.Sprintf("unknown exit code %d", code)
+}
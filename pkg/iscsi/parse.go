@@ -0,0 +1,286 @@
+package iscsi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// empty how iscsiadm shows a value that is not set
+const empty = "<empty>"
+
+// Portal an address of a target, with its target portal group tag
+type Portal struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+	TPGT int    `json:"tpgt"`
+}
+
+// String the portal as iscsiadm takes it, ip:port, with IPv6 addresses in brackets
+func (p Portal) String() string {
+	return net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+}
+
+// ParsePortal read a portal as iscsiadm shows it, ip:port,tpgt; the tpgt is optional
+func ParsePortal(s string) (Portal, error) {
+	p := Portal{TPGT: -1}
+	address := s
+	if i := strings.LastIndex(s, ","); i >= 0 {
+		tpgt, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return p, fmt.Errorf("invalid portal group tag in portal %s", s)
+		}
+		p.TPGT = tpgt
+		address = s[:i]
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return p, fmt.Errorf("invalid portal %s: %v", s, err)
+	}
+	p.IP = host
+	if p.Port, err = strconv.Atoi(port); err != nil {
+		return p, fmt.Errorf("invalid port in portal %s", s)
+	}
+	return p, nil
+}
+
+// Session an active session, as iscsiadm --mode session -P 3 shows it
+type Session struct {
+	SID              int    `json:"sid"`
+	Target           string `json:"target"`
+	Portal           Portal `json:"portal"`
+	PersistentPortal Portal `json:"persistentPortal"`
+	Iface            string `json:"iface"`
+	Transport        string `json:"transport"`
+	Initiator        string `json:"initiator"`
+	IPAddress        string `json:"ipAddress"`
+	// ConnectionState e.g. LOGGED IN, or TRANSPORT WAIT while it reconnects
+	ConnectionState string `json:"connectionState"`
+	// SessionState e.g. LOGGED_IN, or FAILED
+	SessionState string `json:"sessionState"`
+	// HostNumber the SCSI host of the session, -1 if it has none
+	HostNumber int `json:"hostNumber"`
+	// Devices the SCSI disks attached by the session, e.g. sdb
+	Devices []Device `json:"devices"`
+}
+
+// LoggedIn check if the session is logged in, rather than failed or recovering
+func (s Session) LoggedIn() bool {
+	return s.SessionState == "LOGGED_IN"
+}
+
+// Device a SCSI disk attached by a session
+type Device struct {
+	Name  string `json:"name"`
+	LUN   int    `json:"lun"`
+	State string `json:"state"`
+}
+
+// ParseSessions read the output of iscsiadm --mode session -P 3:
+//
+//	Target: iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b (non-flash)
+//		Current Portal: 10.144.144.226:3260,1
+//		Persistent Portal: 10.144.144.226:3260,1
+//			Iface Name: kubernetescsi0
+//			...
+//			SID: 1
+//			...
+//			Host Number: 2	State: running
+//			scsi2 Channel 00 Id 0 Lun: 0
+//				Attached scsi disk sdb		State: running
+//
+// A target with several portals is followed by each of their sessions.
+func ParseSessions(out string) ([]Session, error) {
+	sessions := []Session{}
+	var target string
+	var session *Session
+	lun := -1
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "Target: "):
+			target = strings.Fields(strings.TrimPrefix(line, "Target: "))[0]
+		case strings.HasPrefix(line, "Current Portal: "):
+			portal, err := ParsePortal(strings.TrimPrefix(line, "Current Portal: "))
+			if err != nil {
+				return nil, err
+			}
+			if target == "" {
+				return nil, fmt.Errorf("portal %s before any target", portal)
+			}
+			sessions = append(sessions, Session{Target: target, Portal: portal, SID: -1, HostNumber: -1, Devices: []Device{}})
+			session = &sessions[len(sessions)-1]
+			lun = -1
+		case session == nil:
+			continue
+		case strings.HasPrefix(line, "Persistent Portal: "):
+			portal, err := ParsePortal(strings.TrimPrefix(line, "Persistent Portal: "))
+			if err != nil {
+				return nil, err
+			}
+			session.PersistentPortal = portal
+		case strings.HasPrefix(line, "Host Number: "):
+			fields := strings.Fields(strings.TrimPrefix(line, "Host Number: "))
+			host, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid host number in %q", line)
+			}
+			session.HostNumber = host
+		case strings.HasPrefix(line, "scsi") && strings.Contains(line, " Lun: "):
+			n, err := strconv.Atoi(strings.TrimSpace(line[strings.LastIndex(line, " Lun: ")+len(" Lun: "):]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid lun in %q", line)
+			}
+			lun = n
+		case strings.HasPrefix(line, "Attached scsi disk "):
+			fields := strings.Fields(strings.TrimPrefix(line, "Attached scsi disk "))
+			device := Device{Name: fields[0], LUN: lun}
+			if len(fields) == 3 && fields[1] == "State:" {
+				device.State = fields[2]
+			}
+			session.Devices = append(session.Devices, device)
+		default:
+			name, value, ok := field(line, ": ")
+			if !ok {
+				continue
+			}
+			switch name {
+			case "Iface Name":
+				session.Iface = value
+			case "Iface Transport":
+				session.Transport = value
+			case "Iface Initiatorname":
+				session.Initiator = value
+			case "Iface IPaddress":
+				session.IPAddress = value
+			case "SID":
+				sid, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid session id in %q", line)
+				}
+				session.SID = sid
+			case "iSCSI Connection State":
+				session.ConnectionState = value
+			case "iSCSI Session State":
+				session.SessionState = value
+			}
+		}
+	}
+	return sessions, scanner.Err()
+}
+
+// field split a line into its name and value, with <empty> values as ""
+func field(line, separator string) (string, string, bool) {
+	parts := strings.SplitN(line, separator, 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	value := strings.TrimSpace(parts[1])
+	if value == empty {
+		value = ""
+	}
+	return strings.TrimSpace(parts[0]), value, true
+}
+
+// Node a node record, a target at a portal, as iscsiadm --mode node and discovery show them
+type Node struct {
+	Portal Portal `json:"portal"`
+	Target string `json:"target"`
+}
+
+// ParseNodes read the output of iscsiadm --mode node, or of discovery, a line for each portal and target:
+//
+//	10.144.144.226:3260,1 iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b
+func ParseNodes(out string) ([]Node, error) {
+	nodes := []Node{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid node %q", scanner.Text())
+		}
+		portal, err := ParsePortal(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, Node{Portal: portal, Target: fields[1]})
+	}
+	return nodes, scanner.Err()
+}
+
+// Iface an iface, as iscsiadm --mode iface lists them
+type Iface struct {
+	Name      string `json:"name"`
+	Transport string `json:"transport"`
+	HWAddress string `json:"hwAddress"`
+	IPAddress string `json:"ipAddress"`
+	NetDev    string `json:"netDev"`
+	Initiator string `json:"initiator"`
+}
+
+// ParseIfaces read the output of iscsiadm --mode iface, a line for each iface:
+//
+//	kubernetescsi0 tcp,<empty>,<empty>,<empty>,iqn.2014-05.net.packet:device.7c8d0ba0
+func ParseIfaces(out string) ([]Iface, error) {
+	ifaces := []Iface{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid iface %q", scanner.Text())
+		}
+		values := strings.Split(fields[1], ",")
+		if len(values) != 5 {
+			return nil, fmt.Errorf("invalid iface %q", scanner.Text())
+		}
+		for i := range values {
+			if values[i] == empty {
+				values[i] = ""
+			}
+		}
+		ifaces = append(ifaces, Iface{
+			Name:      fields[0],
+			Transport: values[0],
+			HWAddress: values[1],
+			IPAddress: values[2],
+			NetDev:    values[3],
+			Initiator: values[4],
+		})
+	}
+	return ifaces, scanner.Err()
+}
+
+// Record the settings of an iface, discovery or node record, by name, with values that are not set as ""
+type Record map[string]string
+
+// ParseRecord read a record as iscsiadm -o show shows it:
+//
+//	# BEGIN RECORD 2.0-874
+//	iface.iscsi_ifacename = default
+//	iface.net_ifacename = <empty>
+//	# END RECORD
+func ParseRecord(out string) (Record, error) {
+	record := Record{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := field(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid record setting %q", line)
+		}
+		record[name] = value
+	}
+	return record, scanner.Err()
+}
@@ -0,0 +1,124 @@
+package iscsi
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// update rewrite the golden files from what the parsers return, after checking the changes by hand
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// golden parse a recorded iscsiadm output in testdata and compare the result, as JSON, to its golden file
+func golden(t *testing.T, name string, parse func(string) (interface{}, error)) {
+	out, err := ioutil.ReadFile(filepath.Join("testdata", name+".txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := parse(string(out))
+	if err != nil {
+		t.Fatalf("parsing %s: %v", name, err)
+	}
+	actual, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual = append(actual, '\n')
+	path := filepath.Join("testdata", name+".golden.json")
+	if *update {
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(expected), string(actual), name)
+}
+
+func TestParseSessionsGolden(t *testing.T) {
+	golden(t, "sessions", func(out string) (interface{}, error) { return ParseSessions(out) })
+}
+
+func TestParseNodesGolden(t *testing.T) {
+	golden(t, "nodes", func(out string) (interface{}, error) { return ParseNodes(out) })
+}
+
+func TestParseIfacesGolden(t *testing.T) {
+	golden(t, "ifaces", func(out string) (interface{}, error) { return ParseIfaces(out) })
+}
+
+func TestParseRecordGolden(t *testing.T) {
+	golden(t, "iface-default", func(out string) (interface{}, error) { return ParseRecord(out) })
+	golden(t, "node-record", func(out string) (interface{}, error) { return ParseRecord(out) })
+}
+
+func TestParseSessions(t *testing.T) {
+	out, err := ioutil.ReadFile("testdata/sessions.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := ParseSessions(string(out))
+	assert.Nil(t, err)
+	if !assert.Equal(t, 3, len(sessions)) {
+		return
+	}
+	// two portals of one target
+	assert.Equal(t, sessions[0].Target, sessions[1].Target)
+	assert.True(t, sessions[0].LoggedIn())
+	assert.False(t, sessions[1].LoggedIn())
+	assert.Equal(t, "TRANSPORT WAIT", sessions[1].ConnectionState)
+	assert.Equal(t, []Device{{Name: "sdc", LUN: 0, State: "blocked"}}, sessions[1].Devices)
+	// IPv6 portals keep their brackets only as a string
+	assert.Equal(t, Portal{IP: "fd00:ab::12", Port: 3260, TPGT: 1}, sessions[2].Portal)
+	assert.Equal(t, "[fd00:ab::12]:3260", sessions[2].Portal.String())
+	assert.Equal(t, 2, len(sessions[2].Devices))
+	assert.Equal(t, 1, sessions[2].Devices[1].LUN)
+}
+
+func TestParseSessionsNone(t *testing.T) {
+	sessions, err := ParseSessions("")
+	assert.Nil(t, err)
+	assert.Equal(t, []Session{}, sessions)
+}
+
+func TestParsePortal(t *testing.T) {
+	tests := []struct {
+		portal   string
+		expected Portal
+		valid    bool
+	}{
+		{"10.144.144.226:3260,1", Portal{IP: "10.144.144.226", Port: 3260, TPGT: 1}, true},
+		{"10.144.144.226:3260", Portal{IP: "10.144.144.226", Port: 3260, TPGT: -1}, true},
+		{"[fd00:ab::12]:3260,1", Portal{IP: "fd00:ab::12", Port: 3260, TPGT: 1}, true},
+		{"10.144.144.226", Portal{}, false},
+		{"10.144.144.226:3260,x", Portal{}, false},
+		{"10.144.144.226:port,1", Portal{}, false},
+	}
+	for _, tt := range tests {
+		portal, err := ParsePortal(tt.portal)
+		assert.Equal(t, tt.valid, err == nil, tt.portal)
+		if tt.valid {
+			assert.Equal(t, tt.expected, portal, tt.portal)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	_, err := ParseNodes("10.144.144.226:3260,1")
+	assert.NotNil(t, err)
+	_, err = ParseIfaces("default tcp,<empty>")
+	assert.NotNil(t, err)
+	_, err = ParseRecord("# BEGIN RECORD 2.0-874\niface.iscsi_ifacename default\n")
+	assert.NotNil(t, err)
+	_, err = ParseSessions("\tCurrent Portal: 10.144.144.226:3260,1\n")
+	assert.NotNil(t, err)
+	_, err = ParseSessions(strings.Join([]string{"Target: iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b", "\tCurrent Portal: 10.144.144.226:3260,1", "\t\tSID: one"}, "\n"))
+	assert.NotNil(t, err)
+}
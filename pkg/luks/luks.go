@@ -0,0 +1,161 @@
+package luks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+)
+
+// the exit codes of cryptsetup, see cryptsetup(8)
+const (
+	exitNoPermission = 2
+	exitWrongDevice  = 4
+	exitBusy         = 5
+)
+
+// Error a cryptsetup command that failed
+type Error struct {
+	Op       string
+	Device   string
+	ExitCode int
+	// Output what cryptsetup wrote, which never includes the key
+	Output string
+	// Err the error running cryptsetup, if it could not be run at all
+	Err error
+}
+
+// Error return the error string
+func (e Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("cryptsetup %s %s: %v", e.Op, e.Device, e.Err)
+	}
+	return fmt.Sprintf("cryptsetup %s %s: exit code %d: %s", e.Op, e.Device, e.ExitCode, e.Output)
+}
+
+// IsBadKey check if this error is because the key did not open the device
+func IsBadKey(err error) bool {
+	switch e := err.(type) {
+	case *Error:
+		return e.ExitCode == exitNoPermission
+	}
+	return false
+}
+
+// IsBusy check if this error is because the device or mapping is in use, or already exists
+func IsBusy(err error) bool {
+	switch e := err.(type) {
+	case *Error:
+		return e.ExitCode == exitBusy
+	}
+	return false
+}
+
+// Status what an active mapping is
+type Status struct {
+	// Type the type of the mapping, e.g. LUKS2
+	Type string
+	// Device the device that the mapping decrypts
+	Device   string
+	ReadOnly bool
+}
+
+// cryptsetup run cryptsetup, with the key, if any, on its standard input, so that it never is on the command line
+func cryptsetup(e executor.Executor, op, device string, key []byte, args ...string) (string, error) {
+	result, err := e.Run(context.Background(), key, "cryptsetup", args...)
+	output := strings.TrimSpace(string(result.Output()))
+	if err != nil {
+		return output, &Error{Op: op, Device: device, Err: err}
+	}
+	if result.ExitCode != 0 {
+		return output, &Error{Op: op, Device: device, ExitCode: result.ExitCode, Output: output}
+	}
+	return output, nil
+}
+
+// Format write a new LUKS2 header to a device, with the key in its first key slot. Everything on the device is lost.
+func Format(e executor.Executor, device string, key []byte) error {
+	_, err := cryptsetup(e, "luksFormat", device, key, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-", device)
+	return err
+}
+
+// Open open the LUKS device with the key, as the mapping /dev/mapper/<name>. A mapping of the same device
+// that already is open is fine, but one of another device is an error.
+func Open(e executor.Executor, device, name string, key []byte, readOnly bool) error {
+	status, err := GetStatus(e, name)
+	if err != nil {
+		return err
+	}
+	if status != nil {
+		if status.Device != device {
+			return &Error{Op: "open", Device: device, ExitCode: exitBusy, Output: fmt.Sprintf("mapping %s already is open for %s", name, status.Device)}
+		}
+		return nil
+	}
+	args := []string{"open", "--type", "luks", "--key-file", "-"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	args = append(args, device, name)
+	_, err = cryptsetup(e, "open", device, key, args...)
+	return err
+}
+
+// Close close the mapping /dev/mapper/<name>, if it is open
+func Close(e executor.Executor, name string) error {
+	status, err := GetStatus(e, name)
+	if err != nil || status == nil {
+		return err
+	}
+	_, err = cryptsetup(e, "close", name, nil, "close", name)
+	return err
+}
+
+// Resize grow the mapping /dev/mapper/<name> to the size of its device, after the device grew. LUKS2 may
+// keep its volume key in the kernel keyring, in which case resizing takes the key again.
+func Resize(e executor.Executor, name string, key []byte) error {
+	_, err := cryptsetup(e, "resize", name, key, "resize", "--key-file", "-", name)
+	return err
+}
+
+// GetStatus the status of the mapping /dev/mapper/<name>, or nil if it is not active
+func GetStatus(e executor.Executor, name string) (*Status, error) {
+	out, err := cryptsetup(e, "status", name, nil, "status", name)
+	if e, ok := err.(*Error); ok && e.ExitCode == exitWrongDevice {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseStatus(out), nil
+}
+
+// parseStatus read the output of cryptsetup status, which is a line about the mapping followed by fields:
+//
+//	/dev/mapper/volume-3ee59355-crypt is active and is in use.
+//	  type:    LUKS2
+//	  cipher:  aes-xts-plain64
+//	  device:  /dev/mapper/volume-3ee59355
+//	  mode:    read/write
+func parseStatus(out string) *Status {
+	status := &Status{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case "type":
+			status.Type = value
+		case "device":
+			status.Device = value
+		case "mode":
+			status.ReadOnly = value == "readonly"
+		}
+	}
+	return status
+}
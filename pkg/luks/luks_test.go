@@ -0,0 +1,85 @@
+package luks
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStatus(t *testing.T) {
+	status := parseStatus(`/dev/mapper/volume-3ee59355-crypt is active and is in use.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: keyring
+  device:  /dev/mapper/volume-3ee59355
+  sector size:  512
+  offset:  32768 sectors
+  size:    20938752 sectors
+  mode:    read/write`)
+	assert.Equal(t, &Status{Type: "LUKS2", Device: "/dev/mapper/volume-3ee59355"}, status)
+
+	status = parseStatus(`/dev/mapper/volume-3ee59355-crypt is active.
+  type:    LUKS2
+  device:  /dev/mapper/volume-3ee59355
+  mode:    readonly`)
+	assert.True(t, status.ReadOnly)
+}
+
+func TestErrors(t *testing.T) {
+	badKey := &Error{Op: "open", Device: "/dev/mapper/volume-1", ExitCode: 2, Output: "No key available with this passphrase."}
+	assert.True(t, IsBadKey(badKey))
+	assert.False(t, IsBusy(badKey))
+	assert.Equal(t, "cryptsetup open /dev/mapper/volume-1: exit code 2: No key available with this passphrase.", badKey.Error())
+
+	busy := &Error{Op: "close", Device: "volume-1-crypt", ExitCode: 5}
+	assert.True(t, IsBusy(busy))
+	assert.False(t, IsBadKey(busy))
+
+	notRun := &Error{Op: "open", Device: "/dev/mapper/volume-1", Err: errors.New("executable file not found in $PATH")}
+	assert.Equal(t, "cryptsetup open /dev/mapper/volume-1: executable file not found in $PATH", notRun.Error())
+	assert.False(t, IsBadKey(errors.New("exit status 2")))
+}
+
+func TestOpen(t *testing.T) {
+	script := executor.NewScript(
+		executor.Expect("cryptsetup", "status", "volume-1-crypt").Returns("/dev/mapper/volume-1-crypt is inactive.\n", 4),
+		executor.Expect("cryptsetup", "open", "--type", "luks", "--key-file", "-", "/dev/mapper/volume-1", "volume-1-crypt"),
+		// opening it again finds it open
+		executor.Expect("cryptsetup", "status", "volume-1-crypt").Returns("/dev/mapper/volume-1-crypt is active.\n  type:    LUKS2\n  device:  /dev/mapper/volume-1\n", 0),
+		// but not for another device
+		executor.Expect("cryptsetup", "status", "volume-1-crypt").Returns("/dev/mapper/volume-1-crypt is active.\n  type:    LUKS2\n  device:  /dev/mapper/volume-2\n", 0),
+	)
+	assert.Nil(t, Open(script, "/dev/mapper/volume-1", "volume-1-crypt", []byte("passphrase"), false))
+	// the key is on stdin, never on the command line
+	assert.Equal(t, []byte("passphrase"), script.Stdin(1))
+	assert.Nil(t, Open(script, "/dev/mapper/volume-1", "volume-1-crypt", []byte("passphrase"), false))
+	assert.True(t, IsBusy(Open(script, "/dev/mapper/volume-1", "volume-1-crypt", []byte("passphrase"), false)))
+	assert.Nil(t, script.Done())
+}
+
+func TestClose(t *testing.T) {
+	script := executor.NewScript(
+		executor.Expect("cryptsetup", "status", "volume-1-crypt").Returns("", 4),
+		executor.Expect("cryptsetup", "status", "volume-1-crypt").Returns("/dev/mapper/volume-1-crypt is active and is in use.\n  device:  /dev/mapper/volume-1\n", 0),
+		executor.Expect("cryptsetup", "close", "volume-1-crypt").Returns("Device volume-1-crypt is still in use.\n", 5),
+	)
+	// a mapping that is not open is fine
+	assert.Nil(t, Close(script, "volume-1-crypt"))
+	assert.True(t, IsBusy(Close(script, "volume-1-crypt")))
+	assert.Nil(t, script.Done())
+}
+
+func TestResize(t *testing.T) {
+	script := executor.NewScript(
+		executor.Expect("cryptsetup", "resize", "--key-file", "-", "volume-1-crypt"),
+		executor.Expect("cryptsetup", "resize", "--key-file", "-", "volume-1-crypt").Returns("No key available with this passphrase.\n", 2),
+	)
+	assert.Nil(t, Resize(script, "volume-1-crypt", []byte("passphrase")))
+	assert.Equal(t, []byte("passphrase"), script.Stdin(0))
+	assert.True(t, IsBadKey(Resize(script, "volume-1-crypt", []byte("wrong"))))
+	assert.Nil(t, script.Done())
+}
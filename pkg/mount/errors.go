@@ -0,0 +1,89 @@
+package mount
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Error a mount or unmount that failed
+type Error struct {
+	Op      string
+	Source  string
+	Target  string
+	FSType  string
+	Options []string
+	// Err why it failed, a syscall.Errno for mount(2) and umount(2), or the exit error of mount(8)
+	Err error
+	// Output what mount(8) wrote, if it was run
+	Output string
+}
+
+// Error return the error string
+func (e Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	if e.Source != "" {
+		fmt.Fprintf(&b, " %s", e.Source)
+	}
+	fmt.Fprintf(&b, " %s", e.Target)
+	if e.FSType != "" {
+		fmt.Fprintf(&b, " type %s", e.FSType)
+	}
+	if len(e.Options) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(e.Options, ","))
+	}
+	fmt.Fprintf(&b, ": %v", e.Err)
+	if e.Output != "" {
+		fmt.Fprintf(&b, ": %s", e.Output)
+	}
+	return b.String()
+}
+
+// IsMountError check if this error is a failed mount or unmount
+func IsMountError(err error) bool {
+	switch err.(type) {
+	case *Error:
+		return true
+	}
+	return false
+}
+
+// ConflictError error type that something is mounted at a target already, other than what was to be mounted
+type ConflictError struct {
+	Target string
+	State  State
+	Info   MountInfo
+}
+
+// Error return the error string
+func (c ConflictError) Error() string {
+	return fmt.Sprintf("%s already is %s: %s mounted from %d:%d %s", c.Target, c.State, c.Info.Source, c.Info.Major, c.Info.Minor, c.Info.Root)
+}
+
+// IsConflict check if this error is a conflict with an existing mount
+func IsConflict(err error) bool {
+	switch err.(type) {
+	case *ConflictError:
+		return true
+	}
+	return false
+}
+
+// Errno the errno that caused an error, if it has one
+func Errno(err error) (syscall.Errno, bool) {
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e, true
+	case *Error:
+		return Errno(e.Err)
+	case *os.PathError:
+		return Errno(e.Err)
+	case *os.LinkError:
+		return Errno(e.Err)
+	case *os.SyscallError:
+		return Errno(e.Err)
+	}
+	return 0, false
+}
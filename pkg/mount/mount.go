@@ -0,0 +1,199 @@
+package mount
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+	"golang.org/x/sys/unix"
+)
+
+// optionFlags the mount options that are flags of mount(2), rather than data for the filesystem, with
+// the flag each one sets, or clears if it is negated
+var optionFlags = map[string]struct {
+	flag  uintptr
+	clear bool
+}{
+	"ro":          {unix.MS_RDONLY, false},
+	"rw":          {unix.MS_RDONLY, true},
+	"nosuid":      {unix.MS_NOSUID, false},
+	"suid":        {unix.MS_NOSUID, true},
+	"nodev":       {unix.MS_NODEV, false},
+	"dev":         {unix.MS_NODEV, true},
+	"noexec":      {unix.MS_NOEXEC, false},
+	"exec":        {unix.MS_NOEXEC, true},
+	"sync":        {unix.MS_SYNCHRONOUS, false},
+	"async":       {unix.MS_SYNCHRONOUS, true},
+	"dirsync":     {unix.MS_DIRSYNC, false},
+	"mand":        {unix.MS_MANDLOCK, false},
+	"nomand":      {unix.MS_MANDLOCK, true},
+	"noatime":     {unix.MS_NOATIME, false},
+	"atime":       {unix.MS_NOATIME, true},
+	"nodiratime":  {unix.MS_NODIRATIME, false},
+	"diratime":    {unix.MS_NODIRATIME, true},
+	"relatime":    {unix.MS_RELATIME, false},
+	"norelatime":  {unix.MS_RELATIME, true},
+	"strictatime": {unix.MS_STRICTATIME, false},
+	"lazytime":    {unix.MS_LAZYTIME, false},
+	"nolazytime":  {unix.MS_LAZYTIME, true},
+	"silent":      {unix.MS_SILENT, false},
+	"loud":        {unix.MS_SILENT, true},
+	"bind":        {unix.MS_BIND, false},
+	"rbind":       {unix.MS_BIND | unix.MS_REC, false},
+	"remount":     {unix.MS_REMOUNT, false},
+	"defaults":    {0, false},
+}
+
+// ParseOptions translate mount options, as given to mount(8), into the flags and data of mount(2).
+// Options that are not flags are passed to the filesystem, in order.
+func ParseOptions(options []string) (uintptr, string) {
+	var flags uintptr
+	data := []string{}
+	for _, option := range options {
+		if option == "" {
+			continue
+		}
+		f, ok := optionFlags[option]
+		switch {
+		case !ok:
+			data = append(data, option)
+		case f.clear:
+			flags &^= f.flag
+		default:
+			flags |= f.flag
+		}
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// WithMode replace any ro or rw in mount options with the one for a mode
+func WithMode(options []string, readOnly bool) []string {
+	mode := "rw"
+	if readOnly {
+		mode = "ro"
+	}
+	result := []string{}
+	for _, option := range options {
+		if option != "ro" && option != "rw" {
+			result = append(result, option)
+		}
+	}
+	return append(result, mode)
+}
+
+// Mount mount a filesystem with mount(2)
+func Mount(source, target, fsType string, options []string) error {
+	flags, data := ParseOptions(options)
+	if err := unix.Mount(source, target, fsType, flags, data); err != nil {
+		return &Error{Op: "mount", Source: source, Target: target, FSType: fsType, Options: options, Err: err}
+	}
+	return nil
+}
+
+// BindMount bind mount a file or directory. The kernel ignores ro when creating a bind mount, so a
+// read-only one takes a remount, which keeps the options that the new mount got from its source, as the
+// table lists them. If that fails the bind mount is removed, rather than left writable.
+func BindMount(table *Table, source, target string, readOnly bool) error {
+	if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+		return &Error{Op: "bind mount", Source: source, Target: target, Err: err}
+	}
+	if !readOnly {
+		return nil
+	}
+	info, err := table.Lookup(target)
+	if err == nil && info == nil {
+		err = fmt.Errorf("%s is not in the mount table", target)
+	}
+	if err != nil {
+		_ = unix.Unmount(target, 0)
+		return &Error{Op: "remount", Target: target, Options: []string{"ro"}, Err: err}
+	}
+	if err := Remount(target, WithMode(info.Options, true)); err != nil {
+		_ = unix.Unmount(target, 0)
+		return err
+	}
+	return nil
+}
+
+// Remount change the options of an existing bind mount. The options of the mount that are meant to stay
+// must be given too, since a remount sets all of them; see Table.Lookup for the current ones.
+func Remount(target string, options []string) error {
+	flags, _ := ParseOptions(options)
+	if err := unix.Mount("", target, "", flags|unix.MS_REMOUNT|unix.MS_BIND, ""); err != nil {
+		return &Error{Op: "remount", Target: target, Options: options, Err: err}
+	}
+	return nil
+}
+
+// Unmount unmount a path with umount(2), detaching it if lazy, so that it is unmounted once it is not busy
+func Unmount(target string, lazy bool) error {
+	var flags int
+	if lazy {
+		flags = unix.MNT_DETACH
+	}
+	if err := unix.Unmount(target, flags); err != nil {
+		return &Error{Op: "unmount", Target: target, Err: err}
+	}
+	return nil
+}
+
+// Sync write everything that is cached of the filesystem mounted at a path to its device, with syncfs(2), or
+// of the block device that is bind mounted at it, with fsync(2)
+func Sync(target string) error {
+	fd, err := unix.Open(target, unix.O_RDONLY|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return &Error{Op: "sync", Target: target, Err: err}
+	}
+	defer unix.Close(fd)
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return &Error{Op: "sync", Target: target, Err: err}
+	}
+	if stat.Mode&unix.S_IFMT == unix.S_IFDIR {
+		err = unix.Syncfs(fd)
+	} else {
+		err = unix.Fsync(fd)
+	}
+	if err != nil {
+		return &Error{Op: "sync", Target: target, Err: err}
+	}
+	return nil
+}
+
+// helperDirs where mount(8) looks for the helpers of filesystem types
+var helperDirs = []string{"/sbin", "/usr/sbin"}
+
+// NeedsHelper determine if mounting a filesystem type takes more than mount(2), i.e. if mount(8) would
+// run a helper for it, such as mount.nfs, or it is a FUSE filesystem; lstat looks for the helpers in the
+// filesystem that mount(8) runs in, such as the host's when it runs there, and os.Lstat if it is nil
+func NeedsHelper(fsType string, lstat func(string) (os.FileInfo, error)) bool {
+	if fsType == "fuse" || strings.HasPrefix(fsType, "fuse.") || strings.HasPrefix(fsType, "fuseblk") {
+		return true
+	}
+	if lstat == nil {
+		lstat = os.Lstat
+	}
+	for _, dir := range helperDirs {
+		// a helper may well be a link, which is resolved by whoever runs it
+		if _, err := lstat(dir + "/mount." + fsType); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// MountWithHelper mount a filesystem by running mount(8), for filesystems that need a helper
+func MountWithHelper(e executor.Executor, source, target, fsType string, options []string) error {
+	args := []string{"-t", fsType}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, source, target)
+	out, err := executor.CombinedOutput(context.Background(), e, "mount", args...)
+	if err != nil {
+		return &Error{Op: "mount", Source: source, Target: target, FSType: fsType, Options: options, Err: err, Output: strings.TrimSpace(string(out))}
+	}
+	return nil
+}
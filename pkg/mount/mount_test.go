@@ -0,0 +1,102 @@
+package mount
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		options []string
+		flags   uintptr
+		data    string
+	}{
+		{nil, 0, ""},
+		{[]string{"defaults"}, 0, ""},
+		{[]string{"ro", "noload"}, unix.MS_RDONLY, "noload"},
+		{[]string{"ro", "rw"}, 0, ""},
+		{[]string{"rw", "ro"}, unix.MS_RDONLY, ""},
+		{[]string{"noatime", "nodev", "nosuid", "noexec"}, unix.MS_NOATIME | unix.MS_NODEV | unix.MS_NOSUID | unix.MS_NOEXEC, ""},
+		{[]string{"remount", "bind", "ro"}, unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY, ""},
+		{[]string{"rbind"}, unix.MS_BIND | unix.MS_REC, ""},
+		{[]string{"data=ordered", "", "sync", "discard"}, unix.MS_SYNCHRONOUS, "data=ordered,discard"},
+	}
+	for _, tt := range tests {
+		flags, data := ParseOptions(tt.options)
+		assert.Equal(t, tt.flags, flags, "%v", tt.options)
+		assert.Equal(t, tt.data, data, "%v", tt.options)
+	}
+}
+
+func TestWithMode(t *testing.T) {
+	assert.Equal(t, []string{"nosuid", "relatime", "ro"}, WithMode([]string{"rw", "nosuid", "relatime"}, true))
+	assert.Equal(t, []string{"nosuid", "rw"}, WithMode([]string{"nosuid", "ro"}, false))
+	assert.Equal(t, []string{"ro"}, WithMode(nil, true))
+}
+
+func TestNeedsHelper(t *testing.T) {
+	assert.True(t, NeedsHelper("fuse.sshfs", nil))
+	assert.False(t, NeedsHelper("no-such-filesystem", nil))
+
+	// the helpers are looked for where mount(8) runs, such as under the root of the host
+	var looked []string
+	lstat := func(path string) (os.FileInfo, error) {
+		looked = append(looked, path)
+		if path == "/usr/sbin/mount.nfs" {
+			return nil, nil
+		}
+		return nil, os.ErrNotExist
+	}
+	assert.True(t, NeedsHelper("nfs", lstat))
+	assert.Equal(t, []string{"/sbin/mount.nfs", "/usr/sbin/mount.nfs"}, looked)
+	assert.False(t, NeedsHelper("ext4", lstat))
+}
+
+func TestErrors(t *testing.T) {
+	err := &Error{Op: "mount", Source: "/dev/mapper/volume-1", Target: "/mnt", FSType: "ext4", Options: []string{"ro"}, Err: unix.EBUSY}
+	assert.Equal(t, "mount /dev/mapper/volume-1 /mnt type ext4 (ro): device or resource busy", err.Error())
+	assert.True(t, IsMountError(err))
+	errno, ok := Errno(err)
+	assert.True(t, ok)
+	assert.Equal(t, unix.EBUSY, errno)
+
+	errno, ok = Errno(&os.PathError{Op: "stat", Path: "/mnt", Err: unix.ENOENT})
+	assert.True(t, ok)
+	assert.Equal(t, unix.ENOENT, errno)
+
+	_, ok = Errno(errors.New("exit status 32"))
+	assert.False(t, ok)
+	assert.False(t, IsMountError(errors.New("exit status 32")))
+
+	conflict := &ConflictError{Target: "/mnt", State: MountedOther, Info: MountInfo{Major: 8, Minor: 1, Root: "/", Source: "/dev/sda1"}}
+	assert.Equal(t, "/mnt already is mounted from another source: /dev/sda1 mounted from 8:1 /", conflict.Error())
+	assert.True(t, IsConflict(conflict))
+	assert.False(t, IsConflict(err))
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "device")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a filesystem, and what stands in for a block device
+	assert.Nil(t, Sync(dir))
+	assert.Nil(t, Sync(file))
+	err = Sync(filepath.Join(dir, "missing"))
+	assert.Equal(t, "sync "+filepath.Join(dir, "missing")+": no such file or directory", err.Error())
+	errno, ok := Errno(err)
+	assert.True(t, ok)
+	assert.Equal(t, unix.ENOENT, errno)
+}
@@ -0,0 +1,146 @@
+package mount
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MountInfo a single mount, as described by a line of /proc/<pid>/mountinfo, see proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//	(1)(2)(3)   (4)   (5)      (6)      (7)   (8) (9)   (10)         (11)
+type MountInfo struct {
+	ID       int
+	ParentID int
+	Major    uint32
+	Minor    uint32
+	// Root the directory within the filesystem that is the root of the mount, "/" unless it is a bind mount of a subdirectory
+	Root       string
+	MountPoint string
+	// Options the options of the mount itself, e.g. ro or nosuid
+	Options []string
+	// Optional the optional fields, e.g. shared:1
+	Optional []string
+	FSType   string
+	Source   string
+	// SuperOptions the options of the filesystem, shared by all of its mounts
+	SuperOptions []string
+}
+
+// ReadOnly determine if the mount is read-only
+func (m MountInfo) ReadOnly() bool {
+	return m.HasOption("ro")
+}
+
+// HasOption determine if the mount, or its filesystem, has the given option
+func (m MountInfo) HasOption(option string) bool {
+	for _, o := range m.Options {
+		if o == option {
+			return true
+		}
+	}
+	for _, o := range m.SuperOptions {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMountInfo read the mounts from the contents of a mountinfo file
+func ParseMountInfo(r io.Reader) ([]MountInfo, error) {
+	mounts := []MountInfo{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		info, err := parseMountInfoLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("mountinfo line %d: %v", line, err)
+		}
+		mounts = append(mounts, info)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+func parseMountInfoLine(line string) (MountInfo, error) {
+	info := MountInfo{}
+	fields := strings.Fields(line)
+	// there is a variable number of optional fields, ended by a lone -
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator < 0 || len(fields) < separator+3 {
+		return info, fmt.Errorf("malformed entry %q", line)
+	}
+
+	var err error
+	if info.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return info, fmt.Errorf("invalid mount ID %q", fields[0])
+	}
+	if info.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return info, fmt.Errorf("invalid parent ID %q", fields[1])
+	}
+	devices := strings.SplitN(fields[2], ":", 2)
+	if len(devices) != 2 {
+		return info, fmt.Errorf("invalid device %q", fields[2])
+	}
+	major, err := strconv.ParseUint(devices[0], 10, 32)
+	if err != nil {
+		return info, fmt.Errorf("invalid device %q", fields[2])
+	}
+	minor, err := strconv.ParseUint(devices[1], 10, 32)
+	if err != nil {
+		return info, fmt.Errorf("invalid device %q", fields[2])
+	}
+	info.Major, info.Minor = uint32(major), uint32(minor)
+	info.Root = unescape(fields[3])
+	info.MountPoint = unescape(fields[4])
+	info.Options = strings.Split(fields[5], ",")
+	info.Optional = fields[6:separator]
+	info.FSType = unescape(fields[separator+1])
+	info.Source = unescape(fields[separator+2])
+	if len(fields) > separator+3 {
+		info.SuperOptions = strings.Split(fields[separator+3], ",")
+	}
+	return info, nil
+}
+
+// unescape undo the octal escaping of space, tab, newline and backslash in mountinfo fields
+func unescape(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) && isOctal(field[i+1:i+4]) {
+			value, _ := strconv.ParseUint(field[i+1:i+4], 8, 8)
+			b.WriteByte(byte(value))
+			i += 3
+			continue
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+func isOctal(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '7' {
+			return false
+		}
+	}
+	return true
+}
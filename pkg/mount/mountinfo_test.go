@@ -0,0 +1,83 @@
+package mount
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	f, err := os.Open("testdata/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	mounts, err := ParseMountInfo(f)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(mounts))
+
+	assert.Equal(t, MountInfo{
+		ID:           120,
+		ParentID:     22,
+		Major:        253,
+		Minor:        0,
+		Root:         "/",
+		MountPoint:   "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount",
+		Options:      []string{"rw", "relatime"},
+		Optional:     []string{"shared:60"},
+		FSType:       "ext4",
+		Source:       "/dev/mapper/volume-3ee59355",
+		SuperOptions: []string{"rw", "data=ordered"},
+	}, mounts[3])
+
+	// read-only, by the mount or by the filesystem
+	assert.False(t, mounts[4].ReadOnly())
+	assert.True(t, mounts[5].ReadOnly())
+	assert.True(t, mounts[6].HasOption("norecovery"))
+
+	// a bind mount of a device node has the node as its root
+	assert.Equal(t, "/dm-2", mounts[7].Root)
+
+	// escaped characters
+	assert.Equal(t, "/mnt/with space", mounts[8].MountPoint)
+	assert.Equal(t, "/srv/data", mounts[8].Root)
+}
+
+func TestParseMountInfoOptionalFields(t *testing.T) {
+	mounts, err := ParseMountInfo(strings.NewReader("36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 shared:2 - ext3 /dev/root rw,errors=continue\n" +
+		"37 35 98:0 / /mnt3 rw - ext3 /dev/root rw\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"master:1", "shared:2"}, mounts[0].Optional)
+	assert.Equal(t, "/dev/root", mounts[0].Source)
+	assert.Equal(t, []string{}, mounts[1].Optional)
+	assert.Equal(t, "ext3", mounts[1].FSType)
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	for _, line := range []string{
+		"36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 ext3 /dev/root rw",
+		"36 35 98 /mnt1 /mnt2 rw - ext3 /dev/root rw",
+		"x 35 98:0 /mnt1 /mnt2 rw - ext3 /dev/root rw",
+		"36 35 98:0 /mnt1 /mnt2 rw - ext3",
+	} {
+		_, err := ParseMountInfo(strings.NewReader(line))
+		assert.NotNil(t, err, line)
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := map[string]string{
+		`/plain`:              "/plain",
+		`/a\040b`:             "/a b",
+		`/tab\011and\012line`: "/tab\tand\nline",
+		`/back\134slash`:      `/back\slash`,
+		`/not\09escape`:       `/not\09escape`,
+		`/trailing\04`:        `/trailing\04`,
+	}
+	for escaped, expected := range tests {
+		assert.Equal(t, expected, unescape(escaped), escaped)
+	}
+}
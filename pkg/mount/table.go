@@ -0,0 +1,195 @@
+package mount
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMountInfoPath the mount table of this process
+const DefaultMountInfoPath = "/proc/self/mountinfo"
+
+// State what is mounted at a path, compared to what is expected there
+type State int
+
+const (
+	// NotMounted nothing is mounted at the path
+	NotMounted State = iota
+	// Mounted the expected source is mounted at the path, with the expected options
+	Mounted
+	// MountedWrongMode the expected source is mounted at the path, but read-write instead of read-only or vice versa
+	MountedWrongMode
+	// MountedOther something other than the expected source is mounted at the path
+	MountedOther
+	// Corrupted something is mounted at the path, but it cannot be accessed, e.g. because its device is gone
+	Corrupted
+)
+
+func (s State) String() string {
+	switch s {
+	case NotMounted:
+		return "not mounted"
+	case Mounted:
+		return "mounted"
+	case MountedWrongMode:
+		return "mounted with the wrong mode"
+	case MountedOther:
+		return "mounted from another source"
+	case Corrupted:
+		return "corrupted"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Source identifies what is mounted: a directory or file within the filesystem on a device. Comparing
+// these instead of the source names in the mount table finds bind mounts and mounts by device alias too.
+type Source struct {
+	Major uint32
+	Minor uint32
+	// Root the path within the filesystem
+	Root string
+}
+
+func (s Source) String() string {
+	return fmt.Sprintf("%d:%d %s", s.Major, s.Minor, s.Root)
+}
+
+// Table the mount table, as read from a mountinfo file each time it is used, since mounts change
+type Table struct {
+	// Path of the mountinfo file
+	Path string
+}
+
+// NewTable create a Table of the mounts of this process
+func NewTable() *Table {
+	return &Table{Path: DefaultMountInfoPath}
+}
+
+// List read all of the mounts
+func (t *Table) List() ([]MountInfo, error) {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMountInfo(f)
+}
+
+// Lookup find the mount at a path, which is the last one when several are stacked there, or nil if there is none
+func (t *Table) Lookup(path string) (*MountInfo, error) {
+	mounts, err := t.List()
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == path {
+			return &mounts[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// SourceOf the Source that a bind mount of a path would have, i.e. where the path is within the mount that contains it
+func (t *Table) SourceOf(path string) (Source, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return Source{}, err
+	}
+	mounts, err := t.List()
+	if err != nil {
+		return Source{}, err
+	}
+	// the mount with the longest mount point containing the path, the last one if several are stacked
+	var containing *MountInfo
+	for i := range mounts {
+		m := &mounts[i]
+		if !within(resolved, m.MountPoint) {
+			continue
+		}
+		if containing == nil || len(m.MountPoint) >= len(containing.MountPoint) {
+			containing = m
+		}
+	}
+	if containing == nil {
+		return Source{}, fmt.Errorf("no mount contains %s", resolved)
+	}
+	rel, _ := filepath.Rel(containing.MountPoint, resolved)
+	return Source{
+		Major: containing.Major,
+		Minor: containing.Minor,
+		Root:  filepath.Join(containing.Root, rel),
+	}, nil
+}
+
+// MountsOf list every mount of a source, including those that others are stacked on
+func (t *Table) MountsOf(source Source) ([]MountInfo, error) {
+	mounts, err := t.List()
+	if err != nil {
+		return nil, err
+	}
+	var of []MountInfo
+	for _, m := range mounts {
+		if m.Major == source.Major && m.Minor == source.Minor && filepath.Clean(m.Root) == filepath.Clean(source.Root) {
+			of = append(of, m)
+		}
+	}
+	return of, nil
+}
+
+// DeviceSource the Source that a mount of the whole filesystem on a block device would have
+func DeviceSource(device string) (Source, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(device, &stat); err != nil {
+		return Source{}, &os.PathError{Op: "stat", Path: device, Err: err}
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return Source{}, fmt.Errorf("%s is not a block device", device)
+	}
+	return Source{
+		Major: unix.Major(uint64(stat.Rdev)),
+		Minor: unix.Minor(uint64(stat.Rdev)),
+		Root:  "/",
+	}, nil
+}
+
+// Check compare what is mounted at a path with the expected source and mode
+func (t *Table) Check(path string, source Source, readOnly bool) (State, *MountInfo, error) {
+	// a mount whose filesystem is gone still is in the table, but cannot be accessed
+	if _, err := os.Stat(path); err != nil && IsCorruptedMount(err) {
+		info, _ := t.Lookup(path)
+		return Corrupted, info, nil
+	}
+	info, err := t.Lookup(path)
+	switch {
+	case err != nil:
+		return NotMounted, nil, err
+	case info == nil:
+		return NotMounted, nil, nil
+	case info.Major != source.Major || info.Minor != source.Minor || filepath.Clean(info.Root) != filepath.Clean(source.Root):
+		return MountedOther, info, nil
+	case info.ReadOnly() != readOnly:
+		return MountedWrongMode, info, nil
+	}
+	return Mounted, info, nil
+}
+
+// IsCorruptedMount determine if an error accessing a path means that it is a mount that no longer works
+func IsCorruptedMount(err error) bool {
+	errno, ok := Errno(err)
+	if !ok {
+		return false
+	}
+	return errno == unix.ENOTCONN || errno == unix.ESTALE || errno == unix.EIO || errno == unix.EHOSTDOWN
+}
+
+// within determine if a path is at or below a directory
+func within(path, dir string) bool {
+	if dir == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
@@ -0,0 +1,122 @@
+package mount
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableLookup(t *testing.T) {
+	table := &Table{Path: "testdata/mountinfo"}
+
+	info, err := table.Lookup("/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount/")
+	assert.Nil(t, err)
+	assert.Equal(t, 120, info.ID)
+
+	// the last of several stacked mounts is the one that is visible
+	info, err = table.Lookup("/mnt/stacked")
+	assert.Nil(t, err)
+	assert.Equal(t, 171, info.ID)
+
+	info, err = table.Lookup("/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1")
+	assert.Nil(t, err)
+	assert.Nil(t, info)
+
+	_, err = (&Table{Path: "testdata/missing"}).Lookup("/")
+	assert.NotNil(t, err)
+}
+
+func TestTableCheck(t *testing.T) {
+	table := &Table{Path: "testdata/mountinfo"}
+	volume := Source{Major: 253, Minor: 0, Root: "/"}
+	device := Source{Major: 0, Minor: 6, Root: "/dm-2"}
+
+	tests := []struct {
+		description string
+		path        string
+		source      Source
+		readOnly    bool
+		state       State
+	}{
+		{"staged", "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-1/globalmount", volume, false, Mounted},
+		{"published", "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pvc-1/mount", volume, false, Mounted},
+		{"published read-only", "/var/lib/kubelet/pods/uid-2/volumes/kubernetes.io~csi/pvc-1/mount", volume, true, Mounted},
+		{"published read-write instead of read-only", "/var/lib/kubelet/pods/uid-1/volumes/kubernetes.io~csi/pvc-1/mount", volume, true, MountedWrongMode},
+		{"published read-only instead of read-write", "/var/lib/kubelet/pods/uid-2/volumes/kubernetes.io~csi/pvc-1/mount", volume, false, MountedWrongMode},
+		{"another volume", "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-2/globalmount", volume, false, MountedOther},
+		{"block device", "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-3/uid-3", device, false, Mounted},
+		{"another subdirectory", "/mnt/with space", Source{Major: 8, Minor: 1, Root: "/srv/other"}, false, MountedOther},
+		{"nothing", "/var/lib/kubelet/pods/uid-4/volumes/kubernetes.io~csi/pvc-1/mount", volume, false, NotMounted},
+	}
+	for _, tt := range tests {
+		state, _, err := table.Check(tt.path, tt.source, tt.readOnly)
+		assert.Nil(t, err, tt.description)
+		assert.Equal(t, tt.state, state, tt.description)
+	}
+}
+
+func TestTableMountsOf(t *testing.T) {
+	table := &Table{Path: "testdata/mountinfo"}
+
+	mounts, err := table.MountsOf(Source{Major: 253, Minor: 0, Root: "/"})
+	assert.Nil(t, err)
+	var ids []int
+	for _, m := range mounts {
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []int{120, 131, 132, 170}, ids)
+
+	mounts, err = table.MountsOf(Source{Major: 8, Minor: 1, Root: "/srv/other"})
+	assert.Nil(t, err)
+	assert.Empty(t, mounts)
+}
+
+func TestTableSourceOf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("data", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the root filesystem, and a bind mount of a subdirectory of another one over the temporary directory
+	mountinfo := filepath.Join(dir, "mountinfo")
+	contents := "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n" +
+		"2 1 8:17 /exports " + dir + " rw - ext4 /dev/sdb1 rw\n"
+	if err := ioutil.WriteFile(mountinfo, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table := &Table{Path: mountinfo}
+
+	source, err := table.SourceOf(filepath.Join(dir, "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, Source{Major: 8, Minor: 17, Root: "/exports/data"}, source)
+
+	source, err = table.SourceOf(filepath.Dir(dir))
+	assert.Nil(t, err)
+	assert.Equal(t, Source{Major: 8, Minor: 1, Root: filepath.Dir(dir)}, source)
+
+	_, err = table.SourceOf(filepath.Join(dir, "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestIsCorruptedMount(t *testing.T) {
+	assert.False(t, IsCorruptedMount(nil))
+	assert.False(t, IsCorruptedMount(&os.PathError{Op: "stat", Path: "/mnt", Err: syscall.ENOENT}))
+	assert.True(t, IsCorruptedMount(&os.PathError{Op: "stat", Path: "/mnt", Err: syscall.ENOTCONN}))
+	assert.True(t, IsCorruptedMount(&os.PathError{Op: "stat", Path: "/mnt", Err: syscall.ESTALE}))
+	assert.True(t, IsCorruptedMount(syscall.EIO))
+}
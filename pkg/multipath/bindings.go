@@ -0,0 +1,121 @@
+package multipath
+
+import (
+	"bytes"
+	"strings"
+)
+
+// BindingsHeader the comments that multipath starts a bindings file with
+const BindingsHeader = `# Multipath bindings, Version : 1.0
+# NOTE: this file is automatically maintained by the multipath program.
+# You should not need to edit this file in normal circumstances.
+#
+# Format:
+# alias wwid
+#
+`
+
+// Binding an alias of the map of a WWID
+type Binding struct {
+	Alias string
+	WWID  string
+}
+
+// bindingLine a line of a bindings file, which is a binding, or a comment or anything else that is kept as it is
+type bindingLine struct {
+	text    string
+	binding *Binding
+}
+
+// Bindings the bindings of a bindings file, which keep its comments and any other lines, and the order of
+// its entries, so that writing them changes only the bindings that were changed
+type Bindings struct {
+	lines []bindingLine
+}
+
+// ParseBindings parse a bindings file; an empty one gets the header that multipath writes
+func ParseBindings(data []byte) *Bindings {
+	if len(bytes.TrimSpace(data)) == 0 {
+		data = []byte(BindingsHeader)
+	}
+	b := &Bindings{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		parsed := bindingLine{text: line}
+		// a comment can follow the wwid, as multipath allows
+		fields := strings.Fields(strings.SplitN(line, "#", 2)[0])
+		if len(fields) == 2 {
+			parsed.binding = &Binding{Alias: fields[0], WWID: fields[1]}
+		}
+		b.lines = append(b.lines, parsed)
+	}
+	return b
+}
+
+// Bytes the bindings file
+func (b *Bindings) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range b.lines {
+		buf.WriteString(line.text)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// Entries the bindings, in the order of the file
+func (b *Bindings) Entries() []Binding {
+	entries := []Binding{}
+	for _, line := range b.lines {
+		if line.binding != nil {
+			entries = append(entries, *line.binding)
+		}
+	}
+	return entries
+}
+
+// Get the WWID that an alias is bound to
+func (b *Bindings) Get(alias string) (string, bool) {
+	for _, line := range b.lines {
+		if line.binding != nil && line.binding.Alias == alias {
+			return line.binding.WWID, true
+		}
+	}
+	return "", false
+}
+
+// Aliases the aliases that a WWID is bound to
+func (b *Bindings) Aliases(wwid string) []string {
+	aliases := []string{}
+	for _, line := range b.lines {
+		if line.binding != nil && line.binding.WWID == wwid {
+			aliases = append(aliases, line.binding.Alias)
+		}
+	}
+	return aliases
+}
+
+// Set bind an alias to a WWID, in place of its binding if it has one, and at the end otherwise; it returns
+// whether that changed anything
+func (b *Bindings) Set(alias, wwid string) bool {
+	for i, line := range b.lines {
+		if line.binding != nil && line.binding.Alias == alias {
+			if line.binding.WWID == wwid {
+				return false
+			}
+			b.lines[i] = bindingLine{text: alias + " " + wwid, binding: &Binding{Alias: alias, WWID: wwid}}
+			return true
+		}
+	}
+	b.lines = append(b.lines, bindingLine{text: alias + " " + wwid, binding: &Binding{Alias: alias, WWID: wwid}})
+	return true
+}
+
+// Remove the binding of an alias, returning whether it had one
+func (b *Bindings) Remove(alias string) bool {
+	for i, line := range b.lines {
+		if line.binding != nil && line.binding.Alias == alias {
+			b.lines = append(b.lines[:i], b.lines[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
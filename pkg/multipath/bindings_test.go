@@ -0,0 +1,35 @@
+package multipath
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBindings(t *testing.T) {
+	file := BindingsHeader + "mpatha 36001405aaaa\nvolume-other 36001405bbbb # staged by hand\nnot a binding at all\n"
+	b := ParseBindings([]byte(file))
+	assert.Equal(t, []Binding{{"mpatha", "36001405aaaa"}, {"volume-other", "36001405bbbb"}}, b.Entries())
+	wwid, ok := b.Get("volume-other")
+	assert.True(t, ok)
+	assert.Equal(t, "36001405bbbb", wwid)
+
+	// nothing that is not changed is rewritten
+	assert.Equal(t, file, string(b.Bytes()))
+	assert.False(t, b.Set("volume-other", "36001405bbbb"))
+	assert.Equal(t, file, string(b.Bytes()))
+
+	assert.True(t, b.Set("volume-3ee59355", "36001405aaaa"))
+	assert.Equal(t, []string{"mpatha", "volume-3ee59355"}, b.Aliases("36001405aaaa"))
+	assert.True(t, b.Remove("mpatha"))
+	assert.False(t, b.Remove("mpatha"))
+	assert.True(t, b.Set("volume-other", "36001405cccc"))
+	assert.Equal(t, BindingsHeader+"volume-other 36001405cccc\nnot a binding at all\nvolume-3ee59355 36001405aaaa\n", string(b.Bytes()))
+}
+
+func TestBindingsEmpty(t *testing.T) {
+	b := ParseBindings(nil)
+	assert.Empty(t, b.Entries())
+	b.Set("volume-3ee59355", "36001405aaaa")
+	assert.Equal(t, BindingsHeader+"volume-3ee59355 36001405aaaa\n", string(b.Bytes()))
+}
@@ -0,0 +1,235 @@
+package multipath
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSocket the abstract unix socket that multipathd listens on, which is in the network namespace of the host
+	DefaultSocket = "@/org/kernel/linux/storage/multipathd"
+	// DefaultTimeout how long a command may take, including connecting
+	DefaultTimeout = 10 * time.Second
+
+	// replyOK the reply to a command that succeeded
+	replyOK = "ok"
+	// maxReply the longest reply that is read, far more than any map or path listing
+	maxReply = 64 << 20
+)
+
+// Client runs commands of multipathd over its control socket, as multipathd -k does
+type Client struct {
+	// Socket the address of the control socket; one that starts with @ is an abstract socket
+	Socket string
+	// Timeout of every command
+	Timeout time.Duration
+}
+
+// NewClient create a Client of the multipathd of this host
+func NewClient() *Client {
+	return &Client{Socket: DefaultSocket, Timeout: DefaultTimeout}
+}
+
+// Error a command that multipathd could not be asked, or that it failed
+type Error struct {
+	Command string
+	// Reply what multipathd replied, if it did
+	Reply string
+	// Err why multipathd could not be asked, if it was not
+	Err error
+}
+
+// Error return the error string
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("multipathd %s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("multipathd %s: %s", e.Command, e.Reply)
+}
+
+// IsFailed check if an error is of a command that multipathd ran, and that failed, rather than of asking it at all
+func IsFailed(err error) bool {
+	switch e := err.(type) {
+	case *Error:
+		return e.Err == nil
+	}
+	return false
+}
+
+// Command run a command, returning what multipathd replied
+func (c *Client) Command(ctx context.Context, command string) (string, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	reply, err := c.exchange(ctx, command)
+	if err != nil {
+		return "", &Error{Command: command, Err: err}
+	}
+	return reply, nil
+}
+
+// exchange send a command and read the reply; both are prefixed with their length as a size_t, which is
+// little endian on every platform the driver runs on, and the command is terminated with a NUL, as the reply is
+func (c *Client) exchange(ctx context.Context, command string) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", c.Socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var request bytes.Buffer
+	binary.Write(&request, binary.LittleEndian, uint64(len(command)+1))
+	request.WriteString(command)
+	request.WriteByte(0)
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return "", err
+	}
+
+	var length uint64
+	if err := binary.Read(conn, binary.LittleEndian, &length); err != nil {
+		return "", fmt.Errorf("unable to read reply: %v", err)
+	}
+	if length > maxReply {
+		return "", fmt.Errorf("reply of %d bytes is too long", length)
+	}
+	reply := make([]byte, length)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", fmt.Errorf("unable to read reply: %v", err)
+	}
+	return string(bytes.TrimRight(reply, "\x00")), nil
+}
+
+// action run a command that replies ok if it succeeded
+func (c *Client) action(ctx context.Context, command string) error {
+	reply, err := c.Command(ctx, command)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != replyOK {
+		return &Error{Command: command, Reply: strings.TrimSpace(reply)}
+	}
+	return nil
+}
+
+// AddMap create the map of a WWID, named as its binding says, from the paths that multipathd knows of;
+// a map that exists already is reloaded
+func (c *Client) AddMap(ctx context.Context, wwid string) error {
+	return c.action(ctx, "add map "+wwid)
+}
+
+// RemoveMap flush a map and stop monitoring it, which fails if it is in use; a map that does not exist is not an error
+func (c *Client) RemoveMap(ctx context.Context, name string) error {
+	m, err := c.Map(ctx, name)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return nil
+	}
+	return c.action(ctx, "remove map "+name)
+}
+
+// ResizeMap grow a map to the size of its paths, after they were resized
+func (c *Client) ResizeMap(ctx context.Context, name string) error {
+	return c.action(ctx, "resize map "+name)
+}
+
+// Reconfigure make multipathd read its configuration again, and reload its maps with it
+func (c *Client) Reconfigure(ctx context.Context) error {
+	return c.action(ctx, "reconfigure")
+}
+
+// states of multipathd
+const (
+	DaemonRunning = "running"
+	DaemonIdle    = "idle"
+)
+
+// DaemonState what multipathd is doing, e.g. running, or configure while it reconfigures
+func (c *Client) DaemonState(ctx context.Context) (string, error) {
+	command := "show daemon"
+	reply, err := c.Command(ctx, command)
+	if err != nil {
+		return "", err
+	}
+	// pid 1234 running
+	fields := strings.Fields(reply)
+	if len(fields) != 3 || fields[0] != "pid" {
+		return "", &Error{Command: command, Reply: strings.TrimSpace(reply)}
+	}
+	return fields[2], nil
+}
+
+// Maps the maps that multipathd monitors, with their paths
+func (c *Client) Maps(ctx context.Context) ([]Map, error) {
+	command := "show maps json"
+	reply, err := c.Command(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	maps, err := ParseMaps([]byte(reply))
+	if err != nil {
+		return nil, &Error{Command: command, Reply: strings.TrimSpace(reply), Err: err}
+	}
+	return maps, nil
+}
+
+// Map the map of a name, nil if there is none
+func (c *Client) Map(ctx context.Context, name string) (*Map, error) {
+	maps, err := c.Maps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range maps {
+		if maps[i].Name == name {
+			return &maps[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Paths the paths that multipathd knows of, whether they are in a map or not
+func (c *Client) Paths(ctx context.Context) ([]PathInfo, error) {
+	command := "show paths raw format \"" + pathFormat + "\""
+	reply, err := c.Command(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePaths(reply), nil
+}
+
+// mapsReply the reply to show maps json
+type mapsReply struct {
+	MajorVersion int   `json:"major_version"`
+	MinorVersion int   `json:"minor_version"`
+	Maps         []Map `json:"maps"`
+}
+
+// ParseMaps parse the reply to show maps json; one without any maps may be empty
+func ParseMaps(data []byte) ([]Map, error) {
+	maps := []Map{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return maps, nil
+	}
+	var reply mapsReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, fmt.Errorf("invalid maps: %v", err)
+	}
+	if reply.Maps != nil {
+		maps = reply.Maps
+	}
+	return maps, nil
+}
@@ -0,0 +1,144 @@
+package multipath
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve a multipathd that replies to each command it is expected to run, recording the commands
+func serve(t *testing.T, replies map[string]string) (*Client, func() []string, func()) {
+	server, err := NewFakeServer(func(command string) string {
+		reply, ok := replies[command]
+		if !ok {
+			return "multipathd: unknown command\n"
+		}
+		return reply
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.Client, server.Commands, server.Close
+}
+
+func readTestdata(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMaps(t *testing.T) {
+	client, _, done := serve(t, map[string]string{"show maps json": readTestdata(t, "maps.json")})
+	defer done()
+
+	maps, err := client.Maps(context.Background())
+	assert.Nil(t, err)
+	if !assert.Equal(t, 1, len(maps)) {
+		return
+	}
+	m := maps[0]
+	assert.Equal(t, "volume-3ee59355", m.Name)
+	assert.Equal(t, "36001405b06f15a423fec58b00000001", m.WWID)
+	assert.Equal(t, 2, m.Paths)
+	assert.Equal(t, 1, m.ActivePaths())
+	assert.Equal(t, []string{"sdb", "sdc"}, m.Devices())
+}
+
+func TestMap(t *testing.T) {
+	client, _, done := serve(t, map[string]string{"show maps json": readTestdata(t, "maps.json")})
+	defer done()
+
+	m, err := client.Map(context.Background(), "volume-3ee59355")
+	assert.Nil(t, err)
+	assert.NotNil(t, m)
+	m, err = client.Map(context.Background(), "volume-other")
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+}
+
+func TestMapsNone(t *testing.T) {
+	client, _, done := serve(t, map[string]string{"show maps json": "\n"})
+	defer done()
+
+	maps, err := client.Maps(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Map{}, maps)
+}
+
+func TestAddMap(t *testing.T) {
+	client, commands, done := serve(t, map[string]string{
+		"add map 36001405b06f15a423fec58b00000001": "ok\n",
+		"add map 36001405aaaa":                     "fail\n",
+	})
+	defer done()
+
+	assert.Nil(t, client.AddMap(context.Background(), "36001405b06f15a423fec58b00000001"))
+	err := client.AddMap(context.Background(), "36001405aaaa")
+	assert.True(t, IsFailed(err))
+	assert.Equal(t, "multipathd add map 36001405aaaa: fail", err.Error())
+	assert.Equal(t, []string{"add map 36001405b06f15a423fec58b00000001", "add map 36001405aaaa"}, commands())
+}
+
+func TestRemoveMap(t *testing.T) {
+	client, commands, done := serve(t, map[string]string{
+		"show maps json":             readTestdata(t, "maps.json"),
+		"remove map volume-3ee59355": "fail\n",
+	})
+	defer done()
+
+	// a map that is in use cannot be removed
+	err := client.RemoveMap(context.Background(), "volume-3ee59355")
+	assert.True(t, IsFailed(err))
+	// one that does not exist is not removed at all
+	assert.Nil(t, client.RemoveMap(context.Background(), "volume-other"))
+	assert.Equal(t, []string{"show maps json", "remove map volume-3ee59355", "show maps json"}, commands())
+}
+
+func TestResizeMap(t *testing.T) {
+	client, _, done := serve(t, map[string]string{"resize map volume-3ee59355": "ok\n"})
+	defer done()
+
+	assert.Nil(t, client.ResizeMap(context.Background(), "volume-3ee59355"))
+}
+
+func TestPaths(t *testing.T) {
+	client, _, done := serve(t, map[string]string{
+		"show paths raw format \"%d %w %m %t %T\"": "sdb 36001405b06f15a423fec58b00000001 volume-3ee59355 active ready\n" +
+			"sdc 36001405b06f15a423fec58b00000001 [orphan] undef i/o pending\n",
+	})
+	defer done()
+
+	paths, err := client.Paths(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []PathInfo{
+		{Dev: "sdb", WWID: "36001405b06f15a423fec58b00000001", Map: "volume-3ee59355", DMState: "active", CheckerState: "ready"},
+		{Dev: "sdc", WWID: "36001405b06f15a423fec58b00000001", DMState: "undef", CheckerState: "i/o pending"},
+	}, paths)
+}
+
+func TestNotRunning(t *testing.T) {
+	client := &Client{Socket: "/nonexistent/multipathd.sock", Timeout: time.Second}
+	_, err := client.Maps(context.Background())
+	assert.NotNil(t, err)
+	assert.False(t, IsFailed(err))
+}
+
+func TestDaemonState(t *testing.T) {
+	client, commands, done := serve(t, map[string]string{
+		"reconfigure": "ok\n",
+		"show daemon": "pid 1234 running\n",
+	})
+	defer done()
+
+	assert.Nil(t, client.Reconfigure(context.Background()))
+	state, err := client.DaemonState(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, DaemonRunning, state)
+	assert.Equal(t, []string{"reconfigure", "show daemon"}, commands())
+}
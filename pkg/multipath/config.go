@@ -0,0 +1,161 @@
+package multipath
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultConfigDir the directory whose files multipath reads after multipath.conf, unless config_dir says otherwise
+const DefaultConfigDir = "/etc/multipath/conf.d"
+
+// Setting a keyword of a section of a multipath configuration, with its value, unquoted
+type Setting struct {
+	Keyword string
+	Value   string
+}
+
+// Section a section of a multipath configuration, such as defaults, or a device of devices; the
+// configuration itself is a section without a name
+type Section struct {
+	Name     string
+	Settings []Setting
+	Sections []*Section
+}
+
+// ParseConfig parse a multipath configuration, such as multipath.conf
+func ParseConfig(data []byte) (*Section, error) {
+	root := &Section{}
+	stack := []*Section{root}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		current := stack[len(stack)-1]
+		switch {
+		case line == "}":
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("line %d: unexpected }", n+1)
+			}
+			stack = stack[:len(stack)-1]
+		case strings.HasSuffix(line, "{"):
+			section := &Section{Name: strings.TrimSpace(strings.TrimSuffix(line, "{"))}
+			current.Sections = append(current.Sections, section)
+			stack = append(stack, section)
+		default:
+			fields := strings.SplitN(line, " ", 2)
+			setting := Setting{Keyword: fields[0]}
+			if len(fields) == 2 {
+				setting.Value = strings.Trim(strings.TrimSpace(fields[1]), `"`)
+			}
+			current.Settings = append(current.Settings, setting)
+		}
+	}
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("section %s is not closed", stack[len(stack)-1].Name)
+	}
+	return root, nil
+}
+
+// stripComment strip a comment, which starts with # or !, from a line, unless it is quoted
+func stripComment(line string) string {
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case (c == '#' || c == '!') && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Get the value of a keyword, the last one if it is set more than once, as multipath takes it
+func (s *Section) Get(keyword string) (string, bool) {
+	value, ok := "", false
+	for _, setting := range s.Settings {
+		if setting.Keyword == keyword {
+			value, ok = setting.Value, true
+		}
+	}
+	return value, ok
+}
+
+// Find the subsections of a name, e.g. the defaults of a configuration, or the devices of devices
+func (s *Section) Find(name string) []*Section {
+	sections := []*Section{}
+	for _, section := range s.Sections {
+		if section.Name == name {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+// Devices the device sections of the devices sections of a configuration
+func (s *Section) Devices() []*Section {
+	devices := []*Section{}
+	for _, section := range s.Find("devices") {
+		devices = append(devices, section.Find("device")...)
+	}
+	return devices
+}
+
+// ConfigDir the directory of the further configuration files, empty if there are none
+func (s *Section) ConfigDir() string {
+	dir := DefaultConfigDir
+	for _, defaults := range s.Find("defaults") {
+		if value, ok := defaults.Get("config_dir"); ok {
+			dir = value
+		}
+	}
+	return dir
+}
+
+// Conflict a setting of an existing configuration that another one overrides with a different value
+type Conflict struct {
+	// Section defaults, or the device of a vendor and product
+	Section  string
+	Keyword  string
+	Existing string
+	Value    string
+}
+
+// String describe the conflict
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s %s is %q, overridden with %q", c.Section, c.Keyword, c.Existing, c.Value)
+}
+
+// Conflicts the settings of an existing configuration that another one, read after it, overrides with
+// different values: those of the defaults, and those of the devices of the same vendor and product
+func Conflicts(existing, config *Section) []Conflict {
+	conflicts := []Conflict{}
+	for _, ours := range config.Find("defaults") {
+		for _, theirs := range existing.Find("defaults") {
+			conflicts = append(conflicts, sectionConflicts("defaults", theirs, ours)...)
+		}
+	}
+	for _, ours := range config.Devices() {
+		vendor, _ := ours.Get("vendor")
+		product, _ := ours.Get("product")
+		for _, theirs := range existing.Devices() {
+			theirVendor, _ := theirs.Get("vendor")
+			theirProduct, _ := theirs.Get("product")
+			if theirVendor == vendor && theirProduct == product {
+				conflicts = append(conflicts, sectionConflicts(fmt.Sprintf("device %s %s", vendor, product), theirs, ours)...)
+			}
+		}
+	}
+	return conflicts
+}
+
+func sectionConflicts(name string, existing, config *Section) []Conflict {
+	conflicts := []Conflict{}
+	for _, setting := range config.Settings {
+		if value, ok := existing.Get(setting.Keyword); ok && value != setting.Value {
+			conflicts = append(conflicts, Conflict{Section: name, Keyword: setting.Keyword, Existing: value, Value: setting.Value})
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,83 @@
+package multipath
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const hostConfig = `# the host's own
+defaults {
+	user_friendly_names no   # other storage relies on WWIDs
+	find_multipaths yes
+}
+blacklist {
+	devnode "^nvme[0-9]"
+}
+devices {
+	device {
+		vendor "DATERA"
+		product "IBLOCK"
+		path_checker "directio"
+		no_path_retry 12
+	}
+	device {
+		vendor "NETAPP"
+		product "LUN.*"
+		path_checker tur
+	}
+}
+`
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(hostConfig))
+	assert.Nil(t, err)
+	defaults := config.Find("defaults")
+	if !assert.Equal(t, 1, len(defaults)) {
+		return
+	}
+	value, ok := defaults[0].Get("user_friendly_names")
+	assert.True(t, ok)
+	assert.Equal(t, "no", value)
+	assert.Equal(t, 2, len(config.Devices()))
+	value, _ = config.Devices()[0].Get("path_checker")
+	assert.Equal(t, "directio", value)
+	value, _ = config.Find("blacklist")[0].Get("devnode")
+	assert.Equal(t, "^nvme[0-9]", value)
+	assert.Equal(t, DefaultConfigDir, config.ConfigDir())
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	_, err := ParseConfig([]byte("defaults {\n"))
+	assert.NotNil(t, err)
+	_, err = ParseConfig([]byte("}\n"))
+	assert.NotNil(t, err)
+}
+
+func TestConfigDir(t *testing.T) {
+	config, _ := ParseConfig([]byte("defaults {\n\tconfig_dir \"\"\n}\n"))
+	assert.Equal(t, "", config.ConfigDir())
+	config, _ = ParseConfig([]byte("defaults {\n\tconfig_dir /etc/multipath.d\n}\n"))
+	assert.Equal(t, "/etc/multipath.d", config.ConfigDir())
+}
+
+func TestConflicts(t *testing.T) {
+	existing, _ := ParseConfig([]byte(hostConfig))
+	config, _ := ParseConfig([]byte(`defaults {
+	user_friendly_names yes
+	polling_interval 3
+}
+devices {
+	device {
+		vendor "DATERA"
+		product "IBLOCK"
+		path_checker tur
+	}
+}
+`))
+	assert.Equal(t, []Conflict{
+		{Section: "defaults", Keyword: "user_friendly_names", Existing: "no", Value: "yes"},
+		{Section: "device DATERA IBLOCK", Keyword: "path_checker", Existing: "directio", Value: "tur"},
+	}, Conflicts(existing, config))
+	assert.Empty(t, Conflicts(config, config))
+}
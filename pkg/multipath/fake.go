@@ -0,0 +1,86 @@
+package multipath
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeServer a fake multipathd that replies to the commands on its control socket with a function, recording them
+type FakeServer struct {
+	// Client a client of the server
+	Client *Client
+
+	reply    func(command string) string
+	dir      string
+	listener net.Listener
+
+	lock     sync.Mutex
+	commands []string
+}
+
+// NewFakeServer serve a control socket in a temporary directory, which replies to each command with what reply returns
+func NewFakeServer(reply func(command string) string) (*FakeServer, error) {
+	dir, err := ioutil.TempDir("", "multipathd")
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dir, "multipathd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	s := &FakeServer{
+		Client:   &Client{Socket: socket, Timeout: time.Second},
+		reply:    reply,
+		dir:      dir,
+		listener: listener,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// serve reply to one command on each connection, as multipathd does to a client that runs a single one
+func (s *FakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		var length uint64
+		if err := binary.Read(conn, binary.LittleEndian, &length); err != nil {
+			conn.Close()
+			continue
+		}
+		buf := make([]byte, length)
+		io.ReadFull(conn, buf)
+		command := strings.TrimRight(string(buf), "\x00")
+		s.lock.Lock()
+		s.commands = append(s.commands, command)
+		s.lock.Unlock()
+		reply := s.reply(command)
+		binary.Write(conn, binary.LittleEndian, uint64(len(reply)+1))
+		conn.Write(append([]byte(reply), 0))
+		conn.Close()
+	}
+}
+
+// Commands the commands that were run, in order
+func (s *FakeServer) Commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Close stop serving, and remove the socket
+func (s *FakeServer) Close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,116 @@
+package multipath
+
+import "strings"
+
+// states of a path, as multipathd reports them
+const (
+	// DMStateActive a path that the map sends I/O to
+	DMStateActive = "active"
+	// CheckerStateReady a path that the path checker found to be up
+	CheckerStateReady = "ready"
+	// orphan the map of a path that is in none
+	orphan = "[orphan]"
+)
+
+// Map a multipath map, as multipathd reports it in JSON
+type Map struct {
+	Name string `json:"name"`
+	// WWID of the device that the map is of
+	WWID       string      `json:"uuid"`
+	Sysfs      string      `json:"sysfs"`
+	Paths      int         `json:"paths"`
+	DMState    string      `json:"dm_st"`
+	WriteProt  string      `json:"write_prot"`
+	PathFaults int         `json:"path_faults"`
+	Vendor     string      `json:"vend"`
+	Product    string      `json:"prod"`
+	PathGroups []PathGroup `json:"path_groups"`
+}
+
+// PathGroup a group of paths of a map, which it uses together
+type PathGroup struct {
+	Selector string `json:"selector"`
+	Priority int    `json:"pri"`
+	DMState  string `json:"dm_st"`
+	Group    int    `json:"group"`
+	Paths    []Path `json:"paths"`
+}
+
+// Path a path of a map, which is a SCSI device of a session
+type Path struct {
+	Dev          string `json:"dev"`
+	DevT         string `json:"dev_t"`
+	DMState      string `json:"dm_st"`
+	DevState     string `json:"dev_st"`
+	CheckerState string `json:"chk_st"`
+	Checker      string `json:"checker"`
+	Priority     int    `json:"pri"`
+	TargetWWNN   string `json:"target_wwnn"`
+	HostAdapter  string `json:"host_adapter"`
+}
+
+// Active check if the map uses the path, and it is up
+func (p Path) Active() bool {
+	return p.DMState == DMStateActive && p.CheckerState == CheckerStateReady
+}
+
+// ActivePaths the number of paths of the map that are active
+func (m Map) ActivePaths() int {
+	active := 0
+	for _, group := range m.PathGroups {
+		for _, path := range group.Paths {
+			if path.Active() {
+				active++
+			}
+		}
+	}
+	return active
+}
+
+// Devices the devices of the paths of the map
+func (m Map) Devices() []string {
+	devices := []string{}
+	for _, group := range m.PathGroups {
+		for _, path := range group.Paths {
+			devices = append(devices, path.Dev)
+		}
+	}
+	return devices
+}
+
+// pathFormat the fields of a path in the raw format of show paths, with the checker state last, since it
+// can have a space in it, as "i/o pending"
+const pathFormat = "%d %w %m %t %T"
+
+// PathInfo a path that multipathd knows of, as it reports it in the raw format of show paths
+type PathInfo struct {
+	Dev  string
+	WWID string
+	// Map the name of the map that the path is in, empty if none
+	Map          string
+	DMState      string
+	CheckerState string
+}
+
+// ParsePaths parse the reply to show paths raw format with pathFormat
+func ParsePaths(reply string) []PathInfo {
+	paths := []PathInfo{}
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		path := PathInfo{
+			Dev:          fields[0],
+			WWID:         fields[1],
+			Map:          fields[2],
+			DMState:      fields[3],
+			CheckerState: strings.Join(fields[4:], " "),
+		}
+		if path.Map == orphan {
+			path.Map = ""
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,137 @@
+package packet
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+// Adoption the outcome of inspecting a volume that was not created by the driver, to decide if the
+// driver can take it over through static provisioning
+type Adoption struct {
+	Volume packngo.Volume
+	Plan   StoragePlan
+	// Managed the volume already has a VolumeDescription of this cluster
+	Managed bool
+	// Problems the reasons the volume cannot be adopted, none if it can be
+	Problems []string
+}
+
+// Adoptable determine if nothing prevents the volume from being adopted
+func (a Adoption) Adoptable() bool {
+	return len(a.Problems) == 0
+}
+
+// InspectVolumesForAdoption check if volumes can be adopted by the driver of the given facility and
+// cluster. Given no volume IDs, it inspects every volume of the project that does not already have a
+// VolumeDescription.
+func InspectVolumesForAdoption(provider VolumeProvider, plans *PlanCache, facilityID, clusterID string, volumeIDs []string) ([]Adoption, error) {
+	if len(volumeIDs) == 0 {
+		volumes, httpResponse, err := provider.ListVolumes(nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to list volumes")
+		}
+		if httpResponse.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("bad status from list volumes, %s", httpResponse.Status)
+		}
+		for _, volume := range volumes {
+			if _, err := ReadDescription(volume.Description); err != nil {
+				volumeIDs = append(volumeIDs, volume.ID)
+			}
+		}
+	}
+
+	adoptions := make([]Adoption, 0, len(volumeIDs))
+	for _, volumeID := range volumeIDs {
+		// get each one individually, to have its attachments
+		volume, httpResponse, err := provider.Get(volumeID)
+		if httpResponse != nil && httpResponse.StatusCode == http.StatusNotFound {
+			adoptions = append(adoptions, Adoption{
+				Volume:   packngo.Volume{ID: volumeID},
+				Problems: []string{"volume not found"},
+			})
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get volume %s", volumeID)
+		}
+		if httpResponse.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("bad status from get volume %s, %s", volumeID, httpResponse.Status)
+		}
+		adoption, err := inspectVolume(*volume, plans, facilityID, clusterID)
+		if err != nil {
+			return nil, err
+		}
+		adoptions = append(adoptions, adoption)
+	}
+	return adoptions, nil
+}
+
+// inspectVolume check a single volume for anything that prevents adopting it
+func inspectVolume(volume packngo.Volume, plans *PlanCache, facilityID, clusterID string) (Adoption, error) {
+	adoption := Adoption{Volume: volume}
+	problem := func(format string, args ...interface{}) {
+		adoption.Problems = append(adoption.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if !VolumeReady(&volume) {
+		problem("volume is %s, not active", volume.State)
+	}
+
+	switch {
+	case volume.Facility == nil:
+		problem("facility of volume is unknown")
+	case volume.Facility.ID != facilityID && volume.Facility.Code != facilityID:
+		problem("volume is in facility %s, not %s", volume.Facility.Code, facilityID)
+	}
+
+	// the driver attaches a volume only to the node that uses it, and never to more than one
+	for _, attachment := range volume.Attachments {
+		if attachment != nil {
+			problem("volume is attached to device %s", attachment.Device.ID)
+		}
+	}
+
+	if volume.Plan == nil {
+		problem("plan of volume is unknown")
+	} else {
+		plan, err := plans.Lookup(volume.Plan.ID)
+		switch {
+		case IsUnknownPlan(err):
+			problem("volume has plan %s, which is not a storage plan", volume.Plan.ID)
+		case err != nil:
+			return adoption, err
+		default:
+			adoption.Plan = plan
+		}
+	}
+
+	if description, err := ReadDescription(volume.Description); err == nil {
+		if !description.InCluster(clusterID) {
+			problem("volume belongs to cluster %q", description.Cluster)
+		}
+		adoption.Managed = true
+	}
+	return adoption, nil
+}
+
+// AdoptedDescription the description that marks a volume as adopted by the driver, keeping the
+// description it had before
+func AdoptedDescription(volume packngo.Volume, name, clusterID string) VolumeDescription {
+	description := NewVolumeDescription(name)
+	description.Cluster = clusterID
+	description.Adopted = true
+	description.OriginalDescription = volume.Description
+	if created, err := time.Parse(time.RFC3339, volume.Created); err == nil {
+		description.Created = created
+	}
+	return description
+}
+
+// MarkAdopted replace the description of a volume with one that marks it as adopted
+func MarkAdopted(provider VolumeProvider, volume packngo.Volume, name, clusterID string) error {
+	return updateDescription(provider, volume.ID, AdoptedDescription(volume, name, clusterID))
+}
@@ -0,0 +1,100 @@
+package packet
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/packethost/csi-packet/pkg/test"
+	"github.com/packethost/packngo"
+	"github.com/stretchr/testify/assert"
+)
+
+const testFacilityID = "e1e9c52e-a0bc-4117-b996-0fc94843ea09"
+
+func TestInspectVolumesForAdoption(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{Response: &http.Response{StatusCode: http.StatusOK}}
+	provider.EXPECT().ListPlans().Return(testPlans(), &resp, nil).Times(1)
+
+	facility := &packngo.Facility{ID: testFacilityID, Code: "ewr1"}
+	standard := &packngo.Plan{ID: "87728148-3155-4992-a730-8d1e6aca8a32"}
+	volumes := []packngo.Volume{
+		{ID: "9d9ba2f5-3b5b-4fa8-a2b2-0c8d6a1c3e01", Name: "volume-9d9ba2f5", Description: "postgres data", State: "active", Facility: facility, Plan: standard},
+		{ID: "2c4e6a8b-0d1f-4a3b-8c5d-7e9f1a2b3c02", Name: "volume-2c4e6a8b", Description: "", State: "active", Facility: &packngo.Facility{ID: "other", Code: "sjc1"}, Plan: standard},
+		{ID: "7a8b9c0d-1e2f-4a5b-8c7d-9e0f1a2b3c03", Name: "volume-7a8b9c0d", Description: "in use", State: "active", Facility: facility, Plan: standard,
+			Attachments: []*packngo.VolumeAttachment{{ID: "attachment", Device: packngo.Device{DeviceRaw: packngo.DeviceRaw{ID: "device"}}}}},
+		{ID: "4f5e6d7c-8b9a-4c0d-9e1f-2a3b4c5d6e04", Name: "volume-4f5e6d7c", Description: "not storage", State: "active", Facility: facility, Plan: &packngo.Plan{ID: "e69c0169-4726-46ea-98f1-939c9e8a3607"}},
+		{ID: "b1c2d3e4-f5a6-4b7c-8d9e-0f1a2b3c4d05", Name: "volume-b1c2d3e4", Description: NewVolumeDescription("pvc-1").String(), State: "active", Facility: facility, Plan: standard},
+	}
+	provider.EXPECT().ListVolumes().Return(volumes, &resp, nil).Times(1)
+	// only the volumes the driver did not create are inspected
+	for i := range volumes[:4] {
+		provider.EXPECT().Get(volumes[i].ID).Return(&volumes[i], &resp, nil).Times(1)
+	}
+
+	adoptions, err := InspectVolumesForAdoption(provider, NewPlanCache(provider, time.Hour), testFacilityID, "", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(adoptions))
+
+	tests := []struct {
+		adoptable bool
+		problem   string
+	}{
+		{true, ""},
+		{false, "volume is in facility sjc1, not " + testFacilityID},
+		{false, "volume is attached to device device"},
+		{false, "volume has plan e69c0169-4726-46ea-98f1-939c9e8a3607, which is not a storage plan"},
+	}
+	for i, tt := range tests {
+		assert.Equal(t, volumes[i].ID, adoptions[i].Volume.ID)
+		assert.Equal(t, tt.adoptable, adoptions[i].Adoptable(), volumes[i].ID)
+		if tt.problem != "" {
+			assert.Equal(t, []string{tt.problem}, adoptions[i].Problems, volumes[i].ID)
+		}
+	}
+	assert.Equal(t, "storage_1", adoptions[0].Plan.Slug)
+}
+
+func TestInspectVolumesForAdoptionByID(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{Response: &http.Response{StatusCode: http.StatusOK}}
+	notFound := packngo.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}
+	provider.EXPECT().ListPlans().Return(testPlans(), &resp, nil).Times(1)
+
+	facility := &packngo.Facility{ID: testFacilityID, Code: "ewr1"}
+	standard := &packngo.Plan{ID: "87728148-3155-4992-a730-8d1e6aca8a32"}
+	owned := NewVolumeDescription("pvc-1")
+	owned.Cluster = "other"
+	volume := packngo.Volume{ID: "b1c2d3e4-f5a6-4b7c-8d9e-0f1a2b3c4d05", Description: owned.String(), State: "active", Facility: facility, Plan: standard}
+	provider.EXPECT().Get(volume.ID).Return(&volume, &resp, nil).Times(1)
+	provider.EXPECT().Get("missing").Return(nil, &notFound, nil).Times(1)
+
+	adoptions, err := InspectVolumesForAdoption(provider, NewPlanCache(provider, time.Hour), "ewr1", "mine", []string{volume.ID, "missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(adoptions))
+	assert.True(t, adoptions[0].Managed)
+	assert.Equal(t, []string{`volume belongs to cluster "other"`}, adoptions[0].Problems)
+	assert.Equal(t, []string{"volume not found"}, adoptions[1].Problems)
+}
+
+func TestAdoptedDescription(t *testing.T) {
+	volume := packngo.Volume{ID: "9d9ba2f5-3b5b-4fa8-a2b2-0c8d6a1c3e01", Description: "postgres data", Created: "2018-06-01T12:00:00Z"}
+	description := AdoptedDescription(volume, "postgres", "prod")
+
+	read, err := ReadDescription(description.String())
+	assert.Nil(t, err)
+	assert.Equal(t, "postgres", read.Name)
+	assert.Equal(t, "prod", read.Cluster)
+	assert.True(t, read.Adopted)
+	assert.Equal(t, "postgres data", read.OriginalDescription)
+	assert.Equal(t, time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC), read.Created.UTC())
+	assert.Equal(t, VolumeDescriptionVersion, read.Version)
+}
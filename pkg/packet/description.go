@@ -0,0 +1,211 @@
+package packet
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The description of a Packet volume carries a json-serialized VolumeDescription, which is how the
+// driver recognizes its own volumes and remembers how they were created. Volumes outlive driver
+// releases, so the schema is versioned:
+//
+//   - version 1 has only Name and Created, and no Version field at all
+//   - version 2 adds Version, Cluster, UnlockOnDelete, Kubernetes, Adopted and OriginalDescription,
+//     all optional
+//
+// A description is decoded regardless of its version. Fields this driver does not know about, e.g.
+// because a newer driver wrote them, are kept and written back unchanged, so that rewriting a
+// description never loses information. Descriptions of older versions are upgraded by running the
+// migrations from their version up to VolumeDescriptionVersion, one version at a time.
+
+const (
+	// VolumeDescriptionLegacyVersion the version of descriptions that predate versioning, which have no Version field
+	VolumeDescriptionLegacyVersion = 1
+	// VolumeDescriptionVersion the version of the VolumeDescription schema written by this driver
+	VolumeDescriptionVersion = 2
+)
+
+// VolumeDescription description of characteristics of a volume
+type VolumeDescription struct {
+	// Version of the schema of the description
+	Version int `json:",omitempty"`
+	Name    string
+	Created time.Time
+	// Cluster ID of the cluster that owns the volume, empty when the driver was not given one
+	Cluster string `json:",omitempty"`
+	// UnlockOnDelete the volume may be unlocked in order to delete it
+	UnlockOnDelete bool `json:",omitempty"`
+	// Kubernetes the objects the volume was provisioned for, added in version 2
+	Kubernetes *KubernetesMetadata `json:",omitempty"`
+	// Adopted the volume was created outside of the driver, and adopted by it later
+	Adopted bool `json:",omitempty"`
+	// OriginalDescription the description an adopted volume had before it was adopted
+	OriginalDescription string `json:",omitempty"`
+
+	// Extra fields unknown to this version of the driver, preserved as they were read
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// KubernetesMetadata the kubernetes PersistentVolumeClaim and PersistentVolume that a volume was provisioned for
+type KubernetesMetadata struct {
+	PVCName      string `json:",omitempty"`
+	PVCNamespace string `json:",omitempty"`
+	PVName       string `json:",omitempty"`
+}
+
+// volumeDescriptionFields has the fields of a VolumeDescription, but none of its methods, so it can
+// be (un)marshaled without recursing into the custom MarshalJSON and UnmarshalJSON
+type volumeDescriptionFields VolumeDescription
+
+// knownDescriptionFields the names of the fields of a serialized VolumeDescription
+var knownDescriptionFields = jsonFieldNames(reflect.TypeOf(VolumeDescription{}))
+
+// descriptionMigrations upgrade a description from the version that is the key to the next one
+var descriptionMigrations = map[int]func(*VolumeDescription) error{
+	// all of the fields added in version 2 are optional, so there is nothing to fill in
+	1: func(desc *VolumeDescription) error {
+		return nil
+	},
+}
+
+// DescriptionError error type that a volume description could not be read
+type DescriptionError struct {
+	reason string
+}
+
+// Error return the error string
+func (d DescriptionError) Error() string {
+	return fmt.Sprintf("invalid volume description: %s", d.reason)
+}
+
+// IsDescriptionError check if this error is an invalid description error
+func IsDescriptionError(err error) bool {
+	switch err.(type) {
+	case *DescriptionError:
+		return true
+	}
+	return false
+}
+
+// String serialize a VolumeDescription to a string
+func (desc VolumeDescription) String() string {
+	serialized, err := json.Marshal(desc)
+	if err != nil {
+		return ""
+	}
+	return string(serialized)
+}
+
+// MarshalJSON serialize the known fields, along with any extra ones that were read
+func (desc VolumeDescription) MarshalJSON() ([]byte, error) {
+	serialized, err := json.Marshal(volumeDescriptionFields(desc))
+	if err != nil || len(desc.Extra) == 0 {
+		return serialized, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(serialized, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range desc.Extra {
+		// never let an extra field replace one we know
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON read the known fields, keeping any others in Extra
+func (desc *VolumeDescription) UnmarshalJSON(data []byte) error {
+	var fields volumeDescriptionFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	// encoding/json matches field names case-insensitively, so anything it matched is known
+	for key := range all {
+		for _, name := range knownDescriptionFields {
+			if strings.EqualFold(key, name) {
+				delete(all, key)
+				break
+			}
+		}
+	}
+	fields.Extra = nil
+	if len(all) > 0 {
+		fields.Extra = all
+	}
+	*desc = VolumeDescription(fields)
+	return nil
+}
+
+// NewVolumeDescription create a new VolumeDescription from a given name
+func NewVolumeDescription(name string) VolumeDescription {
+	return VolumeDescription{
+		Version: VolumeDescriptionVersion,
+		Name:    name,
+		Created: time.Now(),
+	}
+}
+
+// InCluster determine if the description is of a volume owned by the given cluster
+func (desc VolumeDescription) InCluster(cluster string) bool {
+	return desc.Cluster == cluster
+}
+
+// ReadDescription read a serialized form of a VolumeDescription into a VolumeDescription struct,
+// returning a DescriptionError if it is not one
+func ReadDescription(serialized string) (VolumeDescription, error) {
+	desc := VolumeDescription{}
+	if err := json.Unmarshal([]byte(serialized), &desc); err != nil {
+		return desc, &DescriptionError{reason: err.Error()}
+	}
+	if desc.Name == "" {
+		return desc, &DescriptionError{reason: "no name"}
+	}
+	if desc.Version == 0 {
+		desc.Version = VolumeDescriptionLegacyVersion
+	}
+	return desc, nil
+}
+
+// MigrateDescription upgrade a description to VolumeDescriptionVersion, reporting if it changed.
+// Descriptions of a newer version than this driver knows are left as they are.
+func MigrateDescription(desc VolumeDescription) (VolumeDescription, bool, error) {
+	migrated := false
+	for desc.Version < VolumeDescriptionVersion {
+		migrate, ok := descriptionMigrations[desc.Version]
+		if !ok {
+			return desc, migrated, fmt.Errorf("no migration from description version %d", desc.Version)
+		}
+		if err := migrate(&desc); err != nil {
+			return desc, migrated, fmt.Errorf("unable to migrate description from version %d: %v", desc.Version, err)
+		}
+		desc.Version++
+		migrated = true
+	}
+	return desc, migrated, nil
+}
+
+// jsonFieldNames the names of the fields of a struct as encoding/json serializes them
+func jsonFieldNames(t reflect.Type) []string {
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch {
+		case name == "-":
+			continue
+		case name == "":
+			name = field.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,195 @@
+package packet
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/packethost/csi-packet/pkg/test"
+	"github.com/packethost/packngo"
+	"github.com/stretchr/testify/assert"
+)
+
+// readRecordedDescription read a description as it was recorded from a volume in testdata
+func readRecordedDescription(t *testing.T, name string) string {
+	serialized, err := ioutil.ReadFile(filepath.Join("testdata", "descriptions", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(serialized))
+}
+
+func TestReadDescription(t *testing.T) {
+	created := time.Date(2019, 11, 4, 15, 32, 10, 0, time.UTC)
+	tests := []struct {
+		description string
+		serialized  string
+		expected    VolumeDescription
+	}{
+		{
+			description: "legacy, without a version",
+			serialized:  `{"Name":"pvc-3bd4e4b8-2d8c-4c1a-9c4e-1cf6a0e6d6a1","Created":"2019-11-04T15:32:10Z"}`,
+			expected: VolumeDescription{
+				Version: VolumeDescriptionLegacyVersion,
+				Name:    "pvc-3bd4e4b8-2d8c-4c1a-9c4e-1cf6a0e6d6a1",
+				Created: created,
+			},
+		},
+		{
+			description: "with kubernetes metadata",
+			serialized:  `{"Version":2,"Name":"pvc-3bd4e4b8-2d8c-4c1a-9c4e-1cf6a0e6d6a1","Created":"2019-11-04T15:32:10Z","Kubernetes":{"PVCName":"data","PVCNamespace":"default","PVName":"pvc-3bd4e4b8-2d8c-4c1a-9c4e-1cf6a0e6d6a1"}}`,
+			expected: VolumeDescription{
+				Version: 2,
+				Name:    "pvc-3bd4e4b8-2d8c-4c1a-9c4e-1cf6a0e6d6a1",
+				Created: created,
+				Kubernetes: &KubernetesMetadata{
+					PVCName:      "data",
+					PVCNamespace: "default",
+					PVName:       "pvc-3bd4e4b8-2d8c-4c1a-9c4e-1cf6a0e6d6a1",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		desc, err := ReadDescription(tt.serialized)
+		assert.Nil(t, err, tt.description)
+		assert.Equal(t, tt.expected, desc, tt.description)
+	}
+
+	_, err := ReadDescription("created by hand")
+	assert.NotNil(t, err)
+}
+
+func TestRecordedDescriptions(t *testing.T) {
+	tests := []struct {
+		file    string
+		version int
+		name    string
+		cluster string
+		extra   []string
+	}{
+		{"v1.json", 1, "pvc-5c0ae0f6-7e0e-11e9-8f9e-2a86e4085a59", "", nil},
+		{"v2.json", 2, "pvc-0b5ee9f1-3c4d-4e1b-9a2a-6b8e0e6c1f20", "prod-ewr1", nil},
+		{"v3.json", 3, "pvc-8d2f4c6a-1e3b-4f5d-a7c9-0b2d4f6a8c1e", "prod-ewr1", []string{"ContentSource"}},
+	}
+	for _, tt := range tests {
+		serialized := readRecordedDescription(t, tt.file)
+		desc, err := ReadDescription(serialized)
+		assert.Nil(t, err, tt.file)
+		assert.Equal(t, tt.version, desc.Version, tt.file)
+		assert.Equal(t, tt.name, desc.Name, tt.file)
+		assert.Equal(t, tt.cluster, desc.Cluster, tt.file)
+		for _, key := range tt.extra {
+			assert.Contains(t, desc.Extra, key, tt.file)
+		}
+
+		// writing it back out must not lose anything
+		var original, rewritten map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(serialized), &original), tt.file)
+		assert.Nil(t, json.Unmarshal([]byte(desc.String()), &rewritten), tt.file)
+		if tt.version == VolumeDescriptionLegacyVersion {
+			// the version is explicit once read
+			original["Version"] = float64(VolumeDescriptionLegacyVersion)
+		}
+		assert.Equal(t, original, rewritten, tt.file)
+	}
+
+	_, err := ReadDescription(readRecordedDescription(t, "freeform.txt"))
+	assert.True(t, IsDescriptionError(err))
+}
+
+func TestMigrateDescription(t *testing.T) {
+	tests := []struct {
+		file    string
+		changed bool
+		version int
+	}{
+		{"v1.json", true, VolumeDescriptionVersion},
+		{"v2.json", false, VolumeDescriptionVersion},
+		// never downgrade a description written by a newer driver
+		{"v3.json", false, 3},
+	}
+	for _, tt := range tests {
+		desc, err := ReadDescription(readRecordedDescription(t, tt.file))
+		assert.Nil(t, err, tt.file)
+		migrated, changed, err := MigrateDescription(desc)
+		assert.Nil(t, err, tt.file)
+		assert.Equal(t, tt.changed, changed, tt.file)
+		assert.Equal(t, tt.version, migrated.Version, tt.file)
+		assert.Equal(t, desc.Name, migrated.Name, tt.file)
+		assert.Equal(t, desc.Created, migrated.Created, tt.file)
+	}
+}
+
+func TestMigrateVolumeDescriptions(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{Response: &http.Response{StatusCode: http.StatusOK}}
+	volumes := []packngo.Volume{
+		{ID: "5c0ae0f6-7e0e-11e9-8f9e-2a86e4085a59", Description: readRecordedDescription(t, "v1.json")},
+		{ID: "0b5ee9f1-3c4d-4e1b-9a2a-6b8e0e6c1f20", Description: readRecordedDescription(t, "v2.json")},
+		{ID: "8d2f4c6a-1e3b-4f5d-a7c9-0b2d4f6a8c1e", Description: readRecordedDescription(t, "v3.json")},
+		{ID: "e3a1b2c4-d5e6-4f70-8a9b-0c1d2e3f4a5b", Description: readRecordedDescription(t, "freeform.txt")},
+	}
+	provider.EXPECT().ListVolumes().Return(volumes, &resp, nil).Times(2)
+
+	// a dry run changes nothing
+	migrations, err := MigrateVolumeDescriptions(provider, "", true)
+	assert.Nil(t, err)
+	assert.Equal(t, []DescriptionMigration{
+		{VolumeID: volumes[0].ID, Name: "pvc-5c0ae0f6-7e0e-11e9-8f9e-2a86e4085a59", FromVersion: 1, ToVersion: VolumeDescriptionVersion},
+	}, migrations)
+
+	// only the legacy description is rewritten
+	var updated *string
+	provider.EXPECT().Update(volumes[0].ID, gomock.Any()).Do(func(volumeID string, request *packngo.VolumeUpdateRequest) {
+		updated = request.Description
+	}).Return(&volumes[0], &resp, nil)
+	migrations, err = MigrateVolumeDescriptions(provider, "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(migrations))
+	assert.Nil(t, migrations[0].Err)
+
+	desc, err := ReadDescription(*updated)
+	assert.Nil(t, err)
+	assert.Equal(t, VolumeDescriptionVersion, desc.Version)
+	assert.Equal(t, "pvc-5c0ae0f6-7e0e-11e9-8f9e-2a86e4085a59", desc.Name)
+	assert.Equal(t, "", desc.Cluster)
+}
+
+func TestMigrateVolumeDescriptionsCluster(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{Response: &http.Response{StatusCode: http.StatusOK}}
+	volumes := []packngo.Volume{
+		{ID: "5c0ae0f6-7e0e-11e9-8f9e-2a86e4085a59", Description: readRecordedDescription(t, "v1.json")},
+		{ID: "0b5ee9f1-3c4d-4e1b-9a2a-6b8e0e6c1f20", Description: readRecordedDescription(t, "v2.json")},
+		{ID: "9a4c2e1f-6b3d-4c8a-b1e5-2d7f0a9c3e6b", Description: VolumeDescription{Version: VolumeDescriptionVersion, Name: "pvc-9a4c2e1f-6b3d-4c8a-b1e5-2d7f0a9c3e6b"}.String()},
+	}
+	provider.EXPECT().ListVolumes().Return(volumes, &resp, nil)
+
+	// the volumes of no cluster are assigned to the given one, and those of another cluster are left alone
+	updated := map[string]VolumeDescription{}
+	provider.EXPECT().Update(gomock.Any(), gomock.Any()).Do(func(volumeID string, request *packngo.VolumeUpdateRequest) {
+		desc, err := ReadDescription(*request.Description)
+		assert.Nil(t, err)
+		updated[volumeID] = desc
+	}).Return(&volumes[0], &resp, nil).Times(2)
+	migrations, err := MigrateVolumeDescriptions(provider, "staging-ewr1", false)
+	assert.Nil(t, err)
+	assert.Equal(t, []DescriptionMigration{
+		{VolumeID: volumes[0].ID, Name: "pvc-5c0ae0f6-7e0e-11e9-8f9e-2a86e4085a59", FromVersion: 1, ToVersion: VolumeDescriptionVersion, Cluster: "staging-ewr1"},
+		{VolumeID: volumes[2].ID, Name: "pvc-9a4c2e1f-6b3d-4c8a-b1e5-2d7f0a9c3e6b", FromVersion: VolumeDescriptionVersion, ToVersion: VolumeDescriptionVersion, Cluster: "staging-ewr1"},
+	}, migrations)
+	assert.Equal(t, "staging-ewr1", updated[volumes[0].ID].Cluster)
+	assert.Equal(t, "staging-ewr1", updated[volumes[2].ID].Cluster)
+}
@@ -56,3 +56,22 @@ func IsDeviceStillAttached(err error) bool {
 	}
 	return false
 }
+
+// VolumeNotInMetadataError error type that a volume is not in the metadata of the device, i.e. it is not attached to it
+type VolumeNotInMetadataError struct {
+	volumeName string
+}
+
+// Error return the error string
+func (v VolumeNotInMetadataError) Error() string {
+	return fmt.Sprintf("volume %s not found in metadata", v.volumeName)
+}
+
+// IsVolumeNotInMetadata check if this error is a volume not in metadata error
+func IsVolumeNotInMetadata(err error) bool {
+	switch err.(type) {
+	case *VolumeNotInMetadataError:
+		return true
+	}
+	return false
+}
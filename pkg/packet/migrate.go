@@ -0,0 +1,86 @@
+package packet
+
+import (
+	"net/http"
+
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DescriptionMigration the outcome of migrating the description of a single volume
+type DescriptionMigration struct {
+	VolumeID    string
+	Name        string
+	FromVersion int
+	ToVersion   int
+	// Cluster the cluster that the volume was assigned to, empty if it was not
+	Cluster string
+	Err     error
+}
+
+// MigrateVolumeDescriptions upgrade the descriptions of all of the CSI volumes in the project to
+// VolumeDescriptionVersion. Given a cluster, volumes that belong to no cluster, as those created before
+// the driver was given a cluster ID, are assigned to it, so that the driver still lists and reuses them
+// once it is. Volumes whose descriptions are not VolumeDescriptions, or are current already, are left
+// alone. With dryRun, it only reports what it would change.
+func MigrateVolumeDescriptions(provider VolumeProvider, cluster string, dryRun bool) ([]DescriptionMigration, error) {
+	volumes, httpResponse, err := provider.ListVolumes(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list volumes")
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("bad status from list volumes, %s", httpResponse.Status)
+	}
+
+	migrations := []DescriptionMigration{}
+	for _, volume := range volumes {
+		logger := log.WithFields(log.Fields{"volume_id": volume.ID})
+		description, err := ReadDescription(volume.Description)
+		if err != nil {
+			logger.Debugf("not a csi volume, %v", err)
+			continue
+		}
+		upgraded, changed, err := MigrateDescription(description)
+		assigned := err == nil && cluster != "" && upgraded.Cluster == ""
+		if assigned {
+			upgraded.Cluster = cluster
+		}
+		if !changed && !assigned && err == nil {
+			continue
+		}
+		migration := DescriptionMigration{
+			VolumeID:    volume.ID,
+			Name:        description.Name,
+			FromVersion: description.Version,
+			ToVersion:   upgraded.Version,
+			Err:         err,
+		}
+		if assigned {
+			migration.Cluster = cluster
+		}
+		if err == nil && !dryRun {
+			migration.Err = updateDescription(provider, volume.ID, upgraded)
+		}
+		if migration.Err != nil {
+			logger.Errorf("unable to migrate description, %v", migration.Err)
+		} else {
+			logger.WithFields(log.Fields{"from": migration.FromVersion, "to": migration.ToVersion, "cluster": migration.Cluster, "dry_run": dryRun}).Info("migrated description")
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+// updateDescription replace the description of a volume
+func updateDescription(provider VolumeProvider, volumeID string, description VolumeDescription) error {
+	serialized := description.String()
+	_, httpResponse, err := provider.Update(volumeID, &packngo.VolumeUpdateRequest{Description: &serialized})
+	if err != nil {
+		return errors.Wrap(err, "unable to update volume")
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return errors.Errorf("bad status from update volume, %s", httpResponse.Status)
+	}
+	return nil
+}
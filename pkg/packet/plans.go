@@ -0,0 +1,177 @@
+package packet
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StoragePlanLine the plan line used by the Packet API for block storage plans
+	StoragePlanLine = "storage"
+	// DefaultPlanCacheTTL how long a list of storage plans retrieved from the API is used before refreshing it
+	DefaultPlanCacheTTL = 15 * time.Minute
+)
+
+// PlanLimits size restrictions for volumes of a storage plan, all in Gi
+type PlanLimits struct {
+	MinSizeGi   int `json:"min"`
+	MaxSizeGi   int `json:"max"`
+	IncrementGi int `json:"increment"`
+}
+
+// DefaultPlanLimits limits applied to any storage plan that has no specific limits configured
+var DefaultPlanLimits = PlanLimits{
+	MinSizeGi:   MinVolumeSizeGi,
+	MaxSizeGi:   MaxVolumeSizeGi,
+	IncrementGi: 1,
+}
+
+// StoragePlan a block storage plan as offered by the Packet API, with the limits that apply to it
+type StoragePlan struct {
+	ID     string
+	Slug   string
+	Name   string
+	Limits PlanLimits
+}
+
+// Matches determine if a plan is referenced by the given slug, ID or, for the plans that predate slugs, name
+func (p StoragePlan) Matches(ref string) bool {
+	return ref == p.ID || ref == p.Slug || strings.EqualFold(ref, p.Name)
+}
+
+// SizeGi fit a requested size in Gi to the limits of the plan, rounding up to the next increment
+// but never past the largest increment that fits in the maximum
+func (p StoragePlan) SizeGi(requested int) int {
+	size := requested
+	if size < p.Limits.MinSizeGi {
+		size = p.Limits.MinSizeGi
+	}
+	inc := p.Limits.IncrementGi
+	if inc > 1 && size%inc != 0 {
+		size += inc - size%inc
+	}
+	if size > p.Limits.MaxSizeGi {
+		size = p.Limits.MaxSizeGi
+		if inc > 1 {
+			size -= size % inc
+		}
+	}
+	return size
+}
+
+// UnknownPlanError error type that a requested storage plan does not exist
+type UnknownPlanError struct {
+	plan string
+}
+
+// Error return the error string
+func (u UnknownPlanError) Error() string {
+	return fmt.Sprintf("unknown storage plan: %s", u.plan)
+}
+
+// IsUnknownPlan check if this error is an unknown plan error
+func IsUnknownPlan(err error) bool {
+	switch err.(type) {
+	case *UnknownPlanError:
+		return true
+	}
+	return false
+}
+
+// PlanCache looks up storage plans through a VolumeProvider, retaining them for a limited time
+type PlanCache struct {
+	// Limits size restrictions by plan slug or ID, overriding DefaultPlanLimits
+	Limits map[string]PlanLimits
+
+	provider VolumeProvider
+	ttl      time.Duration
+	now      func() time.Time
+
+	lock    sync.Mutex
+	plans   []StoragePlan
+	fetched time.Time
+}
+
+// NewPlanCache create a new PlanCache that retrieves plans from the given provider and keeps them for ttl
+func NewPlanCache(provider VolumeProvider, ttl time.Duration) *PlanCache {
+	return &PlanCache{
+		provider: provider,
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// Lookup find a storage plan by slug, ID or name, returning an UnknownPlanError if there is none
+func (c *PlanCache) Lookup(ref string) (StoragePlan, error) {
+	plans, err := c.List()
+	if err != nil {
+		return StoragePlan{}, err
+	}
+	for _, plan := range plans {
+		if plan.Matches(ref) {
+			return plan, nil
+		}
+	}
+	return StoragePlan{}, &UnknownPlanError{plan: ref}
+}
+
+// List return all of the storage plans, retrieving them from the provider if the cached ones are stale
+func (c *PlanCache) List() ([]StoragePlan, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.plans != nil && c.now().Sub(c.fetched) < c.ttl {
+		return c.plans, nil
+	}
+
+	plans, httpResponse, err := c.provider.ListPlans()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list plans")
+	}
+	if httpResponse != nil && httpResponse.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("bad status from list plans, %s", httpResponse.Status)
+	}
+	storagePlans := make([]StoragePlan, 0)
+	for _, plan := range plans {
+		if plan.Line != StoragePlanLine {
+			continue
+		}
+		storagePlans = append(storagePlans, StoragePlan{
+			ID:     plan.ID,
+			Slug:   plan.Slug,
+			Name:   plan.Name,
+			Limits: c.limitsFor(plan),
+		})
+	}
+	c.plans = storagePlans
+	c.fetched = c.now()
+	return c.plans, nil
+}
+
+// limitsFor get the limits for a plan, from the configured ones if any, else the defaults
+func (c *PlanCache) limitsFor(plan packngo.Plan) PlanLimits {
+	limits, ok := c.Limits[plan.Slug]
+	if !ok {
+		limits, ok = c.Limits[plan.ID]
+	}
+	if !ok {
+		return DefaultPlanLimits
+	}
+	// anything not set explicitly falls back to the default
+	if limits.MinSizeGi == 0 {
+		limits.MinSizeGi = DefaultPlanLimits.MinSizeGi
+	}
+	if limits.MaxSizeGi == 0 {
+		limits.MaxSizeGi = DefaultPlanLimits.MaxSizeGi
+	}
+	if limits.IncrementGi == 0 {
+		limits.IncrementGi = DefaultPlanLimits.IncrementGi
+	}
+	return limits
+}
@@ -0,0 +1,122 @@
+package packet
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/packethost/csi-packet/pkg/test"
+	"github.com/packethost/packngo"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPlans() []packngo.Plan {
+	return []packngo.Plan{
+		{ID: "e69c0169-4726-46ea-98f1-939c9e8a3607", Slug: "c1.small.x86", Name: "c1.small.x86", Line: "baremetal"},
+		{ID: "87728148-3155-4992-a730-8d1e6aca8a32", Slug: "storage_1", Name: "Standard", Line: StoragePlanLine},
+		{ID: "d6570cfb-38fa-4467-92b3-e45d059bb249", Slug: "storage_2", Name: "Performance", Line: StoragePlanLine},
+	}
+}
+
+func TestPlanCacheLookup(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{Response: &http.Response{StatusCode: http.StatusOK}}
+	provider.EXPECT().ListPlans().Return(testPlans(), &resp, nil).Times(1)
+
+	cache := NewPlanCache(provider, time.Hour)
+
+	tests := []struct {
+		ref string
+		id  string
+	}{
+		{"storage_1", "87728148-3155-4992-a730-8d1e6aca8a32"},
+		{"standard", "87728148-3155-4992-a730-8d1e6aca8a32"},
+		{"Performance", "d6570cfb-38fa-4467-92b3-e45d059bb249"},
+		{"d6570cfb-38fa-4467-92b3-e45d059bb249", "d6570cfb-38fa-4467-92b3-e45d059bb249"},
+	}
+	for _, tt := range tests {
+		plan, err := cache.Lookup(tt.ref)
+		assert.Nil(t, err, tt.ref)
+		assert.Equal(t, tt.id, plan.ID, tt.ref)
+	}
+
+	// non-storage plans and typos are unknown
+	for _, ref := range []string{"c1.small.x86", "performnce"} {
+		_, err := cache.Lookup(ref)
+		assert.True(t, IsUnknownPlan(err), ref)
+	}
+}
+
+func TestPlanCacheExpiry(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{Response: &http.Response{StatusCode: http.StatusOK}}
+	provider.EXPECT().ListPlans().Return(testPlans(), &resp, nil).Times(2)
+
+	now := time.Now()
+	cache := NewPlanCache(provider, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	_, err := cache.Lookup("storage_1")
+	assert.Nil(t, err)
+	_, err = cache.Lookup("storage_2")
+	assert.Nil(t, err)
+
+	now = now.Add(2 * time.Minute)
+	_, err = cache.Lookup("storage_1")
+	assert.Nil(t, err)
+}
+
+func TestPlanSize(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	provider := test.NewMockVolumeProvider(mockCtrl)
+	resp := packngo.Response{Response: &http.Response{StatusCode: http.StatusOK}}
+	provider.EXPECT().ListPlans().Return(testPlans(), &resp, nil)
+
+	cache := NewPlanCache(provider, time.Hour)
+	cache.Limits = map[string]PlanLimits{
+		"storage_2": {MinSizeGi: 100, IncrementGi: 50},
+	}
+
+	standard, err := cache.Lookup("storage_1")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultPlanLimits, standard.Limits)
+	assert.Equal(t, MinVolumeSizeGi, standard.SizeGi(1))
+	assert.Equal(t, 173, standard.SizeGi(173))
+	assert.Equal(t, MaxVolumeSizeGi, standard.SizeGi(15000))
+
+	performance, err := cache.Lookup("storage_2")
+	assert.Nil(t, err)
+	assert.Equal(t, PlanLimits{MinSizeGi: 100, MaxSizeGi: MaxVolumeSizeGi, IncrementGi: 50}, performance.Limits)
+	assert.Equal(t, 100, performance.SizeGi(10))
+	assert.Equal(t, 200, performance.SizeGi(173))
+	assert.Equal(t, MaxVolumeSizeGi, performance.SizeGi(15000))
+}
+
+func TestPlanSizeGi(t *testing.T) {
+	tests := []struct {
+		limits    PlanLimits
+		requested int
+		size      int
+	}{
+		{PlanLimits{MinSizeGi: 10, MaxSizeGi: 1000, IncrementGi: 1}, 1, 10},
+		{PlanLimits{MinSizeGi: 10, MaxSizeGi: 1000, IncrementGi: 1}, 1001, 1000},
+		{PlanLimits{MinSizeGi: 100, MaxSizeGi: 1000, IncrementGi: 50}, 173, 200},
+		{PlanLimits{MinSizeGi: 100, MaxSizeGi: 1000, IncrementGi: 50}, 1200, 1000},
+		// the maximum is not a multiple of the increment
+		{PlanLimits{MinSizeGi: 100, MaxSizeGi: 1030, IncrementGi: 50}, 1020, 1000},
+		{PlanLimits{MinSizeGi: 100, MaxSizeGi: 1030, IncrementGi: 50}, 5000, 1000},
+	}
+	for i, tt := range tests {
+		plan := StoragePlan{Limits: tt.limits}
+		assert.Equal(t, tt.size, plan.SizeGi(tt.requested), "%d: size for %d with %+v", i, tt.requested, tt.limits)
+	}
+}
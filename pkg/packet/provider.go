@@ -16,6 +16,8 @@ const (
 	ConsumerToken = "csi-packet"
 	// BillingHourly string to indicate hourly billing
 	BillingHourly = "hourly"
+	// BillingMonthly string to indicate monthly billing
+	BillingMonthly = "monthly"
 	// volumeInUseMessage message that is returned if volume is in use
 	volumeInUseMessage = "Cannot detach since volume is actively being used on your server"
 )
@@ -27,6 +29,10 @@ type Config struct {
 	FacilityID  string  `json:"facility-id"`
 	BaseURL     *string `json:"base-url,omitempty"`
 	MetadataURL *string `json:"metadata-url,omitempty"`
+	// ClusterID identifies the cluster, so that several clusters can share a project without sharing volumes
+	ClusterID string `json:"cluster-id,omitempty"`
+	// StoragePlanLimits size limits by storage plan slug or ID, for plans whose limits differ from the defaults
+	StoragePlanLimits map[string]PlanLimits `json:"storage-plan-limits,omitempty"`
 }
 
 // VolumeProviderPacketImpl the volume provider for Packet
@@ -156,32 +162,36 @@ func (p *VolumeProviderPacketImpl) Create(createRequest *packngo.VolumeCreateReq
 	return p.client().Volumes.Create(createRequest, p.config.ProjectID)
 }
 
+// Unlock wraps the packet api as an interface method
+func (p *VolumeProviderPacketImpl) Unlock(volumeID string) (*packngo.Response, error) {
+	return p.client().Volumes.Unlock(volumeID)
+}
+
 // Attach wraps the packet api as an interface method
-func (p *VolumeProviderPacketImpl) Attach(volumeID, deviceID string) (*packngo.VolumeAttachment, *packngo.Response, error) {
-	// if the volume already is attached to a different node, reject it
+func (p *VolumeProviderPacketImpl) Attach(volumeID, deviceID string, shared bool) (*packngo.VolumeAttachment, *packngo.Response, error) {
+	// if the volume already is attached to a different node, reject it, unless it may be shared
 	volume, httpResponse, err := p.client().Volumes.Get(volumeID, &packngo.GetOptions{})
 	if err != nil || httpResponse.StatusCode != http.StatusOK {
 		return nil, httpResponse, errors.Wrap(err, "prechecking existence of volume attachment")
 	}
-	// we only allow attaching to one node at a time
-	switch len(volume.Attachments) {
-	case 0:
-		// not attached anywhere, so attach it
-		return p.client().VolumeAttachments.Create(volumeID, deviceID)
-	case 1:
-		// attached to just one node, so it better be is
-		attachment := volume.Attachments[0]
+	// each device has at most one attachment of a volume, so if this one has it, we are done
+	for _, attachment := range volume.Attachments {
 		if attachment.Device.ID == deviceID {
-			return p.client().VolumeAttachments.Get(attachment.ID, &packngo.GetOptions{})
+			return attachment, httpResponse, nil
 		}
-		return nil, nil, WrongDeviceAttachmentError{deviceID: attachment.Device.ID}
+	}
+	switch {
+	case shared || len(volume.Attachments) == 0:
+		return p.client().VolumeAttachments.Create(volumeID, deviceID)
+	case len(volume.Attachments) == 1:
+		return nil, nil, &WrongDeviceAttachmentError{deviceID: volume.Attachments[0].Device.ID}
 	default:
 		// attached to more than one node, that is an error
 		devices := make([]string, 0)
 		for _, a := range volume.Attachments {
 			devices = append(devices, a.Device.ID)
 		}
-		return nil, nil, TooManyDevicesAttachedError{deviceIDs: devices}
+		return nil, nil, &TooManyDevicesAttachedError{deviceIDs: devices}
 	}
 }
 
@@ -203,3 +213,18 @@ func (p *VolumeProviderPacketImpl) Detach(attachmentID string) (*packngo.Respons
 func (p *VolumeProviderPacketImpl) GetNodes() ([]packngo.Device, *packngo.Response, error) {
 	return p.client().Devices.List(p.config.ProjectID, &packngo.ListOptions{})
 }
+
+// ListPlans list all plans, of which the storage plans are the ones relevant to volumes
+func (p *VolumeProviderPacketImpl) ListPlans() ([]packngo.Plan, *packngo.Response, error) {
+	return p.client().Plans.List(nil)
+}
+
+// Update wraps the packet api as an interface method
+func (p *VolumeProviderPacketImpl) Update(volumeID string, updateRequest *packngo.VolumeUpdateRequest) (*packngo.Volume, *packngo.Response, error) {
+	return p.client().Volumes.Update(volumeID, updateRequest)
+}
+
+// FacilityID the facility in which the provider creates volumes, as configured or discovered from the metadata
+func (p *VolumeProviderPacketImpl) FacilityID() string {
+	return p.config.FacilityID
+}
@@ -5,7 +5,6 @@ import (
 	"strconv"
 
 	"github.com/packethost/packngo/metadata"
-	"github.com/pkg/errors"
 )
 
 // {
@@ -90,6 +89,19 @@ func (m *MetadataDriver) GetNodeID() (string, error) {
 	return device.ID, nil
 }
 
+// GetVolumeNames get the names of the volumes attached to the node
+func (m *MetadataDriver) GetVolumeNames() ([]string, error) {
+	device, err := m.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(device.Volumes))
+	for _, volume := range device.Volumes {
+		names = append(names, volume.Name)
+	}
+	return names, nil
+}
+
 // use this when packngo serialization is fixed
 // GetVolumeMetadata gets the volume metadata for a named volume
 func (m *MetadataDriver) packngoGetPacketVolumeMetadata(volumeName string) (metadata.VolumeInfo, error) {
@@ -109,7 +121,7 @@ func (m *MetadataDriver) packngoGetPacketVolumeMetadata(volumeName string) (meta
 	}
 
 	if volumeMetaData.Name == "" {
-		return metadata.VolumeInfo{}, errors.Errorf("volume %s not found in metadata", volumeName)
+		return metadata.VolumeInfo{}, &VolumeNotInMetadataError{volumeName: volumeName}
 	}
 
 	return volumeMetaData, nil
@@ -1,9 +1,6 @@
 package packet
 
 import (
-	"encoding/json"
-	"time"
-
 	"github.com/packethost/packngo"
 )
 
@@ -16,55 +13,28 @@ const (
 	DefaultVolumeSizeGi = 100
 	// MinVolumeSizeGi minimum size in Gi
 	MinVolumeSizeGi = 10
-	// VolumePlanStandard standard plan name
+	// VolumePlanStandard standard plan name, used when no plan is requested
 	VolumePlanStandard = "standard"
-	// VolumePlanStandardID standard plan ID
-	VolumePlanStandardID = "87728148-3155-4992-a730-8d1e6aca8a32"
 	// VolumePlanPerformance performance plan name
 	VolumePlanPerformance = "performance"
-	// VolumePlanPerformanceID performance plan ID
-	VolumePlanPerformanceID = "d6570cfb-38fa-4467-92b3-e45d059bb249"
 )
 
+// SnapshotFrequencies the frequencies the Packet API accepts for snapshot policies
+var SnapshotFrequencies = []string{"15min", "1hour", "1day", "1week", "1month", "1year"}
+
 // VolumeProvider interface for a volume provider
 type VolumeProvider interface {
 	ListVolumes(*packngo.ListOptions) ([]packngo.Volume, *packngo.Response, error)
 	Get(volumeID string) (*packngo.Volume, *packngo.Response, error)
 	Delete(volumeID string) (*packngo.Response, error)
 	Create(*packngo.VolumeCreateRequest) (*packngo.Volume, *packngo.Response, error)
-	Attach(volumeID, deviceID string) (*packngo.VolumeAttachment, *packngo.Response, error)
+	Update(volumeID string, updateRequest *packngo.VolumeUpdateRequest) (*packngo.Volume, *packngo.Response, error)
+	Unlock(volumeID string) (*packngo.Response, error)
+	// Attach attach a volume to a device, which is idempotent; unless shared, the volume may not be attached to any other device
+	Attach(volumeID, deviceID string, shared bool) (*packngo.VolumeAttachment, *packngo.Response, error)
 	Detach(attachmentID string) (*packngo.Response, error)
 	GetNodes() ([]packngo.Device, *packngo.Response, error)
-}
-
-// VolumeDescription description of characteristics of a volume
-type VolumeDescription struct {
-	Name    string
-	Created time.Time
-}
-
-// String serialize a VolumeDescription to a string
-func (desc VolumeDescription) String() string {
-	serialized, err := json.Marshal(desc)
-	if err != nil {
-		return ""
-	}
-	return string(serialized)
-}
-
-// NewVolumeDescription create a new VolumeDescription from a given name
-func NewVolumeDescription(name string) VolumeDescription {
-	return VolumeDescription{
-		Name:    name,
-		Created: time.Now(),
-	}
-}
-
-// ReadDescription read a serialized form of a VolumeDescription into a VolumeDescription struct
-func ReadDescription(serialized string) (VolumeDescription, error) {
-	desc := VolumeDescription{}
-	err := json.Unmarshal([]byte(serialized), &desc)
-	return desc, err
+	ListPlans() ([]packngo.Plan, *packngo.Response, error)
 }
 
 // VolumeReady determine if a volume is in the ready state after being created
@@ -0,0 +1,149 @@
+// Package scsi identifies SCSI disks by their WWIDs, from what the kernel exposes of them in sysfs
+package scsi
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// the page of device identification VPD, see SPC-4 7.8.6
+const (
+	pageDeviceIdentification = 0x83
+	// associationLogicalUnit designators of the disk itself, rather than of its port or target
+	associationLogicalUnit = 0
+
+	codeSetBinary = 1
+	codeSetASCII  = 2
+	codeSetUTF8   = 3
+
+	designatorT10      = 1
+	designatorEUI64    = 2
+	designatorNAA      = 3
+	designatorSCSIName = 8
+)
+
+// prefixes of the WWIDs, by the type of designator they are made of, as scsi_id and multipath prefix them
+var wwidPrefixes = map[int]string{
+	designatorT10:      "1",
+	designatorEUI64:    "2",
+	designatorNAA:      "3",
+	designatorSCSIName: "8",
+}
+
+// Designator an identifier of a disk, in the device identification VPD page
+type Designator struct {
+	CodeSet     int
+	Association int
+	Type        int
+	Value       []byte
+}
+
+// WWID the WWID made of the designator, as scsi_id -g -u prints it
+func (d Designator) WWID() string {
+	prefix := wwidPrefixes[d.Type]
+	switch d.CodeSet {
+	case codeSetASCII, codeSetUTF8:
+		value := strings.TrimRight(string(d.Value), "\x00")
+		return prefix + strings.Join(strings.Fields(value), "_")
+	}
+	return prefix + hex.EncodeToString(d.Value)
+}
+
+// rank how much a designator is preferred as the WWID, the way scsi_id prefers them, 0 if it is not used at all
+func (d Designator) rank() int {
+	if d.Association != associationLogicalUnit {
+		return 0
+	}
+	switch d.Type {
+	case designatorNAA:
+		if d.CodeSet != codeSetBinary || len(d.Value) == 0 {
+			return 0
+		}
+		// registered extended, then registered, then IEEE extended and IEEE
+		switch d.Value[0] >> 4 {
+		case 6:
+			return 9
+		case 5:
+			return 8
+		case 3:
+			return 7
+		case 2:
+			return 6
+		}
+		return 5
+	case designatorEUI64:
+		if d.CodeSet != codeSetBinary {
+			return 0
+		}
+		return 2 + len(d.Value)/8
+	case designatorSCSIName:
+		return 2
+	case designatorT10:
+		return 1
+	}
+	return 0
+}
+
+// ParseVPD83 the designators of the device identification VPD page, as in the vpd_pg83 attribute of a disk in sysfs
+func ParseVPD83(data []byte) ([]Designator, error) {
+	if len(data) < 4 || data[1] != pageDeviceIdentification {
+		return nil, fmt.Errorf("not a device identification VPD page")
+	}
+	length := int(data[2])<<8 | int(data[3])
+	if len(data) < 4+length {
+		return nil, fmt.Errorf("device identification VPD page is truncated, %d bytes of %d", len(data)-4, length)
+	}
+	page := data[4 : 4+length]
+	designators := []Designator{}
+	for len(page) > 0 {
+		if len(page) < 4 || len(page) < 4+int(page[3]) {
+			return nil, fmt.Errorf("designator of device identification VPD page is truncated")
+		}
+		designators = append(designators, Designator{
+			CodeSet:     int(page[0] & 0x0f),
+			Association: int(page[1]>>4) & 0x03,
+			Type:        int(page[1] & 0x0f),
+			Value:       page[4 : 4+int(page[3])],
+		})
+		page = page[4+int(page[3]):]
+	}
+	return designators, nil
+}
+
+// WWID the WWID of a disk, from its device identification VPD page, as scsi_id -g -u gets it
+func WWID(vpd83 []byte) (string, error) {
+	designators, err := ParseVPD83(vpd83)
+	if err != nil {
+		return "", err
+	}
+	var best *Designator
+	for i := range designators {
+		if rank := designators[i].rank(); rank > 0 && (best == nil || rank > best.rank()) {
+			best = &designators[i]
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("device identification VPD page has no designator of the logical unit")
+	}
+	return best.WWID(), nil
+}
+
+// ParseWWID the WWID of a disk from its wwid attribute in sysfs, e.g. naa.6001405b06f15a42, for kernels that do not
+// expose its VPD pages
+func ParseWWID(attr string) (string, error) {
+	attr = strings.TrimSpace(attr)
+	fields := strings.SplitN(attr, ".", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		return "", fmt.Errorf("invalid wwid %q", attr)
+	}
+	switch fields[0] {
+	case "naa":
+		return wwidPrefixes[designatorNAA] + strings.ToLower(fields[1]), nil
+	case "eui":
+		return wwidPrefixes[designatorEUI64] + strings.ToLower(fields[1]), nil
+	case "t10":
+		return wwidPrefixes[designatorT10] + strings.Join(strings.Fields(fields[1]), "_"), nil
+	}
+	return "", fmt.Errorf("invalid wwid %q", attr)
+}
@@ -0,0 +1,88 @@
+package scsi
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// designator a designator of a device identification VPD page
+func designator(codeSet, association, kind int, value []byte) []byte {
+	return append([]byte{byte(codeSet), byte(association<<4 | kind), 0, byte(len(value))}, value...)
+}
+
+// page a device identification VPD page of the designators
+func page(designators ...[]byte) []byte {
+	var body []byte
+	for _, d := range designators {
+		body = append(body, d...)
+	}
+	return append([]byte{0, pageDeviceIdentification, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWWID(t *testing.T) {
+	// as LIO, which Equinix Metal volumes are served by, identifies a disk
+	lio := page(
+		designator(codeSetBinary, associationLogicalUnit, designatorNAA, mustHex(t, "6001405b06f15a423fec58b000000001")),
+		designator(codeSetASCII, associationLogicalUnit, designatorT10, []byte("LIO-ORG b06f15a4-23fe-c58b")),
+		designator(codeSetBinary, 1, 4, []byte{0, 0, 0, 1}),
+		designator(codeSetUTF8, 2, designatorSCSIName, []byte("iqn.2013-05.com.daterainc:tc:01:sn:b06f15a423fec58b,t,0x0001\x00\x00")),
+	)
+	wwid, err := WWID(lio)
+	assert.Nil(t, err)
+	assert.Equal(t, "36001405b06f15a423fec58b000000001", wwid)
+
+	// without an NAA, EUI-64 is preferred to the vendor's identification
+	wwid, err = WWID(page(
+		designator(codeSetASCII, associationLogicalUnit, designatorT10, []byte("ATA     ST1000  Z1D0")),
+		designator(codeSetBinary, associationLogicalUnit, designatorEUI64, mustHex(t, "0002c90300a0b0c0")),
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, "20002c90300a0b0c0", wwid)
+
+	wwid, err = WWID(page(designator(codeSetASCII, associationLogicalUnit, designatorT10, []byte("ATA     ST1000  Z1D0"))))
+	assert.Nil(t, err)
+	assert.Equal(t, "1ATA_ST1000_Z1D0", wwid)
+}
+
+func TestWWIDInvalid(t *testing.T) {
+	_, err := WWID(nil)
+	assert.NotNil(t, err)
+	_, err = WWID([]byte{0, 0x80, 0, 0})
+	assert.NotNil(t, err)
+	// the page is shorter than it says
+	_, err = WWID(page(designator(codeSetBinary, associationLogicalUnit, designatorNAA, mustHex(t, "6001405b06f15a42")))[:10])
+	assert.NotNil(t, err)
+	// only designators of the target port
+	_, err = WWID(page(designator(codeSetBinary, 1, 4, []byte{0, 0, 0, 1})))
+	assert.NotNil(t, err)
+}
+
+func TestParseWWID(t *testing.T) {
+	tests := []struct {
+		attr string
+		wwid string
+	}{
+		{"naa.6001405B06F15A423FEC58B000000001\n", "36001405b06f15a423fec58b000000001"},
+		{"eui.0002c90300a0b0c0", "20002c90300a0b0c0"},
+		{"t10.ATA     ST1000  Z1D0", "1ATA_ST1000_Z1D0"},
+	}
+	for _, tt := range tests {
+		wwid, err := ParseWWID(tt.attr)
+		assert.Nil(t, err, tt.attr)
+		assert.Equal(t, tt.wwid, wwid, tt.attr)
+	}
+	for _, attr := range []string{"", "naa.", "6001405b06f15a42"} {
+		_, err := ParseWWID(attr)
+		assert.NotNil(t, err, attr)
+	}
+}
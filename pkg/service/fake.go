@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// Fake a Manager that records the daemons it reconfigures, for tests
+type Fake struct {
+	lock sync.Mutex
+	// Reconfigured the daemons that were reconfigured, in order
+	Reconfigured []Daemon
+	// Unhealthy the daemons that are not healthy, with their states
+	Unhealthy map[Daemon]string
+	// Err what reconfiguring any daemon fails with
+	Err error
+}
+
+// Reconfigure record that a daemon was reconfigured, unless Err is set
+func (f *Fake) Reconfigure(ctx context.Context, daemon Daemon) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Reconfigured = append(f.Reconfigured, daemon)
+	return nil
+}
+
+// Healthy fail for the daemons in Unhealthy
+func (f *Fake) Healthy(ctx context.Context, daemon Daemon) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if state, ok := f.Unhealthy[daemon]; ok {
+		return &UnhealthyError{Daemon: daemon, State: state}
+	}
+	return nil
+}
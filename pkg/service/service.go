@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/packethost/csi-packet/pkg/multipath"
+)
+
+// Daemon a daemon of the host that the driver relies on
+type Daemon string
+
+const (
+	Iscsid     Daemon = "iscsid"
+	Multipathd Daemon = "multipathd"
+)
+
+// Backends of managing the daemons
+const (
+	// BackendNone leave the daemons alone
+	BackendNone = "none"
+	// BackendSystemd manage the daemons as systemd units, over D-Bus
+	BackendSystemd = "systemd"
+	// BackendMultipathd reconfigure multipathd over its control socket; iscsid cannot be managed
+	BackendMultipathd = "multipathd"
+)
+
+// Backends the backends, for usage messages
+var Backends = []string{BackendNone, BackendSystemd, BackendMultipathd}
+
+// ErrNotSupported a daemon that a Manager cannot manage
+var ErrNotSupported = errors.New("not supported")
+
+// Manager manages the daemons of the host
+type Manager interface {
+	// Reconfigure make a daemon read its configuration again, restarting it if need be
+	Reconfigure(ctx context.Context, daemon Daemon) error
+	// Healthy check that a daemon is running, waiting for it to finish starting up, returning an
+	// *UnhealthyError if it is not
+	Healthy(ctx context.Context, daemon Daemon) error
+}
+
+// UnhealthyError a daemon that is not running
+type UnhealthyError struct {
+	Daemon Daemon
+	// State what the daemon was last seen doing
+	State string
+}
+
+// Error return the error string
+func (e *UnhealthyError) Error() string {
+	return fmt.Sprintf("%s is not healthy, it is %s", e.Daemon, e.State)
+}
+
+// IsUnhealthy check if an error is of a daemon that is not running
+func IsUnhealthy(err error) bool {
+	switch err.(type) {
+	case *UnhealthyError:
+		return true
+	}
+	return false
+}
+
+// New a Manager with a backend, nil for BackendNone; systemd is reached with busctl, run with the executor
+func New(backend string, e executor.Executor) (Manager, error) {
+	switch backend {
+	case "", BackendNone:
+		return nil, nil
+	case BackendSystemd:
+		return &Systemd{Executor: e}, nil
+	case BackendMultipathd:
+		return &MultipathdSocket{}, nil
+	}
+	return nil, fmt.Errorf("unknown service backend %q, must be one of %v", backend, Backends)
+}
+
+// MultipathdSocket manages multipathd over its control socket, which it needs no restart for; it cannot manage iscsid
+type MultipathdSocket struct {
+	// Client of multipathd, one of the multipathd of this host if nil
+	Client *multipath.Client
+	// Interval between checks of multipathd while it reconfigures, defaultInterval if 0
+	Interval time.Duration
+
+	// once the client is set up, by whichever of the concurrent calls comes first
+	once sync.Once
+}
+
+func (m *MultipathdSocket) client() *multipath.Client {
+	m.once.Do(func() {
+		if m.Client == nil {
+			m.Client = multipath.NewClient()
+		}
+	})
+	return m.Client
+}
+
+// Reconfigure make multipathd read its configuration again
+func (m *MultipathdSocket) Reconfigure(ctx context.Context, daemon Daemon) error {
+	if daemon != Multipathd {
+		return ErrNotSupported
+	}
+	return m.client().Reconfigure(ctx)
+}
+
+// Healthy wait for multipathd to be done reconfiguring, and to answer on its socket
+func (m *MultipathdSocket) Healthy(ctx context.Context, daemon Daemon) error {
+	if daemon != Multipathd {
+		return ErrNotSupported
+	}
+	interval := m.Interval
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	for {
+		state, err := m.client().DaemonState(ctx)
+		if err != nil {
+			return &UnhealthyError{Daemon: daemon, State: err.Error()}
+		}
+		if state == multipath.DaemonRunning || state == multipath.DaemonIdle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return &UnhealthyError{Daemon: daemon, State: state}
+		case <-time.After(interval):
+		}
+	}
+}
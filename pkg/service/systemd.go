@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+)
+
+const (
+	busctl          = "busctl"
+	systemdService  = "org.freedesktop.systemd1"
+	systemdPath     = "/org/freedesktop/systemd1"
+	systemdManager  = "org.freedesktop.systemd1.Manager"
+	systemdUnit     = "org.freedesktop.systemd1.Unit"
+	unitPathPrefix  = "/org/freedesktop/systemd1/unit/"
+	defaultInterval = 500 * time.Millisecond
+	defaultTimeout  = 30 * time.Second
+
+	// states of a unit
+	stateActive       = "active"
+	stateActivating   = "activating"
+	stateReloading    = "reloading"
+	stateDeactivating = "deactivating"
+)
+
+// units the systemd units of the daemons
+var units = map[Daemon]string{
+	Iscsid:     "iscsid.service",
+	Multipathd: "multipathd.service",
+}
+
+// Systemd manages the daemons as systemd units, calling the systemd manager over D-Bus with busctl, which is run
+// with an Executor so that it can be the host's own, on the host's system bus
+type Systemd struct {
+	// Executor runs busctl, on this host if nil
+	Executor executor.Executor
+	// Timeout how long a unit may take to become active, defaultTimeout if 0
+	Timeout time.Duration
+	// Interval between checks of a unit that is starting, defaultInterval if 0
+	Interval time.Duration
+}
+
+// Reconfigure restart iscsid, which reads its configuration only when it starts, and reload multipathd
+func (s *Systemd) Reconfigure(ctx context.Context, daemon Daemon) error {
+	unit, ok := units[daemon]
+	if !ok {
+		return ErrNotSupported
+	}
+	method := "RestartUnit"
+	if daemon == Multipathd {
+		method = "ReloadOrRestartUnit"
+	}
+	_, err := s.call(ctx, "call", systemdService, systemdPath, systemdManager, method, "ss", unit, "replace")
+	return err
+}
+
+// Healthy wait for the job of the unit of a daemon to finish, such as the restart that Reconfigure queued, and
+// then for the unit to be active, which fails if it becomes anything but active or on its way to it. Until the
+// job runs, the unit is still in the state it was before it, so that alone tells nothing.
+func (s *Systemd) Healthy(ctx context.Context, daemon Daemon) error {
+	unit, ok := units[daemon]
+	if !ok {
+		return ErrNotSupported
+	}
+	timeout, interval := s.Timeout, s.Interval
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		job, err := s.job(ctx, unit)
+		if err != nil {
+			return err
+		}
+		state, err := s.activeState(ctx, unit)
+		if err != nil {
+			return err
+		}
+		switch {
+		case job != 0:
+			// a job that is still waiting to run may be the restart
+			state = fmt.Sprintf("%s with job %d not done", state, job)
+		case state == stateActive:
+			return nil
+		case state == stateActivating, state == stateReloading, state == stateDeactivating:
+			// a unit that restarts deactivates first
+		default:
+			return &UnhealthyError{Daemon: daemon, State: state}
+		}
+		select {
+		case <-ctx.Done():
+			return &UnhealthyError{Daemon: daemon, State: state}
+		case <-time.After(interval):
+		}
+	}
+}
+
+// activeState the ActiveState of a unit, which is inactive if it is not loaded at all
+func (s *Systemd) activeState(ctx context.Context, unit string) (string, error) {
+	out, err := s.call(ctx, "get-property", systemdService, UnitPath(unit), systemdUnit, "ActiveState")
+	if err != nil {
+		return "", err
+	}
+	return parseString(out)
+}
+
+// job the ID of the job that is queued or running for a unit, 0 if there is none
+func (s *Systemd) job(ctx context.Context, unit string) (uint32, error) {
+	out, err := s.call(ctx, "get-property", systemdService, UnitPath(unit), systemdUnit, "Job")
+	if err != nil {
+		return 0, err
+	}
+	return parseJob(out)
+}
+
+// call run busctl
+func (s *Systemd) call(ctx context.Context, args ...string) (string, error) {
+	e := s.Executor
+	if e == nil {
+		e = executor.Local{}
+	}
+	out, err := executor.CombinedOutput(ctx, e, busctl, args...)
+	if err != nil {
+		return "", fmt.Errorf("systemd: %v", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// parseString parse a string that busctl printed, as its type and quoted value, e.g. s "active"
+func parseString(out string) (string, error) {
+	fields := strings.SplitN(out, " ", 2)
+	if len(fields) != 2 || fields[0] != "s" {
+		return "", fmt.Errorf("systemd: unexpected reply %q", out)
+	}
+	value, err := strconv.Unquote(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("systemd: unexpected reply %q", out)
+	}
+	return value, nil
+}
+
+// parseJob parse the Job property of a unit that busctl printed, as its type, the ID of the job and its
+// path, e.g. (uo) 1234 "/org/freedesktop/systemd1/job/1234", or (uo) 0 "/" when there is no job
+func parseJob(out string) (uint32, error) {
+	fields := strings.Fields(out)
+	if len(fields) != 3 || fields[0] != "(uo)" {
+		return 0, fmt.Errorf("systemd: unexpected reply %q", out)
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("systemd: unexpected reply %q", out)
+	}
+	return uint32(id), nil
+}
+
+// UnitPath the D-Bus object path of a unit, its name escaped as systemd does, e.g. iscsid.service ->
+// /org/freedesktop/systemd1/unit/iscsid_2eservice
+func UnitPath(unit string) string {
+	var b strings.Builder
+	for i := 0; i < len(unit); i++ {
+		c := unit[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9' && i > 0) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return unitPathPrefix + b.String()
+}
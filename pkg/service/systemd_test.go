@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/packethost/csi-packet/pkg/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+func getActiveState(unit string) executor.Exchange {
+	return executor.Expect("busctl", "get-property", "org.freedesktop.systemd1", UnitPath(unit), "org.freedesktop.systemd1.Unit", "ActiveState")
+}
+
+func getJob(unit string) executor.Exchange {
+	return executor.Expect("busctl", "get-property", "org.freedesktop.systemd1", UnitPath(unit), "org.freedesktop.systemd1.Unit", "Job")
+}
+
+// noJob the Job of a unit that has none
+const noJob = "(uo) 0 \"/\""
+
+func TestSystemdReconfigure(t *testing.T) {
+	script := executor.NewScript(
+		executor.Expect("busctl", "call", "org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager", "RestartUnit", "ss", "iscsid.service", "replace").Returns("o \"/org/freedesktop/systemd1/job/1\"", 0),
+		executor.Expect("busctl", "call", "org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager", "ReloadOrRestartUnit", "ss", "multipathd.service", "replace").Returns("Unit multipathd.service not found.", 1),
+	)
+	s := &Systemd{Executor: script}
+
+	assert.Nil(t, s.Reconfigure(context.Background(), Iscsid))
+	err := s.Reconfigure(context.Background(), Multipathd)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not found")
+	assert.Equal(t, ErrNotSupported, s.Reconfigure(context.Background(), Daemon("lvmetad")))
+	assert.Nil(t, script.Done())
+}
+
+func TestSystemdHealthy(t *testing.T) {
+	script := executor.NewScript(
+		getJob("iscsid.service").Returns(noJob, 0),
+		getActiveState("iscsid.service").Returns("s \"deactivating\"", 0),
+		getJob("iscsid.service").Returns(noJob, 0),
+		getActiveState("iscsid.service").Returns("s \"activating\"", 0),
+		getJob("iscsid.service").Returns(noJob, 0),
+		getActiveState("iscsid.service").Returns("s \"active\"", 0),
+		getJob("multipathd.service").Returns(noJob, 0),
+		getActiveState("multipathd.service").Returns("s \"failed\"", 0),
+	)
+	s := &Systemd{Executor: script, Interval: time.Millisecond}
+
+	assert.Nil(t, s.Healthy(context.Background(), Iscsid))
+	err := s.Healthy(context.Background(), Multipathd)
+	assert.True(t, IsUnhealthy(err))
+	assert.Equal(t, "multipathd is not healthy, it is failed", err.Error())
+	assert.Nil(t, script.Done())
+}
+
+func TestSystemdHealthyRestarting(t *testing.T) {
+	// until the restart runs, the unit is still active, as it was before, or failed, and only its job tells
+	script := executor.NewScript(
+		executor.Expect("busctl", "call", "org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager", "RestartUnit", "ss", "iscsid.service", "replace").Returns("o \"/org/freedesktop/systemd1/job/1234\"", 0),
+		getJob("iscsid.service").Returns("(uo) 1234 \"/org/freedesktop/systemd1/job/1234\"", 0),
+		getActiveState("iscsid.service").Returns("s \"active\"", 0),
+		getJob("iscsid.service").Returns("(uo) 1234 \"/org/freedesktop/systemd1/job/1234\"", 0),
+		getActiveState("iscsid.service").Returns("s \"failed\"", 0),
+		getJob("iscsid.service").Returns(noJob, 0),
+		getActiveState("iscsid.service").Returns("s \"active\"", 0),
+	)
+	s := &Systemd{Executor: script, Interval: time.Millisecond}
+
+	assert.Nil(t, s.Reconfigure(context.Background(), Iscsid))
+	assert.Nil(t, s.Healthy(context.Background(), Iscsid))
+	assert.Nil(t, script.Done())
+
+	// a restart that fails leaves the unit failed once its job is done
+	script = executor.NewScript(
+		getJob("iscsid.service").Returns("(uo) 1235 \"/org/freedesktop/systemd1/job/1235\"", 0),
+		getActiveState("iscsid.service").Returns("s \"active\"", 0),
+		getJob("iscsid.service").Returns(noJob, 0),
+		getActiveState("iscsid.service").Returns("s \"failed\"", 0),
+	)
+	s.Executor = script
+	err := s.Healthy(context.Background(), Iscsid)
+	assert.True(t, IsUnhealthy(err))
+	assert.Equal(t, "iscsid is not healthy, it is failed", err.Error())
+	assert.Nil(t, script.Done())
+}
+
+func TestSystemdHealthyTimeout(t *testing.T) {
+	script := executor.NewScript()
+	for i := 0; i < 100; i++ {
+		script.Expect(getJob("iscsid.service").Returns(noJob, 0))
+		script.Expect(getActiveState("iscsid.service").Returns("s \"activating\"", 0))
+	}
+	s := &Systemd{Executor: script, Timeout: 20 * time.Millisecond, Interval: time.Millisecond}
+
+	err := s.Healthy(context.Background(), Iscsid)
+	assert.True(t, IsUnhealthy(err))
+	assert.Equal(t, "iscsid is not healthy, it is activating", err.Error())
+
+	// nor may its restart take that long
+	script = executor.NewScript()
+	for i := 0; i < 100; i++ {
+		script.Expect(getJob("iscsid.service").Returns("(uo) 1234 \"/org/freedesktop/systemd1/job/1234\"", 0))
+		script.Expect(getActiveState("iscsid.service").Returns("s \"active\"", 0))
+	}
+	s.Executor = script
+	err = s.Healthy(context.Background(), Iscsid)
+	assert.True(t, IsUnhealthy(err))
+	assert.Equal(t, "iscsid is not healthy, it is active with job 1234 not done", err.Error())
+}
+
+func TestUnitPath(t *testing.T) {
+	assert.Equal(t, "/org/freedesktop/systemd1/unit/iscsid_2eservice", UnitPath("iscsid.service"))
+	assert.Equal(t, "/org/freedesktop/systemd1/unit/systemd_2dudevd_2eservice", UnitPath("systemd-udevd.service"))
+	assert.Equal(t, "/org/freedesktop/systemd1/unit/_31_2eservice", UnitPath("1.service"))
+}
+
+func TestParseString(t *testing.T) {
+	value, err := parseString("s \"active\"")
+	assert.Nil(t, err)
+	assert.Equal(t, "active", value)
+	_, err = parseString("o \"/org/freedesktop/systemd1/job/1\"")
+	assert.NotNil(t, err)
+	_, err = parseString("s active")
+	assert.NotNil(t, err)
+}
+
+func TestParseJob(t *testing.T) {
+	id, err := parseJob("(uo) 1234 \"/org/freedesktop/systemd1/job/1234\"")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1234), id)
+	id, err = parseJob(noJob)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), id)
+	_, err = parseJob("s \"active\"")
+	assert.NotNil(t, err)
+	_, err = parseJob("(uo) x \"/\"")
+	assert.NotNil(t, err)
+}
+
+func TestNew(t *testing.T) {
+	m, err := New(BackendNone, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+	m, err = New(BackendSystemd, nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &Systemd{}, m)
+	m, err = New(BackendMultipathd, nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &MultipathdSocket{}, m)
+	_, err = New("upstart", nil)
+	assert.NotNil(t, err)
+}
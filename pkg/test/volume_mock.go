@@ -89,9 +89,36 @@ func (mr *MockVolumeProviderMockRecorder) Create(arg0 interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockVolumeProvider)(nil).Create), arg0)
 }
 
+// Update mocks base method
+func (m *MockVolumeProvider) Update(volumeID string, updateRequest *packngo.VolumeUpdateRequest) (*packngo.Volume, *packngo.Response, error) {
+	ret := m.ctrl.Call(m, "Update", volumeID, updateRequest)
+	ret0, _ := ret[0].(*packngo.Volume)
+	ret1, _ := ret[1].(*packngo.Response)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Update indicates an expected call of Update
+func (mr *MockVolumeProviderMockRecorder) Update(volumeID, updateRequest interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockVolumeProvider)(nil).Update), volumeID, updateRequest)
+}
+
+// Unlock mocks base method
+func (m *MockVolumeProvider) Unlock(volumeID string) (*packngo.Response, error) {
+	ret := m.ctrl.Call(m, "Unlock", volumeID)
+	ret0, _ := ret[0].(*packngo.Response)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Unlock indicates an expected call of Unlock
+func (mr *MockVolumeProviderMockRecorder) Unlock(volumeID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unlock", reflect.TypeOf((*MockVolumeProvider)(nil).Unlock), volumeID)
+}
+
 // Attach mocks base method
-func (m *MockVolumeProvider) Attach(volumeID, deviceID string) (*packngo.VolumeAttachment, *packngo.Response, error) {
-	ret := m.ctrl.Call(m, "Attach", volumeID, deviceID)
+func (m *MockVolumeProvider) Attach(volumeID, deviceID string, shared bool) (*packngo.VolumeAttachment, *packngo.Response, error) {
+	ret := m.ctrl.Call(m, "Attach", volumeID, deviceID, shared)
 	ret0, _ := ret[0].(*packngo.VolumeAttachment)
 	ret1, _ := ret[1].(*packngo.Response)
 	ret2, _ := ret[2].(error)
@@ -99,8 +126,8 @@ func (m *MockVolumeProvider) Attach(volumeID, deviceID string) (*packngo.VolumeA
 }
 
 // Attach indicates an expected call of Attach
-func (mr *MockVolumeProviderMockRecorder) Attach(volumeID, deviceID interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Attach", reflect.TypeOf((*MockVolumeProvider)(nil).Attach), volumeID, deviceID)
+func (mr *MockVolumeProviderMockRecorder) Attach(volumeID, deviceID, shared interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Attach", reflect.TypeOf((*MockVolumeProvider)(nil).Attach), volumeID, deviceID, shared)
 }
 
 // Detach mocks base method
@@ -130,6 +157,20 @@ func (mr *MockVolumeProviderMockRecorder) GetNodes() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNodes", reflect.TypeOf((*MockVolumeProvider)(nil).GetNodes))
 }
 
+// ListPlans mocks base method
+func (m *MockVolumeProvider) ListPlans() ([]packngo.Plan, *packngo.Response, error) {
+	ret := m.ctrl.Call(m, "ListPlans")
+	ret0, _ := ret[0].([]packngo.Plan)
+	ret1, _ := ret[1].(*packngo.Response)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ListPlans indicates an expected call of ListPlans
+func (mr *MockVolumeProviderMockRecorder) ListPlans() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListPlans", reflect.TypeOf((*MockVolumeProvider)(nil).ListPlans))
+}
+
 // MockNodeVolumeManager is a mock of NodeVolumeManager interface
 type MockNodeVolumeManager struct {
 	ctrl     *gomock.Controller